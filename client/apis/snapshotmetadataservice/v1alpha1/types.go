@@ -36,11 +36,45 @@ type SnapshotMetadataServiceSpec struct {
 	CACert []byte `json:"caCert"`
 }
 
+// The condition types of a SnapshotMetadataService.
+const (
+	// SnapshotMetadataServiceReady indicates whether the gRPC service is
+	// serving metadata requests.
+	SnapshotMetadataServiceReady = "Ready"
+	// SnapshotMetadataServiceDriverValidated indicates whether the CSI driver
+	// has been found to support the SnapshotMetadata service.
+	SnapshotMetadataServiceDriverValidated = "DriverValidated"
+	// SnapshotMetadataServiceCertificateValid indicates whether the TLS
+	// certificate of the gRPC service is within its validity period.
+	SnapshotMetadataServiceCertificateValid = "CertificateValid"
+)
+
+// SnapshotMetadataServiceStatus defines the observed state of SnapshotMetadataService.
+// It is maintained by the external-snapshot-metadata sidecar.
+type SnapshotMetadataServiceStatus struct {
+	// The latest observations of the state of the service.
+	// Known condition types are "Ready", "DriverValidated" and "CertificateValid".
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// The version of the sidecar that last updated the status.
+	// +optional
+	SidecarVersion string `json:"sidecarVersion,omitempty"`
+	// The name of the CSI driver served by the sidecar.
+	// +optional
+	DriverName string `json:"driverName,omitempty"`
+	// The time at which the TLS certificate of the gRPC service expires.
+	// +optional
+	CertificateExpiry *metav1.Time `json:"certificateExpiry,omitempty"`
+}
+
 // +genclient
 // +genclient:nonNamespaced
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:scope=Cluster,shortName=sms
+// +kubebuilder:subresource:status
 // SnapshotMetadataService is the Schema for the snapshotmetadataservices API
 // The presence of a SnapshotMetadataService CR advertises the existence of a CSI
 // driver's Kubernetes SnapshotMetadata gRPC service.
@@ -54,6 +88,9 @@ type SnapshotMetadataService struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	// Required.
 	Spec SnapshotMetadataServiceSpec `json:"spec"`
+	// The observed state of the service.
+	// +optional
+	Status SnapshotMetadataServiceStatus `json:"status,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -22,6 +22,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -31,6 +32,7 @@ func (in *SnapshotMetadataService) DeepCopyInto(out *SnapshotMetadataService) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -105,3 +107,30 @@ func (in *SnapshotMetadataServiceSpec) DeepCopy() *SnapshotMetadataServiceSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotMetadataServiceStatus) DeepCopyInto(out *SnapshotMetadataServiceStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CertificateExpiry != nil {
+		in, out := &in.CertificateExpiry, &out.CertificateExpiry
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotMetadataServiceStatus.
+func (in *SnapshotMetadataServiceStatus) DeepCopy() *SnapshotMetadataServiceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotMetadataServiceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
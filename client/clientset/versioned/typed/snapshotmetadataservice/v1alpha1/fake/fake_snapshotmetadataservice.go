@@ -99,6 +99,18 @@ func (c *FakeSnapshotMetadataServices) Update(ctx context.Context, snapshotMetad
 	return obj.(*v1alpha1.SnapshotMetadataService), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeSnapshotMetadataServices) UpdateStatus(ctx context.Context, snapshotMetadataService *v1alpha1.SnapshotMetadataService, opts v1.UpdateOptions) (result *v1alpha1.SnapshotMetadataService, err error) {
+	emptyResult := &v1alpha1.SnapshotMetadataService{}
+	obj, err := c.Fake.
+		Invokes(testing.NewRootUpdateSubresourceAction(snapshotmetadataservicesResource, "status", snapshotMetadataService), emptyResult)
+	if obj == nil {
+		return emptyResult, err
+	}
+	return obj.(*v1alpha1.SnapshotMetadataService), err
+}
+
 // Delete takes name of the snapshotMetadataService and deletes it. Returns an error if one occurs.
 func (c *FakeSnapshotMetadataServices) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
 	_, err := c.Fake.
@@ -40,6 +40,7 @@ type SnapshotMetadataServicesGetter interface {
 type SnapshotMetadataServiceInterface interface {
 	Create(ctx context.Context, snapshotMetadataService *v1alpha1.SnapshotMetadataService, opts v1.CreateOptions) (*v1alpha1.SnapshotMetadataService, error)
 	Update(ctx context.Context, snapshotMetadataService *v1alpha1.SnapshotMetadataService, opts v1.UpdateOptions) (*v1alpha1.SnapshotMetadataService, error)
+	UpdateStatus(ctx context.Context, snapshotMetadataService *v1alpha1.SnapshotMetadataService, opts v1.UpdateOptions) (*v1alpha1.SnapshotMetadataService, error)
 	Delete(ctx context.Context, name string, opts v1.DeleteOptions) error
 	DeleteCollection(ctx context.Context, opts v1.DeleteOptions, listOpts v1.ListOptions) error
 	Get(ctx context.Context, name string, opts v1.GetOptions) (*v1alpha1.SnapshotMetadataService, error)
@@ -128,6 +129,21 @@ func (c *snapshotMetadataServices) Update(ctx context.Context, snapshotMetadataS
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *snapshotMetadataServices) UpdateStatus(ctx context.Context, snapshotMetadataService *v1alpha1.SnapshotMetadataService, opts v1.UpdateOptions) (result *v1alpha1.SnapshotMetadataService, err error) {
+	result = &v1alpha1.SnapshotMetadataService{}
+	err = c.client.Put().
+		Resource("snapshotmetadataservices").
+		Name(snapshotMetadataService.Name).
+		SubResource("status").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(snapshotMetadataService).
+		Do(ctx).
+		Into(result)
+	return
+}
+
 // Delete takes name of the snapshotMetadataService and deletes it. Returns an error if one occurs.
 func (c *snapshotMetadataServices) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
 	return c.client.Delete().
@@ -0,0 +1,30 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+// The SnapshotMetadata service attaches a google.rpc.ErrorInfo detail with
+// the following domain and reasons to some of its errors, so that clients
+// do not depend on the wording of the error messages.
+const (
+	// ErrorDomain is the domain of the ErrorInfo details.
+	ErrorDomain = "snapshot-metadata.cbt.storage.k8s.io"
+
+	// ErrorReasonSnapshotNotReady is the reason of the Unavailable error
+	// returned when a VolumeSnapshot or its VolumeSnapshotContent is not
+	// yet ready to use.
+	ErrorReasonSnapshotNotReady = "SNAPSHOT_NOT_READY"
+)
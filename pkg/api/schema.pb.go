@@ -347,7 +347,7 @@ type GetMetadataDeltaRequest struct {
 	// It is the backup application's responsibility to determine if the underlying CSI
 	// driver requires the base VolumeSnapshot object to exist at the time that this
 	// request is made, and take that into consideration in its snapshot retention policy.
-	// This field is REQUIRED.
+	// Exactly one of base_snapshot_id or base_snapshot_name must be specified.
 	BaseSnapshotId string `protobuf:"bytes,3,opt,name=base_snapshot_id,json=baseSnapshotId,proto3" json:"base_snapshot_id,omitempty"`
 	// This is the name of a second VolumeSnapshot in the same volume,
 	// created after the base snapshot.
@@ -373,9 +373,20 @@ type GetMetadataDeltaRequest struct {
 	// The sidecar will determine an appropriate value if 0, and is
 	// always free to send less than the requested value.
 	// This field is OPTIONAL.
-	MaxResults    int32 `protobuf:"varint,6,opt,name=max_results,json=maxResults,proto3" json:"max_results,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	MaxResults int32 `protobuf:"varint,6,opt,name=max_results,json=maxResults,proto3" json:"max_results,omitempty"`
+	// This is the name of the base VolumeSnapshot object in the same
+	// Namespace, against which changes are to be computed.
+	// The sidecar resolves the CSI handle of the base snapshot from the
+	// VolumeSnapshotContent object bound to it, after checking that both
+	// are ready to use and that the snapshot was created by the same CSI
+	// driver as the target snapshot.
+	// This relieves the backup application from needing access to the
+	// cluster scoped VolumeSnapshotContent objects, but requires the base
+	// VolumeSnapshot object to exist at the time the request is made.
+	// Exactly one of base_snapshot_id or base_snapshot_name must be specified.
+	BaseSnapshotName string `protobuf:"bytes,7,opt,name=base_snapshot_name,json=baseSnapshotName,proto3" json:"base_snapshot_name,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
 }
 
 func (x *GetMetadataDeltaRequest) Reset() {
@@ -450,6 +461,13 @@ func (x *GetMetadataDeltaRequest) GetMaxResults() int32 {
 	return 0
 }
 
+func (x *GetMetadataDeltaRequest) GetBaseSnapshotName() string {
+	if x != nil {
+		return x.BaseSnapshotName
+	}
+	return ""
+}
+
 // GetMetadataDeltaResponse messages are returned in a gRPC stream.
 // Cumulatively, they provide information on the data ranges that
 // have changed between the base and target snapshots specified
@@ -557,7 +575,7 @@ const file_schema_proto_rawDesc = "" +
 	"\x1cGetMetadataAllocatedResponse\x12S\n" +
 	"\x13block_metadata_type\x18\x01 \x01(\x0e2#.snapshotmetadata.BlockMetadataTypeR\x11blockMetadataType\x122\n" +
 	"\x15volume_capacity_bytes\x18\x02 \x01(\x03R\x13volumeCapacityBytes\x12F\n" +
-	"\x0eblock_metadata\x18\x03 \x03(\v2\x1f.snapshotmetadata.BlockMetadataR\rblockMetadata\"\x84\x02\n" +
+	"\x0eblock_metadata\x18\x03 \x03(\v2\x1f.snapshotmetadata.BlockMetadataR\rblockMetadata\"\xb2\x02\n" +
 	"\x17GetMetadataDeltaRequest\x12%\n" +
 	"\x0esecurity_token\x18\x01 \x01(\tR\rsecurityToken\x12\x1c\n" +
 	"\tnamespace\x18\x02 \x01(\tR\tnamespace\x12(\n" +
@@ -565,7 +583,8 @@ const file_schema_proto_rawDesc = "" +
 	"\x14target_snapshot_name\x18\x04 \x01(\tR\x12targetSnapshotName\x12'\n" +
 	"\x0fstarting_offset\x18\x05 \x01(\x03R\x0estartingOffset\x12\x1f\n" +
 	"\vmax_results\x18\x06 \x01(\x05R\n" +
-	"maxResults\"\xeb\x01\n" +
+	"maxResults\x12,\n" +
+	"\x12base_snapshot_name\x18\a \x01(\tR\x10baseSnapshotName\"\xeb\x01\n" +
 	"\x18GetMetadataDeltaResponse\x12S\n" +
 	"\x13block_metadata_type\x18\x01 \x01(\x0e2#.snapshotmetadata.BlockMetadataTypeR\x11blockMetadataType\x122\n" +
 	"\x15volume_capacity_bytes\x18\x02 \x01(\x03R\x13volumeCapacityBytes\x12F\n" +
@@ -0,0 +1,104 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package authcache provides a bounded cache of authentication and
+// authorization decisions, in the manner of the kube-apiserver webhook caches.
+package authcache
+
+import (
+	"time"
+
+	"k8s.io/utils/clock"
+	"k8s.io/utils/lru"
+)
+
+// Config configures a decision cache.
+type Config struct {
+	// Size is the maximum number of cached decisions.
+	// Decisions are not cached if the size is not positive.
+	Size int
+	// PositiveTTL is the duration for which an allowing decision is cached.
+	PositiveTTL time.Duration
+	// NegativeTTL is the duration for which a denying decision is cached.
+	NegativeTTL time.Duration
+	// RecordLookup, if set, is called with the outcome of every lookup.
+	RecordLookup func(hit bool)
+}
+
+// Enabled returns true if decisions should be cached.
+func (c Config) Enabled() bool {
+	return c.Size > 0
+}
+
+// Cache is a least-recently-used cache of decisions that expire after
+// the positive or negative TTL. It is safe for concurrent use.
+type Cache[V any] struct {
+	config Config
+	clock  clock.PassiveClock
+	lru    *lru.Cache
+}
+
+type entry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// New returns a cache with the given configuration.
+func New[V any](config Config) *Cache[V] {
+	return newWithClock[V](config, clock.RealClock{})
+}
+
+func newWithClock[V any](config Config, clock clock.PassiveClock) *Cache[V] {
+	return &Cache[V]{
+		config: config,
+		clock:  clock,
+		lru:    lru.New(config.Size),
+	}
+}
+
+// Get returns the unexpired value cached for the key.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	var value V
+
+	found := false
+	if obj, ok := c.lru.Get(key); ok {
+		if e := obj.(*entry[V]); c.clock.Now().Before(e.expires) {
+			value, found = e.value, true
+		} else {
+			c.lru.Remove(key)
+		}
+	}
+
+	if c.config.RecordLookup != nil {
+		c.config.RecordLookup(found)
+	}
+
+	return value, found
+}
+
+// Add caches the value for the key with the positive or negative TTL.
+func (c *Cache[V]) Add(key string, value V, positive bool) {
+	ttl := c.config.NegativeTTL
+	if positive {
+		ttl = c.config.PositiveTTL
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	c.lru.Add(key, &entry[V]{value: value, expires: c.clock.Now().Add(ttl)})
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestCache(t *testing.T) {
+	var hits, misses int
+
+	config := Config{
+		Size:        2,
+		PositiveTTL: time.Minute,
+		NegativeTTL: time.Second,
+		RecordLookup: func(hit bool) {
+			if hit {
+				hits++
+			} else {
+				misses++
+			}
+		},
+	}
+	assert.True(t, config.Enabled())
+	assert.False(t, Config{}.Enabled())
+
+	fakeClock := clocktesting.NewFakePassiveClock(time.Now())
+	c := newWithClock[string](config, fakeClock)
+
+	_, found := c.Get("k1")
+	assert.False(t, found)
+
+	c.Add("k1", "allowed", true)
+	c.Add("k2", "denied", false)
+
+	v, found := c.Get("k1")
+	assert.True(t, found)
+	assert.Equal(t, "allowed", v)
+
+	v, found = c.Get("k2")
+	assert.True(t, found)
+	assert.Equal(t, "denied", v)
+
+	// negative TTL expires first
+	fakeClock.SetTime(fakeClock.Now().Add(2 * time.Second))
+	_, found = c.Get("k2")
+	assert.False(t, found)
+	_, found = c.Get("k1")
+	assert.True(t, found)
+
+	// positive TTL expires
+	fakeClock.SetTime(fakeClock.Now().Add(time.Minute))
+	_, found = c.Get("k1")
+	assert.False(t, found)
+
+	// size is bounded
+	c.Add("k1", "v1", true)
+	c.Add("k2", "v2", true)
+	c.Add("k3", "v3", true)
+	_, found = c.Get("k1")
+	assert.False(t, found)
+	_, found = c.Get("k3")
+	assert.True(t, found)
+
+	// a TTL that is not positive disables caching
+	c.config.NegativeTTL = 0
+	c.Add("k4", "v4", false)
+	_, found = c.Get("k4")
+	assert.False(t, found)
+
+	assert.Equal(t, 4, hits)
+	assert.Equal(t, 5, misses)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+)
+
+// Authenticator authenticates a security token for an audience.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string, audience string) (bool, *authv1.UserInfo, error)
+}
+
+// CachedTokenAuthenticator caches the decisions of a TokenAuthenticator.
+// Errors are not cached.
+type CachedTokenAuthenticator struct {
+	authenticator Authenticator
+	cache         *authcache.Cache[tokenReviewResult]
+}
+
+type tokenReviewResult struct {
+	authenticated bool
+	userInfo      *authv1.UserInfo
+}
+
+func NewCachedTokenAuthenticator(kubeClient kubernetes.Interface, config authcache.Config) *CachedTokenAuthenticator {
+	return &CachedTokenAuthenticator{
+		authenticator: NewTokenAuthenticator(kubeClient),
+		cache:         authcache.New[tokenReviewResult](config),
+	}
+}
+
+// Authenticate the user with the cached decision for the token and audience
+// if present, or else with the TokenReview API.
+func (c *CachedTokenAuthenticator) Authenticate(ctx context.Context, token string, audience string) (bool, *authv1.UserInfo, error) {
+	key := tokenCacheKey(token, audience)
+
+	if res, found := c.cache.Get(key); found {
+		return res.authenticated, res.userInfo, nil
+	}
+
+	authenticated, userInfo, err := c.authenticator.Authenticate(ctx, token, audience)
+	if err != nil {
+		return false, nil, err
+	}
+
+	c.cache.Add(key, tokenReviewResult{authenticated: authenticated, userInfo: userInfo}, authenticated)
+
+	return authenticated, userInfo, nil
+}
+
+// tokenCacheKey returns a key that does not retain the token.
+func tokenCacheKey(token, audience string) string {
+	h := sha256.New()
+	h.Write([]byte(audience))
+	h.Write([]byte{0})
+	h.Write([]byte(token))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authn
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	authv1 "k8s.io/api/authentication/v1"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clientgotesting "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+)
+
+func TestCachedTokenAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	numReviews := 0
+	failReview := false
+
+	fakeClientset := fake.NewSimpleClientset()
+	fakeClientset.PrependReactor("create", "tokenreviews", func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+		numReviews++
+		if failReview {
+			return true, nil, errors.New("failed to create TokenReview")
+		}
+		tr := action.(clientgotesting.CreateAction).GetObject().(*authv1.TokenReview)
+		tr.Status = authv1.TokenReviewStatus{
+			Authenticated: tr.Spec.Token == "valid-token",
+			Audiences:     tr.Spec.Audiences,
+			User:          authv1.UserInfo{Username: "user-a"},
+		}
+		return true, tr, nil
+	})
+
+	var hits int
+	auth := NewCachedTokenAuthenticator(fakeClientset, authcache.Config{
+		Size:        10,
+		PositiveTTL: time.Minute,
+		NegativeTTL: time.Minute,
+		RecordLookup: func(hit bool) {
+			if hit {
+				hits++
+			}
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		authenticated, userInfo, err := auth.Authenticate(ctx, "valid-token", "audience")
+		assert.NoError(t, err)
+		assert.True(t, authenticated)
+		assert.Equal(t, "user-a", userInfo.Username)
+
+		authenticated, _, err = auth.Authenticate(ctx, "invalid-token", "audience")
+		assert.NoError(t, err)
+		assert.False(t, authenticated)
+	}
+	assert.Equal(t, 2, numReviews)
+	assert.Equal(t, 2, hits)
+
+	// the audience is part of the key
+	_, _, err := auth.Authenticate(ctx, "valid-token", "other-audience")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numReviews)
+
+	// errors are not cached
+	failReview = true
+	for i := 0; i < 2; i++ {
+		_, _, err = auth.Authenticate(ctx, "new-token", "audience")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 5, numReviews)
+}
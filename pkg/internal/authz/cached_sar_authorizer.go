@@ -0,0 +1,97 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authz
+
+import (
+	"context"
+	"encoding/json"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+)
+
+// Authorizer authorizes a user to access a named VolumeSnapshot of a namespace.
+type Authorizer interface {
+	Authorize(ctx context.Context, userInfo *authv1.UserInfo, namespace, name string) (authorizer.Decision, string, error)
+}
+
+// CachedSARAuthorizer caches the decisions of a SARAuthorizer.
+// Errors are not cached.
+type CachedSARAuthorizer struct {
+	authorizer Authorizer
+	cache      *authcache.Cache[sarResult]
+	config     SARConfig
+}
+
+type sarResult struct {
+	decision authorizer.Decision
+	reason   string
+}
+
+func NewCachedSARAuthorizer(cli kubernetes.Interface, sarConfig SARConfig, config authcache.Config) *CachedSARAuthorizer {
+	return &CachedSARAuthorizer{
+		authorizer: NewSARAuthorizer(cli, sarConfig),
+		cache:      authcache.New[sarResult](config),
+		config:     sarConfig,
+	}
+}
+
+// Authorize the user with the cached decision for the user, namespace and,
+// if included in the review, name if present, or else with the
+// SubjectAccessReview API.
+func (c *CachedSARAuthorizer) Authorize(ctx context.Context, userInfo *authv1.UserInfo, namespace, name string) (authorizer.Decision, string, error) {
+	key := sarCacheKey(userInfo, namespace, c.config.resourceName(name))
+
+	if res, found := c.cache.Get(key); found {
+		return res.decision, res.reason, nil
+	}
+
+	decision, reason, err := c.authorizer.Authorize(ctx, userInfo, namespace, name)
+	if err != nil {
+		return decision, reason, err
+	}
+
+	c.cache.Add(key, sarResult{decision: decision, reason: reason}, decision == authorizer.DecisionAllow)
+
+	return decision, reason, nil
+}
+
+// sarCacheKey returns a key derived from all the fields of the SubjectAccessReview.
+// The map of extra values is marshaled with sorted keys. Marshaling cannot fail
+// as the fields are strings, slices of strings and a map with string keys.
+func sarCacheKey(userInfo *authv1.UserInfo, namespace, name string) string {
+	key, _ := json.Marshal(struct {
+		Namespace string
+		Name      string
+		Username  string
+		UID       string
+		Groups    []string
+		Extra     map[string]authv1.ExtraValue
+	}{
+		Namespace: namespace,
+		Name:      name,
+		Username:  userInfo.Username,
+		UID:       userInfo.UID,
+		Groups:    userInfo.Groups,
+		Extra:     userInfo.Extra,
+	})
+
+	return string(key)
+}
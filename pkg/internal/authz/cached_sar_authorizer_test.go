@@ -0,0 +1,105 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes/fake"
+	clientgotesting "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+)
+
+func TestCachedSARAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	numReviews := 0
+	failReview := false
+
+	fakeClientset := fake.NewSimpleClientset()
+	fakeClientset.PrependReactor("create", "subjectaccessreviews", func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+		numReviews++
+		if failReview {
+			return true, nil, errors.New("failed to create SubjectAccessReview")
+		}
+		sar := action.(clientgotesting.CreateAction).GetObject().(*authzv1.SubjectAccessReview)
+		sar.Status.Allowed = sar.Spec.ResourceAttributes.Namespace == "allowed"
+		sar.Status.Reason = "mock reason"
+		return true, sar, nil
+	})
+
+	cacheConfig := authcache.Config{
+		Size:        10,
+		PositiveTTL: time.Minute,
+		NegativeTTL: time.Minute,
+	}
+	authz := NewCachedSARAuthorizer(fakeClientset, SARConfig{}, cacheConfig)
+
+	userInfo := &authv1.UserInfo{
+		Username: "user-a",
+		Groups:   []string{"group-a"},
+		Extra:    map[string]authv1.ExtraValue{"k1": {"v1"}, "k2": {"v2"}},
+	}
+
+	// the name is not part of the key if not reviewed
+	for i := 0; i < 2; i++ {
+		decision, reason, err := authz.Authorize(ctx, userInfo, "allowed", fmt.Sprintf("snap-%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, authorizer.DecisionAllow, decision)
+		assert.Equal(t, "mock reason", reason)
+
+		decision, _, err = authz.Authorize(ctx, userInfo, "denied", fmt.Sprintf("snap-%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, authorizer.DecisionDeny, decision)
+	}
+	assert.Equal(t, 2, numReviews)
+
+	// the groups are part of the key
+	otherUserInfo := userInfo.DeepCopy()
+	otherUserInfo.Groups = append(otherUserInfo.Groups, "group-b")
+	_, _, err := authz.Authorize(ctx, otherUserInfo, "allowed", "snap-0")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numReviews)
+
+	// errors are not cached
+	failReview = true
+	for i := 0; i < 2; i++ {
+		_, _, err = authz.Authorize(ctx, userInfo, "other", "snap-0")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 5, numReviews)
+
+	// the name is part of the key if reviewed
+	failReview = false
+	authz = NewCachedSARAuthorizer(fakeClientset, SARConfig{IncludeName: true}, cacheConfig)
+	for i := 0; i < 2; i++ {
+		_, _, err = authz.Authorize(ctx, userInfo, "allowed", "snap-0")
+		assert.NoError(t, err)
+		_, _, err = authz.Authorize(ctx, userInfo, "allowed", "snap-1")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 7, numReviews)
+}
@@ -27,24 +27,57 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// DefaultSARVerb is the verb checked on volumesnapshots if not configured.
+const DefaultSARVerb = "get"
+
+// SARConfig specifies the resource attributes of the SubjectAccessReview
+// used to authorize access to the metadata of a VolumeSnapshot.
+type SARConfig struct {
+	// Verb is the verb checked. DefaultSARVerb is used if not set.
+	Verb string
+
+	// Subresource is an optional subresource of volumesnapshots to check,
+	// such as "metadata".
+	Subresource string
+
+	// IncludeName adds the name of the VolumeSnapshot to the review so that
+	// access can be restricted to specific snapshots with RBAC resourceNames.
+	IncludeName bool
+}
+
+// resourceName returns the name to review for the named VolumeSnapshot.
+func (c SARConfig) resourceName(name string) string {
+	if c.IncludeName {
+		return name
+	}
+
+	return ""
+}
+
 // SARAuthorizer authorizes user using K8s SubjectAccessReview API
 type SARAuthorizer struct {
 	kubeClient kubernetes.Interface
+	config     SARConfig
 }
 
-func NewSARAuthorizer(cli kubernetes.Interface) *SARAuthorizer {
-	return &SARAuthorizer{kubeClient: cli}
+func NewSARAuthorizer(cli kubernetes.Interface, config SARConfig) *SARAuthorizer {
+	if config.Verb == "" {
+		config.Verb = DefaultSARVerb
+	}
+
+	return &SARAuthorizer{kubeClient: cli, config: config}
 }
 
-// Authorize check if the user is authorized to access volumesnapshots resources using SubjectAccessReview API
-func (s *SARAuthorizer) Authorize(ctx context.Context, userInfo *authv1.UserInfo, namespace string) (authorizer.Decision, string, error) {
+// Authorize check if the user is authorized to access the named volumesnapshot resource using SubjectAccessReview API.
+// The name is only included in the review if configured.
+func (s *SARAuthorizer) Authorize(ctx context.Context, userInfo *authv1.UserInfo, namespace, name string) (authorizer.Decision, string, error) {
 	extra := make(map[string]authzv1.ExtraValue, len(userInfo.Extra))
 	for u, e := range userInfo.Extra {
 		extra[u] = authzv1.ExtraValue(e)
 	}
 	sar := &authzv1.SubjectAccessReview{
 		Spec: authzv1.SubjectAccessReviewSpec{
-			ResourceAttributes: volumeSnapshotResourceAttrib(namespace),
+			ResourceAttributes: s.volumeSnapshotResourceAttrib(namespace, name),
 			User:               userInfo.Username,
 			Groups:             userInfo.Groups,
 			Extra:              extra,
@@ -62,12 +95,14 @@ func (s *SARAuthorizer) Authorize(ctx context.Context, userInfo *authv1.UserInfo
 	return authorizer.DecisionAllow, sarResp.Status.Reason, nil
 }
 
-func volumeSnapshotResourceAttrib(namespace string) *authzv1.ResourceAttributes {
+func (s *SARAuthorizer) volumeSnapshotResourceAttrib(namespace, name string) *authzv1.ResourceAttributes {
 	return &authzv1.ResourceAttributes{
-		Verb:      "get",
-		Namespace: namespace,
-		Group:     "snapshot.storage.k8s.io",
-		Version:   "v1",
-		Resource:  "volumesnapshots",
+		Verb:        s.config.Verb,
+		Namespace:   namespace,
+		Group:       "snapshot.storage.k8s.io",
+		Version:     "v1",
+		Resource:    "volumesnapshots",
+		Subresource: s.config.Subresource,
+		Name:        s.config.resourceName(name),
 	}
 }
@@ -84,8 +84,8 @@ func TestAuthenticate(t *testing.T) {
 	} {
 		fakeClientset := fake.NewSimpleClientset()
 		fakeClientset.PrependReactor("create", "subjectaccessreviews", tc.reactor)
-		authz := NewSARAuthorizer(fakeClientset)
-		decision, reason, err := authz.Authorize(ctx, userInfo, "default")
+		authz := NewSARAuthorizer(fakeClientset, SARConfig{})
+		decision, reason, err := authz.Authorize(ctx, userInfo, "default", "snap-1")
 		if tc.errExpected {
 			assert.NotNil(t, err)
 		} else {
@@ -95,3 +95,73 @@ func TestAuthenticate(t *testing.T) {
 		}
 	}
 }
+
+func TestSARResourceAttributes(t *testing.T) {
+	ctx := context.Background()
+	userInfo := &authv1.UserInfo{
+		Username: "user-a",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   SARConfig
+		expAttrs authzv1.ResourceAttributes
+	}{
+		{
+			name:   "default",
+			config: SARConfig{},
+			expAttrs: authzv1.ResourceAttributes{
+				Verb:      "get",
+				Namespace: "default",
+				Group:     "snapshot.storage.k8s.io",
+				Version:   "v1",
+				Resource:  "volumesnapshots",
+			},
+		},
+		{
+			name: "subresource-with-name",
+			config: SARConfig{
+				Subresource: "metadata",
+				IncludeName: true,
+			},
+			expAttrs: authzv1.ResourceAttributes{
+				Verb:        "get",
+				Namespace:   "default",
+				Group:       "snapshot.storage.k8s.io",
+				Version:     "v1",
+				Resource:    "volumesnapshots",
+				Subresource: "metadata",
+				Name:        "snap-1",
+			},
+		},
+		{
+			name: "custom-verb",
+			config: SARConfig{
+				Verb: "getmetadata",
+			},
+			expAttrs: authzv1.ResourceAttributes{
+				Verb:      "getmetadata",
+				Namespace: "default",
+				Group:     "snapshot.storage.k8s.io",
+				Version:   "v1",
+				Resource:  "volumesnapshots",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var attrs *authzv1.ResourceAttributes
+			fakeClientset := fake.NewSimpleClientset()
+			fakeClientset.PrependReactor("create", "subjectaccessreviews", func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+				sar := action.(clientgotesting.CreateAction).GetObject().(*authzv1.SubjectAccessReview)
+				attrs = sar.Spec.ResourceAttributes
+				sar.Status.Allowed = true
+				return true, sar, nil
+			})
+
+			decision, _, err := NewSARAuthorizer(fakeClientset, tc.config).Authorize(ctx, userInfo, "default", "snap-1")
+			assert.NoError(t, err)
+			assert.Equal(t, authorizer.DecisionAllow, decision)
+			assert.Equal(t, &tc.expAttrs, attrs)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	snapshotinformers "github.com/kubernetes-csi/external-snapshotter/client/v8/informers/externalversions"
+	snapshotlisters "github.com/kubernetes-csi/external-snapshotter/client/v8/listers/volumesnapshot/v1"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+
+	cbtinformers "github.com/kubernetes-csi/external-snapshot-metadata/client/informers/externalversions"
+	cbtlisters "github.com/kubernetes-csi/external-snapshot-metadata/client/listers/snapshotmetadataservice/v1alpha1"
+)
+
+const (
+	// informerResyncPeriod is 0 as the informers are only used for their listers.
+	informerResyncPeriod = 0
+
+	// snapshotHandleIndex indexes VolumeSnapshotContents by Status.SnapshotHandle.
+	snapshotHandleIndex = "snapshotHandle"
+)
+
+// Listers provide cached access to the resources looked up by the sidecar.
+// Objects returned by the listers must be treated as read-only.
+type Listers struct {
+	VolumeSnapshots          snapshotlisters.VolumeSnapshotLister
+	VolumeSnapshotContents   snapshotlisters.VolumeSnapshotContentLister
+	VolumeSnapshotClasses    snapshotlisters.VolumeSnapshotClassLister
+	SnapshotMetadataServices cbtlisters.SnapshotMetadataServiceLister
+
+	vscIndexer cache.Indexer
+	hasSynced  []cache.InformerSynced
+}
+
+// VolumeSnapshotContentsForHandle returns the VolumeSnapshotContents with the
+// specified snapshot handle in their status.
+func (l *Listers) VolumeSnapshotContentsForHandle(snapshotHandle string) ([]*snapshotv1.VolumeSnapshotContent, error) {
+	objs, err := l.vscIndexer.ByIndex(snapshotHandleIndex, snapshotHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	vscs := make([]*snapshotv1.VolumeSnapshotContent, 0, len(objs))
+	for _, obj := range objs {
+		vscs = append(vscs, obj.(*snapshotv1.VolumeSnapshotContent))
+	}
+
+	return vscs, nil
+}
+
+func snapshotHandleIndexFunc(obj any) ([]string, error) {
+	vsc, ok := obj.(*snapshotv1.VolumeSnapshotContent)
+	if !ok || vsc.Status == nil || vsc.Status.SnapshotHandle == nil {
+		return nil, nil
+	}
+
+	return []string{*vsc.Status.SnapshotHandle}, nil
+}
+
+// HasSynced returns true when the caches of all the listers have synced.
+func (l *Listers) HasSynced() bool {
+	for _, synced := range l.hasSynced {
+		if !synced() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// StartInformers starts the shared informers for the VolumeSnapshot, VolumeSnapshotContent,
+// VolumeSnapshotClass and SnapshotMetadataService resources and sets the Listers.
+// It does not wait for the caches to sync; the informers run until the context is canceled.
+// Only the SnapshotMetadataService CR of the CSI driver is cached.
+func (rt *Runtime) StartInformers(ctx context.Context) error {
+	snapshotFactory := snapshotinformers.NewSharedInformerFactory(rt.SnapshotClient, informerResyncPeriod)
+	cbtFactory := cbtinformers.NewSharedInformerFactoryWithOptions(rt.CBTClient, informerResyncPeriod,
+		cbtinformers.WithTweakListOptions(func(opts *apimetav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", rt.DriverName).String()
+		}))
+
+	vsInformer := snapshotFactory.Snapshot().V1().VolumeSnapshots()
+	vscInformer := snapshotFactory.Snapshot().V1().VolumeSnapshotContents()
+	vsClassInformer := snapshotFactory.Snapshot().V1().VolumeSnapshotClasses()
+	smsInformer := cbtFactory.Cbt().V1alpha1().SnapshotMetadataServices()
+
+	if err := vscInformer.Informer().AddIndexers(cache.Indexers{snapshotHandleIndex: snapshotHandleIndexFunc}); err != nil {
+		return fmt.Errorf("error adding the VolumeSnapshotContent index: %w", err)
+	}
+
+	listers := &Listers{
+		VolumeSnapshots:          vsInformer.Lister(),
+		VolumeSnapshotContents:   vscInformer.Lister(),
+		VolumeSnapshotClasses:    vsClassInformer.Lister(),
+		SnapshotMetadataServices: smsInformer.Lister(),
+		vscIndexer:               vscInformer.Informer().GetIndexer(),
+		hasSynced: []cache.InformerSynced{
+			vsInformer.Informer().HasSynced,
+			vscInformer.Informer().HasSynced,
+			vsClassInformer.Informer().HasSynced,
+			smsInformer.Informer().HasSynced,
+		},
+	}
+
+	snapshotFactory.Start(ctx.Done())
+	cbtFactory.Start(ctx.Done())
+
+	rt.Listers = listers
+
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runtime
+
+import (
+	"context"
+	"testing"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	fakesnapshot "github.com/kubernetes-csi/external-snapshotter/client/v8/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientfeatures "k8s.io/client-go/features"
+	clientfeaturestesting "k8s.io/client-go/features/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+
+	smsv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	fakecbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned/fake"
+)
+
+func TestStartInformers(t *testing.T) {
+	// The generated fake clientsets do not support watch-list semantics.
+	clientfeaturestesting.SetFeatureDuringTest(t, clientfeatures.WatchListClient, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vs := &snapshotv1.VolumeSnapshot{ObjectMeta: apimetav1.ObjectMeta{Name: "vs", Namespace: "ns"}}
+	vsc := &snapshotv1.VolumeSnapshotContent{
+		ObjectMeta: apimetav1.ObjectMeta{Name: "vsc"},
+		Status:     &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: ptr.To("handle")},
+	}
+	vsClass := &snapshotv1.VolumeSnapshotClass{ObjectMeta: apimetav1.ObjectMeta{Name: "vs-class"}}
+	sms := &smsv1alpha1.SnapshotMetadataService{ObjectMeta: apimetav1.ObjectMeta{Name: "driver"}}
+
+	rt := &Runtime{
+		SnapshotClient: fakesnapshot.NewSimpleClientset(vs, vsc, vsClass),
+		CBTClient:      fakecbt.NewSimpleClientset(sms),
+		DriverName:     "driver",
+	}
+	assert.Nil(t, rt.Listers)
+
+	assert.NoError(t, rt.StartInformers(ctx))
+	assert.NotNil(t, rt.Listers)
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), rt.Listers.HasSynced))
+
+	retVS, err := rt.Listers.VolumeSnapshots.VolumeSnapshots("ns").Get("vs")
+	assert.NoError(t, err)
+	assert.Equal(t, vs, retVS)
+
+	retVSC, err := rt.Listers.VolumeSnapshotContents.Get("vsc")
+	assert.NoError(t, err)
+	assert.Equal(t, vsc, retVSC)
+
+	retVSCs, err := rt.Listers.VolumeSnapshotContentsForHandle("handle")
+	assert.NoError(t, err)
+	assert.Equal(t, []*snapshotv1.VolumeSnapshotContent{vsc}, retVSCs)
+
+	retVSCs, err = rt.Listers.VolumeSnapshotContentsForHandle("other-handle")
+	assert.NoError(t, err)
+	assert.Empty(t, retVSCs)
+
+	retVSClass, err := rt.Listers.VolumeSnapshotClasses.Get("vs-class")
+	assert.NoError(t, err)
+	assert.Equal(t, vsClass, retVSClass)
+
+	retSMS, err := rt.Listers.SnapshotMetadataServices.Get("driver")
+	assert.NoError(t, err)
+	assert.Equal(t, sms, retSMS)
+}
@@ -28,13 +28,19 @@ import (
 	csirpc "github.com/kubernetes-csi/csi-lib-utils/rpc"
 	snapshot "github.com/kubernetes-csi/external-snapshotter/client/v8/clientset/versioned"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
 
 	cbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned"
 )
 
+// ErrCSIDriverNameChanged is returned by RevalidateCSIDriver if the CSI driver
+// name differs from that of the initial connection.
+var ErrCSIDriverNameChanged = errors.New("CSI driver name changed")
+
 type Args struct {
 	// Address of the CSI driver socket.
 	CSIAddress string
@@ -52,12 +58,23 @@ type Args struct {
 	TLSCertFile string
 	// Absolute path to the TLS key file.
 	TLSKeyFile string
+	// SelfSignedTLS causes a self-signed TLS certificate to be used
+	// instead of the TLS cert and key files.
+	SelfSignedTLS bool
 	// HttpEndpoint is the address of the metrics sever
 	HttpEndpoint string
 	// MetricsPath is the path where metrics will be recorded
 	MetricsPath string
 	// Audience string is used for authentication.
 	Audience string
+	// CSIReconnect causes the connection to the CSI driver to be re-established
+	// when lost, instead of exiting the process.
+	CSIReconnect bool
+	// DisableSnapshotMetricLabels omits the high-cardinality snapshot labels
+	// from the operation metrics.
+	DisableSnapshotMetricLabels bool
+	// EnableTracing causes the trace context to be propagated to the CSI driver.
+	EnableTracing bool
 }
 
 func (args *Args) Validate() error {
@@ -68,6 +85,10 @@ func (args *Args) Validate() error {
 		return errors.New("CSITimeout is required")
 	case args.GRPCPort <= 0:
 		return errors.New("invalid GRPCPort")
+	case args.SelfSignedTLS && (args.TLSCertFile != "" || args.TLSKeyFile != ""):
+		return errors.New("TLSCertFile and TLSKeyFile cannot be used with SelfSignedTLS")
+	case args.SelfSignedTLS:
+		return nil
 	case args.TLSCertFile == "":
 		return errors.New("missing TLSCertFile")
 	case args.TLSKeyFile == "":
@@ -103,9 +124,16 @@ type Runtime struct {
 	MetricsManager metrics.CSIMetricsManager
 	DriverName     string
 	Audience       string
+
+	// Listers are set by StartInformers.
+	Listers *Listers
+
+	// metrics are set by RegisterMetrics.
+	metrics *metricVecs
 }
 
-// initialize obtains the clients and then the CSI driver name.
+// initialize obtains the clients, registers the metrics and then obtains
+// the CSI driver name.
 func (rt *Runtime) initialize() error {
 	if err := rt.kubeConnect(rt.Kubeconfig, rt.KubeAPIQPS, rt.KubeAPIBurst); err != nil {
 		return err
@@ -115,6 +143,10 @@ func (rt *Runtime) initialize() error {
 		return err
 	}
 
+	if err := rt.RegisterMetrics(); err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), rt.CSITimeout)
 	defer cancel()
 
@@ -176,14 +208,23 @@ func (rt *Runtime) kubeConnect(kubeconfig string, kubeAPIQPS float32, kubeAPIBur
 func (rt *Runtime) csiConnect(csiAddress string) error {
 	ctx := context.Background()
 
-	metricsManager := metrics.NewCSIMetricsManagerWithOptions("",
-		metrics.WithSubsystem(SubSystem),
-		metrics.WithLabelNames(LabelTargetSnapshotName, LabelBaseSnapshotID))
-	csiConn, err := connection.Connect(
-		ctx,
-		csiAddress,
-		metricsManager,
-		connection.OnConnectionLoss(connection.ExitOnConnectionLoss()))
+	metricsOptions := []metrics.MetricsManagerOption{metrics.WithSubsystem(SubSystem)}
+	if !rt.DisableSnapshotMetricLabels {
+		metricsOptions = append(metricsOptions, metrics.WithLabelNames(LabelTargetSnapshotName, LabelBaseSnapshotID))
+	}
+
+	metricsManager := metrics.NewCSIMetricsManagerWithOptions("", metricsOptions...)
+	onConnectionLoss := connection.ExitOnConnectionLoss()
+	if rt.CSIReconnect {
+		onConnectionLoss = rt.onCSIConnectionLoss
+	}
+
+	connectOptions := []connection.Option{connection.OnConnectionLoss(onConnectionLoss)}
+	if rt.EnableTracing {
+		connectOptions = append(connectOptions, connection.WithOtelTracing())
+	}
+
+	csiConn, err := connection.Connect(ctx, csiAddress, metricsManager, connectOptions...)
 	if err != nil {
 		return fmt.Errorf("error connecting to CSI driver: %w", err)
 	}
@@ -194,6 +235,87 @@ func (rt *Runtime) csiConnect(csiAddress string) error {
 	return nil
 }
 
+// onCSIConnectionLoss allows the connection to the CSI driver to be re-established.
+func (rt *Runtime) onCSIConnectionLoss(ctx context.Context) bool {
+	klog.FromContext(ctx).Error(nil, "Lost connection to CSI driver, reconnecting")
+	return true
+}
+
+// WatchCSIConnection monitors the connection to the CSI driver until the
+// context is canceled. The returned channel receives a value when the
+// connection is lost, and the connection is re-established in the background.
+// It should only be used if CSIReconnect is set.
+func (rt *Runtime) WatchCSIConnection(ctx context.Context) <-chan struct{} {
+	lost := make(chan struct{}, 1)
+
+	go func() {
+		state := rt.CSIConn.GetState()
+
+		for rt.CSIConn.WaitForStateChange(ctx, state) {
+			newState := rt.CSIConn.GetState()
+
+			if state == connectivity.Ready && newState != connectivity.Ready {
+				select {
+				case lost <- struct{}{}:
+				default: // already signaled
+				}
+			}
+
+			// An idle connection is not re-established until used.
+			if newState == connectivity.Idle {
+				rt.CSIConn.Connect()
+			}
+
+			state = newState
+		}
+	}()
+
+	return lost
+}
+
+// RevalidateCSIDriver waits until the connection to the CSI driver is
+// re-established, and then validates the CSI driver again. It fails if the
+// name of the CSI driver has changed, as the name cannot be changed at runtime.
+func (rt *Runtime) RevalidateCSIDriver(ctx context.Context) error {
+	if err := rt.waitForCSIConnection(ctx); err != nil {
+		return fmt.Errorf("error waiting for the connection to the CSI driver: %w", err)
+	}
+
+	if err := rt.WaitTillCSIDriverIsValidated(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rt.CSITimeout)
+	defer cancel()
+
+	driverName, err := csirpc.GetDriverName(ctx, rt.CSIConn)
+	if err != nil {
+		return fmt.Errorf("error getting CSI driver name: %w", err)
+	}
+
+	if driverName != rt.DriverName {
+		return fmt.Errorf("%w from %q to %q", ErrCSIDriverNameChanged, rt.DriverName, driverName)
+	}
+
+	return nil
+}
+
+// waitForCSIConnection waits until the connection to the CSI driver is ready.
+func (rt *Runtime) waitForCSIConnection(ctx context.Context) error {
+	for {
+		state := rt.CSIConn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+
+		rt.CSIConn.Connect()
+
+		if !rt.CSIConn.WaitForStateChange(ctx, state) {
+			return ctx.Err()
+		}
+	}
+}
+
 // WaitTillCSIDriverIsValidated waits until the CSI driver becomes ready, and
 // then confirms that it supports the snapshot metadata service.
 func (rt *Runtime) WaitTillCSIDriverIsValidated() error {
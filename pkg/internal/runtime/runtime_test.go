@@ -17,6 +17,7 @@ limitations under the License.
 package runtime
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"testing"
@@ -37,6 +38,7 @@ func TestNew(t *testing.T) {
 			{CSIAddress: "1.2.3.4", CSITimeout: time.Hour},
 			{CSIAddress: "1.2.3.4", CSITimeout: time.Hour, GRPCPort: 10},
 			{CSIAddress: "1.2.3.4", CSITimeout: time.Hour, GRPCPort: 10, TLSCertFile: "/certFile"},
+			{CSIAddress: "1.2.3.4", CSITimeout: time.Hour, GRPCPort: 10, TLSCertFile: "/certFile", SelfSignedTLS: true},
 		}
 		for i, tc := range invalidArgs {
 			t.Run(fmt.Sprintf("invalid-%d", i), func(t *testing.T) {
@@ -58,6 +60,18 @@ func TestNew(t *testing.T) {
 			err := validArgs.Validate()
 			assert.NoError(t, err)
 		})
+
+		t.Run("success-self-signed", func(t *testing.T) {
+			validArgs := Args{
+				CSIAddress:    "1.2.3.4",
+				CSITimeout:    time.Hour,
+				GRPCPort:      10,
+				SelfSignedTLS: true,
+			}
+
+			err := validArgs.Validate()
+			assert.NoError(t, err)
+		})
 	})
 
 	t.Run("kubeconfig-error", func(t *testing.T) {
@@ -237,3 +251,57 @@ func TestWaitTillCSIDriverIsValidated(t *testing.T) {
 		assert.NoError(t, err, "CSICheckDriver")
 	})
 }
+
+func TestRevalidateCSIDriver(t *testing.T) {
+	th := NewTestHarness().WithFakeKubeConfig(t).WithFakeCSIDriver(t, &csi.UnimplementedSnapshotMetadataServer{})
+	defer th.RemoveFakeKubeConfig(t)
+	defer th.TerminateFakeCSIDriver(t)
+
+	th.FakeProbeResponse = &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: true}}
+
+	rta := th.RuntimeArgs()
+	rta.CSIReconnect = true
+
+	rt, err := New(rta)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.WaitTillCSIDriverIsValidated())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lost := rt.WatchCSIConnection(ctx)
+
+	waitForConnectionLoss := func() {
+		select {
+		case <-lost:
+		case <-ctx.Done():
+			assert.Fail(t, "connection loss not signaled")
+		}
+	}
+
+	// the driver restarts
+	th.FakeCSIDriver.Stop()
+	waitForConnectionLoss()
+	th.RestartFakeCSIDriver(t)
+
+	assert.NoError(t, rt.RevalidateCSIDriver(ctx))
+
+	// the driver restarts with a different name
+	th.FakeCSIDriver.Stop()
+	waitForConnectionLoss()
+	th.driverName = "other-csi-driver"
+	th.RestartFakeCSIDriver(t)
+
+	err = rt.RevalidateCSIDriver(ctx)
+	assert.ErrorIs(t, err, ErrCSIDriverNameChanged)
+
+	// the driver does not restart
+	th.FakeCSIDriver.Stop()
+	waitForConnectionLoss()
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shortCancel()
+
+	err = rt.RevalidateCSIDriver(shortCtx)
+	assert.ErrorContains(t, err, "error waiting for the connection to the CSI driver")
+}
@@ -80,12 +80,13 @@ type TestHarness struct {
 	FakeGetPluginCapabilitiesResponse *csi.GetPluginCapabilitiesResponse
 
 	// internal
-	fakeCSIDriverAddr  string
-	fakeKubeConfigFile *os.File
-	fakeGRPCServerDir  string
-	tlsCertFile        string
-	tlsKeyFile         string
-	tlsGenerator       *testTLSCertGenerator
+	fakeCSIDriverAddr    string
+	fakeCSIDriverServers *driver.CSIDriverServers
+	fakeKubeConfigFile   *os.File
+	fakeGRPCServerDir    string
+	tlsCertFile          string
+	tlsKeyFile           string
+	tlsGenerator         *testTLSCertGenerator
 	// Minimize port-in-use errors from back-to-back test harness usage
 	// by dynamically assigning a port number to be used in the runtime
 	// arguments and ensuring that numbers are not repeated (at least not
@@ -270,6 +271,7 @@ func (th *TestHarness) WithFakeCSIDriver(t *testing.T, sms csi.SnapshotMetadataS
 	assert.NoError(t, err)
 
 	th.FakeCSIDriver = csiDriver
+	th.fakeCSIDriverServers = servers
 	th.driverName = "fake-csi-driver"
 	if sms != nil {
 		// ensure that the service gets advertised.
@@ -289,6 +291,19 @@ func (th *TestHarness) WithFakeCSIDriver(t *testing.T, sms csi.SnapshotMetadataS
 	return th
 }
 
+// RestartFakeCSIDriver launches a new fake CSIDriver on the address of the
+// stopped fake CSIDriver.
+func (th *TestHarness) RestartFakeCSIDriver(t *testing.T) {
+	listener, err := net.Listen("unix", th.fakeCSIDriverAddr)
+	assert.NoError(t, err, "net.Listen")
+
+	csiDriver := driver.NewCSIDriver(th.fakeCSIDriverServers)
+	err = csiDriver.Start(listener)
+	assert.NoError(t, err)
+
+	th.FakeCSIDriver = csiDriver
+}
+
 func (th *TestHarness) TerminateFakeCSIDriver(t *testing.T) {
 	if th.FakeCSIDriver != nil {
 		th.FakeCSIDriver.Stop()
@@ -17,8 +17,11 @@ limitations under the License.
 package runtime
 
 import (
+	"fmt"
 	"time"
 
+	"google.golang.org/grpc/codes"
+	k8smetrics "k8s.io/component-base/metrics"
 	"k8s.io/klog/v2"
 )
 
@@ -38,17 +41,309 @@ const (
 	// - Start_time: controller notices the first time that there is a GetMetadataDelta RPC call to fetch the changed blocks between 2 snapshots
 	// - End_time:   controller notices that the RPC call is finished and the changed blocks is streamed back to the driver
 	MetadataDeltaOperationName = "MetadataDelta"
+
+	// InvalidCSIResponsesMetricName is the name of the counter of CSI driver responses
+	// that violate the CSI specification, labeled by operation name.
+	InvalidCSIResponsesMetricName = "invalid_csi_responses_total"
+	LabelOperationName            = "operation_name"
+
+	// AuthCacheLookupsMetricName is the name of the counter of lookups in the
+	// authentication and authorization decision caches, labeled by cache and result.
+	AuthCacheLookupsMetricName = "auth_cache_lookups_total"
+	LabelAuthCache             = "cache"
+	LabelAuthCacheResult       = "result"
+	AuthCacheAuthentication    = "authentication"
+	AuthCacheAuthorization     = "authorization"
+	AuthCacheResultHit         = "hit"
+	AuthCacheResultMiss        = "miss"
+
+	// RejectedRPCsMetricName is the name of the counter of metadata RPCs
+	// rejected by the rate and concurrent stream limits, labeled by operation name and reason.
+	RejectedRPCsMetricName = "rejected_rpcs_total"
+	LabelRejectReason      = "reason"
+
+	// ActiveStreamsMetricName is the name of the gauge of metadata RPCs in progress,
+	// labeled by operation name.
+	ActiveStreamsMetricName = "active_streams"
+
+	// ResponsesMetricName, BlockMetadataTuplesMetricName and BlockMetadataBytesMetricName
+	// are the names of the counters of the responses sent to clients, the BlockMetadata
+	// tuples in them and the bytes described by the tuples, labeled by operation name.
+	ResponsesMetricName           = "responses_total"
+	BlockMetadataTuplesMetricName = "block_metadata_tuples_total"
+	BlockMetadataBytesMetricName  = "block_metadata_bytes_total"
+
+	// TimeToFirstResponseMetricName is the name of the histogram of the time from the
+	// start of a metadata RPC to its first response, labeled by operation name.
+	TimeToFirstResponseMetricName = "time_to_first_response_seconds"
+
+	// AuthDurationMetricName is the name of the histogram of the duration of the
+	// authentication and authorization of metadata RPCs, labeled by phase and result.
+	AuthDurationMetricName  = "auth_duration_seconds"
+	LabelAuthPhase          = "phase"
+	LabelAuthResult         = "result"
+	AuthPhaseAuthentication = "authentication"
+	AuthPhaseAuthorization  = "authorization"
+	AuthResultAllowed       = "allowed"
+	AuthResultDenied        = "denied"
+	AuthResultError         = "error"
+
+	// CSIStreamErrorsMetricName is the name of the counter of failed CSI driver
+	// metadata streams, labeled by operation name and gRPC status code.
+	CSIStreamErrorsMetricName = "csi_stream_errors_total"
+	LabelGRPCCode             = "grpc_code"
+
+	// ClientSendErrorsMetricName is the name of the counter of failures to send
+	// a response to the client, labeled by operation name.
+	ClientSendErrorsMetricName = "client_send_errors_total"
+
+	// AuditRecordsDroppedMetricName is the name of the counter of audit records
+	// that were not persisted by the audit sink, labeled by reason.
+	AuditRecordsDroppedMetricName = "audit_records_dropped_total"
+	LabelAuditDropReason          = "reason"
+	AuditDropReasonQueueFull      = "queue_full"
+	AuditDropReasonWriteFailed    = "write_failed"
+	AuditDropReasonDeliveryFailed = "delivery_failed"
 )
 
 // RecordMetricsWithLabels is a wrapper on the csi-lib-utils RecordMetrics function, that calls the
 // "RecordMetrics" functions with the necessary labels added to the MetricsManager runtime.
+// The labels are dropped if DisableSnapshotMetricLabels is set.
 func (rt *Runtime) RecordMetricsWithLabels(opLabel map[string]string, opName string, startTime time.Time, opErr error) {
+	if rt.DisableSnapshotMetricLabels {
+		rt.MetricsManager.RecordMetrics(opName, opErr, time.Since(startTime))
+		return
+	}
+
 	metricsWithLabel, err := rt.MetricsManager.WithLabelValues(opLabel)
 	if err != nil {
-		klog.Error(err, "failed to add labels to metrics")
+		klog.ErrorS(err, "Failed to add labels to metrics")
 		return
 	}
 
 	opDuration := time.Since(startTime)
 	metricsWithLabel.RecordMetrics(opName, opErr, opDuration)
 }
+
+// metricVecs holds the metric vectors of a Runtime, shared by its copies.
+type metricVecs struct {
+	invalidCSIResponses *k8smetrics.CounterVec
+	authCacheLookups    *k8smetrics.CounterVec
+	rejectedRPCs        *k8smetrics.CounterVec
+	activeStreams       *k8smetrics.GaugeVec
+	responses           *k8smetrics.CounterVec
+	blockMetadataTuples *k8smetrics.CounterVec
+	blockMetadataBytes  *k8smetrics.CounterVec
+	timeToFirstResponse *k8smetrics.HistogramVec
+	authDuration        *k8smetrics.HistogramVec
+	csiStreamErrors     *k8smetrics.CounterVec
+	clientSendErrors    *k8smetrics.CounterVec
+	auditRecordsDropped *k8smetrics.CounterVec
+}
+
+func newMetricVecs() *metricVecs {
+	counterVec := func(name, help string, labels ...string) *k8smetrics.CounterVec {
+		return k8smetrics.NewCounterVec(&k8smetrics.CounterOpts{
+			Subsystem:      SubSystem,
+			Name:           name,
+			Help:           help,
+			StabilityLevel: k8smetrics.ALPHA,
+		}, labels)
+	}
+
+	histogramVec := func(name, help string, buckets []float64, labels ...string) *k8smetrics.HistogramVec {
+		return k8smetrics.NewHistogramVec(&k8smetrics.HistogramOpts{
+			Subsystem:      SubSystem,
+			Name:           name,
+			Help:           help,
+			Buckets:        buckets,
+			StabilityLevel: k8smetrics.ALPHA,
+		}, labels)
+	}
+
+	return &metricVecs{
+		invalidCSIResponses: counterVec(InvalidCSIResponsesMetricName,
+			"The number of CSI driver responses that violate the CSI specification.", LabelOperationName),
+		authCacheLookups: counterVec(AuthCacheLookupsMetricName,
+			"The number of lookups in the authentication and authorization decision caches.", LabelAuthCache, LabelAuthCacheResult),
+		rejectedRPCs: counterVec(RejectedRPCsMetricName,
+			"The number of metadata RPCs rejected by the rate and concurrent stream limits.", LabelOperationName, LabelRejectReason),
+		activeStreams: k8smetrics.NewGaugeVec(&k8smetrics.GaugeOpts{
+			Subsystem:      SubSystem,
+			Name:           ActiveStreamsMetricName,
+			Help:           "The number of metadata RPCs in progress.",
+			StabilityLevel: k8smetrics.ALPHA,
+		}, []string{LabelOperationName}),
+		responses: counterVec(ResponsesMetricName,
+			"The number of metadata responses sent to clients.", LabelOperationName),
+		blockMetadataTuples: counterVec(BlockMetadataTuplesMetricName,
+			"The number of BlockMetadata tuples sent to clients.", LabelOperationName),
+		blockMetadataBytes: counterVec(BlockMetadataBytesMetricName,
+			"The number of bytes described by the BlockMetadata tuples sent to clients.", LabelOperationName),
+		timeToFirstResponse: histogramVec(TimeToFirstResponseMetricName,
+			"The time in seconds from the start of a metadata RPC to its first response.",
+			k8smetrics.ExponentialBuckets(0.01, 2, 14), LabelOperationName),
+		authDuration: histogramVec(AuthDurationMetricName,
+			"The duration in seconds of the authentication and authorization of metadata RPCs.",
+			k8smetrics.DefBuckets, LabelAuthPhase, LabelAuthResult),
+		csiStreamErrors: counterVec(CSIStreamErrorsMetricName,
+			"The number of CSI driver metadata streams that failed, by gRPC status code.", LabelOperationName, LabelGRPCCode),
+		clientSendErrors: counterVec(ClientSendErrorsMetricName,
+			"The number of failures to send a metadata response to the client.", LabelOperationName),
+		auditRecordsDropped: counterVec(AuditRecordsDroppedMetricName,
+			"The number of audit records that were not persisted by the audit sink.", LabelAuditDropReason),
+	}
+}
+
+func (mv *metricVecs) all() []k8smetrics.Registerable {
+	return []k8smetrics.Registerable{
+		mv.invalidCSIResponses,
+		mv.authCacheLookups,
+		mv.rejectedRPCs,
+		mv.activeStreams,
+		mv.responses,
+		mv.blockMetadataTuples,
+		mv.blockMetadataBytes,
+		mv.timeToFirstResponse,
+		mv.authDuration,
+		mv.csiStreamErrors,
+		mv.clientSendErrors,
+		mv.auditRecordsDropped,
+	}
+}
+
+// RegisterMetrics creates the metrics of the sidecar and registers them with
+// the MetricsManager registry. It is called by New, and must otherwise be
+// called once after the MetricsManager is set. Metrics are not recorded
+// until it succeeds.
+func (rt *Runtime) RegisterMetrics() error {
+	mv := newMetricVecs()
+	registry := rt.MetricsManager.GetRegistry()
+
+	for _, metric := range mv.all() {
+		if err := registry.Register(metric); err != nil {
+			return fmt.Errorf("failed to register the metric %s: %w", metric.FQName(), err)
+		}
+	}
+
+	rt.metrics = mv
+
+	return nil
+}
+
+// RecordInvalidCSIResponse increments the counter of invalid CSI driver responses
+// for the operation.
+func (rt *Runtime) RecordInvalidCSIResponse(opName string) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.invalidCSIResponses.WithLabelValues(opName).Inc()
+}
+
+// RecordAuthCacheLookup increments the counter of lookups in the named
+// authentication or authorization cache.
+func (rt *Runtime) RecordAuthCacheLookup(cacheName string, hit bool) {
+	if rt.metrics == nil {
+		return
+	}
+
+	result := AuthCacheResultMiss
+	if hit {
+		result = AuthCacheResultHit
+	}
+
+	rt.metrics.authCacheLookups.WithLabelValues(cacheName, result).Inc()
+}
+
+// RecordRejectedRPC increments the counter of metadata RPCs rejected by the
+// limits of the server.
+func (rt *Runtime) RecordRejectedRPC(opName, reason string) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.rejectedRPCs.WithLabelValues(opName, reason).Inc()
+}
+
+// RecordStreamStarted increments the gauge of metadata RPCs in progress
+// for the operation.
+func (rt *Runtime) RecordStreamStarted(opName string) {
+	rt.addActiveStreams(opName, 1)
+}
+
+// RecordStreamEnded decrements the gauge of metadata RPCs in progress
+// for the operation.
+func (rt *Runtime) RecordStreamEnded(opName string) {
+	rt.addActiveStreams(opName, -1)
+}
+
+func (rt *Runtime) addActiveStreams(opName string, delta float64) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.activeStreams.WithLabelValues(opName).Add(delta)
+}
+
+// RecordResponseSent increments the counters of the responses sent to clients,
+// the BlockMetadata tuples in them and the bytes described by the tuples.
+func (rt *Runtime) RecordResponseSent(opName string, numTuples int, numBytes int64) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.responses.WithLabelValues(opName).Inc()
+	rt.metrics.blockMetadataTuples.WithLabelValues(opName).Add(float64(numTuples))
+	rt.metrics.blockMetadataBytes.WithLabelValues(opName).Add(float64(numBytes))
+}
+
+// RecordTimeToFirstResponse observes the time from the start of a metadata RPC
+// to its first response.
+func (rt *Runtime) RecordTimeToFirstResponse(opName string, d time.Duration) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.timeToFirstResponse.WithLabelValues(opName).Observe(d.Seconds())
+}
+
+// RecordAuth observes the duration of the authentication or authorization of
+// a metadata RPC, labeled by its result.
+func (rt *Runtime) RecordAuth(phase, result string, d time.Duration) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.authDuration.WithLabelValues(phase, result).Observe(d.Seconds())
+}
+
+// RecordCSIStreamError increments the counter of failed CSI driver metadata
+// streams.
+func (rt *Runtime) RecordCSIStreamError(opName string, code codes.Code) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.csiStreamErrors.WithLabelValues(opName, code.String()).Inc()
+}
+
+// RecordClientSendError increments the counter of failures to send a response
+// to the client.
+func (rt *Runtime) RecordClientSendError(opName string) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.clientSendErrors.WithLabelValues(opName).Inc()
+}
+
+// RecordAuditRecordDropped increments the counter of audit records that were
+// not persisted by the audit sink.
+func (rt *Runtime) RecordAuditRecordDropped(reason string) {
+	if rt.metrics == nil {
+		return
+	}
+
+	rt.metrics.auditRecordsDropped.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runtime
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	rt := &Runtime{
+		MetricsManager: metrics.NewCSIMetricsManagerWithOptions("driver", metrics.WithSubsystem(SubSystem)),
+	}
+	assert.NoError(t, rt.RegisterMetrics())
+	assert.NotNil(t, rt.metrics)
+
+	// the metrics of each Runtime are distinct
+	other := &Runtime{
+		MetricsManager: metrics.NewCSIMetricsManagerWithOptions("driver", metrics.WithSubsystem(SubSystem)),
+	}
+	assert.NoError(t, other.RegisterMetrics())
+	assert.NotSame(t, rt.metrics.responses, other.metrics.responses)
+
+	// metrics that fail to register are not used
+	rt.metrics = nil
+	err := rt.RegisterMetrics()
+	assert.ErrorContains(t, err, "failed to register the metric")
+	assert.Nil(t, rt.metrics)
+}
+
+func TestRecordCounters(t *testing.T) {
+	rt := &Runtime{
+		MetricsManager: metrics.NewCSIMetricsManagerWithOptions("driver", metrics.WithSubsystem(SubSystem)),
+	}
+	assert.NoError(t, rt.RegisterMetrics())
+
+	rt.RecordInvalidCSIResponse(MetadataAllocatedOperationName)
+	rt.RecordAuthCacheLookup(AuthCacheAuthentication, true)
+	rt.RecordAuthCacheLookup(AuthCacheAuthentication, true)
+	rt.RecordAuthCacheLookup(AuthCacheAuthorization, false)
+	rt.RecordRejectedRPC(MetadataDeltaOperationName, "rpc_rate")
+	rt.RecordAuditRecordDropped(AuditDropReasonQueueFull)
+
+	expected := `
+# HELP snapshot_metadata_controller_audit_records_dropped_total [ALPHA] The number of audit records that were not persisted by the audit sink.
+# TYPE snapshot_metadata_controller_audit_records_dropped_total counter
+snapshot_metadata_controller_audit_records_dropped_total{reason="queue_full"} 1
+# HELP snapshot_metadata_controller_auth_cache_lookups_total [ALPHA] The number of lookups in the authentication and authorization decision caches.
+# TYPE snapshot_metadata_controller_auth_cache_lookups_total counter
+snapshot_metadata_controller_auth_cache_lookups_total{cache="authentication",result="hit"} 2
+snapshot_metadata_controller_auth_cache_lookups_total{cache="authorization",result="miss"} 1
+# HELP snapshot_metadata_controller_invalid_csi_responses_total [ALPHA] The number of CSI driver responses that violate the CSI specification.
+# TYPE snapshot_metadata_controller_invalid_csi_responses_total counter
+snapshot_metadata_controller_invalid_csi_responses_total{operation_name="MetadataAllocated"} 1
+# HELP snapshot_metadata_controller_rejected_rpcs_total [ALPHA] The number of metadata RPCs rejected by the rate and concurrent stream limits.
+# TYPE snapshot_metadata_controller_rejected_rpcs_total counter
+snapshot_metadata_controller_rejected_rpcs_total{operation_name="MetadataDelta",reason="rpc_rate"} 1
+`
+	err := testutil.GatherAndCompare(rt.MetricsManager.GetRegistry(), strings.NewReader(expected),
+		"snapshot_metadata_controller_audit_records_dropped_total", "snapshot_metadata_controller_auth_cache_lookups_total", "snapshot_metadata_controller_invalid_csi_responses_total",
+		"snapshot_metadata_controller_rejected_rpcs_total")
+	assert.NoError(t, err)
+
+	// nothing is recorded if the metrics are not registered
+	rt = &Runtime{}
+	rt.RecordAuthCacheLookup(AuthCacheAuthentication, true)
+	rt.RecordAuditRecordDropped(AuditDropReasonWriteFailed)
+}
+
+func TestRecordStreamMetrics(t *testing.T) {
+	rt := &Runtime{
+		MetricsManager: metrics.NewCSIMetricsManagerWithOptions("driver", metrics.WithSubsystem(SubSystem)),
+	}
+	assert.NoError(t, rt.RegisterMetrics())
+
+	rt.RecordStreamStarted(MetadataAllocatedOperationName)
+	rt.RecordStreamStarted(MetadataAllocatedOperationName)
+	rt.RecordStreamStarted(MetadataDeltaOperationName)
+	rt.RecordStreamEnded(MetadataAllocatedOperationName)
+	rt.RecordResponseSent(MetadataAllocatedOperationName, 2, 8192)
+	rt.RecordResponseSent(MetadataAllocatedOperationName, 0, 0)
+	rt.RecordCSIStreamError(MetadataDeltaOperationName, codes.Aborted)
+	rt.RecordClientSendError(MetadataDeltaOperationName)
+	rt.RecordTimeToFirstResponse(MetadataAllocatedOperationName, time.Second)
+	rt.RecordAuth(AuthPhaseAuthentication, AuthResultAllowed, time.Millisecond)
+	rt.RecordAuth(AuthPhaseAuthorization, AuthResultDenied, time.Millisecond)
+	rt.RecordAuth(AuthPhaseAuthorization, AuthResultDenied, time.Millisecond)
+
+	expected := `
+# HELP snapshot_metadata_controller_active_streams [ALPHA] The number of metadata RPCs in progress.
+# TYPE snapshot_metadata_controller_active_streams gauge
+snapshot_metadata_controller_active_streams{operation_name="MetadataAllocated"} 1
+snapshot_metadata_controller_active_streams{operation_name="MetadataDelta"} 1
+# HELP snapshot_metadata_controller_block_metadata_bytes_total [ALPHA] The number of bytes described by the BlockMetadata tuples sent to clients.
+# TYPE snapshot_metadata_controller_block_metadata_bytes_total counter
+snapshot_metadata_controller_block_metadata_bytes_total{operation_name="MetadataAllocated"} 8192
+# HELP snapshot_metadata_controller_block_metadata_tuples_total [ALPHA] The number of BlockMetadata tuples sent to clients.
+# TYPE snapshot_metadata_controller_block_metadata_tuples_total counter
+snapshot_metadata_controller_block_metadata_tuples_total{operation_name="MetadataAllocated"} 2
+# HELP snapshot_metadata_controller_client_send_errors_total [ALPHA] The number of failures to send a metadata response to the client.
+# TYPE snapshot_metadata_controller_client_send_errors_total counter
+snapshot_metadata_controller_client_send_errors_total{operation_name="MetadataDelta"} 1
+# HELP snapshot_metadata_controller_csi_stream_errors_total [ALPHA] The number of CSI driver metadata streams that failed, by gRPC status code.
+# TYPE snapshot_metadata_controller_csi_stream_errors_total counter
+snapshot_metadata_controller_csi_stream_errors_total{grpc_code="Aborted",operation_name="MetadataDelta"} 1
+# HELP snapshot_metadata_controller_responses_total [ALPHA] The number of metadata responses sent to clients.
+# TYPE snapshot_metadata_controller_responses_total counter
+snapshot_metadata_controller_responses_total{operation_name="MetadataAllocated"} 2
+`
+	err := testutil.GatherAndCompare(rt.MetricsManager.GetRegistry(), strings.NewReader(expected),
+		"snapshot_metadata_controller_active_streams", "snapshot_metadata_controller_block_metadata_bytes_total",
+		"snapshot_metadata_controller_block_metadata_tuples_total", "snapshot_metadata_controller_client_send_errors_total",
+		"snapshot_metadata_controller_csi_stream_errors_total", "snapshot_metadata_controller_responses_total")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		metricName string
+		labels     map[string]string
+		expCount   uint64
+	}{
+		{"snapshot_metadata_controller_time_to_first_response_seconds", map[string]string{LabelOperationName: MetadataAllocatedOperationName}, 1},
+		{"snapshot_metadata_controller_auth_duration_seconds", map[string]string{LabelAuthPhase: AuthPhaseAuthentication, LabelAuthResult: AuthResultAllowed}, 1},
+		{"snapshot_metadata_controller_auth_duration_seconds", map[string]string{LabelAuthPhase: AuthPhaseAuthorization, LabelAuthResult: AuthResultDenied}, 2},
+	} {
+		vec, err := testutil.GetHistogramVecFromGatherer(rt.MetricsManager.GetRegistry(), tc.metricName, tc.labels)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expCount, vec.GetAggregatedSampleCount(), "%s %v", tc.metricName, tc.labels)
+	}
+
+	// nothing is recorded if the metrics are not registered
+	rt = &Runtime{}
+	rt.RecordStreamStarted(MetadataAllocatedOperationName)
+	rt.RecordResponseSent(MetadataAllocatedOperationName, 1, 1)
+	rt.RecordTimeToFirstResponse(MetadataAllocatedOperationName, time.Second)
+	rt.RecordAuth(AuthPhaseAuthentication, AuthResultError, time.Second)
+	rt.RecordCSIStreamError(MetadataAllocatedOperationName, codes.Internal)
+	rt.RecordClientSendError(MetadataAllocatedOperationName)
+}
+
+func TestRecordMetricsWithLabels(t *testing.T) {
+	opLabel := map[string]string{LabelTargetSnapshotName: "ns/snap", LabelBaseSnapshotID: "base"}
+
+	t.Run("snapshot-labels", func(t *testing.T) {
+		rt := &Runtime{
+			MetricsManager: metrics.NewCSIMetricsManagerWithOptions("driver",
+				metrics.WithSubsystem(SubSystem), metrics.WithLabelNames(LabelTargetSnapshotName, LabelBaseSnapshotID)),
+		}
+
+		rt.RecordMetricsWithLabels(opLabel, MetadataDeltaOperationName, time.Now(), errors.New("error"))
+
+		vec, err := testutil.GetHistogramVecFromGatherer(rt.MetricsManager.GetRegistry(), "snapshot_metadata_controller_operations_seconds",
+			map[string]string{LabelTargetSnapshotName: "ns/snap", "method_name": MetadataDeltaOperationName})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), vec.GetAggregatedSampleCount())
+	})
+
+	t.Run("no-snapshot-labels", func(t *testing.T) {
+		rt := &Runtime{
+			Args:           Args{DisableSnapshotMetricLabels: true},
+			MetricsManager: metrics.NewCSIMetricsManagerWithOptions("driver", metrics.WithSubsystem(SubSystem)),
+		}
+
+		rt.RecordMetricsWithLabels(opLabel, MetadataDeltaOperationName, time.Now(), nil)
+
+		vec, err := testutil.GetHistogramVecFromGatherer(rt.MetricsManager.GetRegistry(), "snapshot_metadata_controller_operations_seconds",
+			map[string]string{"method_name": MetadataDeltaOperationName})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), vec.GetAggregatedSampleCount())
+
+		mfs, err := rt.MetricsManager.GetRegistry().Gather()
+		assert.NoError(t, err)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					assert.NotEqual(t, LabelTargetSnapshotName, l.GetName())
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,560 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package selfsigned provides a self-signed CA and a serving certificate
+// signed by it. The certificates are stored in a Kubernetes Secret so that
+// they are shared by the replicas of the sidecar, and are re-issued by the
+// first replica that finds them close to expiry. A new CA is published along
+// with the current one for an overlap period before it signs the serving
+// certificate, so that the clients trust it when the serving certificate changes.
+package selfsigned
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+const (
+	// SecretKeyCACert is the key of the PEM encoded CA certificate in the Secret.
+	SecretKeyCACert = "ca.crt"
+	// SecretKeyCAKey is the key of the PEM encoded CA private key in the Secret.
+	SecretKeyCAKey = "ca.key"
+	// SecretKeyNextCACert is the key of the PEM encoded CA certificate that
+	// replaces the current CA after the overlap period.
+	SecretKeyNextCACert = "next-ca.crt"
+	// SecretKeyNextCAKey is the key of the PEM encoded private key of the next CA.
+	SecretKeyNextCAKey = "next-ca.key"
+
+	// DefaultValidity is the default validity period of the serving certificate.
+	DefaultValidity = 90 * 24 * time.Hour
+	// DefaultCheckInterval is the default interval between checks of the Secret.
+	DefaultCheckInterval = time.Minute
+	// DefaultCAOverlap is the default period during which the current and the
+	// next CA are both published before the next CA signs the serving certificate.
+	DefaultCAOverlap = 24 * time.Hour
+
+	// caValidityFactor is the ratio of the validity period of the CA to that
+	// of the serving certificate, so that the CA is rotated less often.
+	caValidityFactor = 10
+
+	// maxSyncAttempts bounds the attempts to store the certificates when
+	// another replica updates the Secret concurrently.
+	maxSyncAttempts = 3
+
+	// caCommonName is the common name of the CA certificate.
+	caCommonName = "external-snapshot-metadata-ca"
+
+	// clockSkew is subtracted from the start of the validity period of the
+	// certificates to allow for clock skew.
+	clockSkew = time.Minute
+)
+
+// Config configures the self-signed certificates.
+type Config struct {
+	// The namespace of the Secret.
+	Namespace string
+	// The name of the Secret.
+	SecretName string
+	// The DNS subject alternative names of the serving certificate.
+	DNSNames []string
+	// The validity period of the serving certificate. A certificate is
+	// re-issued when two thirds of its validity period have elapsed.
+	// If not set then DefaultValidity is used.
+	Validity time.Duration
+	// The interval at which the Secret is checked for certificates that
+	// must be re-issued or that were re-issued by another replica.
+	// If not set then DefaultCheckInterval is used.
+	CheckInterval time.Duration
+	// The period during which the next CA is published along with the current
+	// CA before it signs the serving certificate. It must be less than a third
+	// of the validity period of the CA. If not set then DefaultCAOverlap is
+	// used, or the validity period of the serving certificate if shorter.
+	CAOverlap time.Duration
+}
+
+// Validate checks the configuration.
+func (c Config) Validate() error {
+	switch {
+	case c.Namespace == "":
+		return errors.New("the namespace of the certificate Secret is required")
+	case c.SecretName == "":
+		return errors.New("the name of the certificate Secret is required")
+	case len(c.DNSNames) == 0:
+		return errors.New("at least one DNS name is required for the self-signed certificate")
+	case c.Validity < 0:
+		return errors.New("invalid certificate validity")
+	case c.CAOverlap < 0:
+		return errors.New("invalid CA overlap")
+	case c.CAOverlap > 0 && c.CAOverlap*3 >= c.validity()*caValidityFactor:
+		return errors.New("the CA overlap must be less than a third of the validity period of the CA")
+	}
+
+	return nil
+}
+
+// validity returns the validity period of the serving certificate.
+func (c Config) validity() time.Duration {
+	if c.Validity == 0 {
+		return DefaultValidity
+	}
+
+	return c.Validity
+}
+
+// Manager maintains the self-signed certificates.
+// It is safe for concurrent use.
+type Manager struct {
+	config Config
+	client kubernetes.Interface
+	clock  clock.PassiveClock
+
+	mux       sync.Mutex
+	current   *bundle
+	caChanged chan struct{}
+}
+
+// NewManager returns a manager with the given configuration.
+// Initialize must be called before the certificate is used.
+func NewManager(client kubernetes.Interface, config Config) (*Manager, error) {
+	return newManagerWithClock(client, config, clock.RealClock{})
+}
+
+func newManagerWithClock(client kubernetes.Interface, config Config, clock clock.PassiveClock) (*Manager, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	config.Validity = config.validity()
+
+	if config.CAOverlap == 0 {
+		config.CAOverlap = min(DefaultCAOverlap, config.Validity)
+	}
+
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+
+	return &Manager{
+		config:    config,
+		client:    client,
+		clock:     clock,
+		caChanged: make(chan struct{}, 1),
+	}, nil
+}
+
+// Initialize loads the certificates from the Secret, creating or re-issuing
+// them if necessary.
+func (m *Manager) Initialize(ctx context.Context) error {
+	return m.sync(ctx)
+}
+
+// Run checks the Secret periodically until the context is canceled.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := m.sync(ctx); err != nil && ctx.Err() == nil {
+			klog.Errorf("failed to maintain the self-signed certificate in Secret %s/%s: %v", m.config.Namespace, m.config.SecretName, err)
+		}
+	}
+}
+
+// GetCertificate returns the serving certificate.
+// It has the signature of tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.current == nil {
+		return nil, errors.New("the self-signed certificate is not initialized")
+	}
+
+	return &m.current.cert, nil
+}
+
+// CACert returns the PEM encoded CA certificate, followed by the next CA
+// certificate during the overlap period.
+func (m *Manager) CACert() []byte {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.current == nil {
+		return nil
+	}
+
+	return m.current.caBundle()
+}
+
+// CACertChanged returns a channel that receives a value when the CA
+// certificate changes after initialization.
+func (m *Manager) CACertChanged() <-chan struct{} {
+	return m.caChanged
+}
+
+// sync loads the certificates from the Secret, and re-issues them if they
+// are missing, invalid or close to expiry.
+func (m *Manager) sync(ctx context.Context) error {
+	secrets := m.client.CoreV1().Secrets(m.config.Namespace)
+
+	for attempt := 1; ; attempt++ {
+		secret, err := secrets.Get(ctx, m.config.SecretName, apimetav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			secret, err = nil, nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("error getting the certificate Secret: %w", err)
+		}
+
+		var stored *bundle
+		if secret != nil {
+			if stored, err = parseBundle(secret.Data); err != nil {
+				klog.Infof("Re-issuing the self-signed certificate: %v", err)
+			}
+		}
+
+		if stored != nil && !m.needsRenewal(stored) {
+			m.setCurrent(stored)
+			return nil
+		}
+
+		issued, err := m.issue(stored)
+		if err != nil {
+			return err
+		}
+
+		if secret == nil {
+			secret = &corev1.Secret{
+				ObjectMeta: apimetav1.ObjectMeta{
+					Name:      m.config.SecretName,
+					Namespace: m.config.Namespace,
+				},
+				Type: corev1.SecretTypeTLS,
+				Data: issued.secretData(),
+			}
+			_, err = secrets.Create(ctx, secret, apimetav1.CreateOptions{})
+		} else {
+			secret = secret.DeepCopy()
+			secret.Data = issued.secretData()
+			_, err = secrets.Update(ctx, secret, apimetav1.UpdateOptions{})
+		}
+
+		// Use the certificates of another replica if it stored them first.
+		if (apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err)) && attempt < maxSyncAttempts {
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("error storing the certificate Secret: %w", err)
+		}
+
+		if stored == nil || issued.leaf != stored.leaf {
+			klog.Infof("Issued a self-signed certificate valid until %s", issued.leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+
+		if issued.nextCA != nil && (stored == nil || stored.nextCA == nil) {
+			klog.Infof("Created the next self-signed CA, which signs the certificate after %s",
+				issued.nextCA.cert.NotBefore.Add(clockSkew+m.config.CAOverlap).UTC().Format(time.RFC3339))
+		}
+
+		m.setCurrent(issued)
+
+		return nil
+	}
+}
+
+// setCurrent sets the certificates in use, and signals a change of the CA.
+func (m *Manager) setCurrent(b *bundle) {
+	m.mux.Lock()
+	caChanged := m.current != nil && !bytes.Equal(m.current.caBundle(), b.caBundle())
+	m.current = b
+	m.mux.Unlock()
+
+	if caChanged {
+		select {
+		case m.caChanged <- struct{}{}:
+		default: // already pending
+		}
+	}
+}
+
+// needsRenewal returns true if the certificates must be re-issued, or the
+// next CA must be created or must sign the serving certificate.
+func (m *Manager) needsRenewal(b *bundle) bool {
+	switch {
+	case m.expiring(b.leaf), !sameNames(b.leaf.DNSNames, m.config.DNSNames):
+		return true
+	case b.nextCA != nil:
+		return m.overlapElapsed(b.nextCA.cert)
+	default:
+		return m.expiring(b.ca.cert)
+	}
+}
+
+// expiring returns true if two thirds of the validity period of the certificate have elapsed.
+func (m *Manager) expiring(cert *x509.Certificate) bool {
+	renewAt := cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 2 / 3)
+	return !m.clock.Now().Before(renewAt)
+}
+
+// overlapElapsed returns true if the CA certificate was created at least the
+// overlap period ago.
+func (m *Manager) overlapElapsed(cert *x509.Certificate) bool {
+	return !m.clock.Now().Before(cert.NotBefore.Add(clockSkew + m.config.CAOverlap))
+}
+
+func sameNames(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(a, b)
+}
+
+// issue returns the next certificates. A CA close to expiry is not replaced
+// at once: the next CA is created and published along with it, and signs the
+// serving certificate once the overlap period has elapsed. The serving
+// certificate is re-issued if it is close to expiry or is signed by another CA.
+func (m *Manager) issue(prev *bundle) (*bundle, error) {
+	now := m.clock.Now()
+
+	var err error
+
+	b := &bundle{}
+	switch {
+	case prev == nil || !now.Before(prev.ca.cert.NotAfter):
+		// There is no published CA that is still valid to overlap with.
+		if b.ca, err = m.createCA(now); err != nil {
+			return nil, err
+		}
+	case prev.nextCA != nil && m.overlapElapsed(prev.nextCA.cert):
+		b.ca = prev.nextCA
+	default:
+		b.ca, b.nextCA = prev.ca, prev.nextCA
+
+		if b.nextCA == nil && m.expiring(prev.ca.cert) {
+			if b.nextCA, err = m.createCA(now); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if prev != nil && b.ca == prev.ca && !m.expiring(prev.leaf) && sameNames(prev.leaf.DNSNames, m.config.DNSNames) {
+		b.certPEM, b.keyPEM, b.leaf, b.cert = prev.certPEM, prev.keyPEM, prev.leaf, prev.cert
+		return b, nil
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: m.config.DNSNames[0]},
+		DNSNames:    m.config.DNSNames,
+		NotBefore:   now.Add(-clockSkew),
+		NotAfter:    now.Add(m.config.Validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	leaf, _, certPEM, keyPEM, err := createCertificate(template, b.ca.cert, b.ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the serving certificate: %w", err)
+	}
+
+	if b.cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+
+	b.leaf, b.certPEM, b.keyPEM = leaf, certPEM, keyPEM
+
+	return b, nil
+}
+
+// createCA returns a new CA.
+func (m *Manager) createCA(now time.Time) (*caKeyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: caCommonName},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(m.config.Validity * caValidityFactor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	ca := &caKeyPair{}
+
+	var err error
+	if ca.cert, ca.key, ca.certPEM, ca.keyPEM, err = createCertificate(template, nil, nil); err != nil {
+		return nil, fmt.Errorf("error creating the CA certificate: %w", err)
+	}
+
+	return ca, nil
+}
+
+// createCertificate creates a certificate with a new key, signed by the
+// parent, or self-signed if the parent is nil.
+func createCertificate(template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	if template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return cert, key, certPEM, keyPEM, nil
+}
+
+// caKeyPair contains a CA certificate and its private key.
+type caKeyPair struct {
+	certPEM []byte
+	keyPEM  []byte
+
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// parseCAKeyPair parses a PEM encoded CA certificate and private key.
+func parseCAKeyPair(certPEM, keyPEM []byte) (*caKeyPair, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("invalid CA private key")
+	}
+
+	return &caKeyPair{certPEM: certPEM, keyPEM: keyPEM, cert: pair.Leaf, key: key}, nil
+}
+
+// bundle contains the CA and serving certificates, and the next CA during
+// the overlap period.
+type bundle struct {
+	ca      *caKeyPair
+	nextCA  *caKeyPair
+	certPEM []byte
+	keyPEM  []byte
+
+	leaf *x509.Certificate
+	cert tls.Certificate
+}
+
+// caBundle returns the PEM encoded certificates of the CA and of the next CA.
+func (b *bundle) caBundle() []byte {
+	if b.nextCA == nil {
+		return b.ca.certPEM
+	}
+
+	return slices.Concat(b.ca.certPEM, b.nextCA.certPEM)
+}
+
+func (b *bundle) secretData() map[string][]byte {
+	data := map[string][]byte{
+		SecretKeyCACert:         b.ca.certPEM,
+		SecretKeyCAKey:          b.ca.keyPEM,
+		corev1.TLSCertKey:       b.certPEM,
+		corev1.TLSPrivateKeyKey: b.keyPEM,
+	}
+
+	if b.nextCA != nil {
+		data[SecretKeyNextCACert] = b.nextCA.certPEM
+		data[SecretKeyNextCAKey] = b.nextCA.keyPEM
+	}
+
+	return data
+}
+
+// parseBundle parses the certificates of a Secret, and checks that the
+// serving certificate is signed by the CA.
+func parseBundle(data map[string][]byte) (*bundle, error) {
+	b := &bundle{
+		certPEM: data[corev1.TLSCertKey],
+		keyPEM:  data[corev1.TLSPrivateKeyKey],
+	}
+
+	var err error
+	if b.ca, err = parseCAKeyPair(data[SecretKeyCACert], data[SecretKeyCAKey]); err != nil {
+		return nil, fmt.Errorf("invalid CA certificate: %w", err)
+	}
+
+	if len(data[SecretKeyNextCACert]) > 0 || len(data[SecretKeyNextCAKey]) > 0 {
+		if b.nextCA, err = parseCAKeyPair(data[SecretKeyNextCACert], data[SecretKeyNextCAKey]); err != nil {
+			return nil, fmt.Errorf("invalid next CA certificate: %w", err)
+		}
+	}
+
+	if b.cert, err = tls.X509KeyPair(b.certPEM, b.keyPEM); err != nil {
+		return nil, fmt.Errorf("invalid serving certificate: %w", err)
+	}
+
+	b.leaf = b.cert.Leaf
+
+	if err := b.leaf.CheckSignatureFrom(b.ca.cert); err != nil {
+		return nil, fmt.Errorf("the serving certificate is not signed by the CA: %w", err)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selfsigned
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	clientgotesting "k8s.io/client-go/testing"
+	testclock "k8s.io/utils/clock/testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{
+		Namespace:  "ns",
+		SecretName: "secret",
+		DNSNames:   []string{"svc.ns"},
+	}
+	assert.NoError(t, valid.Validate())
+
+	for name, modify := range map[string]func(c *Config){
+		"namespace":   func(c *Config) { c.Namespace = "" },
+		"secret-name": func(c *Config) { c.SecretName = "" },
+		"dns-names":   func(c *Config) { c.DNSNames = nil },
+		"validity":    func(c *Config) { c.Validity = -time.Hour },
+		"ca-overlap":  func(c *Config) { c.CAOverlap = -time.Hour },
+		"ca-overlap-too-long": func(c *Config) {
+			c.CAOverlap = DefaultValidity * caValidityFactor / 3
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := valid
+			modify(&c)
+			assert.Error(t, c.Validate())
+
+			_, err := NewManager(fakekube.NewSimpleClientset(), c)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestManager(t *testing.T) {
+	const validity = 30 * 24 * time.Hour
+
+	config := Config{
+		Namespace:  "ns",
+		SecretName: "secret",
+		DNSNames:   []string{"svc.ns", "svc.ns.svc"},
+		Validity:   validity,
+	}
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	newManager := func(t *testing.T, client *fakekube.Clientset, clock *testclock.FakeClock, config Config) *Manager {
+		m, err := newManagerWithClock(client, config, clock)
+		assert.NoError(t, err)
+		return m
+	}
+
+	getSecret := func(t *testing.T, client *fakekube.Clientset) *corev1.Secret {
+		secret, err := client.CoreV1().Secrets(config.Namespace).Get(context.Background(), config.SecretName, apimetav1.GetOptions{})
+		assert.NoError(t, err)
+		return secret
+	}
+
+	leafOf := func(t *testing.T, m *Manager) *x509.Certificate {
+		cert, err := m.GetCertificate(nil)
+		assert.NoError(t, err)
+		assert.NotNil(t, cert.Leaf)
+		return cert.Leaf
+	}
+
+	caChanged := func(m *Manager) bool {
+		select {
+		case <-m.CACertChanged():
+			return true
+		default:
+			return false
+		}
+	}
+
+	t.Run("not-initialized", func(t *testing.T) {
+		m := newManager(t, fakekube.NewSimpleClientset(), testclock.NewFakeClock(start), config)
+		_, err := m.GetCertificate(nil)
+		assert.ErrorContains(t, err, "not initialized")
+		assert.Nil(t, m.CACert())
+	})
+
+	t.Run("create", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		m := newManager(t, client, testclock.NewFakeClock(start), config)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		secret := getSecret(t, client)
+		assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+		assert.Equal(t, m.CACert(), secret.Data[SecretKeyCACert])
+
+		leaf := leafOf(t, m)
+		assert.Equal(t, config.DNSNames, leaf.DNSNames)
+		assert.Equal(t, start.Add(validity), leaf.NotAfter)
+
+		// The serving certificate is verified by the published CA.
+		block, _ := pem.Decode(m.CACert())
+		assert.NotNil(t, block)
+		ca, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(t, err)
+		assert.True(t, ca.IsCA)
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: "svc.ns", Roots: roots, CurrentTime: start})
+		assert.NoError(t, err)
+
+		assert.False(t, caChanged(m))
+	})
+
+	t.Run("shared-by-replicas", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		clock := testclock.NewFakeClock(start)
+
+		m1 := newManager(t, client, clock, config)
+		assert.NoError(t, m1.Initialize(context.Background()))
+
+		clock.Step(time.Hour)
+		m2 := newManager(t, client, clock, config)
+		assert.NoError(t, m2.Initialize(context.Background()))
+
+		assert.Equal(t, m1.CACert(), m2.CACert())
+		assert.Equal(t, leafOf(t, m1).SerialNumber, leafOf(t, m2).SerialNumber)
+	})
+
+	t.Run("rotate-leaf", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		clock := testclock.NewFakeClock(start)
+		m := newManager(t, client, clock, config)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		ca, leaf := m.CACert(), leafOf(t, m)
+
+		// Not renewed before two thirds of the validity period.
+		clock.Step(validity / 2)
+		assert.NoError(t, m.sync(context.Background()))
+		assert.Equal(t, leaf.SerialNumber, leafOf(t, m).SerialNumber)
+
+		clock.Step(validity / 4)
+		assert.NoError(t, m.sync(context.Background()))
+		assert.NotEqual(t, leaf.SerialNumber, leafOf(t, m).SerialNumber)
+		assert.Equal(t, clock.Now().Add(validity), leafOf(t, m).NotAfter)
+
+		// The CA is kept.
+		assert.Equal(t, ca, m.CACert())
+		assert.False(t, caChanged(m))
+		assert.Equal(t, leafOf(t, m).Raw, pemBytes(t, getSecret(t, client).Data[corev1.TLSCertKey]))
+	})
+
+	t.Run("rotate-ca", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		clock := testclock.NewFakeClock(start)
+		m := newManager(t, client, clock, config)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		ca := m.CACert()
+
+		// The next CA is published along with the CA, which still signs the serving certificate.
+		clock.Step(validity * caValidityFactor * 2 / 3)
+		assert.NoError(t, m.sync(context.Background()))
+		assert.True(t, caChanged(m))
+
+		cas := caCerts(t, m.CACert())
+		assert.Len(t, cas, 2)
+		assert.Equal(t, pemBytes(t, ca), cas[0].Raw)
+		assert.NoError(t, leafOf(t, m).CheckSignatureFrom(cas[0]))
+
+		secret := getSecret(t, client)
+		assert.Equal(t, ca, secret.Data[SecretKeyCACert])
+		assert.Equal(t, cas[1].Raw, pemBytes(t, secret.Data[SecretKeyNextCACert]))
+
+		// The other replicas publish the same CA certificates.
+		other := newManager(t, client, clock, config)
+		assert.NoError(t, other.Initialize(context.Background()))
+		assert.Equal(t, m.CACert(), other.CACert())
+
+		// The serving certificate is signed by the next CA after the overlap period.
+		leaf := leafOf(t, m)
+		clock.Step(DefaultCAOverlap - time.Second)
+		assert.NoError(t, m.sync(context.Background()))
+		assert.Equal(t, leaf.SerialNumber, leafOf(t, m).SerialNumber)
+		assert.False(t, caChanged(m))
+
+		clock.Step(time.Second)
+		assert.NoError(t, m.sync(context.Background()))
+		assert.True(t, caChanged(m))
+		assert.Equal(t, []*x509.Certificate{cas[1]}, caCerts(t, m.CACert()))
+		assert.NoError(t, leafOf(t, m).CheckSignatureFrom(cas[1]))
+
+		secret = getSecret(t, client)
+		assert.Equal(t, cas[1].Raw, pemBytes(t, secret.Data[SecretKeyCACert]))
+		assert.NotContains(t, secret.Data, SecretKeyNextCACert)
+		assert.NotContains(t, secret.Data, SecretKeyNextCAKey)
+	})
+
+	t.Run("ca-expired", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		clock := testclock.NewFakeClock(start)
+		m := newManager(t, client, clock, config)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		ca := m.CACert()
+
+		// There is nothing to overlap with if the CA was not rotated in time.
+		clock.Step(validity * caValidityFactor)
+		assert.NoError(t, m.sync(context.Background()))
+		assert.True(t, caChanged(m))
+
+		cas := caCerts(t, m.CACert())
+		assert.Len(t, cas, 1)
+		assert.NotEqual(t, pemBytes(t, ca), cas[0].Raw)
+		assert.NoError(t, leafOf(t, m).CheckSignatureFrom(cas[0]))
+	})
+
+	t.Run("dns-names-changed", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		clock := testclock.NewFakeClock(start)
+		m := newManager(t, client, clock, config)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		c := config
+		c.DNSNames = []string{"other.ns"}
+		m = newManager(t, client, clock, c)
+		assert.NoError(t, m.Initialize(context.Background()))
+		assert.Equal(t, c.DNSNames, leafOf(t, m).DNSNames)
+	})
+
+	t.Run("invalid-secret", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: apimetav1.ObjectMeta{Name: config.SecretName, Namespace: config.Namespace},
+			Data:       map[string][]byte{corev1.TLSCertKey: []byte("garbage")},
+		})
+		m := newManager(t, client, testclock.NewFakeClock(start), config)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		_, err := parseBundle(getSecret(t, client).Data)
+		assert.NoError(t, err)
+	})
+
+	t.Run("created-by-another-replica", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		clock := testclock.NewFakeClock(start)
+
+		other := newManager(t, client, clock, config)
+		assert.NoError(t, other.Initialize(context.Background()))
+		stored := getSecret(t, client)
+		assert.NoError(t, client.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("secrets"), config.Namespace, config.SecretName))
+
+		// The other replica creates the Secret between the get and the create.
+		client.PrependReactor("create", "secrets", func(clientgotesting.Action) (bool, k8sruntime.Object, error) {
+			assert.NoError(t, client.Tracker().Add(stored))
+			return true, nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, config.SecretName)
+		})
+
+		m := newManager(t, client, clock, config)
+		assert.NoError(t, m.Initialize(context.Background()))
+		assert.Equal(t, other.CACert(), m.CACert())
+	})
+
+	t.Run("get-error", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		client.PrependReactor("get", "secrets", func(clientgotesting.Action) (bool, k8sruntime.Object, error) {
+			return true, nil, errors.New("get failed")
+		})
+
+		m := newManager(t, client, testclock.NewFakeClock(start), config)
+		assert.ErrorContains(t, m.Initialize(context.Background()), "get failed")
+	})
+
+	t.Run("store-error", func(t *testing.T) {
+		client := fakekube.NewSimpleClientset()
+		client.PrependReactor("create", "secrets", func(clientgotesting.Action) (bool, k8sruntime.Object, error) {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, config.SecretName, errors.New("denied"))
+		})
+
+		m := newManager(t, client, testclock.NewFakeClock(start), config)
+		assert.ErrorContains(t, m.Initialize(context.Background()), "error storing the certificate Secret")
+	})
+}
+
+// caCerts parses the PEM encoded certificates of a CA bundle.
+func caCerts(t *testing.T, data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(t, err)
+		certs = append(certs, cert)
+	}
+
+	return certs
+}
+
+func pemBytes(t *testing.T, data []byte) []byte {
+	block, _ := pem.Decode(data)
+	assert.NotNil(t, block)
+	return block.Bytes
+}
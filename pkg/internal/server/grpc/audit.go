@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/status"
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+// AuditLevel controls the content of the audit records emitted per RPC.
+type AuditLevel string
+
+const (
+	// AuditLevelNone disables auditing.
+	AuditLevelNone AuditLevel = "none"
+
+	// AuditLevelMetadata records the identity of the user, the snapshots
+	// accessed, the amount of metadata streamed, the duration and the
+	// final status of the RPC.
+	AuditLevelMetadata AuditLevel = "metadata"
+
+	// AuditLevelRequest additionally records the starting offset and
+	// max results parameters of the request.
+	AuditLevelRequest AuditLevel = "request"
+)
+
+// Validate returns an error if the level is not recognized.
+func (l AuditLevel) Validate() error {
+	switch l {
+	case AuditLevelNone, AuditLevelMetadata, AuditLevelRequest:
+		return nil
+	}
+
+	return fmt.Errorf("invalid audit level %q", l)
+}
+
+// AuditSink persists audit records.
+type AuditSink interface {
+	// Write persists a record. It should not block for long as it
+	// is called before the RPC completes.
+	Write(record *AuditRecord) error
+
+	// Close releases the resources of the sink.
+	Close() error
+}
+
+// AuditConfig configures the audit subsystem of the server.
+type AuditConfig struct {
+	// Level of the audit records.
+	// If not set then AuditLevelNone is used.
+	Level AuditLevel
+
+	// Sink receives the audit records. Required unless the level is AuditLevelNone.
+	Sink AuditSink
+}
+
+// AuditRecord describes the access to snapshot metadata by a single RPC.
+type AuditRecord struct {
+	Level            AuditLevel       `json:"level"`
+	Operation        string           `json:"operation"`
+	StartTime        time.Time        `json:"startTime"`
+	DurationSeconds  float64          `json:"durationSeconds"`
+	User             *authv1.UserInfo `json:"user,omitempty"`
+	Namespace        string           `json:"namespace"`
+	SnapshotName     string           `json:"snapshotName"`
+	BaseSnapshotID   string           `json:"baseSnapshotId,omitempty"`
+	BaseSnapshotName string           `json:"baseSnapshotName,omitempty"`
+	StartingOffset   *int64           `json:"startingOffset,omitempty"`
+	MaxResults       *int32           `json:"maxResults,omitempty"`
+	NumResponses     int              `json:"numResponses"`
+	NumTuples        int              `json:"numTuples"`
+	BytesDescribed   int64            `json:"bytesDescribed"`
+	Code             string           `json:"code"`
+	Message          string           `json:"message,omitempty"`
+}
+
+// auditEvent accumulates the audit record of an RPC.
+// All methods are no-ops on a nil receiver, which is used when auditing is disabled.
+type auditEvent struct {
+	record AuditRecord
+}
+
+// newAuditEvent returns a new audit event for the RPC, or nil if auditing is disabled.
+func (s *Server) newAuditEvent(operation, namespace, snapshotName string, startingOffset int64, maxResults int32) *auditEvent {
+	level := s.config.Audit.Level
+	if level == "" || level == AuditLevelNone || s.config.Audit.Sink == nil {
+		return nil
+	}
+
+	ae := &auditEvent{
+		record: AuditRecord{
+			Level:        level,
+			Operation:    operation,
+			StartTime:    time.Now(),
+			Namespace:    namespace,
+			SnapshotName: snapshotName,
+		},
+	}
+
+	if level == AuditLevelRequest {
+		ae.record.StartingOffset = &startingOffset
+		ae.record.MaxResults = &maxResults
+	}
+
+	return ae
+}
+
+// setBaseSnapshot records the base snapshot of a GetMetadataDelta RPC.
+func (ae *auditEvent) setBaseSnapshot(baseSnapshotID, baseSnapshotName string) {
+	if ae == nil {
+		return
+	}
+
+	ae.record.BaseSnapshotID = baseSnapshotID
+	ae.record.BaseSnapshotName = baseSnapshotName
+}
+
+// setUser records the authenticated identity of the user.
+func (ae *auditEvent) setUser(userInfo *authv1.UserInfo) {
+	if ae == nil {
+		return
+	}
+
+	ae.record.User = userInfo
+}
+
+// addResponse accounts for a response sent to the client.
+func (ae *auditEvent) addResponse(bmds []*api.BlockMetadata) {
+	if ae == nil {
+		return
+	}
+
+	ae.record.NumResponses++
+	ae.record.NumTuples += len(bmds)
+	for _, bmd := range bmds {
+		ae.record.BytesDescribed += bmd.SizeBytes
+	}
+}
+
+// emitAuditRecord completes the audit record with the final status of the
+// RPC and writes it to the sink. A sink failure is logged and counted as a
+// dropped record, but does not affect the RPC.
+func (s *Server) emitAuditRecord(ae *auditEvent, err error) {
+	if ae == nil {
+		return
+	}
+
+	st := status.Convert(err)
+	ae.record.Code = st.Code().String()
+	ae.record.Message = st.Message()
+	ae.record.DurationSeconds = time.Since(ae.record.StartTime).Seconds()
+
+	if err := s.config.Audit.Sink.Write(&ae.record); err != nil {
+		klog.ErrorS(err, "failed to write audit record", "operation", ae.record.Operation)
+
+		reason := runtime.AuditDropReasonWriteFailed
+		if errors.Is(err, ErrAuditQueueFull) {
+			reason = runtime.AuditDropReasonQueueFull
+		}
+
+		s.config.Runtime.RecordAuditRecordDropped(reason)
+	}
+}
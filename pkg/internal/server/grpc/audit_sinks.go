@@ -0,0 +1,390 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// AuditFileSink writes audit records as JSON lines to a file.
+// The file is rotated when it would exceed its maximum size, keeping up
+// to a maximum number of backups named with the suffixes ".1", ".2", etc.,
+// with ".1" being the most recent.
+type AuditFileSink struct {
+	mux        sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewAuditFileSink opens the file at the path for appending.
+// The file is not rotated if maxSize is not positive.
+func NewAuditFileSink(path string, maxSize int64, maxBackups int) (*AuditFileSink, error) {
+	fs := &AuditFileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *AuditFileSink) open() error {
+	f, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	fs.file = f
+	fs.size = fi.Size()
+
+	return nil
+}
+
+// rotate closes the current file, shifts the backups and opens a new file.
+// The oldest backup is removed if the maximum number of backups is exceeded.
+func (fs *AuditFileSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		return err
+	}
+
+	if fs.maxBackups <= 0 {
+		if err := os.Remove(fs.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return fs.open()
+	}
+
+	for i := fs.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fs.backupPath(i), fs.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(fs.path, fs.backupPath(1)); err != nil {
+		return err
+	}
+
+	return fs.open()
+}
+
+func (fs *AuditFileSink) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", fs.path, n)
+}
+
+// Write appends the record to the file, rotating the file first if required.
+func (fs *AuditFileSink) Write(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	if fs.file == nil {
+		return os.ErrClosed
+	}
+
+	if fs.maxSize > 0 && fs.size > 0 && fs.size+int64(len(line)) > fs.maxSize {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := fs.file.Write(line)
+	fs.size += int64(n)
+
+	return err
+}
+
+// Close closes the file.
+func (fs *AuditFileSink) Close() error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	if fs.file == nil {
+		return nil
+	}
+
+	err := fs.file.Close()
+	fs.file = nil
+
+	return err
+}
+
+const (
+	// AuditWebhookDefaultQueueSize is the number of records that can be
+	// queued for delivery before further records are dropped.
+	AuditWebhookDefaultQueueSize = 1000
+
+	// AuditWebhookDefaultTimeout is the default timeout of a webhook request.
+	AuditWebhookDefaultTimeout = 10 * time.Second
+
+	// AuditWebhookDefaultRetryBackoff is the default delay before retrying
+	// a failed webhook request.
+	AuditWebhookDefaultRetryBackoff = time.Second
+
+	// AuditWebhookDefaultCloseTimeout is the default time that Close waits
+	// for the queued records to be delivered.
+	AuditWebhookDefaultCloseTimeout = 30 * time.Second
+)
+
+// ErrAuditQueueFull is returned by AuditWebhookSink.Write if the record
+// cannot be queued for delivery.
+var ErrAuditQueueFull = errors.New("audit webhook queue is full")
+
+// ErrAuditCloseTimeout is returned by AuditWebhookSink.Close if the queued
+// records could not be delivered in time.
+var ErrAuditCloseTimeout = errors.New("timed out delivering the queued audit records")
+
+// AuditWebhookOptions configures an AuditWebhookSink.
+type AuditWebhookOptions struct {
+	// Timeout of a webhook request.
+	// AuditWebhookDefaultTimeout is used if not positive.
+	Timeout time.Duration
+
+	// QueueSize is the number of records that can be queued for delivery.
+	// AuditWebhookDefaultQueueSize is used if not positive.
+	QueueSize int
+
+	// MaxRetries is the number of times a failed request is retried before
+	// the record is dropped.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry of a request, which
+	// is doubled for each further retry.
+	// AuditWebhookDefaultRetryBackoff is used if not positive.
+	RetryBackoff time.Duration
+
+	// Block causes Write to wait for room in a full queue, delaying the
+	// completion of the RPC, instead of dropping the record.
+	// A blocked Write returns once the sink is closed.
+	Block bool
+
+	// CloseTimeout bounds the time that Close waits for the queued records
+	// to be delivered, after which the remaining records are dropped.
+	// AuditWebhookDefaultCloseTimeout is used if not positive.
+	CloseTimeout time.Duration
+
+	// OnDropped is optional, and if specified is called when a queued
+	// record is dropped because it could not be delivered.
+	OnDropped func()
+}
+
+// AuditWebhookSink posts each audit record as a JSON document to a URL.
+// Records are delivered asynchronously so that the RPCs are not delayed
+// by the webhook. Failed requests are retried with an exponential backoff,
+// and records are dropped if the queue is full, unless Write is configured
+// to block, or if the retries are exhausted.
+type AuditWebhookSink struct {
+	url       string
+	client    *http.Client
+	opts      AuditWebhookOptions
+	mux       sync.RWMutex
+	closed    bool
+	queue     chan *AuditRecord
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+
+	// ctx is canceled to abandon the delivery of the queued records.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewAuditWebhookSink returns a sink that posts the records to the URL.
+func NewAuditWebhookSink(url string, opts AuditWebhookOptions) *AuditWebhookSink {
+	if opts.Timeout <= 0 {
+		opts.Timeout = AuditWebhookDefaultTimeout
+	}
+
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = AuditWebhookDefaultQueueSize
+	}
+
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = AuditWebhookDefaultRetryBackoff
+	}
+
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = AuditWebhookDefaultCloseTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ws := &AuditWebhookSink{
+		url:     url,
+		client:  &http.Client{Timeout: opts.Timeout},
+		opts:    opts,
+		queue:   make(chan *AuditRecord, opts.QueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	go ws.deliver()
+
+	return ws
+}
+
+// Write queues the record for delivery.
+// ErrAuditQueueFull is returned if the queue is full, unless configured
+// to block until the record can be queued or the sink is closed.
+func (ws *AuditWebhookSink) Write(record *AuditRecord) error {
+	ws.mux.RLock()
+	defer ws.mux.RUnlock()
+
+	if ws.closed {
+		return os.ErrClosed
+	}
+
+	if ws.opts.Block {
+		select {
+		case ws.queue <- record:
+			return nil
+		case <-ws.closing:
+			return os.ErrClosed
+		}
+	}
+
+	select {
+	case ws.queue <- record:
+		return nil
+	default:
+		return ErrAuditQueueFull
+	}
+}
+
+// Close delivers the queued records and stops the sink.
+// Failed requests are not retried once the sink is closed, and the records
+// that are not delivered within the CloseTimeout are dropped.
+func (ws *AuditWebhookSink) Close() error {
+	// Release the blocked writers before waiting for them.
+	ws.closeOnce.Do(func() { close(ws.closing) })
+
+	ws.mux.Lock()
+	if !ws.closed {
+		ws.closed = true
+		close(ws.queue)
+	}
+	ws.mux.Unlock()
+
+	timer := time.NewTimer(ws.opts.CloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ws.done:
+		return nil
+	case <-timer.C:
+	}
+
+	ws.cancel()
+	<-ws.done
+
+	return ErrAuditCloseTimeout
+}
+
+func (ws *AuditWebhookSink) deliver() {
+	defer close(ws.done)
+	defer ws.cancel()
+
+	for record := range ws.queue {
+		if err := ws.postWithRetry(record); err != nil {
+			klog.ErrorS(err, "failed to deliver audit record", "url", ws.url, "operation", record.Operation)
+
+			if ws.opts.OnDropped != nil {
+				ws.opts.OnDropped()
+			}
+		}
+	}
+}
+
+// postWithRetry posts the record, retrying failed requests with an
+// exponential backoff until MaxRetries is reached or the sink is closed.
+func (ws *AuditWebhookSink) postWithRetry(record *AuditRecord) error {
+	backoff := ws.opts.RetryBackoff
+
+	for retry := 0; ; retry++ {
+		err := ws.post(record)
+		if err == nil || retry >= ws.opts.MaxRetries {
+			return err
+		}
+
+		klog.V(4).InfoS("retrying the delivery of an audit record", "url", ws.url, "operation", record.Operation, "err", err, "backoff", backoff)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ws.closing:
+			return err
+		}
+	}
+}
+
+func (ws *AuditWebhookSink) post(record *AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ws.ctx, http.MethodPost, ws.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,417 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/component-base/metrics/testutil"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+type fakeAuditSink struct {
+	mux     sync.Mutex
+	records []AuditRecord
+	closed  bool
+	retErr  error
+}
+
+func (fs *fakeAuditSink) Write(record *AuditRecord) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	if fs.retErr != nil {
+		return fs.retErr
+	}
+	fs.records = append(fs.records, *record)
+	return nil
+}
+
+func (fs *fakeAuditSink) Close() error {
+	fs.closed = true
+	return nil
+}
+
+func (fs *fakeAuditSink) lastRecord() AuditRecord {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.records[len(fs.records)-1]
+}
+
+func TestAuditLevel(t *testing.T) {
+	for _, l := range []AuditLevel{AuditLevelNone, AuditLevelMetadata, AuditLevelRequest} {
+		assert.NoError(t, l.Validate())
+	}
+
+	assert.Error(t, AuditLevel("foo").Validate())
+}
+
+func TestAuditRecordsViaGRPCClient(t *testing.T) {
+	ctx := context.Background()
+	th := newTestHarness().WithMockCSIDriver(t).WithFakeClientAPIs()
+	defer th.TerminateMockCSIDriver()
+
+	grpcServer := th.StartGRPCServer(t, th.Runtime())
+	defer th.StopGRPCServer(t)
+	grpcServer.CSIDriverIsReady()
+
+	sink := &fakeAuditSink{}
+	grpcServer.config.Audit = AuditConfig{Level: AuditLevelRequest, Sink: sink}
+
+	client := th.GRPCSnapshotMetadataClient(t)
+
+	drain := func(recv func() error) {
+		for {
+			if err := recv(); err != nil {
+				return
+			}
+		}
+	}
+
+	t.Run("allocated-success", func(t *testing.T) {
+		th.MockCSISnapshotMetadataServer.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(req *csi.GetMetadataAllocatedRequest, stream csi.SnapshotMetadata_GetMetadataAllocatedServer) error {
+				for i := int64(0); i < 2; i++ {
+					stream.Send(&csi.GetMetadataAllocatedResponse{
+						BlockMetadataType:   csi.BlockMetadataType_FIXED_LENGTH,
+						VolumeCapacityBytes: 1 << 20,
+						BlockMetadata: []*csi.BlockMetadata{
+							{ByteOffset: 2 * i * 1024, SizeBytes: 1024},
+							{ByteOffset: (2*i + 1) * 1024, SizeBytes: 1024},
+						},
+					})
+				}
+				return nil
+			})
+
+		stream, err := client.GetMetadataAllocated(ctx, &api.GetMetadataAllocatedRequest{
+			SecurityToken:  th.SecurityToken,
+			Namespace:      th.Namespace,
+			SnapshotName:   "snap-1",
+			StartingOffset: 512,
+			MaxResults:     2,
+		})
+		assert.NoError(t, err)
+		drain(func() error { _, err := stream.Recv(); return err })
+
+		rec := sink.lastRecord()
+		assert.Equal(t, AuditLevelRequest, rec.Level)
+		assert.Equal(t, "GetMetadataAllocated", rec.Operation)
+		assert.NotNil(t, rec.User)
+		assert.Equal(t, th.Namespace, rec.Namespace)
+		assert.Equal(t, "snap-1", rec.SnapshotName)
+		assert.Equal(t, int64(512), *rec.StartingOffset)
+		assert.Equal(t, int32(2), *rec.MaxResults)
+		assert.Equal(t, 2, rec.NumResponses)
+		assert.Equal(t, 4, rec.NumTuples)
+		assert.Equal(t, int64(4096), rec.BytesDescribed)
+		assert.Equal(t, "OK", rec.Code)
+		assert.Empty(t, rec.Message)
+	})
+
+	t.Run("delta-permission-denied", func(t *testing.T) {
+		grpcServer.config.Audit.Level = AuditLevelMetadata
+
+		stream, err := client.GetMetadataDelta(ctx, &api.GetMetadataDeltaRequest{
+			SecurityToken:      th.SecurityToken,
+			Namespace:          th.Namespace + "foo",
+			BaseSnapshotName:   "snap-1",
+			TargetSnapshotName: "snap-2",
+		})
+		assert.NoError(t, err)
+		drain(func() error { _, err := stream.Recv(); return err })
+
+		rec := sink.lastRecord()
+		assert.Equal(t, AuditLevelMetadata, rec.Level)
+		assert.Equal(t, "GetMetadataDelta", rec.Operation)
+		assert.Nil(t, rec.User)
+		assert.Equal(t, "snap-2", rec.SnapshotName)
+		assert.Equal(t, "snap-1", rec.BaseSnapshotName)
+		assert.Empty(t, rec.BaseSnapshotID)
+		assert.Nil(t, rec.StartingOffset)
+		assert.Nil(t, rec.MaxResults)
+		assert.Zero(t, rec.NumResponses)
+		assert.Equal(t, "PermissionDenied", rec.Code)
+		assert.Contains(t, rec.Message, msgPermissionDeniedPrefix)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		grpcServer.config.Audit.Level = AuditLevelNone
+		numRecords := len(sink.records)
+
+		stream, err := client.GetMetadataAllocated(ctx, &api.GetMetadataAllocatedRequest{})
+		assert.NoError(t, err)
+		drain(func() error { _, err := stream.Recv(); return err })
+
+		assert.Len(t, sink.records, numRecords)
+	})
+}
+
+func TestAuditRecordsDropped(t *testing.T) {
+	th := newTestHarness()
+	s := th.ServerWithRuntime(t, th.Runtime())
+
+	sink := &fakeAuditSink{}
+	s.config.Audit = AuditConfig{Level: AuditLevelMetadata, Sink: sink}
+
+	for _, err := range []error{ErrAuditQueueFull, errors.New("write failed"), errors.New("write failed")} {
+		sink.retErr = err
+		s.emitAuditRecord(s.newAuditEvent("GetMetadataAllocated", th.Namespace, "snap-1", 0, 0), nil)
+	}
+
+	expected := `
+# HELP snapshot_metadata_controller_audit_records_dropped_total [ALPHA] The number of audit records that were not persisted by the audit sink.
+# TYPE snapshot_metadata_controller_audit_records_dropped_total counter
+snapshot_metadata_controller_audit_records_dropped_total{reason="queue_full"} 1
+snapshot_metadata_controller_audit_records_dropped_total{reason="write_failed"} 2
+`
+	err := testutil.GatherAndCompare(s.config.Runtime.MetricsManager.GetRegistry(), strings.NewReader(expected),
+		"snapshot_metadata_controller_audit_records_dropped_total")
+	assert.NoError(t, err)
+}
+
+func TestAuditFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	record := &AuditRecord{Level: AuditLevelMetadata, Operation: "GetMetadataAllocated", Code: "OK"}
+	line, err := json.Marshal(record)
+	assert.NoError(t, err)
+	lineLen := int64(len(line) + 1)
+
+	readRecords := func(path string) []AuditRecord {
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+		defer f.Close()
+
+		var records []AuditRecord
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var r AuditRecord
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+			records = append(records, r)
+		}
+		return records
+	}
+
+	// room for 2 records per file, with 2 backups
+	fs, err := NewAuditFileSink(path, 2*lineLen, 2)
+	assert.NoError(t, err)
+
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, fs.Write(record))
+	}
+
+	assert.Len(t, readRecords(path), 1)
+	assert.Len(t, readRecords(path+".1"), 2)
+	assert.Len(t, readRecords(path+".2"), 2)
+	assert.NoFileExists(t, path+".3")
+	assert.Equal(t, *record, readRecords(path)[0])
+
+	assert.NoError(t, fs.Close())
+	assert.ErrorIs(t, fs.Write(record), os.ErrClosed)
+
+	// reopened files are appended to
+	fs, err = NewAuditFileSink(path, 0, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Write(record))
+	assert.NoError(t, fs.Close())
+	assert.Len(t, readRecords(path), 2)
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	var (
+		mux      sync.Mutex
+		received []AuditRecord
+		failures = map[string]int{} // the number of requests to fail, by operation
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var rec AuditRecord
+		assert.NoError(t, json.Unmarshal(body, &rec))
+
+		mux.Lock()
+		defer mux.Unlock()
+		received = append(received, rec)
+
+		if failures[rec.Operation] > 0 {
+			failures[rec.Operation]--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	reset := func(fail map[string]int) {
+		mux.Lock()
+		defer mux.Unlock()
+		received = nil
+		failures = fail
+	}
+
+	operations := func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		ops := []string{}
+		for _, rec := range received {
+			ops = append(ops, rec.Operation)
+		}
+		return ops
+	}
+
+	t.Run("no-retry", func(t *testing.T) {
+		reset(map[string]int{"GetMetadataDelta": 1})
+		dropped := 0
+		ws := NewAuditWebhookSink(srv.URL, AuditWebhookOptions{OnDropped: func() { dropped++ }})
+		assert.NoError(t, ws.Write(&AuditRecord{Operation: "GetMetadataAllocated"}))
+		assert.NoError(t, ws.Write(&AuditRecord{Operation: "GetMetadataDelta"})) // webhook fails
+
+		// close delivers the queued records
+		assert.NoError(t, ws.Close())
+		assert.NoError(t, ws.Close())
+		assert.Equal(t, []string{"GetMetadataAllocated", "GetMetadataDelta"}, operations())
+		assert.Equal(t, 1, dropped)
+
+		assert.ErrorIs(t, ws.Write(&AuditRecord{}), os.ErrClosed)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		reset(map[string]int{"GetMetadataAllocated": 2, "GetMetadataDelta": 3})
+		dropped := 0
+		ws := NewAuditWebhookSink(srv.URL, AuditWebhookOptions{
+			MaxRetries:   2,
+			RetryBackoff: time.Millisecond,
+			OnDropped:    func() { dropped++ },
+		})
+		assert.NoError(t, ws.Write(&AuditRecord{Operation: "GetMetadataAllocated"})) // delivered by the last retry
+		assert.NoError(t, ws.Write(&AuditRecord{Operation: "GetMetadataDelta"}))     // retries exhausted
+
+		assert.Eventually(t, func() bool { return len(operations()) == 6 }, 5*time.Second, time.Millisecond)
+		assert.NoError(t, ws.Close())
+		assert.Equal(t, []string{
+			"GetMetadataAllocated", "GetMetadataAllocated", "GetMetadataAllocated",
+			"GetMetadataDelta", "GetMetadataDelta", "GetMetadataDelta",
+		}, operations())
+		assert.Equal(t, 1, dropped)
+	})
+
+	t.Run("no-retry-when-closed", func(t *testing.T) {
+		reset(map[string]int{"GetMetadataDelta": 1})
+		ws := NewAuditWebhookSink(srv.URL, AuditWebhookOptions{MaxRetries: 1, RetryBackoff: time.Hour})
+		assert.NoError(t, ws.Write(&AuditRecord{Operation: "GetMetadataDelta"}))
+
+		assert.Eventually(t, func() bool { return len(operations()) == 1 }, 5*time.Second, time.Millisecond)
+		assert.NoError(t, ws.Close())
+		assert.Len(t, operations(), 1)
+	})
+
+	blockingServer := func() (*httptest.Server, chan struct{}, chan struct{}) {
+		posted := make(chan struct{}, 10)
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			posted <- struct{}{}
+			<-release
+		}))
+		return srv, posted, release
+	}
+
+	t.Run("queue-full", func(t *testing.T) {
+		srv, posted, release := blockingServer()
+		defer srv.Close()
+
+		ws := NewAuditWebhookSink(srv.URL, AuditWebhookOptions{QueueSize: 1})
+		assert.NoError(t, ws.Write(&AuditRecord{})) // being delivered
+		<-posted
+		assert.NoError(t, ws.Write(&AuditRecord{})) // queued
+		assert.ErrorIs(t, ws.Write(&AuditRecord{}), ErrAuditQueueFull)
+
+		close(release)
+		assert.NoError(t, ws.Close())
+	})
+
+	t.Run("queue-full-block", func(t *testing.T) {
+		srv, posted, release := blockingServer()
+		defer srv.Close()
+
+		ws := NewAuditWebhookSink(srv.URL, AuditWebhookOptions{QueueSize: 1, Block: true})
+		assert.NoError(t, ws.Write(&AuditRecord{})) // being delivered
+		<-posted
+		assert.NoError(t, ws.Write(&AuditRecord{})) // queued
+
+		written := make(chan error)
+		go func() { written <- ws.Write(&AuditRecord{}) }()
+
+		select {
+		case <-written:
+			assert.Fail(t, "Write did not block")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		assert.NoError(t, <-written)
+		assert.NoError(t, ws.Close())
+		assert.Len(t, posted, 2)
+	})
+
+	t.Run("close-timeout", func(t *testing.T) {
+		srv, posted, release := blockingServer()
+		defer srv.Close()
+		defer close(release)
+
+		dropped := 0
+		ws := NewAuditWebhookSink(srv.URL, AuditWebhookOptions{
+			QueueSize:    1,
+			Block:        true,
+			CloseTimeout: 50 * time.Millisecond,
+			OnDropped:    func() { dropped++ },
+		})
+		assert.NoError(t, ws.Write(&AuditRecord{})) // being delivered
+		<-posted
+		assert.NoError(t, ws.Write(&AuditRecord{})) // queued
+
+		written := make(chan error)
+		go func() { written <- ws.Write(&AuditRecord{}) }()
+
+		select {
+		case <-written:
+			assert.Fail(t, "Write did not block")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// the blocked writer is released and the delivery is abandoned
+		assert.ErrorIs(t, ws.Close(), ErrAuditCloseTimeout)
+		assert.ErrorIs(t, <-written, os.ErrClosed)
+		assert.Equal(t, 2, dropped)
+		assert.NoError(t, ws.Close())
+	})
+}
@@ -19,41 +19,64 @@ package grpc
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	authv1 "k8s.io/api/authentication/v1"
-	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kauthorizer "k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/klog/v2"
 
-	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authn"
-	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authz"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
-func (s *Server) authenticateAndAuthorize(ctx context.Context, token string, namespace string) error {
+// authenticateAndAuthorize returns the identity of the user if authenticated
+// and authorized to access the metadata of the named VolumeSnapshot in the namespace.
+func (s *Server) authenticateAndAuthorize(ctx context.Context, token string, namespace, name string) (*authv1.UserInfo, error) {
 	// Authenticate request with security token and find the user identity
-	authenticated, userInfo, err := s.authenticateRequest(ctx, token)
+	startTime := time.Now()
+	spanCtx, span := tracing.StartSpan(ctx, "authenticate")
+	authenticated, userInfo, err := s.authenticateRequest(spanCtx, token)
+	tracing.EndSpan(span, err)
+	s.recordAuth(runtime.AuthPhaseAuthentication, startTime, authenticated, err)
 	if err != nil {
-		return status.Errorf(codes.Internal, msgInternalFailedToAuthenticateFmt, err)
+		return nil, status.Errorf(codes.Internal, msgInternalFailedToAuthenticateFmt, err)
 	}
 	if !authenticated {
 		klog.FromContext(ctx).Error(err, msgUnauthenticatedUser, "userInfo", userInfo)
-		return status.Error(codes.Unauthenticated, msgUnauthenticatedUser)
+		return nil, status.Error(codes.Unauthenticated, msgUnauthenticatedUser)
 	}
 
 	// Authorize user
-	authorizer := authz.NewSARAuthorizer(s.kubeClient())
-	decision, reason, err := authorizer.Authorize(ctx, userInfo, namespace)
+	startTime = time.Now()
+	spanCtx, span = tracing.StartSpan(ctx, "authorize")
+	decision, reason, err := s.authorizer().Authorize(spanCtx, userInfo, namespace, name)
+	tracing.EndSpan(span, err)
+	s.recordAuth(runtime.AuthPhaseAuthorization, startTime, decision == kauthorizer.DecisionAllow, err)
 	if err != nil {
-		return status.Errorf(codes.Internal, mgsInternalFailedToAuthorizeFmt, err)
+		return nil, status.Errorf(codes.Internal, mgsInternalFailedToAuthorizeFmt, err)
 	}
 	if decision != kauthorizer.DecisionAllow {
 		klog.FromContext(ctx).Error(err, msgPermissionDeniedPrefix, "userInfo", userInfo)
-		return status.Errorf(codes.PermissionDenied, msgPermissionDeniedFmt, reason)
+		return nil, status.Errorf(codes.PermissionDenied, msgPermissionDeniedFmt, reason)
 	}
 
-	return nil
+	return userInfo, nil
+}
+
+// recordAuth records the duration and result of the authentication or authorization phase.
+func (s *Server) recordAuth(phase string, startTime time.Time, allowed bool, err error) {
+	result := runtime.AuthResultDenied
+
+	switch {
+	case err != nil:
+		result = runtime.AuthResultError
+	case allowed:
+		result = runtime.AuthResultAllowed
+	}
+
+	s.config.Runtime.RecordAuth(phase, result, time.Since(startTime))
 }
 
 func (s *Server) authenticateRequest(ctx context.Context, securityToken string) (bool, *authv1.UserInfo, error) {
@@ -64,8 +87,7 @@ func (s *Server) authenticateRequest(ctx context.Context, securityToken string)
 	}
 
 	// Authenticate request with the security token
-	authenticator := authn.NewTokenAuthenticator(s.kubeClient())
-	return authenticator.Authenticate(ctx, securityToken, audience)
+	return s.authenticator().Authenticate(ctx, securityToken, audience)
 }
 
 func (s *Server) getAudienceForDriver(ctx context.Context) (string, error) {
@@ -74,7 +96,7 @@ func (s *Server) getAudienceForDriver(ctx context.Context) (string, error) {
 		return audience, nil
 	}
 
-	sms, err := s.cbtClient().CbtV1alpha1().SnapshotMetadataServices().Get(ctx, s.driverName(), apimetav1.GetOptions{})
+	sms, err := s.lookupSnapshotMetadataService(ctx, s.driverName())
 	if err != nil {
 		klog.FromContext(ctx).Error(err, msgInternalFailedToFindCR, "driver", s.driverName())
 		return "", fmt.Errorf(msgInternalFailedToFindCRFmt, s.driverName(), err)
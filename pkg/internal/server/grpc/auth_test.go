@@ -20,13 +20,20 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	authzv1 "k8s.io/api/authorization/v1"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
 	clientgotesting "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authn"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authz"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
 )
 
 func TestAuthenticateAndAuthorize(t *testing.T) {
@@ -50,7 +57,7 @@ func TestAuthenticateAndAuthorize(t *testing.T) {
 		s.config.Runtime.Audience = ""
 
 		// fail via authenticateAndAuthorize
-		err = s.authenticateAndAuthorize(context.Background(), "some-token", "some-namespace")
+		_, err = s.authenticateAndAuthorize(context.Background(), "some-token", "some-namespace", "snap-1")
 		assert.Error(t, err)
 		st, ok := status.FromError(err)
 		assert.True(t, ok)
@@ -84,7 +91,7 @@ func TestAuthenticateAndAuthorize(t *testing.T) {
 		assert.Nil(t, ui)
 
 		// fail via authenticateAndAuthorize
-		err = s.authenticateAndAuthorize(context.Background(), th.SecurityToken+"foo", "some-namespace")
+		_, err = s.authenticateAndAuthorize(context.Background(), th.SecurityToken+"foo", "some-namespace", "snap-1")
 		assert.Error(t, err)
 		st, ok := status.FromError(err)
 		assert.True(t, ok)
@@ -103,7 +110,7 @@ func TestAuthenticateAndAuthorize(t *testing.T) {
 		assert.Nil(t, ui)
 
 		// fails via authenticateAndAuthorize
-		err = s.authenticateAndAuthorize(context.Background(), th.SecurityToken+"foo", "some-namespace")
+		_, err = s.authenticateAndAuthorize(context.Background(), th.SecurityToken+"foo", "some-namespace", "snap-1")
 		assert.Error(t, err)
 		st, ok := status.FromError(err)
 		assert.True(t, ok)
@@ -121,7 +128,7 @@ func TestAuthenticateAndAuthorize(t *testing.T) {
 			return true, nil, errors.New("create-subjectaccessreviews-error")
 		})
 
-		err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace)
+		_, err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace, "snap-1")
 		assert.Error(t, err)
 		st, ok := status.FromError(err)
 		assert.True(t, ok)
@@ -133,7 +140,7 @@ func TestAuthenticateAndAuthorize(t *testing.T) {
 		th := newTestHarness().WithFakeClientAPIs().WithMockCSIDriver(t)
 		s := th.ServerWithRuntime(t, th.Runtime())
 
-		err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace+"foo")
+		_, err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace+"foo", "snap-1")
 		assert.Error(t, err)
 		st, ok := status.FromError(err)
 		assert.True(t, ok)
@@ -145,7 +152,53 @@ func TestAuthenticateAndAuthorize(t *testing.T) {
 		th := newTestHarness().WithFakeClientAPIs().WithMockCSIDriver(t)
 		s := th.ServerWithRuntime(t, th.Runtime())
 
-		err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace)
+		_, err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace, "snap-1")
 		assert.NoError(t, err)
 	})
+
+	t.Run("resource-attributes", func(t *testing.T) {
+		th := newTestHarness().WithFakeClientAPIs().WithMockCSIDriver(t)
+		s := th.ServerWithRuntime(t, th.Runtime())
+		s.config.SAR = authz.SARConfig{Verb: "list", Subresource: "metadata", IncludeName: true}
+
+		_, err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace, "snap-1")
+		assert.NoError(t, err)
+
+		var attrs *authzv1.ResourceAttributes
+		for _, a := range th.FakeKubeClient.Actions() {
+			if a.GetVerb() == "create" && a.GetResource().Resource == "subjectaccessreviews" {
+				attrs = a.(clientgotesting.CreateAction).GetObject().(*authzv1.SubjectAccessReview).Spec.ResourceAttributes
+			}
+		}
+		assert.NotNil(t, attrs)
+		assert.Equal(t, "list", attrs.Verb)
+		assert.Equal(t, "metadata", attrs.Subresource)
+		assert.Equal(t, "snap-1", attrs.Name)
+	})
+
+	t.Run("cached-decisions", func(t *testing.T) {
+		th := newTestHarness().WithFakeClientAPIs().WithMockCSIDriver(t)
+		rt := th.Runtime()
+		s := th.ServerWithRuntime(t, rt)
+		s.config.AuthCache = authcache.Config{Size: 10, PositiveTTL: time.Minute, NegativeTTL: time.Minute}
+		s.tokenAuthenticator = authn.NewCachedTokenAuthenticator(rt.KubeClient, s.authCacheConfig(runtime.AuthCacheAuthentication))
+		s.sarAuthorizer = authz.NewCachedSARAuthorizer(rt.KubeClient, s.config.SAR, s.authCacheConfig(runtime.AuthCacheAuthorization))
+
+		for i := 0; i < 3; i++ {
+			_, err := s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace, "snap-1")
+			assert.NoError(t, err)
+
+			_, err = s.authenticateAndAuthorize(context.Background(), th.SecurityToken, th.Namespace+"foo", "snap-1")
+			assert.Error(t, err)
+		}
+
+		numCreated := map[string]int{}
+		for _, a := range th.FakeKubeClient.Actions() {
+			if a.GetVerb() == "create" {
+				numCreated[a.GetResource().Resource]++
+			}
+		}
+		assert.Equal(t, 1, numCreated["tokenreviews"])
+		assert.Equal(t, 2, numCreated["subjectaccessreviews"])
+	})
 }
@@ -0,0 +1,167 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	authv1 "k8s.io/api/authentication/v1"
+	kauthorizer "k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+// getBaseSnapshotID returns the CSI handle of the base snapshot of the request.
+// A base snapshot specified by name is resolved from its VolumeSnapshotContent
+// with the same checks applied to the target snapshot, and is authorized if
+// access is reviewed per snapshot; one specified by handle is verified with
+// verifyBaseSnapshot.
+func (s *Server) getBaseSnapshotID(ctx context.Context, req *api.GetMetadataDeltaRequest, userInfo *authv1.UserInfo, vsiTarget *volSnapshotInfo) (string, error) {
+	if req.BaseSnapshotName == "" {
+		if err := s.verifyBaseSnapshot(ctx, userInfo, req.Namespace, req.BaseSnapshotId, vsiTarget); err != nil {
+			return "", err
+		}
+
+		return req.BaseSnapshotId, nil
+	}
+
+	vsiBase, err := s.getVolSnapshotInfo(ctx, req.Namespace, req.BaseSnapshotName)
+	if err != nil {
+		return "", err
+	}
+
+	if vsiBase.DriverName != s.driverName() {
+		err = status.Errorf(codes.InvalidArgument, msgInvalidArgumentSnaphotDriverInvalidFmt, req.BaseSnapshotName, s.driverName())
+		klog.FromContext(ctx).Error(err, "invalid driver")
+		return "", err
+	}
+
+	if s.config.SAR.IncludeName {
+		decision, _, err := s.authorizer().Authorize(ctx, userInfo, req.Namespace, req.BaseSnapshotName)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, mgsInternalFailedToAuthorizeFmt, err)
+		}
+
+		if decision != kauthorizer.DecisionAllow {
+			klog.FromContext(ctx).Error(nil, msgPermissionDeniedBaseSnapshot, "userInfo", userInfo)
+			return "", status.Errorf(codes.PermissionDenied, msgPermissionDeniedBaseSnapshotFmt, req.BaseSnapshotName)
+		}
+	}
+
+	if s.config.VerifyBaseSnapshot {
+		if err := checkSourceVolume(ctx, req.BaseSnapshotName, vsiBase.SourceVolumeHandle, vsiTarget.SourceVolumeHandle); err != nil {
+			return "", err
+		}
+	}
+
+	return vsiBase.SnapshotHandle, nil
+}
+
+// checkSourceVolume returns an InvalidArgument error unless the source volume
+// handles of the base and target snapshots are both known and equal.
+// Pre-provisioned VolumeSnapshotContents have no source volume handle, so
+// their snapshots cannot be verified.
+func checkSourceVolume(ctx context.Context, baseSnapshot, baseHandle, targetHandle string) error {
+	logger := klog.FromContext(ctx).WithValues("targetSourceVolumeHandle", targetHandle, "baseSourceVolumeHandle", baseHandle)
+
+	if baseHandle == "" || targetHandle == "" {
+		logger.Error(nil, msgInvalidArgumentBaseSnapshotSourceUnknown)
+		return status.Errorf(codes.InvalidArgument, msgInvalidArgumentBaseSnapshotSourceUnknownFmt, baseSnapshot)
+	}
+
+	if baseHandle != targetHandle {
+		logger.Error(nil, msgInvalidArgumentBaseSnapshotSourceMismatch)
+		return status.Errorf(codes.InvalidArgument, msgInvalidArgumentBaseSnapshotSourceMismatchFmt, baseSnapshot)
+	}
+
+	return nil
+}
+
+// verifyBaseSnapshot checks that the base snapshot handle belongs to a
+// VolumeSnapshotContent of the CSI driver that is bound to a VolumeSnapshot
+// in a namespace accessible to the user, and whose source volume is that of
+// the target snapshot. The namespace of the request has already been authorized,
+// unless access is reviewed per snapshot.
+// The check is skipped if not enabled in the server configuration.
+func (s *Server) verifyBaseSnapshot(ctx context.Context, userInfo *authv1.UserInfo, namespace, baseSnapshotID string, vsiTarget *volSnapshotInfo) error {
+	if !s.config.VerifyBaseSnapshot {
+		return nil
+	}
+
+	logger := klog.FromContext(ctx).WithValues("baseSnapshotId", baseSnapshotID)
+
+	vscs, err := s.lookupVolumeSnapshotContentsForHandle(ctx, baseSnapshotID)
+	if err != nil {
+		logger.Error(err, msgUnavailableFailedToListVolumeSnapshotContents)
+		return status.Errorf(codes.Unavailable, msgUnavailableFailedToListVolumeSnapshotContentsFmt, err)
+	}
+
+	var bound []*snapshotv1.VolumeSnapshotContent
+	for _, vsc := range vscs {
+		if vsc.Spec.Driver == s.driverName() && vsc.Spec.VolumeSnapshotRef.Name != "" {
+			bound = append(bound, vsc)
+		}
+	}
+
+	if len(bound) == 0 {
+		logger.Error(nil, msgInvalidArgumentBaseSnapshotNotFound)
+		return status.Errorf(codes.InvalidArgument, msgInvalidArgumentBaseSnapshotNotFoundFmt, baseSnapshotID)
+	}
+
+	var (
+		sameSource  []*snapshotv1.VolumeSnapshotContent
+		mismatchErr error
+	)
+	for _, vsc := range bound {
+		sourceVolumeHandle := ""
+		if vsc.Spec.Source.VolumeHandle != nil {
+			sourceVolumeHandle = *vsc.Spec.Source.VolumeHandle
+		}
+
+		if mismatchErr = checkSourceVolume(ctx, baseSnapshotID, sourceVolumeHandle, vsiTarget.SourceVolumeHandle); mismatchErr == nil {
+			sameSource = append(sameSource, vsc)
+		}
+	}
+
+	if len(sameSource) == 0 {
+		return mismatchErr
+	}
+
+	for _, vsc := range sameSource {
+		if vsc.Spec.VolumeSnapshotRef.Namespace == namespace && !s.config.SAR.IncludeName {
+			return nil
+		}
+	}
+
+	for _, vsc := range sameSource {
+		decision, _, err := s.authorizer().Authorize(ctx, userInfo, vsc.Spec.VolumeSnapshotRef.Namespace, vsc.Spec.VolumeSnapshotRef.Name)
+		if err != nil {
+			return status.Errorf(codes.Internal, mgsInternalFailedToAuthorizeFmt, err)
+		}
+
+		if decision == kauthorizer.DecisionAllow {
+			return nil
+		}
+	}
+
+	logger.Error(nil, msgPermissionDeniedBaseSnapshot, "userInfo", userInfo)
+	return status.Errorf(codes.PermissionDenied, msgPermissionDeniedBaseSnapshotFmt, baseSnapshotID)
+}
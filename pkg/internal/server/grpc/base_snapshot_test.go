@@ -0,0 +1,315 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authz"
+)
+
+func TestVerifyBaseSnapshot(t *testing.T) {
+	userInfo := &authv1.UserInfo{Username: "user"}
+	baseSnapshotName := "base-snap"
+	targetSnapshotName := "target-snap"
+
+	for _, tc := range []struct {
+		name            string
+		disabled        bool
+		reqNamespace    string
+		baseNamespace   string
+		baseInTestNs    bool
+		baseDriver      string
+		baseVolume      string
+		preProvisioned  bool
+		sarError        bool
+		noCache         bool
+		notSynced       bool
+		expStatusCode   codes.Code
+		expStatusMsgPat string
+	}{
+		{
+			name:     "disabled",
+			disabled: true,
+		},
+		{
+			name:         "same-namespace",
+			reqNamespace: "other-ns",
+		},
+		{
+			name:         "authorized-namespace",
+			reqNamespace: "other-ns",
+			baseInTestNs: true,
+		},
+		{
+			name:            "not-found",
+			reqNamespace:    "other-ns",
+			baseDriver:      "other-driver",
+			expStatusCode:   codes.InvalidArgument,
+			expStatusMsgPat: msgInvalidArgumentBaseSnapshotNotFound,
+		},
+		{
+			name:            "different-source-volume",
+			reqNamespace:    "other-ns",
+			baseVolume:      "other-volume",
+			expStatusCode:   codes.InvalidArgument,
+			expStatusMsgPat: msgInvalidArgumentBaseSnapshotSourceMismatch,
+		},
+		{
+			name:            "pre-provisioned-base",
+			reqNamespace:    "other-ns",
+			preProvisioned:  true,
+			expStatusCode:   codes.InvalidArgument,
+			expStatusMsgPat: msgInvalidArgumentBaseSnapshotSourceUnknown,
+		},
+		{
+			name:            "unauthorized-namespace",
+			reqNamespace:    "other-ns",
+			baseNamespace:   "secret-ns",
+			expStatusCode:   codes.PermissionDenied,
+			expStatusMsgPat: msgPermissionDeniedBaseSnapshot,
+		},
+		{
+			name:            "authorization-error",
+			reqNamespace:    "other-ns",
+			baseNamespace:   "secret-ns",
+			sarError:        true,
+			expStatusCode:   codes.Internal,
+			expStatusMsgPat: mgsInternalFailedToAuthorizePrefix,
+		},
+		{
+			name:            "no-cache",
+			reqNamespace:    "other-ns",
+			noCache:         true,
+			expStatusCode:   codes.Unavailable,
+			expStatusMsgPat: msgUnavailableFailedToListVolumeSnapshotContents,
+		},
+		{
+			name:            "cache-not-synced",
+			reqNamespace:    "other-ns",
+			notSynced:       true,
+			expStatusCode:   codes.Unavailable,
+			expStatusMsgPat: msgUnavailableFailedToListVolumeSnapshotContents,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			th := newTestHarness().WithFakeClientAPIs()
+			rt := th.Runtime()
+			s := th.ServerWithRuntime(t, rt)
+			s.config.VerifyBaseSnapshot = !tc.disabled
+
+			targetVSC := th.VolumeSnapshotContent(th.ContentNameFromSnapshot(targetSnapshotName), th.DriverName)
+			vsiTarget := &volSnapshotInfo{
+				DriverName:         th.DriverName,
+				SnapshotHandle:     *targetVSC.Status.SnapshotHandle,
+				SourceVolumeHandle: *targetVSC.Spec.Source.VolumeHandle,
+			}
+
+			baseVSC := th.VolumeSnapshotContent(th.ContentNameFromSnapshot(baseSnapshotName), th.DriverName)
+			baseVSC.Spec.Source.VolumeHandle = targetVSC.Spec.Source.VolumeHandle
+			baseVSC.Spec.VolumeSnapshotRef.Namespace = tc.reqNamespace
+			if tc.baseInTestNs {
+				baseVSC.Spec.VolumeSnapshotRef.Namespace = th.Namespace
+			} else if tc.baseNamespace != "" {
+				baseVSC.Spec.VolumeSnapshotRef.Namespace = tc.baseNamespace
+			}
+			if tc.baseDriver != "" {
+				baseVSC.Spec.Driver = tc.baseDriver
+			}
+			if tc.baseVolume != "" {
+				baseVSC.Spec.Source.VolumeHandle = &tc.baseVolume
+			}
+			if tc.preProvisioned {
+				baseVSC.Spec.Source.VolumeHandle = nil
+				baseVSC.Spec.Source.SnapshotHandle = baseVSC.Status.SnapshotHandle
+			}
+
+			assert.NoError(t, th.FakeSnapshotClient.Tracker().Add(baseVSC))
+			assert.NoError(t, th.FakeSnapshotClient.Tracker().Add(targetVSC))
+
+			ctx := context.Background()
+			switch {
+			case tc.notSynced:
+				th.FakeSnapshotClient.PrependReactor("list", "volumesnapshotcontents", func(action clientgotesting.Action) (bool, apiruntime.Object, error) {
+					return true, nil, errors.New("list error")
+				})
+				assert.NoError(t, rt.StartInformers(t.Context()))
+
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, 3*cacheSyncPollInterval)
+				defer cancel()
+			case !tc.noCache:
+				th.StartInformers(t, rt)
+			}
+
+			// the API server is never listed
+			listed := false
+			th.FakeSnapshotClient.PrependReactor("list", "volumesnapshotcontents", func(action clientgotesting.Action) (bool, apiruntime.Object, error) {
+				listed = !tc.notSynced
+				return false, nil, nil
+			})
+
+			if tc.sarError {
+				th.FakeKubeClient.PrependReactor("create", "subjectaccessreviews", func(action clientgotesting.Action) (bool, apiruntime.Object, error) {
+					return true, nil, errors.New("sar error")
+				})
+			}
+
+			err := s.verifyBaseSnapshot(ctx, userInfo, tc.reqNamespace, th.HandleFromSnapshot(baseSnapshotName), vsiTarget)
+			assert.False(t, listed)
+			if tc.expStatusCode == codes.OK {
+				assert.NoError(t, err)
+				return
+			}
+
+			st, ok := status.FromError(err)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expStatusCode, st.Code())
+			assert.Contains(t, st.Message(), tc.expStatusMsgPat)
+		})
+	}
+}
+
+func TestGetBaseSnapshotIDSourceMismatch(t *testing.T) {
+	th := newTestHarness().WithFakeClientAPIs()
+	s := th.ServerWithRuntime(t, th.Runtime())
+	s.config.VerifyBaseSnapshot = true
+
+	vsiTarget, err := s.getVolSnapshotInfo(context.Background(), "test-ns", "snap-2")
+	assert.NoError(t, err)
+
+	req := &api.GetMetadataDeltaRequest{
+		Namespace:          "test-ns",
+		BaseSnapshotName:   "snap-1",
+		TargetSnapshotName: "snap-2",
+	}
+
+	// the fake VolumeSnapshotContents are of different source volumes
+	baseSnapshotID, err := s.getBaseSnapshotID(context.Background(), req, nil, vsiTarget)
+	assert.Empty(t, baseSnapshotID)
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Contains(t, st.Message(), msgInvalidArgumentBaseSnapshotSourceMismatch)
+
+	// no mismatch when the source volumes are the same
+	th.FakeSnapshotClient.PrependReactor("get", "volumesnapshotcontents", func(action clientgotesting.Action) (bool, apiruntime.Object, error) {
+		vsc := th.VolumeSnapshotContent(action.(clientgotesting.GetAction).GetName(), th.DriverName)
+		vsc.Spec.Source.VolumeHandle = &vsiTarget.SourceVolumeHandle
+		return true, vsc, nil
+	})
+
+	baseSnapshotID, err = s.getBaseSnapshotID(context.Background(), req, nil, vsiTarget)
+	assert.NoError(t, err)
+	assert.Equal(t, th.HandleFromSnapshot("snap-1"), baseSnapshotID)
+}
+
+func TestGetBaseSnapshotIDPreProvisioned(t *testing.T) {
+	th := newTestHarness().WithFakeClientAPIs()
+	rt := th.Runtime()
+	s := th.ServerWithRuntime(t, rt)
+	s.config.VerifyBaseSnapshot = true
+	s.config.LiveLookupOnCacheMiss = true
+
+	vsiTarget, err := s.getVolSnapshotInfo(context.Background(), th.Namespace, "snap-2")
+	assert.NoError(t, err)
+
+	// the base VolumeSnapshotContent is pre-provisioned, without a source volume handle
+	preProvisioned := th.VolumeSnapshotContent(th.ContentNameFromSnapshot("snap-1"), th.DriverName)
+	preProvisioned.Spec.Source.VolumeHandle = nil
+	preProvisioned.Spec.Source.SnapshotHandle = preProvisioned.Status.SnapshotHandle
+	preProvisioned.Spec.VolumeSnapshotRef.Namespace = th.Namespace
+	th.FakeSnapshotClient.PrependReactor("get", "volumesnapshotcontents", func(action clientgotesting.Action) (bool, apiruntime.Object, error) {
+		if action.(clientgotesting.GetAction).GetName() != preProvisioned.Name {
+			return false, nil, nil
+		}
+		return true, preProvisioned, nil
+	})
+	assert.NoError(t, th.FakeSnapshotClient.Tracker().Add(preProvisioned))
+	th.StartInformers(t, rt)
+
+	// rejected by name and by handle as the source volume cannot be verified
+	req := &api.GetMetadataDeltaRequest{
+		Namespace:          th.Namespace,
+		BaseSnapshotName:   "snap-1",
+		TargetSnapshotName: "snap-2",
+	}
+	for _, baseSnapshotName := range []string{"snap-1", ""} {
+		req.BaseSnapshotName = baseSnapshotName
+		if baseSnapshotName == "" {
+			req.BaseSnapshotId = th.HandleFromSnapshot("snap-1")
+		}
+
+		baseSnapshotID, err := s.getBaseSnapshotID(context.Background(), req, nil, vsiTarget)
+		assert.Empty(t, baseSnapshotID)
+		st, ok := status.FromError(err)
+		assert.True(t, ok)
+		assert.Equal(t, codes.InvalidArgument, st.Code())
+		assert.Contains(t, st.Message(), msgInvalidArgumentBaseSnapshotSourceUnknown)
+	}
+
+	// accepted if not verified
+	s.config.VerifyBaseSnapshot = false
+	baseSnapshotID, err := s.getBaseSnapshotID(context.Background(), req, nil, vsiTarget)
+	assert.NoError(t, err)
+	assert.Equal(t, th.HandleFromSnapshot("snap-1"), baseSnapshotID)
+}
+
+func TestGetBaseSnapshotIDAuthorizeName(t *testing.T) {
+	th := newTestHarness().WithFakeClientAPIs()
+	s := th.ServerWithRuntime(t, th.Runtime())
+	s.config.SAR = authz.SARConfig{IncludeName: true}
+
+	th.FakeKubeClient.PrependReactor("create", "subjectaccessreviews", func(action clientgotesting.Action) (bool, apiruntime.Object, error) {
+		sar := action.(clientgotesting.CreateAction).GetObject().(*authzv1.SubjectAccessReview)
+		sar.Status.Allowed = sar.Spec.ResourceAttributes.Name == "snap-1"
+		return true, sar, nil
+	})
+
+	vsiTarget, err := s.getVolSnapshotInfo(context.Background(), th.Namespace, "snap-2")
+	assert.NoError(t, err)
+
+	req := &api.GetMetadataDeltaRequest{
+		Namespace:          th.Namespace,
+		BaseSnapshotName:   "snap-1",
+		TargetSnapshotName: "snap-2",
+	}
+
+	userInfo := &authv1.UserInfo{Username: "user"}
+	baseSnapshotID, err := s.getBaseSnapshotID(context.Background(), req, userInfo, vsiTarget)
+	assert.NoError(t, err)
+	assert.Equal(t, th.HandleFromSnapshot("snap-1"), baseSnapshotID)
+
+	req.BaseSnapshotName = "snap-0"
+	baseSnapshotID, err = s.getBaseSnapshotID(context.Background(), req, userInfo, vsiTarget)
+	assert.Empty(t, baseSnapshotID)
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.PermissionDenied, st.Code())
+	assert.Contains(t, st.Message(), msgPermissionDeniedBaseSnapshot)
+}
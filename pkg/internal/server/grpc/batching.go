@@ -0,0 +1,161 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+// BatchingConfig controls the number of BlockMetadata tuples in the
+// responses sent to the client.
+type BatchingConfig struct {
+	// DefaultMaxResults is the batch size used when the client does not
+	// specify max_results. The batch size is not bounded if not set.
+	DefaultMaxResults int32
+
+	// MaxResults is the upper bound of the batch size, applied to the
+	// max_results specified by the client. Not enforced if not set.
+	MaxResults int32
+
+	// Coalesce causes the tuples of consecutive CSI driver responses to be
+	// combined into responses of the batch size. Otherwise only the CSI driver
+	// responses that exceed the batch size are split.
+	Coalesce bool
+}
+
+// batchSize returns the maximum number of tuples in a response given the
+// max_results of the request, or 0 if unbounded.
+func (c BatchingConfig) batchSize(maxResults int32) int32 {
+	if maxResults <= 0 {
+		maxResults = c.DefaultMaxResults
+	}
+
+	if c.MaxResults > 0 && (maxResults <= 0 || maxResults > c.MaxResults) {
+		maxResults = c.MaxResults
+	}
+
+	if maxResults < 0 {
+		return 0
+	}
+
+	return maxResults
+}
+
+// responseSender sends a response to the client.
+type responseSender func(bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata) error
+
+// responseBatcher re-batches the tuples of the CSI driver responses into
+// client responses of at most batchSize tuples, preserving their order.
+// A response is not split if batchSize is 0.
+type responseBatcher struct {
+	batchSize int
+	coalesce  bool
+	send      responseSender
+
+	hasPending          bool
+	pending             []*api.BlockMetadata
+	blockMetadataType   api.BlockMetadataType
+	volumeCapacityBytes int64
+	numSent             int
+}
+
+func (s *Server) newResponseBatcher(batchSize int32, send responseSender) *responseBatcher {
+	return &responseBatcher{
+		batchSize: int(batchSize),
+		coalesce:  s.config.Batching.Coalesce && batchSize > 0,
+		send:      send,
+	}
+}
+
+// add accepts the content of a CSI driver response.
+// The tuples are sent in batches of batchSize, with the remainder held back
+// until the next call if coalescing.
+func (b *responseBatcher) add(bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata) error {
+	// tuples are only coalesced with responses of the same type and capacity.
+	if b.hasPending && (bmt != b.blockMetadataType || volumeCapacityBytes != b.volumeCapacityBytes) {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+
+	if !b.coalesce {
+		return b.sendBatches(bmt, volumeCapacityBytes, bmds, true)
+	}
+
+	b.hasPending = true
+	b.blockMetadataType = bmt
+	b.volumeCapacityBytes = volumeCapacityBytes
+	b.pending = append(b.pending, bmds...)
+
+	n := len(b.pending) - len(b.pending)%b.batchSize
+	if err := b.sendBatches(bmt, volumeCapacityBytes, b.pending[:n], false); err != nil {
+		return err
+	}
+
+	b.pending = b.pending[n:]
+
+	return nil
+}
+
+// flush sends the tuples held back. A response without tuples is sent if
+// no response has been sent, so that the client learns the type and capacity.
+func (b *responseBatcher) flush() error {
+	if !b.hasPending {
+		return nil
+	}
+
+	b.hasPending = false
+
+	if len(b.pending) == 0 && b.numSent > 0 {
+		return nil
+	}
+
+	bmds := b.pending
+	b.pending = nil
+	b.numSent++
+
+	return b.send(b.blockMetadataType, b.volumeCapacityBytes, bmds)
+}
+
+// sendBatches sends the tuples in responses of at most batchSize tuples.
+// A response without tuples is sent only if sendEmpty is set.
+func (b *responseBatcher) sendBatches(bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata, sendEmpty bool) error {
+	if len(bmds) == 0 {
+		if !sendEmpty {
+			return nil
+		}
+
+		b.numSent++
+		return b.send(bmt, volumeCapacityBytes, bmds)
+	}
+
+	for len(bmds) > 0 {
+		n := len(bmds)
+		if b.batchSize > 0 && n > b.batchSize {
+			n = b.batchSize
+		}
+
+		b.numSent++
+		if err := b.send(bmt, volumeCapacityBytes, bmds[:n]); err != nil {
+			return err
+		}
+
+		bmds = bmds[n:]
+	}
+
+	return nil
+}
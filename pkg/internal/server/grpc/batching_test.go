@@ -0,0 +1,263 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+func TestBatchingConfigBatchSize(t *testing.T) {
+	for _, tc := range []struct {
+		config     BatchingConfig
+		maxResults int32
+		exp        int32
+	}{
+		{BatchingConfig{}, 0, 0},
+		{BatchingConfig{}, 10, 10},
+		{BatchingConfig{}, -1, 0},
+		{BatchingConfig{DefaultMaxResults: 100}, 0, 100},
+		{BatchingConfig{DefaultMaxResults: 100}, 10, 10},
+		{BatchingConfig{MaxResults: 50}, 0, 50},
+		{BatchingConfig{MaxResults: 50}, 10, 10},
+		{BatchingConfig{MaxResults: 50}, 100, 50},
+		{BatchingConfig{DefaultMaxResults: 100, MaxResults: 50}, 0, 50},
+		{BatchingConfig{DefaultMaxResults: 20, MaxResults: 50}, 0, 20},
+	} {
+		assert.Equal(t, tc.exp, tc.config.batchSize(tc.maxResults), "%+v %d", tc.config, tc.maxResults)
+	}
+}
+
+// bmdRange returns n tuples of size 1 starting at the offset.
+func bmdRange(offset, n int64) []*api.BlockMetadata {
+	bmds := []*api.BlockMetadata{}
+	for i := int64(0); i < n; i++ {
+		bmds = append(bmds, &api.BlockMetadata{ByteOffset: offset + i, SizeBytes: 1})
+	}
+
+	return bmds
+}
+
+func TestResponseBatcher(t *testing.T) {
+	type response struct {
+		bmt  api.BlockMetadataType
+		cap  int64
+		bmds []*api.BlockMetadata
+	}
+
+	fixed := api.BlockMetadataType_FIXED_LENGTH
+	variable := api.BlockMetadataType_VARIABLE_LENGTH
+
+	for _, tc := range []struct {
+		name      string
+		batchSize int32
+		coalesce  bool
+		input     []response
+		exp       []response
+	}{
+		{
+			name: "unbounded",
+			input: []response{
+				{fixed, 100, bmdRange(0, 5)},
+				{fixed, 100, []*api.BlockMetadata{}},
+				{fixed, 100, bmdRange(5, 2)},
+			},
+			exp: []response{
+				{fixed, 100, bmdRange(0, 5)},
+				{fixed, 100, []*api.BlockMetadata{}},
+				{fixed, 100, bmdRange(5, 2)},
+			},
+		},
+		{
+			name:      "split",
+			batchSize: 2,
+			input: []response{
+				{fixed, 100, bmdRange(0, 5)},
+				{fixed, 100, bmdRange(5, 1)},
+			},
+			exp: []response{
+				{fixed, 100, bmdRange(0, 2)},
+				{fixed, 100, bmdRange(2, 2)},
+				{fixed, 100, bmdRange(4, 1)},
+				{fixed, 100, bmdRange(5, 1)},
+			},
+		},
+		{
+			name:      "coalesce",
+			batchSize: 3,
+			coalesce:  true,
+			input: []response{
+				{fixed, 100, bmdRange(0, 1)},
+				{fixed, 100, bmdRange(1, 1)},
+				{fixed, 100, []*api.BlockMetadata{}},
+				{fixed, 100, bmdRange(2, 5)},
+				{fixed, 100, bmdRange(7, 1)},
+			},
+			exp: []response{
+				{fixed, 100, bmdRange(0, 3)},
+				{fixed, 100, bmdRange(3, 3)},
+				{fixed, 100, bmdRange(6, 2)},
+			},
+		},
+		{
+			name:      "coalesce-exact",
+			batchSize: 2,
+			coalesce:  true,
+			input: []response{
+				{fixed, 100, bmdRange(0, 1)},
+				{fixed, 100, bmdRange(1, 1)},
+			},
+			exp: []response{
+				{fixed, 100, bmdRange(0, 2)},
+			},
+		},
+		{
+			name:      "coalesce-no-tuples",
+			batchSize: 2,
+			coalesce:  true,
+			input: []response{
+				{fixed, 100, []*api.BlockMetadata{}},
+				{fixed, 100, []*api.BlockMetadata{}},
+			},
+			exp: []response{
+				{fixed, 100, []*api.BlockMetadata{}},
+			},
+		},
+		{
+			name:      "coalesce-type-change",
+			batchSize: 3,
+			coalesce:  true,
+			input: []response{
+				{fixed, 100, bmdRange(0, 1)},
+				{variable, 100, bmdRange(1, 1)},
+				{variable, 200, bmdRange(2, 1)},
+			},
+			exp: []response{
+				{fixed, 100, bmdRange(0, 1)},
+				{variable, 100, bmdRange(1, 1)},
+				{variable, 200, bmdRange(2, 1)},
+			},
+		},
+		{
+			name:     "coalesce-unbounded",
+			coalesce: true,
+			input: []response{
+				{fixed, 100, bmdRange(0, 1)},
+				{fixed, 100, bmdRange(1, 1)},
+			},
+			exp: []response{
+				{fixed, 100, bmdRange(0, 1)},
+				{fixed, 100, bmdRange(1, 1)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{config: ServerConfig{Batching: BatchingConfig{Coalesce: tc.coalesce}}}
+
+			var sent []response
+			b := s.newResponseBatcher(tc.batchSize, func(bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata) error {
+				sent = append(sent, response{bmt, volumeCapacityBytes, append([]*api.BlockMetadata{}, bmds...)})
+				return nil
+			})
+
+			for _, r := range tc.input {
+				assert.NoError(t, b.add(r.bmt, r.cap, r.bmds))
+			}
+
+			assert.NoError(t, b.flush())
+			assert.Equal(t, tc.exp, sent)
+		})
+	}
+
+	t.Run("send-error", func(t *testing.T) {
+		s := &Server{config: ServerConfig{Batching: BatchingConfig{Coalesce: true}}}
+		errSend := errors.New("send-error")
+
+		b := s.newResponseBatcher(2, func(api.BlockMetadataType, int64, []*api.BlockMetadata) error {
+			return errSend
+		})
+
+		assert.NoError(t, b.add(fixed, 100, bmdRange(0, 1)))
+		assert.ErrorIs(t, b.add(fixed, 100, bmdRange(1, 1)), errSend)
+
+		b = s.newResponseBatcher(2, b.send)
+		assert.NoError(t, b.add(fixed, 100, bmdRange(0, 1)))
+		assert.ErrorIs(t, b.flush(), errSend)
+	})
+}
+
+func TestBatchingViaGRPCClient(t *testing.T) {
+	ctx := context.Background()
+	th := newTestHarness().WithMockCSIDriver(t).WithFakeClientAPIs()
+	defer th.TerminateMockCSIDriver()
+
+	grpcServer := th.StartGRPCServer(t, th.Runtime())
+	defer th.StopGRPCServer(t)
+	grpcServer.CSIDriverIsReady()
+	grpcServer.config.Batching = BatchingConfig{MaxResults: 4, Coalesce: true}
+
+	client := th.GRPCSnapshotMetadataClient(t)
+
+	th.MockCSISnapshotMetadataServer.EXPECT().GetMetadataDelta(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(req *csi.GetMetadataDeltaRequest, stream csi.SnapshotMetadata_GetMetadataDeltaServer) error {
+			assert.Equal(t, int32(4), req.MaxResults) // bounded by the server
+
+			// the driver returns a tuple per response
+			for i := int64(0); i < 6; i++ {
+				stream.Send(&csi.GetMetadataDeltaResponse{
+					BlockMetadataType:   csi.BlockMetadataType_VARIABLE_LENGTH,
+					VolumeCapacityBytes: 1 << 20,
+					BlockMetadata:       []*csi.BlockMetadata{{ByteOffset: i, SizeBytes: 1}},
+				})
+			}
+			return nil
+		})
+
+	stream, err := client.GetMetadataDelta(ctx, &api.GetMetadataDeltaRequest{
+		SecurityToken:      th.SecurityToken,
+		Namespace:          th.Namespace,
+		BaseSnapshotId:     th.HandleFromSnapshot("snap-1"),
+		TargetSnapshotName: "snap-2",
+		MaxResults:         100,
+	})
+	assert.NoError(t, err)
+
+	var batches [][]*api.BlockMetadata
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			break
+		}
+
+		assert.Equal(t, api.BlockMetadataType_VARIABLE_LENGTH, resp.BlockMetadataType)
+		assert.Equal(t, int64(1<<20), resp.VolumeCapacityBytes)
+		batches = append(batches, resp.BlockMetadata)
+	}
+
+	assert.Len(t, batches, 2)
+	assert.Equal(t, bmdRange(0, 4), batches[0])
+	assert.Equal(t, bmdRange(4, 2), batches[1])
+}
@@ -31,6 +31,7 @@ import (
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
 	fakesnapshot "github.com/kubernetes-csi/external-snapshotter/client/v8/clientset/versioned/fake"
 	snapshotutils "github.com/kubernetes-csi/external-snapshotter/v8/pkg/utils"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -41,8 +42,12 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientfeatures "k8s.io/client-go/features"
+	clientfeaturestesting "k8s.io/client-go/features/testing"
 	"k8s.io/client-go/kubernetes/fake"
 	clientgotesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
 	smsv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
@@ -74,6 +79,7 @@ type testHarness struct {
 
 	mockCSIDriverConn *grpc.ClientConn
 	grpcServer        *grpc.Server
+	serverOptions     []grpc.ServerOption
 	listener          *bufconn.Listener
 }
 
@@ -107,7 +113,7 @@ func (th *testHarness) WithFakeClientAPIs() *testHarness {
 }
 
 func (th *testHarness) Runtime() *runtime.Runtime {
-	return &runtime.Runtime{
+	rt := &runtime.Runtime{
 		CBTClient:      th.FakeCBTClient,
 		KubeClient:     th.FakeKubeClient,
 		SnapshotClient: th.FakeSnapshotClient,
@@ -115,6 +121,22 @@ func (th *testHarness) Runtime() *runtime.Runtime {
 		CSIConn:        th.mockCSIDriverConn,
 		MetricsManager: metrics.NewCSIMetricsManagerWithOptions(th.DriverName, metrics.WithSubsystem(runtime.SubSystem), metrics.WithLabelNames(runtime.LabelTargetSnapshotName, runtime.LabelBaseSnapshotID)),
 	}
+	utilruntime.Must(rt.RegisterMetrics())
+
+	return rt
+}
+
+// StartInformers starts the informers of the runtime and waits for their
+// caches to sync. The objects of the fake clients must be added before.
+func (th *testHarness) StartInformers(t *testing.T, rt *runtime.Runtime) {
+	// The generated fake clientsets do not support watch-list semantics.
+	clientfeaturestesting.SetFeatureDuringTest(t, clientfeatures.WatchListClient, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	assert.NoError(t, rt.StartInformers(ctx))
+	assert.True(t, cache.WaitForCacheSync(ctx.Done(), rt.Listers.HasSynced))
 }
 
 func (th *testHarness) ServerWithRuntime(t *testing.T, rt *runtime.Runtime) *Server {
@@ -131,7 +153,7 @@ func (th *testHarness) StartGRPCServer(t *testing.T, rt *runtime.Runtime) *Serve
 	buffer := 1024 * 1024
 
 	th.listener = bufconn.Listen(buffer)
-	th.grpcServer = grpc.NewServer()
+	th.grpcServer = grpc.NewServer(th.serverOptions...)
 
 	s := th.ServerWithRuntime(t, rt)
 	assert.NotZero(t, s.config.MaxStreamDur)
@@ -651,3 +673,14 @@ func (s *testSnapshotMetadataServerCtxPropagator) GetMetadataDelta(req *csi.GetM
 			})
 		})
 }
+
+// findMetricFamily returns the named metric family, or nil if not found.
+func findMetricFamily(metricFamilies []*dto.MetricFamily, name string) *dto.MetricFamily {
+	for _, mf := range metricFamilies {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+const (
+	// DrainErrorReason is the reason of the ErrorInfo detail of the Unavailable
+	// error returned by a stream canceled when the server shuts down.
+	DrainErrorReason = "SERVER_SHUTTING_DOWN"
+
+	// DrainErrorNextByteOffsetKey is the ErrorInfo metadata key of the byte offset
+	// from which the client should resume the stream.
+	DrainErrorNextByteOffsetKey = "nextByteOffset"
+
+	// drainStopGracePeriod bounds the time that the server waits for the
+	// canceled streams to end before closing their connections.
+	drainStopGracePeriod = 5 * time.Second
+)
+
+var errServerDraining = errors.New(msgUnavailableServerShuttingDown)
+
+// drainStreams rejects new metadata RPCs and returns a channel that is closed
+// after the drain timeout with the RPCs still in progress canceled.
+func (s *Server) drainStreams() <-chan struct{} {
+	t := &s.streams
+
+	t.mux.Lock()
+	t.draining = true
+	t.mux.Unlock()
+
+	expired := make(chan struct{})
+
+	time.AfterFunc(s.config.DrainTimeout, func() {
+		t.mux.Lock()
+		defer t.mux.Unlock()
+
+		if len(t.streams) > 0 {
+			klog.Infof("Canceling %d streams after the drain timeout of %v", len(t.streams), s.config.DrainTimeout)
+		}
+
+		for as := range t.streams {
+			as.cancel(errServerDraining)
+		}
+
+		close(expired)
+	})
+
+	return expired
+}
+
+// checkServerDraining returns an Unavailable error with the byte offset from
+// which the client should resume if the context was canceled because the
+// server is shutting down, or else the error.
+func (s *Server) checkServerDraining(ctx context.Context, as *activeStream, err error) error {
+	if err == nil || !errors.Is(context.Cause(ctx), errServerDraining) {
+		return err
+	}
+
+	nextOffset := as.nextOffset.Load()
+	st := status.Newf(codes.Unavailable, msgUnavailableServerShuttingDownFmt, nextOffset)
+
+	if stDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   DrainErrorReason,
+		Domain:   api.ErrorDomain,
+		Metadata: map[string]string{DrainErrorNextByteOffsetKey: strconv.FormatInt(nextOffset, 10)},
+	}); err == nil {
+		st = stDetails
+	}
+
+	return st.Err()
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+// assertServerDraining checks the error of a stream canceled by the drain.
+func assertServerDraining(t *testing.T, err error, expNextOffset int64) {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.Equal(t, fmt.Sprintf(msgUnavailableServerShuttingDownFmt, expNextOffset), st.Message())
+
+	for _, detail := range st.Details() {
+		if ei, ok := detail.(*errdetails.ErrorInfo); ok {
+			assert.Equal(t, DrainErrorReason, ei.Reason)
+			assert.Equal(t, fmt.Sprintf("%d", expNextOffset), ei.Metadata[DrainErrorNextByteOffsetKey])
+			return
+		}
+	}
+
+	assert.Fail(t, "no ErrorInfo in the status details")
+}
+
+func TestDrainStreams(t *testing.T) {
+	s := &Server{config: ServerConfig{Runtime: &runtime.Runtime{}, DrainTimeout: time.Millisecond}}
+
+	ctx1, as1, end1, err := s.startStream(context.Background(), runtime.MetadataAllocatedOperationName, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), as1.nextOffset.Load())
+
+	_, _, end2, err := s.startStream(context.Background(), runtime.MetadataDeltaOperationName, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.ActiveStreams())
+
+	end2()
+	assert.Equal(t, 1, s.ActiveStreams())
+
+	as1.sent(nil)
+	assert.Equal(t, int64(100), as1.nextOffset.Load())
+	as1.sent(bmdRange(200, 3))
+	assert.Equal(t, int64(203), as1.nextOffset.Load())
+
+	// errors are not converted unless the stream was drained
+	errOther := errors.New("other")
+	assert.Equal(t, errOther, s.checkServerDraining(ctx1, as1, errOther))
+
+	<-s.drainStreams()
+
+	assert.Error(t, ctx1.Err())
+	assertServerDraining(t, s.checkServerDraining(ctx1, as1, errOther), 203)
+	assert.Nil(t, s.checkServerDraining(ctx1, as1, nil))
+
+	_, _, _, err = s.startStream(context.Background(), runtime.MetadataDeltaOperationName, 0)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, msgUnavailableServerShuttingDown, status.Convert(err).Message())
+
+	end1()
+	assert.Zero(t, s.ActiveStreams())
+}
+
+func TestDrainViaGRPCClient(t *testing.T) {
+	ctx := context.Background()
+	th := newTestHarness().WithMockCSIDriver(t).WithFakeClientAPIs()
+	defer th.TerminateMockCSIDriver()
+
+	grpcServer := th.StartGRPCServer(t, th.Runtime())
+	grpcServer.CSIDriverIsReady()
+	grpcServer.config.DrainTimeout = 10 * time.Millisecond
+
+	client := th.GRPCSnapshotMetadataClient(t)
+
+	th.MockCSISnapshotMetadataServer.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(req *csi.GetMetadataAllocatedRequest, stream csi.SnapshotMetadata_GetMetadataAllocatedServer) error {
+			stream.Send(&csi.GetMetadataAllocatedResponse{
+				BlockMetadataType:   csi.BlockMetadataType_FIXED_LENGTH,
+				VolumeCapacityBytes: 1 << 20,
+				BlockMetadata:       []*csi.BlockMetadata{{ByteOffset: 0, SizeBytes: 1024}},
+			})
+			<-stream.Context().Done() // the driver does not end the stream
+			return stream.Context().Err()
+		})
+
+	stream, err := client.GetMetadataAllocated(ctx, &api.GetMetadataAllocatedRequest{
+		SecurityToken: th.SecurityToken,
+		Namespace:     th.Namespace,
+		SnapshotName:  "snap-1",
+	})
+	assert.NoError(t, err)
+
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, grpcServer.ActiveStreams())
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.Stop()
+		close(stopped)
+	}()
+
+	_, err = stream.Recv()
+	assertServerDraining(t, err, 1024)
+
+	<-stopped
+	assert.Zero(t, grpcServer.ActiveStreams())
+	assert.False(t, grpcServer.IsReady())
+}
@@ -30,6 +30,7 @@ import (
 
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
 func (s *Server) GetMetadataAllocated(req *api.GetMetadataAllocatedRequest, stream api.SnapshotMetadata_GetMetadataAllocatedServer) (err error) {
@@ -39,23 +40,50 @@ func (s *Server) GetMetadataAllocated(req *api.GetMetadataAllocatedRequest, stre
 	ctx, cancelFn := context.WithTimeout(s.getMetadataAllocatedContextWithLogger(req, stream), s.config.MaxStreamDur)
 	defer cancelFn()
 
-	// Record metrics when the operation ends
+	ae := s.newAuditEvent("GetMetadataAllocated", req.GetNamespace(), req.GetSnapshotName(), req.GetStartingOffset(), req.GetMaxResults())
+
+	// Record metrics and audit when the operation ends
 	defer func(startTime time.Time) {
 		opLabel := map[string]string{
 			runtime.LabelTargetSnapshotName: fmt.Sprintf("%s/%s", req.Namespace, req.SnapshotName),
 		}
 		s.config.Runtime.RecordMetricsWithLabels(opLabel, runtime.MetadataAllocatedOperationName, startTime, err)
+		s.emitAuditRecord(ae, err)
 	}(time.Now())
 
+	// Track the stream so that it can be drained when the server shuts down.
+	ctx, as, endStream, err := s.startStream(ctx, runtime.MetadataAllocatedOperationName, req.GetStartingOffset())
+	if err != nil {
+		return err
+	}
+
+	defer endStream()
+
+	stream = trackedAllocatedStream{stream, as}
+
 	if err := s.validateGetMetadataAllocatedRequest(req); err != nil {
 		klog.FromContext(ctx).Error(err, "validation failed")
 		return err
 	}
 
-	if err := s.authenticateAndAuthorize(ctx, req.SecurityToken, req.Namespace); err != nil {
+	if err := s.checkRPCRate(ctx, runtime.MetadataAllocatedOperationName); err != nil {
+		return err
+	}
+
+	userInfo, err := s.authenticateAndAuthorize(ctx, req.SecurityToken, req.Namespace, req.SnapshotName)
+	if err != nil {
 		return err
 	}
 
+	ae.setUser(userInfo)
+
+	releaseStream, err := s.acquireStream(ctx, runtime.MetadataAllocatedOperationName, req.Namespace, userInfo.Username)
+	if err != nil {
+		return err
+	}
+
+	defer releaseStream()
+
 	if err := s.isCSIDriverReady(ctx); err != nil {
 		return err
 	}
@@ -65,16 +93,24 @@ func (s *Server) GetMetadataAllocated(req *api.GetMetadataAllocatedRequest, stre
 		return err
 	}
 
+	// Abort the stream if the connection to the CSI driver is lost.
+	ctx, stopCSIConn := s.withCSIConnection(ctx)
+	defer stopCSIConn()
+
+	ctx, csiSpan := tracing.StartSpan(ctx, "csi.GetMetadataAllocated")
+	defer func() { tracing.EndSpan(csiSpan, err) }()
+
 	// Invoke the CSI Driver's GetMetadataDelta gRPC and stream the response back to client
 	klog.FromContext(ctx).V(HandlerTraceLogLevel).Info("calling CSI driver", "snapshotId", csiReq.SnapshotId)
 	csiStream, err := csi.NewSnapshotMetadataClient(s.csiConnection()).GetMetadataAllocated(ctx, csiReq)
 	if err != nil {
 		klog.FromContext(ctx).Error(err, "csi.GetMetadataAllocated")
-		return err
+		s.config.Runtime.RecordCSIStreamError(runtime.MetadataAllocatedOperationName, status.Code(err))
+		return s.checkServerDraining(ctx, as, s.checkCSIConnectionLost(ctx, err))
 	}
 
-	err = s.streamGetMetadataAllocatedResponse(ctx, stream, csiStream)
-	return err
+	err = s.streamGetMetadataAllocatedResponse(ctx, stream, csiStream, csiReq.MaxResults, s.newResponseValidator(csiReq.StartingOffset, csiReq.MaxResults), ae)
+	return s.checkServerDraining(ctx, as, s.checkCSIConnectionLost(ctx, err))
 }
 
 // getMetadataAllocatedContextWithLogger returns the stream context with an embedded
@@ -126,12 +162,12 @@ func (s *Server) convertToCSIGetMetadataAllocatedRequest(ctx context.Context, re
 	return &csi.GetMetadataAllocatedRequest{
 		SnapshotId:     vsi.SnapshotHandle,
 		StartingOffset: req.StartingOffset,
-		MaxResults:     req.MaxResults,
+		MaxResults:     s.config.Batching.batchSize(req.MaxResults),
 		Secrets:        secretsMap,
 	}, nil
 }
 
-func (s *Server) streamGetMetadataAllocatedResponse(ctx context.Context, clientStream api.SnapshotMetadata_GetMetadataAllocatedServer, csiStream csi.SnapshotMetadata_GetMetadataAllocatedClient) error { //nolint:dupl
+func (s *Server) streamGetMetadataAllocatedResponse(ctx context.Context, clientStream api.SnapshotMetadata_GetMetadataAllocatedServer, csiStream csi.SnapshotMetadata_GetMetadataAllocatedClient, batchSize int32, rv *responseValidator, ae *auditEvent) error { //nolint:dupl
 	var (
 		blockMetadataType   api.BlockMetadataType
 		lastByteOffset      int64
@@ -142,6 +178,29 @@ func (s *Server) streamGetMetadataAllocatedResponse(ctx context.Context, clientS
 		volumeCapacityBytes int64
 	)
 
+	batcher := s.newResponseBatcher(batchSize, func(bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata) error {
+		clientResp := &api.GetMetadataAllocatedResponse{
+			BlockMetadataType:   bmt,
+			VolumeCapacityBytes: volumeCapacityBytes,
+			BlockMetadata:       bmds,
+		}
+
+		if err := clientStream.Send(clientResp); err != nil {
+			logger.WithValues(
+				"blockMetadataType", blockMetadataType.String(),
+				"lastByteOffset", lastByteOffset,
+				"lastSize", lastSize,
+				"responseNum", responseNum,
+				"volumeCapacityBytes", volumeCapacityBytes,
+			).Error(err, msgInternalFailedToSendResponse)
+			return s.statusPassOrWrapError(err, codes.Internal, msgInternalFailedToSendResponseFmt, err)
+		}
+
+		ae.addResponse(bmds)
+
+		return nil
+	})
+
 	for {
 		csiResp, err := csiStream.Recv()
 		if err == io.EOF {
@@ -152,7 +211,7 @@ func (s *Server) streamGetMetadataAllocatedResponse(ctx context.Context, clientS
 				"lastResponseNum", responseNum,
 				"volumeCapacityBytes", volumeCapacityBytes,
 			).Info("stream EOF")
-			return nil
+			return batcher.flush()
 		}
 
 		if err != nil {
@@ -163,6 +222,7 @@ func (s *Server) streamGetMetadataAllocatedResponse(ctx context.Context, clientS
 				"lastResponseNum", responseNum,
 				"volumeCapacityBytes", volumeCapacityBytes,
 			).Error(err, msgInternalFailedCSIDriverResponse)
+			s.config.Runtime.RecordCSIStreamError(runtime.MetadataAllocatedOperationName, status.Code(err))
 			return s.statusPassOrWrapError(err, codes.Internal, msgInternalFailedCSIDriverResponseFmt, err)
 		}
 
@@ -193,15 +253,12 @@ func (s *Server) streamGetMetadataAllocatedResponse(ctx context.Context, clientS
 			).Info("stream response")
 		}
 
-		if err := clientStream.Send(clientResp); err != nil {
-			logger.WithValues(
-				"blockMetadataType", blockMetadataType.String(),
-				"lastByteOffset", lastByteOffset,
-				"lastSize", lastSize,
-				"responseNum", responseNum,
-				"volumeCapacityBytes", volumeCapacityBytes,
-			).Error(err, msgInternalFailedToSendResponse)
-			return s.statusPassOrWrapError(err, codes.Internal, msgInternalFailedToSendResponseFmt, err)
+		if err := s.checkCSIResponse(ctx, rv, runtime.MetadataAllocatedOperationName, responseNum, blockMetadataType, volumeCapacityBytes, clientResp.BlockMetadata); err != nil {
+			return err
+		}
+
+		if err := batcher.add(blockMetadataType, volumeCapacityBytes, clientResp.BlockMetadata); err != nil {
+			return err
 		}
 	}
 }
@@ -27,6 +27,7 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -158,12 +159,12 @@ func TestGetMetadataAllocatedViaGRPCClient(t *testing.T) {
 			snapshotFound := 0
 
 			// Validate that both gauge and controller metrics is recorded
-			assert.GreaterOrEqual(t, 2, len(metrics))
-			assert.Equal(t, *metrics[0].Name, "process_start_time_seconds")
-			assert.Equal(t, *metrics[1].Name, "snapshot_metadata_controller_operations_seconds")
+			assert.NotNil(t, findMetricFamily(metrics, "process_start_time_seconds"))
+			operations := findMetricFamily(metrics, "snapshot_metadata_controller_operations_seconds")
+			assert.NotNil(t, operations)
 
 			// Validate grpc_status_code and target_snapshot name
-			for _, metric := range metrics[1].Metric {
+			for _, metric := range operations.GetMetric() {
 				for _, labels := range metric.Label {
 					expTargetSnapshotName := fmt.Sprintf("%s/%s", tc.req.Namespace, tc.req.SnapshotName)
 					if *labels.Name == "grpc_status_code" && *labels.Value == tc.expStatusCode.String() {
@@ -273,6 +274,7 @@ func TestConvertToCSIGetMetadataAllocatedRequest(t *testing.T) {
 		expectError               bool
 		expStatusCode             codes.Code
 		expStatusMsgPat           string
+		expErrorReason            string
 	}{
 		{
 			// valid case
@@ -345,6 +347,7 @@ func TestConvertToCSIGetMetadataAllocatedRequest(t *testing.T) {
 			expectError:     true,
 			expStatusCode:   codes.Unavailable,
 			expStatusMsgPat: fmt.Sprintf(msgUnavailableVolumeSnapshotNotReadyFmt, "snap-not-ready"),
+			expErrorReason:  api.ErrorReasonSnapshotNotReady,
 		},
 		{
 			// Snapshot with BoundVolumeSnapshotContent nil
@@ -407,6 +410,7 @@ func TestConvertToCSIGetMetadataAllocatedRequest(t *testing.T) {
 			expectError:     true,
 			expStatusCode:   codes.Unavailable,
 			expStatusMsgPat: fmt.Sprintf(msgUnavailableVolumeSnapshotContentNotReadyFmt, th.ContentNameFromSnapshot("snap-with-content-not-ready")),
+			expErrorReason:  api.ErrorReasonSnapshotNotReady,
 		},
 		{
 			// VolumeSnapshotContent associated with snapshot has empty snapshotHandler
@@ -485,6 +489,13 @@ func TestConvertToCSIGetMetadataAllocatedRequest(t *testing.T) {
 				assert.True(t, ok)
 				assert.Equal(t, tc.expStatusCode, st.Code())
 				assert.Regexp(t, tc.expStatusMsgPat, st.Message())
+				if tc.expErrorReason != "" {
+					assert.Len(t, st.Details(), 1)
+					info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+					assert.True(t, ok)
+					assert.Equal(t, api.ErrorDomain, info.Domain)
+					assert.Equal(t, tc.expErrorReason, info.Reason)
+				}
 				return
 			}
 			assert.NoError(t, err)
@@ -735,7 +746,7 @@ func TestStreamGetMetadataAllocatedResponse(t *testing.T) {
 			csiStream, err := csiClient.GetMetadataAllocated(ctx, csiReq)
 			assert.NoError(t, err)
 
-			errStream := grpcServer.streamGetMetadataAllocatedResponse(ctx, sms, csiStream)
+			errStream := grpcServer.streamGetMetadataAllocatedResponse(ctx, sms, csiStream, 0, nil, nil)
 			if tc.expectStreamError {
 				assert.NoError(t, err)
 				st, ok := status.FromError(errStream)
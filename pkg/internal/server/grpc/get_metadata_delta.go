@@ -26,10 +26,12 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	authv1 "k8s.io/api/authentication/v1"
 	"k8s.io/klog/v2"
 
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
 func (s *Server) GetMetadataDelta(req *api.GetMetadataDeltaRequest, stream api.SnapshotMetadata_GetMetadataDeltaServer) (err error) {
@@ -39,43 +41,79 @@ func (s *Server) GetMetadataDelta(req *api.GetMetadataDeltaRequest, stream api.S
 	ctx, cancelFn := context.WithTimeout(s.getMetadataDeltaContextWithLogger(req, stream), s.config.MaxStreamDur)
 	defer cancelFn()
 
-	// Record metrics when the operation ends
+	ae := s.newAuditEvent("GetMetadataDelta", req.GetNamespace(), req.GetTargetSnapshotName(), req.GetStartingOffset(), req.GetMaxResults())
+	ae.setBaseSnapshot(req.GetBaseSnapshotId(), req.GetBaseSnapshotName())
+
+	// Record metrics and audit when the operation ends
 	defer func(startTime time.Time) {
 		opLabel := map[string]string{
 			runtime.LabelTargetSnapshotName: fmt.Sprintf("%s/%s", req.Namespace, req.TargetSnapshotName),
 			runtime.LabelBaseSnapshotID:     req.BaseSnapshotId,
 		}
-		s.config.Runtime.RecordMetricsWithLabels(opLabel, runtime.MetadataAllocatedOperationName, startTime, err)
+		s.config.Runtime.RecordMetricsWithLabels(opLabel, runtime.MetadataDeltaOperationName, startTime, err)
+		s.emitAuditRecord(ae, err)
 	}(time.Now())
 
+	// Track the stream so that it can be drained when the server shuts down.
+	ctx, as, endStream, err := s.startStream(ctx, runtime.MetadataDeltaOperationName, req.GetStartingOffset())
+	if err != nil {
+		return err
+	}
+
+	defer endStream()
+
+	stream = trackedDeltaStream{stream, as}
+
 	if err := s.validateGetMetadataDeltaRequest(req); err != nil {
 		klog.FromContext(ctx).Error(err, "validation failed")
 		return err
 	}
 
-	if err := s.authenticateAndAuthorize(ctx, req.SecurityToken, req.Namespace); err != nil {
+	if err := s.checkRPCRate(ctx, runtime.MetadataDeltaOperationName); err != nil {
+		return err
+	}
+
+	userInfo, err := s.authenticateAndAuthorize(ctx, req.SecurityToken, req.Namespace, req.TargetSnapshotName)
+	if err != nil {
+		return err
+	}
+
+	ae.setUser(userInfo)
+
+	releaseStream, err := s.acquireStream(ctx, runtime.MetadataDeltaOperationName, req.Namespace, userInfo.Username)
+	if err != nil {
 		return err
 	}
 
+	defer releaseStream()
+
 	if err := s.isCSIDriverReady(ctx); err != nil {
 		return err
 	}
 
-	csiReq, err := s.convertToCSIGetMetadataDeltaRequest(ctx, req)
+	csiReq, err := s.convertToCSIGetMetadataDeltaRequest(ctx, req, userInfo)
 	if err != nil {
 		return err
 	}
 
+	// Abort the stream if the connection to the CSI driver is lost.
+	ctx, stopCSIConn := s.withCSIConnection(ctx)
+	defer stopCSIConn()
+
+	ctx, csiSpan := tracing.StartSpan(ctx, "csi.GetMetadataDelta")
+	defer func() { tracing.EndSpan(csiSpan, err) }()
+
 	// Invoke the CSI Driver's GetMetadataDelta gRPC and stream the response back to client
 	klog.FromContext(ctx).V(HandlerTraceLogLevel).Info("calling CSI driver", "baseSnapshotId", csiReq.BaseSnapshotId, "targetSnapshotId", csiReq.TargetSnapshotId)
 	csiStream, err := csi.NewSnapshotMetadataClient(s.csiConnection()).GetMetadataDelta(ctx, csiReq)
 	if err != nil {
 		klog.FromContext(ctx).Error(err, "csi.GetMetadataDelta")
-		return err
+		s.config.Runtime.RecordCSIStreamError(runtime.MetadataDeltaOperationName, status.Code(err))
+		return s.checkServerDraining(ctx, as, s.checkCSIConnectionLost(ctx, err))
 	}
 
-	err = s.streamGetMetadataDeltaResponse(ctx, stream, csiStream)
-	return err
+	err = s.streamGetMetadataDeltaResponse(ctx, stream, csiStream, csiReq.MaxResults, s.newResponseValidator(csiReq.StartingOffset, csiReq.MaxResults), ae)
+	return s.checkServerDraining(ctx, as, s.checkCSIConnectionLost(ctx, err))
 }
 
 func (s *Server) getMetadataDeltaContextWithLogger(req *api.GetMetadataDeltaRequest, stream api.SnapshotMetadata_GetMetadataDeltaServer) context.Context {
@@ -84,6 +122,7 @@ func (s *Server) getMetadataDeltaContextWithLogger(req *api.GetMetadataDeltaRequ
 			"op", s.OperationID("GetMetadataDelta"),
 			"namespace", req.Namespace,
 			"baseSnapshotId", req.BaseSnapshotId,
+			"baseSnapshotName", req.BaseSnapshotName,
 			"targetSnapshotName", req.TargetSnapshotName,
 			"startingOffset", req.StartingOffset,
 			"maxResults", req.MaxResults,
@@ -99,10 +138,14 @@ func (s *Server) validateGetMetadataDeltaRequest(req *api.GetMetadataDeltaReques
 		return status.Errorf(codes.InvalidArgument, msgInvalidArgumentNamespaceMissing)
 	}
 
-	if len(req.GetBaseSnapshotId()) == 0 {
+	if len(req.GetBaseSnapshotId()) == 0 && len(req.GetBaseSnapshotName()) == 0 {
 		return status.Errorf(codes.InvalidArgument, msgInvalidArgumentBaseSnapshotIdMissing)
 	}
 
+	if len(req.GetBaseSnapshotId()) != 0 && len(req.GetBaseSnapshotName()) != 0 {
+		return status.Errorf(codes.InvalidArgument, msgInvalidArgumentBaseSnapshotIdAndName)
+	}
+
 	if len(req.GetTargetSnapshotName()) == 0 {
 		return status.Errorf(codes.InvalidArgument, msgInvalidArgumentTargetSnapshotNameMissing)
 	}
@@ -110,7 +153,7 @@ func (s *Server) validateGetMetadataDeltaRequest(req *api.GetMetadataDeltaReques
 	return nil
 }
 
-func (s *Server) convertToCSIGetMetadataDeltaRequest(ctx context.Context, req *api.GetMetadataDeltaRequest) (*csi.GetMetadataDeltaRequest, error) {
+func (s *Server) convertToCSIGetMetadataDeltaRequest(ctx context.Context, req *api.GetMetadataDeltaRequest, userInfo *authv1.UserInfo) (*csi.GetMetadataDeltaRequest, error) {
 	vsiTarget, err := s.getVolSnapshotInfo(ctx, req.Namespace, req.TargetSnapshotName)
 	if err != nil {
 		return nil, err
@@ -122,21 +165,26 @@ func (s *Server) convertToCSIGetMetadataDeltaRequest(ctx context.Context, req *a
 		return nil, err
 	}
 
+	baseSnapshotID, err := s.getBaseSnapshotID(ctx, req, userInfo, vsiTarget)
+	if err != nil {
+		return nil, err
+	}
+
 	secretsMap, err := s.getSnapshotterCredentials(ctx, vsiTarget)
 	if err != nil {
 		return nil, err
 	}
 
 	return &csi.GetMetadataDeltaRequest{
-		BaseSnapshotId:   req.BaseSnapshotId,
+		BaseSnapshotId:   baseSnapshotID,
 		TargetSnapshotId: vsiTarget.SnapshotHandle,
 		StartingOffset:   req.StartingOffset,
-		MaxResults:       req.MaxResults,
+		MaxResults:       s.config.Batching.batchSize(req.MaxResults),
 		Secrets:          secretsMap,
 	}, nil
 }
 
-func (s *Server) streamGetMetadataDeltaResponse(ctx context.Context, clientStream api.SnapshotMetadata_GetMetadataDeltaServer, csiStream csi.SnapshotMetadata_GetMetadataDeltaClient) error { //nolint:dupl
+func (s *Server) streamGetMetadataDeltaResponse(ctx context.Context, clientStream api.SnapshotMetadata_GetMetadataDeltaServer, csiStream csi.SnapshotMetadata_GetMetadataDeltaClient, batchSize int32, rv *responseValidator, ae *auditEvent) error { //nolint:dupl
 	var (
 		blockMetadataType   api.BlockMetadataType
 		lastByteOffset      int64
@@ -147,6 +195,29 @@ func (s *Server) streamGetMetadataDeltaResponse(ctx context.Context, clientStrea
 		volumeCapacityBytes int64
 	)
 
+	batcher := s.newResponseBatcher(batchSize, func(bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata) error {
+		clientResp := &api.GetMetadataDeltaResponse{
+			BlockMetadataType:   bmt,
+			VolumeCapacityBytes: volumeCapacityBytes,
+			BlockMetadata:       bmds,
+		}
+
+		if err := clientStream.Send(clientResp); err != nil {
+			logger.WithValues(
+				"blockMetadataType", blockMetadataType.String(),
+				"lastByteOffset", lastByteOffset,
+				"lastSize", lastSize,
+				"responseNum", responseNum,
+				"volumeCapacityBytes", volumeCapacityBytes,
+			).Error(err, msgInternalFailedToSendResponse)
+			return s.statusPassOrWrapError(err, codes.Internal, msgInternalFailedToSendResponseFmt, err)
+		}
+
+		ae.addResponse(bmds)
+
+		return nil
+	})
+
 	for {
 		csiResp, err := csiStream.Recv()
 		if err == io.EOF {
@@ -157,7 +228,7 @@ func (s *Server) streamGetMetadataDeltaResponse(ctx context.Context, clientStrea
 				"lastResponseNum", responseNum,
 				"volumeCapacityBytes", volumeCapacityBytes,
 			).Info("stream EOF")
-			return nil
+			return batcher.flush()
 		}
 
 		if err != nil {
@@ -168,6 +239,7 @@ func (s *Server) streamGetMetadataDeltaResponse(ctx context.Context, clientStrea
 				"lastResponseNum", responseNum,
 				"volumeCapacityBytes", volumeCapacityBytes,
 			).Error(err, msgInternalFailedCSIDriverResponse)
+			s.config.Runtime.RecordCSIStreamError(runtime.MetadataDeltaOperationName, status.Code(err))
 			return s.statusPassOrWrapError(err, codes.Internal, msgInternalFailedCSIDriverResponseFmt, err)
 		}
 
@@ -198,15 +270,12 @@ func (s *Server) streamGetMetadataDeltaResponse(ctx context.Context, clientStrea
 			).Info("stream response")
 		}
 
-		if err := clientStream.Send(clientResp); err != nil {
-			logger.WithValues(
-				"blockMetadataType", blockMetadataType.String(),
-				"lastByteOffset", lastByteOffset,
-				"lastSize", lastSize,
-				"responseNum", responseNum,
-				"volumeCapacityBytes", volumeCapacityBytes,
-			).Error(err, msgInternalFailedToSendResponse)
-			return s.statusPassOrWrapError(err, codes.Internal, msgInternalFailedToSendResponseFmt, err)
+		if err := s.checkCSIResponse(ctx, rv, runtime.MetadataDeltaOperationName, responseNum, blockMetadataType, volumeCapacityBytes, clientResp.BlockMetadata); err != nil {
+			return err
+		}
+
+		if err := batcher.add(blockMetadataType, volumeCapacityBytes, clientResp.BlockMetadata); err != nil {
+			return err
 		}
 	}
 }
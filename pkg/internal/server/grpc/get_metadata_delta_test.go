@@ -35,6 +35,7 @@ import (
 
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/csiclientmocks"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
 )
 
 func TestGetMetadataDeltaViaGRPCClient(t *testing.T) {
@@ -162,14 +163,15 @@ func TestGetMetadataDeltaViaGRPCClient(t *testing.T) {
 			statusFound := 0
 			targetSnapshotFound := 0
 			baseSnapshotFound := 0
+			methodFound := 0
 
 			// Validate that both gauge and controller metrics is recorded
-			assert.GreaterOrEqual(t, 2, len(metrics))
-			assert.Equal(t, *metrics[0].Name, "process_start_time_seconds")
-			assert.Equal(t, *metrics[1].Name, "snapshot_metadata_controller_operations_seconds")
+			assert.NotNil(t, findMetricFamily(metrics, "process_start_time_seconds"))
+			operations := findMetricFamily(metrics, "snapshot_metadata_controller_operations_seconds")
+			assert.NotNil(t, operations)
 
 			// Validate grpc_status_code and target_snapshot name
-			for _, metric := range metrics[1].Metric {
+			for _, metric := range operations.GetMetric() {
 				for _, labels := range metric.Label {
 					expTargetSnapshotName := fmt.Sprintf("%s/%s", tc.req.Namespace, tc.req.TargetSnapshotName)
 					expBaseSnapshotId := tc.req.BaseSnapshotId
@@ -182,11 +184,15 @@ func TestGetMetadataDeltaViaGRPCClient(t *testing.T) {
 					if *labels.Name == "base_snapshot" && *labels.Value == expBaseSnapshotId {
 						baseSnapshotFound = 1
 					}
+					if *labels.Name == "method_name" && *labels.Value == runtime.MetadataDeltaOperationName {
+						methodFound = 1
+					}
 				}
 			}
 			assert.Equal(t, 1, statusFound)
 			assert.Equal(t, 1, targetSnapshotFound)
 			assert.Equal(t, 1, baseSnapshotFound)
+			assert.Equal(t, 1, methodFound)
 		})
 	}
 }
@@ -245,6 +251,18 @@ func TestValidateGetMetadataDeltaRequest(t *testing.T) {
 			expStatusCode: codes.InvalidArgument,
 			expStatusMsg:  msgInvalidArgumentBaseSnapshotIdMissing,
 		},
+		{
+			name: "base SnapshotId and SnapshotName",
+			req: &api.GetMetadataDeltaRequest{
+				SecurityToken:      "token",
+				Namespace:          "test-ns",
+				BaseSnapshotId:     "snap-1",
+				BaseSnapshotName:   "snap-1",
+				TargetSnapshotName: "snap-2",
+			},
+			expStatusCode: codes.InvalidArgument,
+			expStatusMsg:  msgInvalidArgumentBaseSnapshotIdAndName,
+		},
 		{
 			name: "target SnapshotName missing",
 			req: &api.GetMetadataDeltaRequest{
@@ -265,6 +283,16 @@ func TestValidateGetMetadataDeltaRequest(t *testing.T) {
 			},
 			isValid: true,
 		},
+		{
+			name: "valid with base SnapshotName",
+			req: &api.GetMetadataDeltaRequest{
+				SecurityToken:      "token",
+				Namespace:          "test-ns",
+				BaseSnapshotName:   "snap-1",
+				TargetSnapshotName: "snap-2",
+			},
+			isValid: true,
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			err := grpcServer.validateGetMetadataDeltaRequest(tc.req)
@@ -338,6 +366,71 @@ func TestConvertToCSIGetMetadataDeltaRequest(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "success-base-snapshot-name",
+			apiRequest: &api.GetMetadataDeltaRequest{
+				BaseSnapshotName:   "snap-1",
+				TargetSnapshotName: "snap-2",
+				Namespace:          "test-ns",
+				SecurityToken:      "token",
+				StartingOffset:     0,
+				MaxResults:         256,
+			},
+			expectedCSIRequest: &csi.GetMetadataDeltaRequest{
+				BaseSnapshotId:   th.HandleFromSnapshot("snap-1"),
+				TargetSnapshotId: th.HandleFromSnapshot("snap-2"),
+				StartingOffset:   0,
+				MaxResults:       256,
+				Secrets:          expSecrets,
+			},
+			expectError: false,
+		},
+		{
+			// The base VolumeSnapshot named in the request is not ready
+			name: "base-snapshot-name-not-ready-error",
+			apiRequest: &api.GetMetadataDeltaRequest{
+				BaseSnapshotName:   "snap-not-ready",
+				TargetSnapshotName: "snap-2",
+				Namespace:          "test-ns",
+				SecurityToken:      "token",
+				StartingOffset:     0,
+				MaxResults:         256,
+			},
+			fakeVolumeSnapshot: func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+				ga := action.(clientgotesting.GetAction)
+				vs := th.VolumeSnapshot(ga.GetName(), ga.GetNamespace())
+				if ga.GetName() == "snap-not-ready" {
+					vs.Status.ReadyToUse = boolPtr(false)
+				}
+				return true, vs, nil
+			},
+			expectError:     true,
+			expStatusCode:   codes.Unavailable,
+			expStatusMsgPat: fmt.Sprintf(msgUnavailableVolumeSnapshotNotReadyFmt, "snap-not-ready"),
+		},
+		{
+			// The base VolumeSnapshot named in the request has an unexpected driver
+			name: "base-snapshot-name-invalid-driver-error",
+			apiRequest: &api.GetMetadataDeltaRequest{
+				BaseSnapshotName:   "snap-with-invalid-driver",
+				TargetSnapshotName: "snap-2",
+				Namespace:          "test-ns",
+				SecurityToken:      "token",
+				StartingOffset:     0,
+				MaxResults:         256,
+			},
+			fakeVolumeSnapshotContent: func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+				ga := action.(clientgotesting.GetAction)
+				vsc := th.VolumeSnapshotContent(ga.GetName(), th.DriverName)
+				if ga.GetName() == th.ContentNameFromSnapshot("snap-with-invalid-driver") {
+					vsc.Spec.Driver = "driver-unexpected"
+				}
+				return true, vsc, nil
+			},
+			expectError:     true,
+			expStatusCode:   codes.InvalidArgument,
+			expStatusMsgPat: fmt.Sprintf(msgInvalidArgumentSnaphotDriverInvalidFmt, "snap-with-invalid-driver", th.DriverName),
+		},
 		{
 			// VolumeSnapshot resource with TargetSnapshotName doesn't exist
 			name: "target-snapshot-get-error",
@@ -531,7 +624,7 @@ func TestConvertToCSIGetMetadataDeltaRequest(t *testing.T) {
 			if tc.fakeVolumeSnapshotContent != nil {
 				th.FakeSnapshotClient.PrependReactor("get", "volumesnapshotcontents", tc.fakeVolumeSnapshotContent)
 			}
-			csiReq, err := grpcServer.convertToCSIGetMetadataDeltaRequest(context.TODO(), tc.apiRequest)
+			csiReq, err := grpcServer.convertToCSIGetMetadataDeltaRequest(context.TODO(), tc.apiRequest, nil)
 			if tc.expectError {
 				assert.Error(t, err)
 				st, ok := status.FromError(err)
@@ -787,13 +880,13 @@ func TestStreamGetMetadataDeltaResponse(t *testing.T) {
 			sms := &fakeStreamServerSnapshotDelta{err: tc.mockK8sStreamError}
 			ctx := grpcServer.getMetadataDeltaContextWithLogger(tc.req, sms)
 
-			csiReq, err := grpcServer.convertToCSIGetMetadataDeltaRequest(ctx, tc.req)
+			csiReq, err := grpcServer.convertToCSIGetMetadataDeltaRequest(ctx, tc.req, nil)
 			assert.NoError(t, err)
 
 			csiStream, err := csiClient.GetMetadataDelta(ctx, csiReq)
 			assert.NoError(t, err)
 
-			errStream := grpcServer.streamGetMetadataDeltaResponse(ctx, sms, csiStream)
+			errStream := grpcServer.streamGetMetadataDeltaResponse(ctx, sms, csiStream, 0, nil, nil)
 			if tc.expectStreamError {
 				assert.NoError(t, err)
 				st, ok := status.FromError(errStream)
@@ -18,6 +18,7 @@ package grpc
 
 import (
 	"context"
+	"errors"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
@@ -26,6 +27,8 @@ import (
 	"k8s.io/klog/v2"
 )
 
+var errCSIConnectionLost = errors.New(msgUnavailableCSIConnectionLost)
+
 func newHealthServer() *health.Server {
 	healthServer := health.NewServer()
 	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
@@ -60,6 +63,44 @@ func (s *Server) shuttingDown() {
 	s.healthServer.Shutdown()
 }
 
+// csiConnectionContext returns a context that is canceled with errCSIConnectionLost
+// when the connection to the CSI driver is lost.
+func (s *Server) csiConnectionContext() context.Context {
+	s.csiMux.Lock()
+	defer s.csiMux.Unlock()
+
+	if s.csiCtx == nil {
+		s.csiCtx, s.csiCancel = context.WithCancelCause(context.Background())
+	}
+
+	return s.csiCtx
+}
+
+// withCSIConnection returns a context derived from ctx that is also canceled
+// when the connection to the CSI driver is lost. The returned function must
+// be called to release the resources of the context.
+func (s *Server) withCSIConnection(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(s.csiConnectionContext(), func() {
+		cancel(errCSIConnectionLost)
+	})
+
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+// checkCSIConnectionLost returns an Unavailable error if the context was
+// canceled by the loss of the connection to the CSI driver, or else the error.
+func (s *Server) checkCSIConnectionLost(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), errCSIConnectionLost) {
+		return status.Error(codes.Unavailable, msgUnavailableCSIConnectionLost)
+	}
+
+	return err
+}
+
 // isCSIDriverReady is a helper for the handlers that returns the appropriate error if the
 // CSI driver is not ready.
 func (s *Server) isCSIDriverReady(ctx context.Context) error {
@@ -20,8 +20,14 @@ import (
 	"context"
 	"testing"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
 )
 
 func TestHealthService(t *testing.T) {
@@ -89,3 +95,68 @@ func TestHealthService(t *testing.T) {
 		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
 	})
 }
+
+func TestCSIDriverConnectionLost(t *testing.T) {
+	ctx := context.Background()
+	th := newTestHarness().WithMockCSIDriver(t).WithFakeClientAPIs()
+	defer th.TerminateMockCSIDriver()
+
+	grpcServer := th.StartGRPCServer(t, th.Runtime())
+	defer th.StopGRPCServer(t)
+	grpcServer.CSIDriverIsReady()
+
+	client := th.GRPCSnapshotMetadataClient(t)
+	req := &api.GetMetadataAllocatedRequest{
+		SecurityToken: th.SecurityToken,
+		Namespace:     th.Namespace,
+		SnapshotName:  "snap-1",
+	}
+
+	// the CSI driver stream hangs after the first response
+	th.MockCSISnapshotMetadataServer.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(req *csi.GetMetadataAllocatedRequest, stream csi.SnapshotMetadata_GetMetadataAllocatedServer) error {
+			stream.Send(&csi.GetMetadataAllocatedResponse{
+				BlockMetadataType:   csi.BlockMetadataType_FIXED_LENGTH,
+				VolumeCapacityBytes: 1 << 20,
+				BlockMetadata:       []*csi.BlockMetadata{{ByteOffset: 0, SizeBytes: 1024}},
+			})
+			<-stream.Context().Done()
+			return stream.Context().Err()
+		}).Times(2)
+
+	stream, err := client.GetMetadataAllocated(ctx, req)
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	// the stream in progress fails
+	grpcServer.CSIDriverConnectionLost()
+	assert.False(t, grpcServer.IsReady())
+
+	_, err = stream.Recv()
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.Equal(t, msgUnavailableCSIConnectionLost, st.Message())
+
+	// new streams fail until the CSI driver is ready
+	stream, err = client.GetMetadataAllocated(ctx, req)
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.Equal(t, msgUnavailableCSIDriverNotReady, st.Message())
+
+	grpcServer.CSIDriverIsReady()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err = client.GetMetadataAllocated(streamCtx, req)
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	// the stream is not failed by the earlier loss
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
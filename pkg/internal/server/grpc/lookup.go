@@ -0,0 +1,141 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	smsCRv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+)
+
+// cacheSyncPollInterval is the interval at which a lookup that requires the
+// informer caches checks whether they have synced.
+const cacheSyncPollInterval = 100 * time.Millisecond
+
+var errNoVolumeSnapshotContentCache = errors.New("the VolumeSnapshotContent cache is not available")
+
+// The lookup methods fetch resources from the informer caches of the runtime
+// if available, or else from the API server. Objects returned from the caches
+// must be treated as read-only.
+
+// liveLookupAfter returns true if a resource not found in an informer cache
+// should be fetched from the API server.
+func (s *Server) liveLookupAfter(err error) bool {
+	return s.config.LiveLookupOnCacheMiss && apierrors.IsNotFound(err)
+}
+
+func (s *Server) lookupVolumeSnapshot(ctx context.Context, namespace, vsName string) (*snapshotv1.VolumeSnapshot, error) {
+	if l := s.listers(); l != nil {
+		vs, err := l.VolumeSnapshots.VolumeSnapshots(namespace).Get(vsName)
+		if !s.liveLookupAfter(err) {
+			return vs, err
+		}
+	}
+
+	return s.snapshotClient().SnapshotV1().VolumeSnapshots(namespace).Get(ctx, vsName, apimetav1.GetOptions{})
+}
+
+func (s *Server) lookupVolumeSnapshotContent(ctx context.Context, vscName string) (*snapshotv1.VolumeSnapshotContent, error) {
+	if l := s.listers(); l != nil {
+		vsc, err := l.VolumeSnapshotContents.Get(vscName)
+		if !s.liveLookupAfter(err) {
+			return vsc, err
+		}
+	}
+
+	return s.snapshotClient().SnapshotV1().VolumeSnapshotContents().Get(ctx, vscName, apimetav1.GetOptions{})
+}
+
+func (s *Server) lookupVolumeSnapshotClass(ctx context.Context, vsClassName string) (*snapshotv1.VolumeSnapshotClass, error) {
+	if l := s.listers(); l != nil {
+		vsClass, err := l.VolumeSnapshotClasses.Get(vsClassName)
+		if !s.liveLookupAfter(err) {
+			return vsClass, err
+		}
+	}
+
+	return s.snapshotClient().SnapshotV1().VolumeSnapshotClasses().Get(ctx, vsClassName, apimetav1.GetOptions{})
+}
+
+// listVolumeSnapshotClasses returns the VolumeSnapshotClasses from the informer
+// cache if available, or else from the API server. The fromCache return value
+// indicates where the list was obtained.
+func (s *Server) listVolumeSnapshotClasses(ctx context.Context) (vsClasses []*snapshotv1.VolumeSnapshotClass, fromCache bool, err error) {
+	if l := s.listers(); l != nil {
+		vsClasses, err = l.VolumeSnapshotClasses.List(labels.Everything())
+		return vsClasses, true, err
+	}
+
+	vsClasses, err = s.listVolumeSnapshotClassesLive(ctx)
+
+	return vsClasses, false, err
+}
+
+func (s *Server) listVolumeSnapshotClassesLive(ctx context.Context) ([]*snapshotv1.VolumeSnapshotClass, error) {
+	vscList, err := s.snapshotClient().SnapshotV1().VolumeSnapshotClasses().List(ctx, apimetav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	vsClasses := make([]*snapshotv1.VolumeSnapshotClass, 0, len(vscList.Items))
+	for i := range vscList.Items {
+		vsClasses = append(vsClasses, &vscList.Items[i])
+	}
+
+	return vsClasses, nil
+}
+
+// lookupVolumeSnapshotContentsForHandle returns the VolumeSnapshotContents with the
+// specified snapshot handle from the snapshotHandle index of the informer cache,
+// waiting for the cache to sync. The API server is never used, as the snapshot
+// handle cannot be used in a field selector and a handle that is not cached would
+// otherwise cause all the VolumeSnapshotContents to be listed.
+func (s *Server) lookupVolumeSnapshotContentsForHandle(ctx context.Context, snapshotHandle string) ([]*snapshotv1.VolumeSnapshotContent, error) {
+	l := s.config.Runtime.Listers
+	if l == nil {
+		return nil, errNoVolumeSnapshotContentCache
+	}
+
+	err := wait.PollUntilContextCancel(ctx, cacheSyncPollInterval, true, func(context.Context) (bool, error) {
+		return l.HasSynced(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("the VolumeSnapshotContent cache has not synced: %w", err)
+	}
+
+	return l.VolumeSnapshotContentsForHandle(snapshotHandle)
+}
+
+func (s *Server) lookupSnapshotMetadataService(ctx context.Context, name string) (*smsCRv1alpha1.SnapshotMetadataService, error) {
+	if l := s.listers(); l != nil {
+		sms, err := l.SnapshotMetadataServices.Get(name)
+		if !s.liveLookupAfter(err) {
+			return sms, err
+		}
+	}
+
+	return s.cbtClient().CbtV1alpha1().SnapshotMetadataServices().Get(ctx, name, apimetav1.GetOptions{})
+}
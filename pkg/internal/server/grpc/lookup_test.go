@@ -0,0 +1,143 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"testing"
+
+	fakesnapshot "github.com/kubernetes-csi/external-snapshotter/client/v8/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientfeatures "k8s.io/client-go/features"
+	clientfeaturestesting "k8s.io/client-go/features/testing"
+	"k8s.io/client-go/tools/cache"
+
+	smsv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	fakecbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned/fake"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+func TestLookupWithListers(t *testing.T) {
+	// The generated fake clientsets do not support watch-list semantics.
+	clientfeaturestesting.SetFeatureDuringTest(t, clientfeatures.WatchListClient, false)
+
+	th := newTestHarness()
+
+	vs := th.VolumeSnapshot("vs-1", th.Namespace)
+	vsc := th.VolumeSnapshotContent(th.ContentNameFromSnapshot("vs-1"), th.DriverName)
+	vsClass := th.VSCIsDefaultTrue()
+	sms := &smsv1alpha1.SnapshotMetadataService{
+		ObjectMeta: apimetav1.ObjectMeta{Name: th.DriverName},
+		Spec:       smsv1alpha1.SnapshotMetadataServiceSpec{Audience: th.Audience},
+	}
+
+	newServer := func(t *testing.T, liveLookupOnCacheMiss bool) (*Server, *fakesnapshot.Clientset) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		fakeSnapshotClient := fakesnapshot.NewSimpleClientset(vs, vsc, vsClass)
+		rt := &runtime.Runtime{
+			SnapshotClient: fakeSnapshotClient,
+			CBTClient:      fakecbt.NewSimpleClientset(sms),
+			DriverName:     th.DriverName,
+		}
+
+		assert.NoError(t, rt.StartInformers(ctx))
+		assert.True(t, cache.WaitForCacheSync(ctx.Done(), rt.Listers.HasSynced))
+		fakeSnapshotClient.ClearActions()
+
+		s := th.ServerWithRuntime(t, rt)
+		s.config.LiveLookupOnCacheMiss = liveLookupOnCacheMiss
+
+		return s, fakeSnapshotClient
+	}
+
+	liveActions := func(c *fakesnapshot.Clientset, verb string) int {
+		n := 0
+		for _, a := range c.Actions() {
+			if a.GetVerb() == verb {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("cache-hit", func(t *testing.T) {
+		s, c := newServer(t, true)
+		ctx := context.Background()
+
+		retVS, err := s.lookupVolumeSnapshot(ctx, th.Namespace, vs.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, vs, retVS)
+
+		retVSC, err := s.lookupVolumeSnapshotContent(ctx, vsc.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, vsc, retVSC)
+
+		retVSClass, err := s.lookupVolumeSnapshotClass(ctx, vsClass.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, vsClass, retVSClass)
+
+		retVSClass, err = s.getDefaultVolumeSnapshotClassForDriver(ctx, th.DriverName)
+		assert.NoError(t, err)
+		assert.Equal(t, vsClass, retVSClass)
+
+		retSMS, err := s.lookupSnapshotMetadataService(ctx, th.DriverName)
+		assert.NoError(t, err)
+		assert.Equal(t, sms.Spec, retSMS.Spec)
+
+		assert.Empty(t, c.Actions())
+	})
+
+	t.Run("cache-miss-live-lookup", func(t *testing.T) {
+		s, c := newServer(t, true)
+		ctx := context.Background()
+
+		_, err := s.lookupVolumeSnapshot(ctx, th.Namespace, "vs-2")
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.Equal(t, 1, liveActions(c, "get"))
+
+		_, err = s.getDefaultVolumeSnapshotClassForDriver(ctx, "other-driver")
+		assert.ErrorContains(t, err, msgUnavailableNoDefaultVolumeSnapshotClassForDriver)
+		assert.Equal(t, 1, liveActions(c, "list"))
+	})
+
+	t.Run("cache-miss-no-live-lookup", func(t *testing.T) {
+		s, c := newServer(t, false)
+		ctx := context.Background()
+
+		_, err := s.lookupVolumeSnapshot(ctx, th.Namespace, "vs-2")
+		assert.True(t, apierrors.IsNotFound(err))
+
+		_, err = s.getDefaultVolumeSnapshotClassForDriver(ctx, "other-driver")
+		assert.ErrorContains(t, err, msgUnavailableNoDefaultVolumeSnapshotClassForDriver)
+
+		assert.Empty(t, c.Actions())
+	})
+
+	t.Run("no-listers", func(t *testing.T) {
+		fakeSnapshotClient := fakesnapshot.NewSimpleClientset(vs)
+		s := th.ServerWithRuntime(t, &runtime.Runtime{SnapshotClient: fakeSnapshotClient})
+
+		retVS, err := s.lookupVolumeSnapshot(context.Background(), th.Namespace, vs.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, vs, retVS)
+		assert.Equal(t, 1, liveActions(fakeSnapshotClient, "get"))
+	})
+}
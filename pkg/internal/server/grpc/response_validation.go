@@ -0,0 +1,177 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+// ResponseValidationMode controls how the server reacts to a CSI driver
+// response that violates the CSI specification.
+type ResponseValidationMode string
+
+const (
+	// ResponseValidationOff passes the responses to the client unchecked.
+	ResponseValidationOff ResponseValidationMode = "off"
+
+	// ResponseValidationLog logs and counts invalid responses, and passes them to the client.
+	ResponseValidationLog ResponseValidationMode = "log"
+
+	// ResponseValidationMetric counts invalid responses, and passes them to the client.
+	ResponseValidationMetric ResponseValidationMode = "metric"
+
+	// ResponseValidationStrict logs and counts an invalid response, and aborts
+	// the stream with an Internal error.
+	ResponseValidationStrict ResponseValidationMode = "strict"
+)
+
+// Validate returns an error if the mode is not recognized.
+func (m ResponseValidationMode) Validate() error {
+	switch m {
+	case ResponseValidationOff, ResponseValidationLog, ResponseValidationMetric, ResponseValidationStrict:
+		return nil
+	}
+
+	return fmt.Errorf("invalid response validation mode %q", m)
+}
+
+// responseValidator checks that the responses of a CSI driver stream
+// satisfy the CSI specification:
+//   - the BlockMetadataType is known and is the same in all responses,
+//   - the VolumeCapacityBytes is positive and is the same in all responses,
+//   - the number of tuples in a response does not exceed max_results,
+//   - the tuples have a positive size, are in ascending byte offset order and
+//     do not overlap, both within and across responses,
+//   - the first tuple ends after starting_offset.
+type responseValidator struct {
+	startingOffset      int64
+	maxResults          int32
+	numResponses        int
+	blockMetadataType   api.BlockMetadataType
+	volumeCapacityBytes int64
+	numTuples           int
+	nextOffset          int64
+}
+
+func newResponseValidator(startingOffset int64, maxResults int32) *responseValidator {
+	return &responseValidator{
+		startingOffset: startingOffset,
+		maxResults:     maxResults,
+	}
+}
+
+// validate returns the violations found in a response.
+// The validator state is updated even if the response is invalid, so that
+// subsequent responses are checked against it.
+func (v *responseValidator) validate(bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata) error {
+	var violations []string
+
+	v.numResponses++
+
+	if v.numResponses == 1 {
+		if bmt != api.BlockMetadataType_FIXED_LENGTH && bmt != api.BlockMetadataType_VARIABLE_LENGTH {
+			violations = append(violations, fmt.Sprintf("unsupported block_metadata_type %s", bmt))
+		}
+
+		if volumeCapacityBytes <= 0 {
+			violations = append(violations, fmt.Sprintf("invalid volume_capacity_bytes %d", volumeCapacityBytes))
+		}
+
+		v.blockMetadataType = bmt
+		v.volumeCapacityBytes = volumeCapacityBytes
+	}
+
+	if bmt != v.blockMetadataType {
+		violations = append(violations, fmt.Sprintf("block_metadata_type changed from %s to %s", v.blockMetadataType, bmt))
+	}
+
+	if volumeCapacityBytes != v.volumeCapacityBytes {
+		violations = append(violations, fmt.Sprintf("volume_capacity_bytes changed from %d to %d", v.volumeCapacityBytes, volumeCapacityBytes))
+	}
+
+	if v.maxResults > 0 && len(bmds) > int(v.maxResults) {
+		violations = append(violations, fmt.Sprintf("%d tuples exceed max_results %d", len(bmds), v.maxResults))
+	}
+
+	for i, bmd := range bmds {
+		end := bmd.ByteOffset + bmd.SizeBytes
+
+		switch {
+		case bmd.SizeBytes <= 0:
+			violations = append(violations, fmt.Sprintf("tuple %d: invalid size_bytes %d", i, bmd.SizeBytes))
+		case v.numTuples == 0 && end <= v.startingOffset:
+			violations = append(violations, fmt.Sprintf("tuple %d: extent [%d, %d) ends at or before starting_offset %d", i, bmd.ByteOffset, end, v.startingOffset))
+		case v.numTuples > 0 && bmd.ByteOffset < v.nextOffset:
+			violations = append(violations, fmt.Sprintf("tuple %d: byte_offset %d overlaps or precedes the previous tuple ending at %d", i, bmd.ByteOffset, v.nextOffset))
+		}
+
+		v.numTuples++
+		v.nextOffset = max(v.nextOffset, end)
+	}
+
+	if len(violations) > 0 {
+		return errors.New(strings.Join(violations, "; "))
+	}
+
+	return nil
+}
+
+// newResponseValidator returns a validator for a CSI driver stream,
+// or nil if response validation is disabled.
+func (s *Server) newResponseValidator(startingOffset int64, maxResults int32) *responseValidator {
+	switch s.config.ResponseValidation {
+	case ResponseValidationLog, ResponseValidationMetric, ResponseValidationStrict:
+		return newResponseValidator(startingOffset, maxResults)
+	}
+
+	return nil
+}
+
+// checkCSIResponse validates a CSI driver response and reacts to a violation
+// according to the response validation mode. An error is returned only in
+// the strict mode.
+func (s *Server) checkCSIResponse(ctx context.Context, v *responseValidator, opName string, responseNum int, bmt api.BlockMetadataType, volumeCapacityBytes int64, bmds []*api.BlockMetadata) error {
+	if v == nil {
+		return nil
+	}
+
+	err := v.validate(bmt, volumeCapacityBytes, bmds)
+	if err == nil {
+		return nil
+	}
+
+	s.config.Runtime.RecordInvalidCSIResponse(opName)
+
+	if s.config.ResponseValidation != ResponseValidationMetric {
+		klog.FromContext(ctx).Error(err, msgInternalInvalidCSIDriverResponse, "responseNum", responseNum)
+	}
+
+	if s.config.ResponseValidation == ResponseValidationStrict {
+		return status.Errorf(codes.Internal, msgInternalInvalidCSIDriverResponseFmt, err)
+	}
+
+	return nil
+}
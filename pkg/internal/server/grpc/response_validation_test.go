@@ -0,0 +1,181 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+func TestResponseValidationMode(t *testing.T) {
+	for _, m := range []ResponseValidationMode{ResponseValidationOff, ResponseValidationLog, ResponseValidationMetric, ResponseValidationStrict} {
+		assert.NoError(t, m.Validate(), m)
+	}
+
+	assert.Error(t, ResponseValidationMode("foo").Validate())
+}
+
+func TestResponseValidator(t *testing.T) {
+	type response struct {
+		bmt  api.BlockMetadataType
+		vcb  int64
+		bmds []*api.BlockMetadata
+	}
+
+	fixed := api.BlockMetadataType_FIXED_LENGTH
+	bmd := func(offset, size int64) *api.BlockMetadata {
+		return &api.BlockMetadata{ByteOffset: offset, SizeBytes: size}
+	}
+
+	for _, tc := range []struct {
+		name           string
+		startingOffset int64
+		maxResults     int32
+		responses      []response
+		expErrContains string
+	}{
+		{
+			name:           "valid",
+			startingOffset: 1024,
+			maxResults:     2,
+			responses: []response{
+				{fixed, 1 << 20, []*api.BlockMetadata{bmd(0, 2048), bmd(2048, 1024)}},
+				{fixed, 1 << 20, []*api.BlockMetadata{bmd(4096, 1024)}},
+				{fixed, 1 << 20, nil},
+			},
+		},
+		{
+			name:           "unknown-block-metadata-type",
+			responses:      []response{{api.BlockMetadataType_UNKNOWN, 1 << 20, nil}},
+			expErrContains: "unsupported block_metadata_type",
+		},
+		{
+			name:           "invalid-volume-capacity",
+			responses:      []response{{fixed, 0, nil}},
+			expErrContains: "invalid volume_capacity_bytes",
+		},
+		{
+			name: "block-metadata-type-changed",
+			responses: []response{
+				{fixed, 1 << 20, nil},
+				{api.BlockMetadataType_VARIABLE_LENGTH, 1 << 20, nil},
+			},
+			expErrContains: "block_metadata_type changed",
+		},
+		{
+			name: "volume-capacity-changed",
+			responses: []response{
+				{fixed, 1 << 20, nil},
+				{fixed, 1 << 21, nil},
+			},
+			expErrContains: "volume_capacity_bytes changed",
+		},
+		{
+			name:           "max-results-exceeded",
+			maxResults:     1,
+			responses:      []response{{fixed, 1 << 20, []*api.BlockMetadata{bmd(0, 1024), bmd(1024, 1024)}}},
+			expErrContains: "exceed max_results",
+		},
+		{
+			name:           "invalid-size",
+			responses:      []response{{fixed, 1 << 20, []*api.BlockMetadata{bmd(0, 0)}}},
+			expErrContains: "invalid size_bytes",
+		},
+		{
+			name:           "before-starting-offset",
+			startingOffset: 4096,
+			responses:      []response{{fixed, 1 << 20, []*api.BlockMetadata{bmd(0, 1024)}}},
+			expErrContains: "before starting_offset",
+		},
+		{
+			name:           "overlap-within-response",
+			responses:      []response{{fixed, 1 << 20, []*api.BlockMetadata{bmd(0, 2048), bmd(1024, 1024)}}},
+			expErrContains: "overlaps or precedes",
+		},
+		{
+			name: "descending-across-responses",
+			responses: []response{
+				{fixed, 1 << 20, []*api.BlockMetadata{bmd(4096, 1024)}},
+				{fixed, 1 << 20, []*api.BlockMetadata{bmd(0, 1024)}},
+			},
+			expErrContains: "overlaps or precedes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newResponseValidator(tc.startingOffset, tc.maxResults)
+
+			var err error
+			for _, r := range tc.responses {
+				if err = v.validate(r.bmt, r.vcb, r.bmds); err != nil {
+					break
+				}
+			}
+
+			if tc.expErrContains == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.expErrContains)
+			}
+		})
+	}
+}
+
+func TestCheckCSIResponse(t *testing.T) {
+	th := newTestHarness()
+	invalidBMDs := []*api.BlockMetadata{{ByteOffset: 0, SizeBytes: 0}}
+
+	for _, tc := range []struct {
+		mode      ResponseValidationMode
+		expNilV   bool
+		expStatus bool
+	}{
+		{mode: ResponseValidationOff, expNilV: true},
+		{mode: ResponseValidationLog},
+		{mode: ResponseValidationMetric},
+		{mode: ResponseValidationStrict, expStatus: true},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			s := th.ServerWithRuntime(t, th.Runtime())
+			s.config.ResponseValidation = tc.mode
+
+			v := s.newResponseValidator(0, 0)
+			if tc.expNilV {
+				assert.Nil(t, v)
+			} else {
+				assert.NotNil(t, v)
+			}
+
+			err := s.checkCSIResponse(context.Background(), v, runtime.MetadataAllocatedOperationName, 1, api.BlockMetadataType_FIXED_LENGTH, 1<<20, invalidBMDs)
+			if !tc.expStatus {
+				assert.NoError(t, err)
+				return
+			}
+
+			st, ok := status.FromError(err)
+			assert.True(t, ok)
+			assert.Equal(t, codes.Internal, st.Code())
+			assert.Contains(t, st.Message(), msgInternalInvalidCSIDriverResponse)
+		})
+	}
+}
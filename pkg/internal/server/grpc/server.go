@@ -17,6 +17,7 @@ limitations under the License.
 package grpc
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -28,6 +29,7 @@ import (
 
 	snapshot "github.com/kubernetes-csi/external-snapshotter/client/v8/clientset/versioned"
 	cw "github.com/kubernetes-csi/external-snapshotter/v8/pkg/webhook"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
@@ -37,6 +39,9 @@ import (
 
 	cbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authn"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authz"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
 )
 
@@ -45,6 +50,7 @@ const (
 	HandlerDetailedTraceLogLevel = 5
 
 	HandlerDefaultMaxStreamDuration = time.Minute * 10
+	HandlerDefaultDrainTimeout      = time.Second * 25
 )
 
 type ServerConfig struct {
@@ -56,7 +62,65 @@ type ServerConfig struct {
 	// If not set then HandlerDefaultMaxStreamDuration is used.
 	MaxStreamDur time.Duration
 
-	Certwatcher *cw.CertWatcher
+	// The maximum time that Stop waits for the streams in progress to end.
+	// The remaining streams are then canceled with an Unavailable error that
+	// includes the byte offset from which the client should resume.
+	// If not set then HandlerDefaultDrainTimeout is used.
+	DrainTimeout time.Duration
+
+	// Certwatcher provides the TLS certificate of the server, such as a
+	// CertWatcher of the certificate and key files.
+	Certwatcher CertificateProvider
+
+	// ResponseValidation controls the checking of the CSI driver responses.
+	// If not set then ResponseValidationOff is used.
+	ResponseValidation ResponseValidationMode
+
+	// LiveLookupOnCacheMiss causes a resource that is not found in the
+	// informer caches of the Runtime to be fetched from the API server.
+	LiveLookupOnCacheMiss bool
+
+	// AuthCache configures the caching of the TokenReview and SubjectAccessReview
+	// decisions. Decisions are not cached if AuthCache.Size is not positive.
+	// The RecordLookup field is set by the server.
+	AuthCache authcache.Config
+
+	// VerifyBaseSnapshot causes GetMetadataDelta to check that the base snapshot
+	// is bound to a VolumeSnapshot that the user may access and that it is of the
+	// same source volume as the target snapshot.
+	VerifyBaseSnapshot bool
+
+	// SAR specifies the resource attributes of the SubjectAccessReview that
+	// authorizes access to the metadata of a VolumeSnapshot.
+	// If not set then "get" access to the volumesnapshots of the namespace is checked.
+	SAR authz.SARConfig
+
+	// StreamLimits configures the rate and concurrency limits of the metadata RPCs.
+	// RPCs that exceed a limit fail with ResourceExhausted.
+	StreamLimits StreamLimitsConfig
+
+	// Batching controls the number of tuples in each response sent to the client.
+	// The CSI driver is requested to return batches of the same size.
+	Batching BatchingConfig
+
+	// Audit configures the audit records emitted for each RPC.
+	// The server closes the sink when stopped.
+	Audit AuditConfig
+
+	// Tracing causes the trace context of the client to be extracted from
+	// the RPCs, so that the spans of the server are part of the client trace.
+	Tracing bool
+}
+
+// CertificateProvider provides the TLS certificate of the gRPC server.
+type CertificateProvider interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// isNilCertWatcher detects a CertWatcher that failed to load.
+func isNilCertWatcher(p CertificateProvider) bool {
+	certWatcher, ok := p.(*cw.CertWatcher)
+	return ok && certWatcher == nil
 }
 
 type Server struct {
@@ -66,6 +130,17 @@ type Server struct {
 	grpcServer   *grpc.Server
 	healthServer *health.Server
 	opNumber     int64
+
+	tokenAuthenticator authn.Authenticator
+	sarAuthorizer      authz.Authorizer
+	streamLimiter      *streamLimiter
+
+	// csiCtx is canceled when the connection to the CSI driver is lost.
+	csiMux    sync.Mutex
+	csiCtx    context.Context
+	csiCancel context.CancelCauseFunc
+
+	streams streamTracker
 }
 
 func NewServer(config ServerConfig) (*Server, error) {
@@ -73,24 +148,75 @@ func NewServer(config ServerConfig) (*Server, error) {
 		config.MaxStreamDur = HandlerDefaultMaxStreamDuration
 	}
 
-	if config.Certwatcher == nil {
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = HandlerDefaultDrainTimeout
+	}
+
+	if config.ResponseValidation == "" {
+		config.ResponseValidation = ResponseValidationOff
+	}
+
+	if err := config.ResponseValidation.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Audit.Level == "" {
+		config.Audit.Level = AuditLevelNone
+	}
+
+	if err := config.Audit.Level.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Audit.Level != AuditLevelNone && config.Audit.Sink == nil {
+		return nil, errors.New("the audit sink is unset.")
+	}
+
+	if config.Certwatcher == nil || isNilCertWatcher(config.Certwatcher) {
 		return nil, errors.New("the certificate watcher/provider for the gRPC server is unset.")
 	}
 
-	return &Server{
-		config: config,
-		grpcServer: grpc.NewServer(
-			grpc.Creds(
-				credentials.NewTLS(
-					&tls.Config{
-						GetCertificate: config.Certwatcher.GetCertificate,
-						ClientAuth:     tls.NoClientCert,
-					},
-				),
+	serverOptions := []grpc.ServerOption{
+		grpc.Creds(
+			credentials.NewTLS(
+				&tls.Config{
+					GetCertificate: config.Certwatcher.GetCertificate,
+					ClientAuth:     tls.NoClientCert,
+				},
 			),
 		),
+	}
+
+	if config.Tracing {
+		serverOptions = append(serverOptions, grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	}
+
+	s := &Server{
+		config:       config,
+		grpcServer:   grpc.NewServer(serverOptions...),
 		healthServer: newHealthServer(),
-	}, nil
+	}
+
+	if config.AuthCache.Enabled() {
+		s.tokenAuthenticator = authn.NewCachedTokenAuthenticator(config.Runtime.KubeClient, s.authCacheConfig(runtime.AuthCacheAuthentication))
+		s.sarAuthorizer = authz.NewCachedSARAuthorizer(config.Runtime.KubeClient, config.SAR, s.authCacheConfig(runtime.AuthCacheAuthorization))
+	}
+
+	if config.StreamLimits.Enabled() {
+		s.streamLimiter = newStreamLimiter(config.StreamLimits)
+	}
+
+	return s, nil
+}
+
+// authCacheConfig returns the configuration of the named decision cache.
+func (s *Server) authCacheConfig(cacheName string) authcache.Config {
+	config := s.config.AuthCache
+	config.RecordLookup = func(hit bool) {
+		s.config.Runtime.RecordAuthCacheLookup(cacheName, hit)
+	}
+
+	return config
 }
 
 func (s *Server) driverName() string {
@@ -109,6 +235,36 @@ func (s *Server) snapshotClient() snapshot.Interface {
 	return s.config.Runtime.SnapshotClient
 }
 
+// listers returns the informer listers of the runtime, or nil if they are
+// not set or their caches have not yet synced.
+func (s *Server) listers() *runtime.Listers {
+	if l := s.config.Runtime.Listers; l != nil && l.HasSynced() {
+		return l
+	}
+
+	return nil
+}
+
+// authenticator returns the caching authenticator if configured,
+// or else an authenticator that issues a TokenReview on every call.
+func (s *Server) authenticator() authn.Authenticator {
+	if s.tokenAuthenticator != nil {
+		return s.tokenAuthenticator
+	}
+
+	return authn.NewTokenAuthenticator(s.kubeClient())
+}
+
+// authorizer returns the caching authorizer if configured,
+// or else an authorizer that issues a SubjectAccessReview on every call.
+func (s *Server) authorizer() authz.Authorizer {
+	if s.sarAuthorizer != nil {
+		return s.sarAuthorizer
+	}
+
+	return authz.NewSARAuthorizer(s.kubeClient(), s.config.SAR)
+}
+
 func (s *Server) csiConnection() *grpc.ClientConn {
 	return s.config.Runtime.CSIConn
 }
@@ -147,16 +303,61 @@ func (s *Server) Start() error {
 }
 
 // Stop terminates the gRPC server gracefully.
+// New RPCs are rejected, and the streams in progress are canceled if they
+// do not end within the drain timeout.
 func (s *Server) Stop() {
 	s.shuttingDown()
-	s.grpcServer.GracefulStop()
+	expired := s.drainStreams()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-expired:
+		select {
+		case <-stopped:
+		case <-time.After(drainStopGracePeriod):
+			klog.Info("Closing the remaining connections")
+			s.grpcServer.Stop()
+			<-stopped
+		}
+	}
+
+	if s.config.Audit.Sink != nil {
+		if err := s.config.Audit.Sink.Close(); err != nil {
+			klog.Errorf("failed to close the audit sink: %v", err)
+		}
+	}
 }
 
 // CSIDriverIsReady is used to notify the server that the CSI driver is available for use.
 func (s *Server) CSIDriverIsReady() {
+	s.csiMux.Lock()
+	if s.csiCtx != nil && s.csiCtx.Err() != nil {
+		s.csiCtx = nil // replaced on next use
+	}
+	s.csiMux.Unlock()
+
 	s.setReady()
 }
 
+// CSIDriverConnectionLost is used to notify the server that the connection to
+// the CSI driver was lost. The server stops serving metadata requests, and the
+// requests in progress fail with Unavailable, until CSIDriverIsReady is called.
+func (s *Server) CSIDriverConnectionLost() {
+	s.setNotReady()
+
+	s.csiConnectionContext() // ensure that there is a context to cancel
+
+	s.csiMux.Lock()
+	s.csiCancel(errCSIConnectionLost)
+	s.csiMux.Unlock()
+}
+
 // OperationID generates a unique identifier for an operation.
 func (s *Server) OperationID(op string) string {
 	return fmt.Sprintf("%s-%d", op, atomic.AddInt64(&s.opNumber, 1))
@@ -31,6 +31,9 @@ import (
 
 	fakecbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned/fake"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authn"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authz"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
 )
 
@@ -68,6 +71,44 @@ func TestNewServer(t *testing.T) {
 		assert.Nil(t, server)
 	})
 
+	t.Run("invalid-response-validation", func(t *testing.T) {
+		rth := runtime.NewTestHarness().WithTestTLSFiles(t)
+		defer rth.RemoveTestTLSFiles(t)
+		rta := rth.RuntimeArgs()
+
+		rt := *validConfig.Runtime // copy
+		rt.TLSCertFile = rta.TLSCertFile
+		rt.TLSKeyFile = rta.TLSKeyFile
+
+		cw, err := cw.NewCertWatcher(rt.TLSCertFile, rt.TLSKeyFile)
+		assert.NoError(t, err)
+
+		s, err := NewServer(ServerConfig{Runtime: &rt, Certwatcher: cw, ResponseValidation: "foo"})
+		assert.Error(t, err)
+		assert.Nil(t, s)
+	})
+
+	t.Run("invalid-audit-config", func(t *testing.T) {
+		rth := runtime.NewTestHarness().WithTestTLSFiles(t)
+		defer rth.RemoveTestTLSFiles(t)
+		rta := rth.RuntimeArgs()
+
+		rt := *validConfig.Runtime // copy
+		rt.TLSCertFile = rta.TLSCertFile
+		rt.TLSKeyFile = rta.TLSKeyFile
+
+		cw, err := cw.NewCertWatcher(rt.TLSCertFile, rt.TLSKeyFile)
+		assert.NoError(t, err)
+
+		s, err := NewServer(ServerConfig{Runtime: &rt, Certwatcher: cw, Audit: AuditConfig{Level: "foo"}})
+		assert.Error(t, err)
+		assert.Nil(t, s)
+
+		s, err = NewServer(ServerConfig{Runtime: &rt, Certwatcher: cw, Audit: AuditConfig{Level: AuditLevelMetadata}})
+		assert.Error(t, err)
+		assert.Nil(t, s)
+	})
+
 	t.Run("listen-error", func(t *testing.T) {
 		rth := runtime.NewTestHarness().WithTestTLSFiles(t)
 		defer rth.RemoveTestTLSFiles(t)
@@ -88,6 +129,10 @@ func TestNewServer(t *testing.T) {
 		assert.NotNil(t, s.grpcServer)
 		assert.Equal(t, s.config.Runtime, &rt)
 		assert.Equal(t, HandlerDefaultMaxStreamDuration, s.config.MaxStreamDur)
+		assert.Equal(t, HandlerDefaultDrainTimeout, s.config.DrainTimeout)
+		assert.Equal(t, ResponseValidationOff, s.config.ResponseValidation)
+		assert.Nil(t, s.tokenAuthenticator)
+		assert.Nil(t, s.sarAuthorizer)
 
 		err = s.Start()
 		assert.Error(t, err)
@@ -111,12 +156,15 @@ func TestNewServer(t *testing.T) {
 			Runtime:      &rt,
 			MaxStreamDur: expMaxStreamDur,
 			Certwatcher:  cw,
+			AuthCache:    authcache.Config{Size: 10, PositiveTTL: time.Minute, NegativeTTL: time.Second},
 		})
 		assert.NoError(t, err)
 		assert.NotNil(t, s)
 		assert.NotNil(t, s.grpcServer)
 		assert.Equal(t, s.config.Runtime, &rt)
 		assert.Equal(t, expMaxStreamDur, s.config.MaxStreamDur)
+		assert.IsType(t, &authn.CachedTokenAuthenticator{}, s.authenticator())
+		assert.IsType(t, &authz.CachedSARAuthorizer{}, s.authorizer())
 		assert.False(t, s.IsReady()) // initialized to not ready
 
 		err = s.Start()
@@ -20,22 +20,30 @@ import (
 	"context"
 
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
 type volSnapshotInfo struct {
 	DriverName                string
 	SnapshotHandle            string
 	SourceVolume              string
+	SourceVolumeHandle        string
 	VolumeSnapshot            *snapshotv1.VolumeSnapshot
 	VolumeSnapshotContentName string
 }
 
 // getVolSnapshotInfo returns the CSI snapshot handle and driver name of the specified VolumeSnapshot.
-func (s *Server) getVolSnapshotInfo(ctx context.Context, namespace, vsName string) (*volSnapshotInfo, error) {
+func (s *Server) getVolSnapshotInfo(ctx context.Context, namespace, vsName string) (_ *volSnapshotInfo, err error) {
+	ctx, span := tracing.StartSpan(ctx, "resolveSnapshot", attribute.String("namespace", namespace), attribute.String("snapshotName", vsName))
+	defer func() { tracing.EndSpan(span, err) }()
+
 	vs, err := s.getVolumeSnapshot(ctx, namespace, vsName)
 	if err != nil {
 		return nil, err
@@ -51,17 +59,23 @@ func (s *Server) getVolSnapshotInfo(ctx context.Context, namespace, vsName strin
 		return nil, err
 	}
 
+	sourceVolumeHandle := ""
+	if vsc.Spec.Source.VolumeHandle != nil {
+		sourceVolumeHandle = *vsc.Spec.Source.VolumeHandle
+	}
+
 	return &volSnapshotInfo{
 		DriverName:                vsc.Spec.Driver,
 		SnapshotHandle:            *vsc.Status.SnapshotHandle,
 		SourceVolume:              sourceVolume,
+		SourceVolumeHandle:        sourceVolumeHandle,
 		VolumeSnapshot:            vs,
 		VolumeSnapshotContentName: vsc.Name,
 	}, nil
 }
 
 func (s *Server) getVolumeSnapshot(ctx context.Context, namespace, vsName string) (*snapshotv1.VolumeSnapshot, error) {
-	vs, err := s.snapshotClient().SnapshotV1().VolumeSnapshots(namespace).Get(ctx, vsName, apimetav1.GetOptions{})
+	vs, err := s.lookupVolumeSnapshot(ctx, namespace, vsName)
 	if err != nil {
 		klog.FromContext(ctx).Error(err, msgUnavailableFailedToGetVolumeSnapshot, "vsName", vsName)
 		return nil, status.Errorf(codes.Unavailable, msgUnavailableFailedToGetVolumeSnapshotFmt, namespace, vsName, err)
@@ -69,7 +83,7 @@ func (s *Server) getVolumeSnapshot(ctx context.Context, namespace, vsName string
 
 	if vs.Status.ReadyToUse == nil || !*vs.Status.ReadyToUse {
 		klog.FromContext(ctx).Error(err, msgUnavailableVolumeSnapshotNotReady, "vsName", vsName)
-		return nil, status.Errorf(codes.Unavailable, msgUnavailableVolumeSnapshotNotReadyFmt, vsName)
+		return nil, snapshotNotReadyError(msgUnavailableVolumeSnapshotNotReadyFmt, vsName)
 	}
 
 	if vs.Status.BoundVolumeSnapshotContentName == nil {
@@ -81,7 +95,7 @@ func (s *Server) getVolumeSnapshot(ctx context.Context, namespace, vsName string
 }
 
 func (s *Server) getVolumeSnapshotContent(ctx context.Context, vscName, vsName string) (*snapshotv1.VolumeSnapshotContent, error) {
-	vsc, err := s.snapshotClient().SnapshotV1().VolumeSnapshotContents().Get(ctx, vscName, apimetav1.GetOptions{})
+	vsc, err := s.lookupVolumeSnapshotContent(ctx, vscName)
 	if err != nil {
 		klog.FromContext(ctx).Error(err, msgUnavailableFailedToGetVolumeSnapshotContent, "vscName", vscName, "vsName", vsName)
 		return nil, status.Errorf(codes.Unavailable, msgUnavailableFailedToGetVolumeSnapshotContentFmt, vscName, err)
@@ -89,7 +103,7 @@ func (s *Server) getVolumeSnapshotContent(ctx context.Context, vscName, vsName s
 
 	if vsc.Status.ReadyToUse == nil || !*vsc.Status.ReadyToUse {
 		klog.FromContext(ctx).Error(err, msgUnavailableVolumeSnapshotContentNotReady, "vscName", vscName, "vsName", vsName)
-		return nil, status.Errorf(codes.Unavailable, msgUnavailableVolumeSnapshotContentNotReadyFmt, vscName)
+		return nil, snapshotNotReadyError(msgUnavailableVolumeSnapshotContentNotReadyFmt, vscName)
 	}
 
 	if vsc.Status.SnapshotHandle == nil {
@@ -99,3 +113,18 @@ func (s *Server) getVolumeSnapshotContent(ctx context.Context, vscName, vsName s
 
 	return vsc, nil
 }
+
+// snapshotNotReadyError returns the Unavailable error of a snapshot that is
+// not ready to use, identified by the reason of its ErrorInfo detail.
+func snapshotNotReadyError(format, name string) error {
+	st := status.Newf(codes.Unavailable, format, name)
+
+	if stDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: api.ErrorReasonSnapshotNotReady,
+		Domain: api.ErrorDomain,
+	}); err == nil {
+		st = stDetails
+	}
+
+	return st.Err()
+}
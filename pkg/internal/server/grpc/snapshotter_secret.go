@@ -24,14 +24,18 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
-	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
 // getSnapshotterCredentials returns the snapshotter secret associated with VolumeSnapshotClass, if any.
 // The VolumeSnapshotClass is fetched by name if specified, or else the default VolumeSnapshotClass
 // for the CSI driver is used.
-func (s *Server) getSnapshotterCredentials(ctx context.Context, vsi *volSnapshotInfo) (map[string]string, error) {
+func (s *Server) getSnapshotterCredentials(ctx context.Context, vsi *volSnapshotInfo) (_ map[string]string, err error) {
+	ctx, span := tracing.StartSpan(ctx, "getSecrets")
+	defer func() { tracing.EndSpan(span, err) }()
+
 	secretRef, err := s.getSnapshotterSecretRef(ctx, vsi)
 	if err != nil {
 		return nil, err
@@ -80,7 +84,7 @@ func (s *Server) getSnapshotterSecretRef(ctx context.Context, vsi *volSnapshotIn
 }
 
 func (s *Server) getVolumeSnapshotClass(ctx context.Context, volumeSnapshotClassName string) (*snapshotv1.VolumeSnapshotClass, error) {
-	vsc, err := s.snapshotClient().SnapshotV1().VolumeSnapshotClasses().Get(ctx, volumeSnapshotClassName, apimetav1.GetOptions{})
+	vsc, err := s.lookupVolumeSnapshotClass(ctx, volumeSnapshotClassName)
 	if err != nil {
 		klog.FromContext(ctx).Error(err, msgUnavailableFailedToGetVolumeSnapshotClass, "volumeSnapshotClassName", volumeSnapshotClassName)
 		return nil, status.Errorf(codes.Unavailable, msgUnavailableFailedToGetVolumeSnapshotClassFmt, volumeSnapshotClassName, err)
@@ -90,38 +94,46 @@ func (s *Server) getVolumeSnapshotClass(ctx context.Context, volumeSnapshotClass
 }
 
 func (s *Server) getDefaultVolumeSnapshotClassForDriver(ctx context.Context, driverName string) (*snapshotv1.VolumeSnapshotClass, error) {
-	vscList, err := s.snapshotClient().SnapshotV1().VolumeSnapshotClasses().List(ctx, apimetav1.ListOptions{})
+	vsClasses, fromCache, err := s.listVolumeSnapshotClasses(ctx)
+	defaults := defaultVolumeSnapshotClassesForDriver(vsClasses, driverName)
+
+	if err == nil && len(defaults) == 0 && fromCache && s.config.LiveLookupOnCacheMiss {
+		vsClasses, err = s.listVolumeSnapshotClassesLive(ctx)
+		defaults = defaultVolumeSnapshotClassesForDriver(vsClasses, driverName)
+	}
+
 	if err != nil {
 		klog.FromContext(ctx).Error(err, msgUnavailableFailedToListVolumeSnapshotClasses)
 		return nil, status.Errorf(codes.Unavailable, msgUnavailableFailedToListVolumeSnapshotClassesFmt, err)
 	}
 
-	idxFound := -1
+	switch len(defaults) {
+	case 0:
+		klog.FromContext(ctx).Error(err, msgUnavailableNoDefaultVolumeSnapshotClassForDriver, "driver", driverName)
+		return nil, status.Errorf(codes.Unavailable, msgUnavailableNoDefaultVolumeSnapshotClassForDriverFmt, driverName)
+	case 1:
+		return defaults[0], nil
+	}
 
-	for idx, vsc := range vscList.Items {
-		if vsc.Driver != driverName || vsc.Annotations == nil {
-			continue
-		}
+	// it is an error if there are multiple defaults
+	klog.FromContext(ctx).Error(err, msgUnavailableMultipleDefaultVolumeSnapshotClassesForDriver, "driver", driverName)
+	return nil, status.Errorf(codes.Unavailable, msgUnavailableMultipleDefaultVolumeSnapshotClassesForDriverFmt, driverName)
+}
 
-		annValue, found := vsc.Annotations[snapshotutils.IsDefaultSnapshotClassAnnotation]
-		if !found {
+// defaultVolumeSnapshotClassesForDriver returns the VolumeSnapshotClasses of
+// the driver that are annotated as the default.
+func defaultVolumeSnapshotClassesForDriver(vsClasses []*snapshotv1.VolumeSnapshotClass, driverName string) []*snapshotv1.VolumeSnapshotClass {
+	var defaults []*snapshotv1.VolumeSnapshotClass
+
+	for _, vsc := range vsClasses {
+		if vsc.Driver != driverName || vsc.Annotations == nil {
 			continue
 		}
 
-		if annValue == "true" {
-			if idxFound != -1 { // it is an error if there are multiple defaults
-				klog.FromContext(ctx).Error(err, msgUnavailableMultipleDefaultVolumeSnapshotClassesForDriver, "driver", driverName)
-				return nil, status.Errorf(codes.Unavailable, msgUnavailableMultipleDefaultVolumeSnapshotClassesForDriverFmt, driverName)
-			}
-
-			idxFound = idx
+		if vsc.Annotations[snapshotutils.IsDefaultSnapshotClassAnnotation] == "true" {
+			defaults = append(defaults, vsc)
 		}
 	}
 
-	if idxFound != -1 {
-		return &vscList.Items[idxFound], nil
-	}
-
-	klog.FromContext(ctx).Error(err, msgUnavailableNoDefaultVolumeSnapshotClassForDriver, "driver", driverName)
-	return nil, status.Errorf(codes.Unavailable, msgUnavailableNoDefaultVolumeSnapshotClassForDriverFmt, driverName)
+	return defaults
 }
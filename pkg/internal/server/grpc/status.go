@@ -22,30 +22,52 @@ import (
 )
 
 const (
-	mgsInternalFailedToAuthorizeFmt       = mgsInternalFailedToAuthorizePrefix + ": %v"
-	mgsInternalFailedToAuthorizePrefix    = "failed to authorize the user"
-	msgInternalFailedCSIDriverResponse    = "failed to get response from CSI driver"
-	msgInternalFailedCSIDriverResponseFmt = msgInternalFailedCSIDriverResponse + ": %v"
-	msgInternalFailedToAuthenticateFmt    = msgInternalFailedToAuthenticatePrefix + ": %v"
-	msgInternalFailedToAuthenticatePrefix = "failed to authenticate user"
-	msgInternalFailedToFindCR             = "failed to find the SnapshotMetadataService CR for driver"
-	msgInternalFailedToFindCRFmt          = msgInternalFailedToFindCR + " '%s': %v"
-	msgInternalFailedToSendResponse       = "failed to send response"
-	msgInternalFailedToSendResponseFmt    = msgInternalFailedToSendResponse + ": %v"
-
-	msgInvalidArgumentBaseSnapshotIdMissing     = "baseSnapshotId cannot be empty"
+	mgsInternalFailedToAuthorizeFmt        = mgsInternalFailedToAuthorizePrefix + ": %v"
+	mgsInternalFailedToAuthorizePrefix     = "failed to authorize the user"
+	msgInternalFailedCSIDriverResponse     = "failed to get response from CSI driver"
+	msgInternalFailedCSIDriverResponseFmt  = msgInternalFailedCSIDriverResponse + ": %v"
+	msgInternalFailedToAuthenticateFmt     = msgInternalFailedToAuthenticatePrefix + ": %v"
+	msgInternalFailedToAuthenticatePrefix  = "failed to authenticate user"
+	msgInternalFailedToFindCR              = "failed to find the SnapshotMetadataService CR for driver"
+	msgInternalFailedToFindCRFmt           = msgInternalFailedToFindCR + " '%s': %v"
+	msgInternalInvalidCSIDriverResponse    = "invalid response from CSI driver"
+	msgInternalInvalidCSIDriverResponseFmt = msgInternalInvalidCSIDriverResponse + ": %v"
+	msgInternalFailedToSendResponse        = "failed to send response"
+	msgInternalFailedToSendResponseFmt     = msgInternalFailedToSendResponse + ": %v"
+
+	msgInvalidArgumentBaseSnapshotIdMissing     = "baseSnapshotId or baseSnapshotName must be specified"
+	msgInvalidArgumentBaseSnapshotIdAndName     = "baseSnapshotId and baseSnapshotName are mutually exclusive"
 	msgInvalidArgumentNamespaceMissing          = "namespace parameter cannot be empty"
 	msgInvalidArgumentSecurityTokenMissing      = "securityToken is missing"
 	msgInvalidArgumentSnaphotNameMissing        = "snapshotName cannot be empty"
 	msgInvalidArgumentTargetSnapshotNameMissing = "targetSnapshotName cannot be empty"
 	msgInvalidArgumentSnaphotDriverInvalidFmt   = "VolumeSnapshot '%s' does not belong to the CSI driver '%s'"
 
+	msgInvalidArgumentBaseSnapshotNotFound          = "no VolumeSnapshot of the CSI driver is bound to the base snapshot"
+	msgInvalidArgumentBaseSnapshotNotFoundFmt       = msgInvalidArgumentBaseSnapshotNotFound + " '%s'"
+	msgInvalidArgumentBaseSnapshotSourceMismatch    = "the base snapshot is not of the same source volume as the target snapshot"
+	msgInvalidArgumentBaseSnapshotSourceMismatchFmt = msgInvalidArgumentBaseSnapshotSourceMismatch + " '%s'"
+	msgInvalidArgumentBaseSnapshotSourceUnknown     = "the source volume of the base or target snapshot is unknown"
+	msgInvalidArgumentBaseSnapshotSourceUnknownFmt  = msgInvalidArgumentBaseSnapshotSourceUnknown + " '%s'"
+
 	msgPermissionDeniedPrefix = "user does not have permissions to perform the operation"
 	msgPermissionDeniedFmt    = msgPermissionDeniedPrefix + ": %s"
 
+	msgPermissionDeniedBaseSnapshot    = "user does not have permissions to access the base snapshot"
+	msgPermissionDeniedBaseSnapshotFmt = msgPermissionDeniedBaseSnapshot + " '%s'"
+
+	msgResourceExhaustedRPCRate             = "too many metadata requests"
+	msgResourceExhaustedStreams             = "too many concurrent metadata streams"
+	msgResourceExhaustedNamespaceStreamsFmt = msgResourceExhaustedStreams + " in namespace '%s'"
+	msgResourceExhaustedUserStreamsFmt      = msgResourceExhaustedStreams + " of user '%s'"
+
 	msgUnauthenticatedUser = "unauthenticated user"
 
 	msgUnavailableCSIDriverNotReady = "the CSI driver is not yet ready"
+	msgUnavailableCSIConnectionLost = "lost the connection to the CSI driver"
+
+	msgUnavailableServerShuttingDown    = "the server is shutting down"
+	msgUnavailableServerShuttingDownFmt = msgUnavailableServerShuttingDown + ", resume from byte offset %d"
 
 	msgUnavailableFailedToGetCredentials    = "failed to get credentials"
 	msgUnavailableFailedToGetCredentialsFmt = msgUnavailableFailedToGetCredentials + ": %v"
@@ -64,6 +86,9 @@ const (
 	msgUnavailableInvalidVolumeSnapshotContentStatus    = "snapshotHandle is not set in VolumeSnapshotContent status"
 	msgUnavailableInvalidVolumeSnapshotContentStatusFmt = msgUnavailableInvalidVolumeSnapshotContentStatus + ", name: %s"
 
+	msgUnavailableFailedToListVolumeSnapshotContents    = "failed to list VolumeSnapshotContents"
+	msgUnavailableFailedToListVolumeSnapshotContentsFmt = msgUnavailableFailedToListVolumeSnapshotContents + ": %v"
+
 	msgUnavailableFailedToGetVolumeSnapshotClass    = "failed to get VolumeSnapshotClass"
 	msgUnavailableFailedToGetVolumeSnapshotClassFmt = msgUnavailableFailedToGetVolumeSnapshotClass + " '%s': %v"
 
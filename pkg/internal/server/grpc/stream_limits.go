@@ -0,0 +1,213 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// StreamLimitsRetryDelay is the retry delay suggested to a client whose
+	// RPC was rejected because of a concurrent stream limit.
+	StreamLimitsRetryDelay = 5 * time.Second
+
+	// Reasons for the rejection of an RPC, used as metric label values.
+	rejectReasonRPCRate          = "rpc_rate"
+	rejectReasonStreams          = "streams"
+	rejectReasonNamespaceStreams = "namespace_streams"
+	rejectReasonUserStreams      = "user_streams"
+)
+
+// StreamLimitsConfig configures the limits on the metadata RPCs served.
+// A limit is not enforced if it is not positive.
+type StreamLimitsConfig struct {
+	// MaxStreams is the maximum number of concurrent metadata streams.
+	MaxStreams int
+
+	// MaxStreamsPerNamespace is the maximum number of concurrent metadata
+	// streams for the snapshots of a namespace.
+	MaxStreamsPerNamespace int
+
+	// MaxStreamsPerUser is the maximum number of concurrent metadata
+	// streams of an authenticated user.
+	MaxStreamsPerUser int
+
+	// RPCRate is the sustained number of new metadata RPCs allowed per second.
+	RPCRate float64
+
+	// RPCBurst is the number of new metadata RPCs allowed in excess of RPCRate.
+	// If not set then the RPCRate rounded up is used.
+	RPCBurst int
+}
+
+// Enabled returns true if any limit is configured.
+func (c StreamLimitsConfig) Enabled() bool {
+	return c.MaxStreams > 0 || c.MaxStreamsPerNamespace > 0 || c.MaxStreamsPerUser > 0 || c.RPCRate > 0
+}
+
+// streamLimiter enforces the StreamLimitsConfig.
+// All methods are no-ops on a nil receiver.
+type streamLimiter struct {
+	config     StreamLimitsConfig
+	rpcLimiter *rate.Limiter
+
+	mux                 sync.Mutex
+	numStreams          int
+	numNamespaceStreams map[string]int
+	numUserStreams      map[string]int
+}
+
+func newStreamLimiter(config StreamLimitsConfig) *streamLimiter {
+	l := &streamLimiter{
+		config:              config,
+		numNamespaceStreams: map[string]int{},
+		numUserStreams:      map[string]int{},
+	}
+
+	if config.RPCRate > 0 {
+		burst := config.RPCBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(config.RPCRate))
+		}
+
+		l.rpcLimiter = rate.NewLimiter(rate.Limit(config.RPCRate), burst)
+	}
+
+	return l
+}
+
+// reserveRPC consumes a token for a new RPC if one is available.
+// Otherwise it returns the time until the next token is available.
+func (l *streamLimiter) reserveRPC(now time.Time) (time.Duration, bool) {
+	if l == nil || l.rpcLimiter == nil {
+		return 0, true
+	}
+
+	r := l.rpcLimiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay, false
+	}
+
+	return 0, true
+}
+
+// acquireStream accounts for a new stream of the user in the namespace if
+// no concurrent stream limit is exceeded. Otherwise it returns the reason
+// for the rejection. The returned function must be called when the stream ends.
+func (l *streamLimiter) acquireStream(namespace, username string) (func(), string) {
+	if l == nil {
+		return func() {}, ""
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	switch {
+	case l.config.MaxStreams > 0 && l.numStreams >= l.config.MaxStreams:
+		return nil, rejectReasonStreams
+	case l.config.MaxStreamsPerNamespace > 0 && l.numNamespaceStreams[namespace] >= l.config.MaxStreamsPerNamespace:
+		return nil, rejectReasonNamespaceStreams
+	case l.config.MaxStreamsPerUser > 0 && l.numUserStreams[username] >= l.config.MaxStreamsPerUser:
+		return nil, rejectReasonUserStreams
+	}
+
+	l.numStreams++
+	l.numNamespaceStreams[namespace]++
+	l.numUserStreams[username]++
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.releaseStream(namespace, username)
+		})
+	}, ""
+}
+
+func (l *streamLimiter) releaseStream(namespace, username string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.numStreams--
+
+	if l.numNamespaceStreams[namespace]--; l.numNamespaceStreams[namespace] <= 0 {
+		delete(l.numNamespaceStreams, namespace)
+	}
+
+	if l.numUserStreams[username]--; l.numUserStreams[username] <= 0 {
+		delete(l.numUserStreams, username)
+	}
+}
+
+// checkRPCRate returns a ResourceExhausted error if the RPC exceeds the rate limit.
+func (s *Server) checkRPCRate(ctx context.Context, opName string) error {
+	delay, ok := s.streamLimiter.reserveRPC(time.Now())
+	if ok {
+		return nil
+	}
+
+	return s.rejectRPC(ctx, opName, rejectReasonRPCRate, delay, status.New(codes.ResourceExhausted, msgResourceExhaustedRPCRate))
+}
+
+// acquireStream returns a ResourceExhausted error if the stream would exceed a
+// concurrent stream limit. Otherwise it returns a function that must be called
+// when the stream ends.
+func (s *Server) acquireStream(ctx context.Context, opName, namespace, username string) (func(), error) {
+	release, reason := s.streamLimiter.acquireStream(namespace, username)
+	if release != nil {
+		return release, nil
+	}
+
+	var st *status.Status
+
+	switch reason {
+	case rejectReasonNamespaceStreams:
+		st = status.Newf(codes.ResourceExhausted, msgResourceExhaustedNamespaceStreamsFmt, namespace)
+	case rejectReasonUserStreams:
+		st = status.Newf(codes.ResourceExhausted, msgResourceExhaustedUserStreamsFmt, username)
+	default:
+		st = status.New(codes.ResourceExhausted, msgResourceExhaustedStreams)
+	}
+
+	return nil, s.rejectRPC(ctx, opName, reason, StreamLimitsRetryDelay, st)
+}
+
+// rejectRPC counts the rejection and returns the status error with a hint of
+// when the client should retry.
+func (s *Server) rejectRPC(ctx context.Context, opName, reason string, retryDelay time.Duration, st *status.Status) error {
+	s.config.Runtime.RecordRejectedRPC(opName, reason)
+
+	if stDetails, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)}); err == nil {
+		st = stDetails
+	}
+
+	err := st.Err()
+	klog.FromContext(ctx).Error(err, "rejected", "reason", reason, "retryDelay", retryDelay)
+
+	return err
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/component-base/metrics/testutil"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		assert.False(t, StreamLimitsConfig{}.Enabled())
+
+		var l *streamLimiter
+
+		delay, ok := l.reserveRPC(time.Now())
+		assert.True(t, ok)
+		assert.Zero(t, delay)
+
+		release, reason := l.acquireStream("ns", "user")
+		assert.NotNil(t, release)
+		assert.Empty(t, reason)
+		release()
+	})
+
+	t.Run("concurrent-streams", func(t *testing.T) {
+		config := StreamLimitsConfig{MaxStreams: 3, MaxStreamsPerNamespace: 2, MaxStreamsPerUser: 1}
+		assert.True(t, config.Enabled())
+
+		l := newStreamLimiter(config)
+
+		r1, reason := l.acquireStream("ns1", "user1")
+		assert.NotNil(t, r1)
+		assert.Empty(t, reason)
+
+		_, reason = l.acquireStream("ns2", "user1")
+		assert.Equal(t, rejectReasonUserStreams, reason)
+
+		r2, reason := l.acquireStream("ns1", "user2")
+		assert.NotNil(t, r2)
+		assert.Empty(t, reason)
+
+		_, reason = l.acquireStream("ns1", "user3")
+		assert.Equal(t, rejectReasonNamespaceStreams, reason)
+
+		r3, reason := l.acquireStream("ns2", "user3")
+		assert.NotNil(t, r3)
+		assert.Empty(t, reason)
+
+		_, reason = l.acquireStream("ns3", "user4")
+		assert.Equal(t, rejectReasonStreams, reason)
+
+		// release is idempotent
+		r1()
+		r1()
+		assert.Equal(t, 2, l.numStreams)
+		assert.Equal(t, map[string]int{"ns1": 1, "ns2": 1}, l.numNamespaceStreams)
+		assert.Equal(t, map[string]int{"user2": 1, "user3": 1}, l.numUserStreams)
+
+		r4, reason := l.acquireStream("ns1", "user1")
+		assert.NotNil(t, r4)
+		assert.Empty(t, reason)
+
+		r2()
+		r3()
+		r4()
+		assert.Zero(t, l.numStreams)
+		assert.Empty(t, l.numNamespaceStreams)
+		assert.Empty(t, l.numUserStreams)
+	})
+
+	t.Run("rpc-rate", func(t *testing.T) {
+		l := newStreamLimiter(StreamLimitsConfig{RPCRate: 1.5})
+		assert.Equal(t, 2, l.rpcLimiter.Burst())
+
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			_, ok := l.reserveRPC(now)
+			assert.True(t, ok)
+		}
+
+		delay, ok := l.reserveRPC(now)
+		assert.False(t, ok)
+		assert.InDelta(t, float64(time.Second)/1.5, float64(delay), float64(time.Millisecond))
+
+		// the rejected reservation does not consume a token
+		_, ok = l.reserveRPC(now.Add(delay))
+		assert.True(t, ok)
+
+		l = newStreamLimiter(StreamLimitsConfig{RPCRate: 1, RPCBurst: 5})
+		assert.Equal(t, 5, l.rpcLimiter.Burst())
+	})
+}
+
+func TestStreamLimitsViaGRPCClient(t *testing.T) {
+	ctx := context.Background()
+	th := newTestHarness().WithMockCSIDriver(t).WithFakeClientAPIs()
+	defer th.TerminateMockCSIDriver()
+
+	grpcServer := th.StartGRPCServer(t, th.Runtime())
+	defer th.StopGRPCServer(t)
+	grpcServer.CSIDriverIsReady()
+
+	client := th.GRPCSnapshotMetadataClient(t)
+
+	assertResourceExhausted := func(t *testing.T, err error, expMsg string) time.Duration {
+		st, ok := status.FromError(err)
+		assert.True(t, ok)
+		assert.Equal(t, codes.ResourceExhausted, st.Code())
+		assert.Contains(t, st.Message(), expMsg)
+
+		for _, detail := range st.Details() {
+			if ri, ok := detail.(*errdetails.RetryInfo); ok {
+				return ri.RetryDelay.AsDuration()
+			}
+		}
+
+		assert.Fail(t, "no RetryInfo in the status details")
+		return 0
+	}
+
+	t.Run("user-streams", func(t *testing.T) {
+		grpcServer.streamLimiter = newStreamLimiter(StreamLimitsConfig{MaxStreamsPerUser: 1})
+
+		unblock := make(chan struct{})
+		th.MockCSISnapshotMetadataServer.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(req *csi.GetMetadataAllocatedRequest, stream csi.SnapshotMetadata_GetMetadataAllocatedServer) error {
+				stream.Send(&csi.GetMetadataAllocatedResponse{
+					BlockMetadataType:   csi.BlockMetadataType_FIXED_LENGTH,
+					VolumeCapacityBytes: 1 << 20,
+					BlockMetadata:       []*csi.BlockMetadata{{ByteOffset: 0, SizeBytes: 1024}},
+				})
+				<-unblock
+				return nil
+			})
+
+		req := &api.GetMetadataAllocatedRequest{
+			SecurityToken: th.SecurityToken,
+			Namespace:     th.Namespace,
+			SnapshotName:  "snap-1",
+		}
+
+		stream1, err := client.GetMetadataAllocated(ctx, req)
+		assert.NoError(t, err)
+		_, err = stream1.Recv() // the stream is established
+		assert.NoError(t, err)
+
+		stream2, err := client.GetMetadataAllocated(ctx, req)
+		assert.NoError(t, err)
+		_, err = stream2.Recv()
+		assert.Equal(t, StreamLimitsRetryDelay, assertResourceExhausted(t, err, msgResourceExhaustedStreams))
+
+		close(unblock)
+		_, err = stream1.Recv()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("rpc-rate", func(t *testing.T) {
+		grpcServer.streamLimiter = newStreamLimiter(StreamLimitsConfig{RPCRate: 0.001, RPCBurst: 1})
+
+		req := &api.GetMetadataDeltaRequest{
+			SecurityToken:      th.SecurityToken,
+			Namespace:          th.Namespace + "foo",
+			BaseSnapshotName:   "snap-1",
+			TargetSnapshotName: "snap-2",
+		}
+
+		// invalid requests do not consume a token
+		stream, err := client.GetMetadataDelta(ctx, &api.GetMetadataDeltaRequest{})
+		assert.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		// the first valid request consumes the token and is denied access
+		stream, err = client.GetMetadataDelta(ctx, req)
+		assert.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		stream, err = client.GetMetadataDelta(ctx, req)
+		assert.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Greater(t, assertResourceExhausted(t, err, msgResourceExhaustedRPCRate), time.Duration(0))
+	})
+
+	expected := `
+# HELP snapshot_metadata_controller_rejected_rpcs_total [ALPHA] The number of metadata RPCs rejected by the rate and concurrent stream limits.
+# TYPE snapshot_metadata_controller_rejected_rpcs_total counter
+snapshot_metadata_controller_rejected_rpcs_total{operation_name="MetadataAllocated",reason="user_streams"} 1
+snapshot_metadata_controller_rejected_rpcs_total{operation_name="MetadataDelta",reason="rpc_rate"} 1
+`
+	err := testutil.GatherAndCompare(grpcServer.config.Runtime.MetricsManager.GetRegistry(), strings.NewReader(expected),
+		"snapshot_metadata_controller_rejected_rpcs_total")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+// activeStream is a metadata RPC in progress.
+type activeStream struct {
+	rt        *runtime.Runtime
+	opName    string
+	startTime time.Time
+	cancel    context.CancelCauseFunc
+
+	// nextOffset is the byte offset following the last tuple sent to the client.
+	nextOffset atomic.Int64
+
+	// numResponses is the number of responses sent to the client.
+	numResponses int
+}
+
+// sent records a response sent to the client.
+func (as *activeStream) sent(bmds []*api.BlockMetadata) {
+	if n := len(bmds); n > 0 {
+		as.nextOffset.Store(bmds[n-1].ByteOffset + bmds[n-1].SizeBytes)
+	}
+
+	if as.numResponses++; as.numResponses == 1 {
+		as.rt.RecordTimeToFirstResponse(as.opName, time.Since(as.startTime))
+	}
+
+	var numBytes int64
+	for _, bmd := range bmds {
+		numBytes += bmd.SizeBytes
+	}
+
+	as.rt.RecordResponseSent(as.opName, len(bmds), numBytes)
+}
+
+// sendFailed records the failure to send a response to the client.
+func (as *activeStream) sendFailed() {
+	as.rt.RecordClientSendError(as.opName)
+}
+
+// streamTracker tracks the metadata RPCs in progress.
+type streamTracker struct {
+	mux      sync.Mutex
+	draining bool
+	streams  map[*activeStream]struct{}
+}
+
+// ActiveStreams returns the number of metadata RPCs in progress.
+func (s *Server) ActiveStreams() int {
+	s.streams.mux.Lock()
+	defer s.streams.mux.Unlock()
+
+	return len(s.streams.streams)
+}
+
+// startStream registers a metadata RPC starting at the byte offset. It returns
+// an Unavailable error if the server is shutting down. Otherwise it returns a
+// context derived from ctx that is canceled if the RPC is still in progress when
+// the drain timeout expires, and a function that must be called when the RPC ends.
+func (s *Server) startStream(ctx context.Context, opName string, startingOffset int64) (context.Context, *activeStream, func(), error) {
+	t := &s.streams
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.draining {
+		return nil, nil, nil, status.Error(codes.Unavailable, msgUnavailableServerShuttingDown)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	as := &activeStream{
+		rt:        s.config.Runtime,
+		opName:    opName,
+		startTime: time.Now(),
+		cancel:    cancel,
+	}
+	as.nextOffset.Store(startingOffset)
+
+	if t.streams == nil {
+		t.streams = map[*activeStream]struct{}{}
+	}
+
+	t.streams[as] = struct{}{}
+	as.rt.RecordStreamStarted(opName)
+
+	return ctx, as, func() {
+		t.mux.Lock()
+		delete(t.streams, as)
+		t.mux.Unlock()
+
+		as.rt.RecordStreamEnded(opName)
+		cancel(nil)
+	}, nil
+}
+
+// trackedAllocatedStream records the responses sent to the client.
+type trackedAllocatedStream struct {
+	api.SnapshotMetadata_GetMetadataAllocatedServer
+	as *activeStream
+}
+
+func (ts trackedAllocatedStream) Send(resp *api.GetMetadataAllocatedResponse) error {
+	if err := ts.SnapshotMetadata_GetMetadataAllocatedServer.Send(resp); err != nil {
+		ts.as.sendFailed()
+		return err
+	}
+
+	ts.as.sent(resp.BlockMetadata)
+
+	return nil
+}
+
+// trackedDeltaStream records the responses sent to the client.
+type trackedDeltaStream struct {
+	api.SnapshotMetadata_GetMetadataDeltaServer
+	as *activeStream
+}
+
+func (ts trackedDeltaStream) Send(resp *api.GetMetadataDeltaResponse) error {
+	if err := ts.SnapshotMetadata_GetMetadataDeltaServer.Send(resp); err != nil {
+		ts.as.sendFailed()
+		return err
+	}
+
+	ts.as.sent(resp.BlockMetadata)
+
+	return nil
+}
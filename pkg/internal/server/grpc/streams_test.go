@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/component-base/metrics/testutil"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+func TestStreamMetricsViaGRPCClient(t *testing.T) {
+	ctx := context.Background()
+	th := newTestHarness().WithMockCSIDriver(t).WithFakeClientAPIs()
+	defer th.TerminateMockCSIDriver()
+
+	grpcServer := th.StartGRPCServer(t, th.Runtime())
+	defer th.StopGRPCServer(t)
+	grpcServer.CSIDriverIsReady()
+
+	client := th.GRPCSnapshotMetadataClient(t)
+
+	th.MockCSISnapshotMetadataServer.EXPECT().GetMetadataDelta(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(req *csi.GetMetadataDeltaRequest, stream csi.SnapshotMetadata_GetMetadataDeltaServer) error {
+			stream.Send(&csi.GetMetadataDeltaResponse{
+				BlockMetadataType:   csi.BlockMetadataType_FIXED_LENGTH,
+				VolumeCapacityBytes: 1 << 20,
+				BlockMetadata:       []*csi.BlockMetadata{{ByteOffset: 0, SizeBytes: 1024}, {ByteOffset: 4096, SizeBytes: 1024}},
+			})
+			stream.Send(&csi.GetMetadataDeltaResponse{
+				BlockMetadataType:   csi.BlockMetadataType_FIXED_LENGTH,
+				VolumeCapacityBytes: 1 << 20,
+				BlockMetadata:       []*csi.BlockMetadata{{ByteOffset: 8192, SizeBytes: 1024}},
+			})
+			return status.Error(codes.Aborted, "aborted")
+		})
+
+	stream, err := client.GetMetadataDelta(ctx, &api.GetMetadataDeltaRequest{
+		SecurityToken:      th.SecurityToken,
+		Namespace:          th.Namespace,
+		BaseSnapshotId:     th.HandleFromSnapshot("snap-1"),
+		TargetSnapshotName: "snap-2",
+	})
+	assert.NoError(t, err)
+
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Zero(t, grpcServer.ActiveStreams())
+
+	expected := `
+# HELP snapshot_metadata_controller_active_streams [ALPHA] The number of metadata RPCs in progress.
+# TYPE snapshot_metadata_controller_active_streams gauge
+snapshot_metadata_controller_active_streams{operation_name="MetadataDelta"} 0
+# HELP snapshot_metadata_controller_block_metadata_bytes_total [ALPHA] The number of bytes described by the BlockMetadata tuples sent to clients.
+# TYPE snapshot_metadata_controller_block_metadata_bytes_total counter
+snapshot_metadata_controller_block_metadata_bytes_total{operation_name="MetadataDelta"} 3072
+# HELP snapshot_metadata_controller_block_metadata_tuples_total [ALPHA] The number of BlockMetadata tuples sent to clients.
+# TYPE snapshot_metadata_controller_block_metadata_tuples_total counter
+snapshot_metadata_controller_block_metadata_tuples_total{operation_name="MetadataDelta"} 3
+# HELP snapshot_metadata_controller_csi_stream_errors_total [ALPHA] The number of CSI driver metadata streams that failed, by gRPC status code.
+# TYPE snapshot_metadata_controller_csi_stream_errors_total counter
+snapshot_metadata_controller_csi_stream_errors_total{grpc_code="Aborted",operation_name="MetadataDelta"} 1
+# HELP snapshot_metadata_controller_responses_total [ALPHA] The number of metadata responses sent to clients.
+# TYPE snapshot_metadata_controller_responses_total counter
+snapshot_metadata_controller_responses_total{operation_name="MetadataDelta"} 2
+`
+	registry := grpcServer.config.Runtime.MetricsManager.GetRegistry()
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"snapshot_metadata_controller_active_streams", "snapshot_metadata_controller_block_metadata_bytes_total",
+		"snapshot_metadata_controller_block_metadata_tuples_total", "snapshot_metadata_controller_csi_stream_errors_total",
+		"snapshot_metadata_controller_responses_total")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		metricName string
+		labels     map[string]string
+	}{
+		{"snapshot_metadata_controller_time_to_first_response_seconds", map[string]string{runtime.LabelOperationName: runtime.MetadataDeltaOperationName}},
+		{"snapshot_metadata_controller_auth_duration_seconds", map[string]string{runtime.LabelAuthPhase: runtime.AuthPhaseAuthentication, runtime.LabelAuthResult: runtime.AuthResultAllowed}},
+		{"snapshot_metadata_controller_auth_duration_seconds", map[string]string{runtime.LabelAuthPhase: runtime.AuthPhaseAuthorization, runtime.LabelAuthResult: runtime.AuthResultAllowed}},
+	} {
+		vec, err := testutil.GetHistogramVecFromGatherer(registry, tc.metricName, tc.labels)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), vec.GetAggregatedSampleCount(), "%s %v", tc.metricName, tc.labels)
+	}
+}
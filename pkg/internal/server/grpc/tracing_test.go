@@ -0,0 +1,112 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package grpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
+)
+
+func TestTracingViaGRPCClient(t *testing.T) {
+	tp, prop := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(prop)
+	}()
+
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	th := newTestHarness().WithMockCSIDriver(t).WithFakeClientAPIs()
+	defer th.TerminateMockCSIDriver()
+
+	th.serverOptions = []grpc.ServerOption{grpc.StatsHandler(otelgrpc.NewServerHandler())}
+	grpcServer := th.StartGRPCServer(t, th.Runtime())
+	defer th.StopGRPCServer(t)
+	grpcServer.CSIDriverIsReady()
+
+	conn, err := grpc.NewClient("passthrough://bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return th.listener.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	th.MockCSISnapshotMetadataServer.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(req *csi.GetMetadataAllocatedRequest, stream csi.SnapshotMetadata_GetMetadataAllocatedServer) error {
+			return stream.Send(&csi.GetMetadataAllocatedResponse{
+				BlockMetadataType:   csi.BlockMetadataType_FIXED_LENGTH,
+				VolumeCapacityBytes: 1 << 20,
+				BlockMetadata:       []*csi.BlockMetadata{{ByteOffset: 0, SizeBytes: 1024}},
+			})
+		})
+
+	ctx, clientSpan := tracing.StartSpan(context.Background(), "client")
+
+	stream, err := api.NewSnapshotMetadataClient(conn).GetMetadataAllocated(ctx, &api.GetMetadataAllocatedRequest{
+		SecurityToken: th.SecurityToken,
+		Namespace:     th.Namespace,
+		SnapshotName:  "snap-1",
+	})
+	assert.NoError(t, err)
+
+	for err == nil {
+		_, err = stream.Recv()
+	}
+
+	assert.Equal(t, io.EOF, err)
+	clientSpan.End()
+
+	// the server spans are part of the trace of the client
+	traceID := clientSpan.SpanContext().TraceID()
+	spanNames := map[string]bool{}
+	for _, span := range sr.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			spanNames[span.Name()] = true
+		}
+	}
+
+	for _, name := range []string{
+		"authenticate",
+		"authorize",
+		"resolveSnapshot",
+		"getSecrets",
+		"csi.GetMetadataAllocated",
+		"snapshotmetadata.SnapshotMetadata/GetMetadataAllocated",
+	} {
+		assert.True(t, spanNames[name], "span %s", name)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing provides OpenTelemetry tracing of snapshot metadata
+// enumeration. Spans are created with the global TracerProvider, and so are
+// not recorded unless the application installs one, for example with Setup.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation scope of the spans.
+const TracerName = "github.com/kubernetes-csi/external-snapshot-metadata"
+
+// Config configures the export of traces.
+type Config struct {
+	// EndpointURL is the URL of the OTLP gRPC collector, such as
+	// "http://otel-collector:4317". TLS is used if the scheme is "https".
+	// Tracing is disabled if not set.
+	EndpointURL string
+
+	// SamplingRatio is the fraction of the traces started by the process
+	// that are sampled. Spans with a remote parent follow the sampling
+	// decision of the parent.
+	SamplingRatio float64
+}
+
+// Enabled returns true if traces are exported.
+func (c Config) Enabled() bool {
+	return c.EndpointURL != ""
+}
+
+// Validate checks the configuration.
+func (c Config) Validate() error {
+	if c.SamplingRatio < 0 || c.SamplingRatio > 1 {
+		return errors.New("the sampling ratio must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Setup installs a global TracerProvider that exports spans to the OTLP
+// collector, and the W3C trace context propagator. It must be called before
+// gRPC connections are established so that their stats handlers propagate
+// the trace context. The returned function flushes the spans and stops the export.
+func Setup(ctx context.Context, config Config, serviceName, serviceVersion string) (func(context.Context) error, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(config.EndpointURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the OTLP trace exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SamplingRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(serviceVersion),
+		)),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}
+
+// StartSpan starts a span with the global TracerProvider.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.GetTracerProvider().Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records the error, if any, and ends the span.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
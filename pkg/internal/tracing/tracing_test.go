@@ -0,0 +1,92 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestConfig(t *testing.T) {
+	assert.False(t, Config{}.Enabled())
+	assert.True(t, Config{EndpointURL: "http://localhost:4317"}.Enabled())
+
+	assert.NoError(t, Config{SamplingRatio: 0}.Validate())
+	assert.NoError(t, Config{SamplingRatio: 1}.Validate())
+	assert.Error(t, Config{SamplingRatio: -0.1}.Validate())
+	assert.Error(t, Config{SamplingRatio: 1.1}.Validate())
+}
+
+func TestSetup(t *testing.T) {
+	tp, prop := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(prop)
+	}()
+
+	shutdown, err := Setup(context.Background(), Config{EndpointURL: "http://localhost:4317", SamplingRatio: 2}, "test", "v0")
+	assert.Error(t, err)
+	assert.Nil(t, shutdown)
+
+	shutdown, err = Setup(context.Background(), Config{EndpointURL: "http://localhost:4317", SamplingRatio: 1}, "test", "v0")
+	assert.NoError(t, err)
+	assert.NotNil(t, shutdown)
+
+	_, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	assert.True(t, ok)
+	assert.Contains(t, otel.GetTextMapPropagator().Fields(), "traceparent")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, shutdown(ctx))
+}
+
+func TestSpans(t *testing.T) {
+	tp := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(tp)
+
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	ctx, parent := StartSpan(context.Background(), "parent", attribute.String("key", "value"))
+	_, child := StartSpan(ctx, "child")
+	EndSpan(child, errors.New("child-error"))
+	EndSpan(parent, nil)
+
+	spans := sr.Ended()
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "child", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "child-error", spans[0].Status().Description)
+	assert.Len(t, spans[0].Events(), 1)
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+
+	assert.Equal(t, "parent", spans[1].Name())
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+	assert.Equal(t, []attribute.KeyValue{attribute.String("key", "value")}, spans[1].Attributes())
+	assert.Equal(t, TracerName, spans[1].InstrumentationScope().Name)
+}
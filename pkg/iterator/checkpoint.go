@@ -0,0 +1,177 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var ErrCheckpointMismatch = errors.New("checkpoint does not match the enumeration")
+
+// Checkpoint records the progress of an enumeration.
+type Checkpoint struct {
+	Namespace        string    `json:"namespace"`
+	SnapshotName     string    `json:"snapshot_name"`
+	SnapshotUID      types.UID `json:"snapshot_uid"`
+	PrevSnapshotID   string    `json:"prev_snapshot_id,omitempty"`
+	PrevSnapshotName string    `json:"prev_snapshot_name,omitempty"`
+	PrevSnapshotUID  types.UID `json:"prev_snapshot_uid,omitempty"`
+
+	// RecordNumber is the number of the last record emitted.
+	RecordNumber int `json:"record_number"`
+
+	// NextOffset is the byte offset following the last tuple emitted.
+	NextOffset int64 `json:"next_offset"`
+}
+
+// Checkpointer persists the progress of an enumeration so that it can
+// be resumed by a different process.
+type Checkpointer interface {
+	// LoadCheckpoint returns the saved checkpoint, or nil if there is none.
+	LoadCheckpoint() (*Checkpoint, error)
+
+	// SaveCheckpoint is invoked after each record is emitted.
+	SaveCheckpoint(cp Checkpoint) error
+
+	// DeleteCheckpoint is invoked when the enumeration completes.
+	DeleteCheckpoint() error
+}
+
+// FileCheckpointer saves the checkpoint as JSON in a file.
+type FileCheckpointer struct {
+	// Path is the name of the checkpoint file.
+	Path string
+}
+
+func (fc *FileCheckpointer) LoadCheckpoint() (*Checkpoint, error) {
+	data, err := os.ReadFile(fc.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint(%q): %w", fc.Path, err)
+	}
+
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint(%q): %w", fc.Path, err)
+	}
+
+	return cp, nil
+}
+
+// SaveCheckpoint writes the checkpoint to a temporary file in the same
+// directory and then renames it, so that a crash does not leave a
+// partially written checkpoint behind.
+func (fc *FileCheckpointer) SaveCheckpoint(cp Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fc.Path), filepath.Base(fc.Path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint(%q): %w", fc.Path, err)
+	}
+
+	defer os.Remove(f.Name()) // no-op after the rename
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), fc.Path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint(%q): %w", fc.Path, err)
+	}
+
+	return nil
+}
+
+func (fc *FileCheckpointer) DeleteCheckpoint() error {
+	if err := os.Remove(fc.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete checkpoint(%q): %w", fc.Path, err)
+	}
+
+	return nil
+}
+
+// restoreCheckpoint establishes the identity of the enumeration and, if
+// a checkpoint was saved by an earlier enumeration of the same snapshots,
+// restores the record number and byte offset from it.
+func (iter *iterator) restoreCheckpoint(ctx context.Context) error {
+	vs, err := iter.h.getVolumeSnapshot(ctx, iter.Namespace, iter.SnapshotName)
+	if err != nil {
+		return err
+	}
+
+	iter.checkpoint = &Checkpoint{
+		Namespace:        iter.Namespace,
+		SnapshotName:     iter.SnapshotName,
+		SnapshotUID:      vs.UID,
+		PrevSnapshotID:   iter.PrevSnapshotID,
+		PrevSnapshotName: iter.PrevSnapshotName,
+		PrevSnapshotUID:  iter.prevSnapshotUID,
+		RecordNumber:     iter.recordNum,
+		NextOffset:       iter.nextOffset,
+	}
+
+	cp, err := iter.Checkpointer.LoadCheckpoint()
+	if err != nil || cp == nil {
+		return err
+	}
+
+	switch {
+	case cp.Namespace != iter.checkpoint.Namespace || cp.SnapshotName != iter.checkpoint.SnapshotName:
+		return fmt.Errorf("%w: checkpoint is for VolumeSnapshot %s/%s", ErrCheckpointMismatch, cp.Namespace, cp.SnapshotName)
+	case cp.SnapshotUID != iter.checkpoint.SnapshotUID:
+		return fmt.Errorf("%w: VolumeSnapshot %s/%s UID changed", ErrCheckpointMismatch, cp.Namespace, cp.SnapshotName)
+	case cp.PrevSnapshotID != iter.checkpoint.PrevSnapshotID:
+		return fmt.Errorf("%w: checkpoint is for base snapshot %q", ErrCheckpointMismatch, cp.PrevSnapshotID)
+	case cp.PrevSnapshotUID != iter.checkpoint.PrevSnapshotUID:
+		return fmt.Errorf("%w: base VolumeSnapshot %s/%s UID changed", ErrCheckpointMismatch, cp.Namespace, cp.PrevSnapshotName)
+	}
+
+	iter.recordNum = cp.RecordNumber
+	iter.nextOffset = cp.NextOffset
+	iter.resumed = true
+
+	return nil
+}
+
+func (iter *iterator) saveCheckpoint() error {
+	iter.checkpoint.RecordNumber = iter.recordNum
+	iter.checkpoint.NextOffset = iter.nextOffset
+
+	return iter.Checkpointer.SaveCheckpoint(*iter.checkpoint)
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+type fakeCheckpointer struct {
+	retLoad      *Checkpoint
+	retLoadErr   error
+	retSaveErr   error
+	saved        []Checkpoint
+	calledDelete bool
+	retDeleteErr error
+}
+
+func (fc *fakeCheckpointer) LoadCheckpoint() (*Checkpoint, error) {
+	return fc.retLoad, fc.retLoadErr
+}
+
+func (fc *fakeCheckpointer) SaveCheckpoint(cp Checkpoint) error {
+	fc.saved = append(fc.saved, cp)
+	return fc.retSaveErr
+}
+
+func (fc *fakeCheckpointer) DeleteCheckpoint() error {
+	fc.calledDelete = true
+	return fc.retDeleteErr
+}
+
+func TestFileCheckpointer(t *testing.T) {
+	fc := &FileCheckpointer{Path: filepath.Join(t.TempDir(), "checkpoint.json")}
+
+	cp, err := fc.LoadCheckpoint()
+	assert.NoError(t, err)
+	assert.Nil(t, cp)
+
+	expCP := Checkpoint{
+		Namespace:       "namespace",
+		SnapshotName:    "snapshot",
+		SnapshotUID:     "uid-1",
+		PrevSnapshotID:  "handle",
+		PrevSnapshotUID: "uid-2",
+		RecordNumber:    10,
+		NextOffset:      4096,
+	}
+	assert.NoError(t, fc.SaveCheckpoint(expCP))
+
+	expCP.RecordNumber = 11
+	assert.NoError(t, fc.SaveCheckpoint(expCP))
+
+	cp, err = fc.LoadCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, &expCP, cp)
+
+	entries, err := os.ReadDir(filepath.Dir(fc.Path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1) // no temporary files left behind
+
+	assert.NoError(t, fc.DeleteCheckpoint())
+	assert.NoError(t, fc.DeleteCheckpoint()) // idempotent
+
+	cp, err = fc.LoadCheckpoint()
+	assert.NoError(t, err)
+	assert.Nil(t, cp)
+
+	t.Run("decode-error", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(fc.Path, []byte("{"), 0600))
+		cp, err := fc.LoadCheckpoint()
+		assert.ErrorContains(t, err, "failed to decode checkpoint")
+		assert.Nil(t, cp)
+	})
+
+	t.Run("write-error", func(t *testing.T) {
+		fc := &FileCheckpointer{Path: filepath.Join(t.TempDir(), "missing", "checkpoint.json")}
+		assert.ErrorContains(t, fc.SaveCheckpoint(expCP), "failed to create checkpoint")
+	})
+}
+
+func TestRestoreCheckpoint(t *testing.T) {
+	errTest := errors.New("test-error")
+
+	newCheckpointIterator := func(th *testHarness, fc *fakeCheckpointer) *iterator {
+		vs, _ := th.FakeVS()
+		vs.UID = "snapshot-uid"
+		th.RetGetVolumeSnapshot = vs
+
+		iter := th.NewTestIterator()
+		iter.Checkpointer = fc
+		iter.PrevSnapshotID = th.PrevSnapshotHandle
+		iter.prevSnapshotUID = "prev-snapshot-uid"
+		return iter
+	}
+
+	validCheckpoint := func(th *testHarness) *Checkpoint {
+		return &Checkpoint{
+			Namespace:        th.Namespace,
+			SnapshotName:     th.SnapshotName,
+			SnapshotUID:      "snapshot-uid",
+			PrevSnapshotID:   th.PrevSnapshotHandle,
+			PrevSnapshotName: th.PrevSnapshotName,
+			PrevSnapshotUID:  "prev-snapshot-uid",
+			RecordNumber:     5,
+			NextOffset:       8192,
+		}
+	}
+
+	t.Run("get-vs-error", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newCheckpointIterator(th, &fakeCheckpointer{})
+		th.RetGetVolumeSnapshotErr = errTest
+
+		assert.ErrorIs(t, iter.restoreCheckpoint(context.Background()), errTest)
+		assert.Equal(t, th.SnapshotName, th.InGetVolumeSnapshotName)
+	})
+
+	t.Run("load-error", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newCheckpointIterator(th, &fakeCheckpointer{retLoadErr: errTest})
+
+		assert.ErrorIs(t, iter.restoreCheckpoint(context.Background()), errTest)
+	})
+
+	t.Run("no-checkpoint", func(t *testing.T) {
+		th := newTestHarness()
+		th.StartingOffset = 1024
+		iter := newCheckpointIterator(th, &fakeCheckpointer{})
+
+		assert.NoError(t, iter.restoreCheckpoint(context.Background()))
+		assert.False(t, iter.resumed)
+		assert.Equal(t, int64(1024), iter.nextOffset)
+		assert.Equal(t, "snapshot-uid", string(iter.checkpoint.SnapshotUID))
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newCheckpointIterator(th, &fakeCheckpointer{retLoad: validCheckpoint(th)})
+
+		assert.NoError(t, iter.restoreCheckpoint(context.Background()))
+		assert.True(t, iter.resumed)
+		assert.Equal(t, 5, iter.recordNum)
+		assert.Equal(t, int64(8192), iter.nextOffset)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		modify func(cp *Checkpoint)
+	}{
+		{"snapshot-name", func(cp *Checkpoint) { cp.SnapshotName = "other" }},
+		{"namespace", func(cp *Checkpoint) { cp.Namespace = "other" }},
+		{"snapshot-uid", func(cp *Checkpoint) { cp.SnapshotUID = "other" }},
+		{"prev-snapshot-id", func(cp *Checkpoint) { cp.PrevSnapshotID = "other" }},
+		{"prev-snapshot-uid", func(cp *Checkpoint) { cp.PrevSnapshotUID = "other" }},
+	} {
+		t.Run("mismatch-"+tc.name, func(t *testing.T) {
+			th := newTestHarness()
+			cp := validCheckpoint(th)
+			tc.modify(cp)
+			iter := newCheckpointIterator(th, &fakeCheckpointer{retLoad: cp})
+
+			err := iter.restoreCheckpoint(context.Background())
+			assert.ErrorIs(t, err, ErrCheckpointMismatch)
+			assert.False(t, iter.resumed)
+		})
+	}
+}
+
+func TestCheckpointSavedAfterEachRecord(t *testing.T) {
+	th := newTestHarness()
+	fc := &fakeCheckpointer{}
+	iter := th.NewTestIterator()
+	iter.Checkpointer = fc
+	iter.checkpoint = &Checkpoint{Namespace: th.Namespace, SnapshotName: th.SnapshotName}
+
+	err := iter.emitRecord(IteratorMetadata{
+		BlockMetadataType: api.BlockMetadataType_FIXED_LENGTH,
+		BlockMetadata:     []*api.BlockMetadata{{ByteOffset: 0, SizeBytes: 4096}},
+	})
+	assert.NoError(t, err)
+
+	err = iter.emitRecord(IteratorMetadata{
+		BlockMetadataType: api.BlockMetadataType_FIXED_LENGTH,
+		BlockMetadata:     []*api.BlockMetadata{{ByteOffset: 8192, SizeBytes: 4096}},
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, fc.saved, 2)
+	assert.Equal(t, 1, fc.saved[0].RecordNumber)
+	assert.Equal(t, int64(4096), fc.saved[0].NextOffset)
+	assert.Equal(t, 2, fc.saved[1].RecordNumber)
+	assert.Equal(t, int64(12288), fc.saved[1].NextOffset)
+
+	t.Run("save-error", func(t *testing.T) {
+		fc.retSaveErr = errors.New("test-error")
+		err := iter.emitRecord(IteratorMetadata{
+			BlockMetadata: []*api.BlockMetadata{{ByteOffset: 16384, SizeBytes: 4096}},
+		})
+		assert.ErrorIs(t, err, fc.retSaveErr)
+	})
+}
+
+func TestRunWithCheckpointer(t *testing.T) {
+	newRunHarness := func(t *testing.T) *testHarness {
+		th := newTestHarness()
+		th.RetGetSnapshotMetadataServiceCRService = th.FakeCR()
+		th.RetGetGRPCClient = th.GRPCSnapshotMetadataClient(t)
+		th.RetCreateSecurityToken = "security-token"
+		vs, _ := th.FakeVS()
+		th.RetGetVolumeSnapshot = vs
+		return th
+	}
+
+	t.Run("deleted-on-completion", func(t *testing.T) {
+		th := newRunHarness(t)
+		fc := &fakeCheckpointer{}
+		iter := th.NewTestIterator()
+		iter.CSIDriver = th.CSIDriver
+		iter.Checkpointer = fc
+
+		assert.NoError(t, iter.run(context.Background()))
+		assert.True(t, fc.calledDelete)
+		assert.Empty(t, iter.checkpoint.PrevSnapshotID)
+		assert.Equal(t, th.PrevSnapshotName, iter.checkpoint.PrevSnapshotName)
+		assert.Equal(t, th.RetGetVolumeSnapshot.UID, iter.checkpoint.PrevSnapshotUID)
+	})
+
+	t.Run("restore-error", func(t *testing.T) {
+		th := newRunHarness(t)
+		fc := &fakeCheckpointer{retLoadErr: errors.New("test-error")}
+		iter := th.NewTestIterator()
+		iter.CSIDriver = th.CSIDriver
+		iter.Checkpointer = fc
+
+		assert.ErrorIs(t, iter.run(context.Background()), fc.retLoadErr)
+		assert.Nil(t, th.InGetChangedBlocksClient)
+		assert.False(t, fc.calledDelete)
+	})
+}
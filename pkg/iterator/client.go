@@ -0,0 +1,378 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	smsCRv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+const (
+	DefaultCRRefreshInterval = time.Minute
+
+	// A cached security token is refreshed when less than this fraction
+	// of its lifetime remains.
+	tokenRefreshFraction = 0.2
+)
+
+var ErrClientClosed = errors.New("client is closed")
+
+// ClientConfig contains the arguments to the NewClient function.
+type ClientConfig struct {
+	// Client interfaces are obtained from BuildClients.
+	Clients
+
+	// CRRefreshInterval is the time after which a cached
+	// SnapshotMetadataService CR is fetched again. The CR is also fetched
+	// again after an enumeration fails with an error that it may be out of
+	// date, such as an unavailable service or a rejected certificate or
+	// security token.
+	// If unspecified then the value of DefaultCRRefreshInterval is used.
+	CRRefreshInterval time.Duration
+}
+
+// Client enumerates snapshot metadata like GetSnapshotMetadata, but
+// caches the SnapshotMetadataService CR of each CSI driver, the gRPC
+// connection to each service address, and the security tokens across
+// enumerations.
+// A Client is safe for concurrent use. Close must be called to release
+// the gRPC connections when the Client is no longer needed.
+type Client struct {
+	config ClientConfig
+
+	mux       sync.Mutex
+	closed    bool
+	defaultSA *cachedServiceAccount
+	crs       map[string]*cachedCR
+	conns     map[string]*cachedConn
+	tokens    map[tokenKey]*cachedToken
+}
+
+type cachedServiceAccount struct {
+	namespace string
+	name      string
+}
+
+type cachedCR struct {
+	cr        *smsCRv1alpha1.SnapshotMetadataService
+	fetchedAt time.Time
+}
+
+type cachedConn struct {
+	conn   *grpc.ClientConn
+	caCert []byte
+	refs   int
+	stale  bool
+}
+
+type tokenKey struct {
+	saNamespace string
+	saName      string
+	audience    string
+	expirySecs  int64
+}
+
+type cachedToken struct {
+	token     string
+	refreshAt time.Time
+}
+
+// NewClient returns a Client.
+func NewClient(config ClientConfig) (*Client, error) {
+	if err := config.Clients.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.CRRefreshInterval <= 0 {
+		config.CRRefreshInterval = DefaultCRRefreshInterval
+	}
+
+	return &Client{
+		config: config,
+		crs:    map[string]*cachedCR{},
+		conns:  map[string]*cachedConn{},
+		tokens: map[tokenKey]*cachedToken{},
+	}, nil
+}
+
+// GetSnapshotMetadata behaves like the package function of the same name.
+// The Clients field of the arguments is ignored.
+func (c *Client) GetSnapshotMetadata(ctx context.Context, args Args) error {
+	args.Clients = c.config.Clients
+	if err := args.Validate(); err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	closed := c.closed
+	c.mux.Unlock()
+
+	if closed {
+		return ErrClientClosed
+	}
+
+	iter := newIterator(args)
+	h := &clientHelpers{
+		iteratorHelpers: iter,
+		iter:            iter,
+		client:          c,
+		mintedTokens:    map[tokenKey]bool{},
+	}
+	iter.h = h
+
+	defer h.releaseConns()
+
+	err := iter.run(ctx)
+	if isStaleCRError(err) && h.csiDriver != "" {
+		c.invalidateCR(h.csiDriver)
+	}
+
+	return err
+}
+
+// Close releases the gRPC connections. Connections in use by
+// in-progress enumerations are closed when the enumerations complete.
+func (c *Client) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var errs []error
+
+	c.closed = true
+	for url, cc := range c.conns {
+		delete(c.conns, url)
+		cc.stale = true
+		errs = append(errs, c.closeConnIfUnused(cc))
+	}
+
+	return errors.Join(errs...)
+}
+
+// isStaleCRError returns true if the error may be caused by a cached
+// SnapshotMetadataService CR that is out of date: the service may have
+// moved, or its CA certificate or audience may have changed.
+func isStaleCRError(err error) bool {
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certificateErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+		verificationErr     *tls.CertificateVerificationError
+	)
+
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &certificateErr),
+		errors.As(err, &hostnameErr), errors.As(err, &verificationErr):
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Unauthenticated:
+		return true
+	}
+
+	return false
+}
+
+func (c *Client) invalidateCR(csiDriver string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.crs, csiDriver)
+}
+
+// closeConnIfUnused closes a stale connection once it is no longer in use.
+// It must be called with the mutex held.
+func (c *Client) closeConnIfUnused(cc *cachedConn) error {
+	if cc.stale && cc.refs == 0 {
+		return cc.conn.Close()
+	}
+
+	return nil
+}
+
+// clientHelpers overrides the iterator helpers that can use the
+// Client's cache.
+type clientHelpers struct {
+	iteratorHelpers
+
+	iter         *iterator
+	client       *Client
+	csiDriver    string
+	conns        []*cachedConn
+	mintedTokens map[tokenKey]bool // protected by the Client mutex
+}
+
+func (h *clientHelpers) getDefaultServiceAccount(ctx context.Context) (string, string, error) {
+	c := h.client
+
+	c.mux.Lock()
+	sa := c.defaultSA
+	c.mux.Unlock()
+
+	if sa != nil {
+		return sa.namespace, sa.name, nil
+	}
+
+	namespace, name, err := h.iteratorHelpers.getDefaultServiceAccount(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	c.mux.Lock()
+	c.defaultSA = &cachedServiceAccount{namespace: namespace, name: name}
+	c.mux.Unlock()
+
+	return namespace, name, nil
+}
+
+func (h *clientHelpers) getSnapshotMetadataServiceCR(ctx context.Context, csiDriver string) (*smsCRv1alpha1.SnapshotMetadataService, error) {
+	c := h.client
+	h.csiDriver = csiDriver
+
+	c.mux.Lock()
+	entry := c.crs[csiDriver]
+	c.mux.Unlock()
+
+	if entry != nil && time.Since(entry.fetchedAt) < c.config.CRRefreshInterval {
+		return entry.cr, nil
+	}
+
+	cr, err := h.iteratorHelpers.getSnapshotMetadataServiceCR(ctx, csiDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mux.Lock()
+	c.crs[csiDriver] = &cachedCR{cr: cr, fetchedAt: time.Now()}
+	c.mux.Unlock()
+
+	return cr, nil
+}
+
+// createSecurityToken returns a cached token if it is not close to expiry.
+// Tokens provided by a TokenSource are not cached.
+// A new token is always created if the iterator has already been given
+// one for the same audience, as it is then re-minting a rejected token.
+func (h *clientHelpers) createSecurityToken(ctx context.Context, saNamespace, saName, audience string) (string, error) {
+	if h.iter.TokenSource != nil {
+		return h.iteratorHelpers.createSecurityToken(ctx, saNamespace, saName, audience)
+	}
+
+	c := h.client
+	key := tokenKey{
+		saNamespace: saNamespace,
+		saName:      saName,
+		audience:    audience,
+		expirySecs:  h.iter.TokenExpirySecs,
+	}
+
+	c.mux.Lock()
+	entry := c.tokens[key]
+	reMint := h.mintedTokens[key]
+	h.mintedTokens[key] = true
+	c.mux.Unlock()
+
+	if entry != nil && !reMint && time.Now().Before(entry.refreshAt) {
+		return entry.token, nil
+	}
+
+	tokenResp, err := h.iter.createTokenRequest(ctx, saNamespace, saName, audience)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	lifetime := time.Duration(h.iter.TokenExpirySecs) * time.Second
+	if expiry := tokenResp.Status.ExpirationTimestamp.Time; expiry.After(now) {
+		lifetime = expiry.Sub(now)
+	}
+
+	c.mux.Lock()
+	c.tokens[key] = &cachedToken{
+		token:     tokenResp.Status.Token,
+		refreshAt: now.Add(lifetime - time.Duration(float64(lifetime)*tokenRefreshFraction)),
+	}
+	c.mux.Unlock()
+
+	return tokenResp.Status.Token, nil
+}
+
+// getGRPCClient returns a client using the cached connection to the address.
+// The connection is replaced if the CA certificate has changed.
+func (h *clientHelpers) getGRPCClient(caCert []byte, url string) (api.SnapshotMetadataClient, error) {
+	c := h.client
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+
+	cc := c.conns[url]
+	if cc != nil && !bytes.Equal(cc.caCert, caCert) {
+		delete(c.conns, url)
+		cc.stale = true
+		_ = c.closeConnIfUnused(cc)
+		cc = nil
+	}
+
+	if cc == nil {
+		conn, err := newGRPCConn(caCert, url)
+		if err != nil {
+			return nil, err
+		}
+
+		cc = &cachedConn{conn: conn, caCert: caCert}
+		c.conns[url] = cc
+	}
+
+	cc.refs++
+	h.conns = append(h.conns, cc)
+
+	return api.NewSnapshotMetadataClient(cc.conn), nil
+}
+
+// releaseConns releases the connections used by the enumeration, and
+// closes those that were replaced while in use.
+func (h *clientHelpers) releaseConns() {
+	c := h.client
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, cc := range h.conns {
+		cc.refs--
+		_ = c.closeConnIfUnused(cc)
+	}
+
+	h.conns = nil
+}
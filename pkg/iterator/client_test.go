@@ -0,0 +1,310 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+func newTestClient(t *testing.T, th *testHarness) *Client {
+	c, err := NewClient(ClientConfig{Clients: th.Clients()})
+	assert.NoError(t, err)
+	return c
+}
+
+// newTestClientHelpers returns the helpers of a single enumeration.
+func newTestClientHelpers(th *testHarness, c *Client) *clientHelpers {
+	iter := th.NewTestIterator()
+	iter.h = iter
+	return &clientHelpers{
+		iteratorHelpers: iter,
+		iter:            iter,
+		client:          c,
+		mintedTokens:    map[tokenKey]bool{},
+	}
+}
+
+func countActions(actions []clientgotesting.Action, verb, resource string) int {
+	n := 0
+	for _, action := range actions {
+		if action.GetVerb() == verb && action.GetResource().Resource == resource {
+			n++
+		}
+	}
+	return n
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient(ClientConfig{})
+	assert.ErrorIs(t, err, ErrInvalidArgs)
+
+	th := newTestHarness()
+	c := newTestClient(t, th)
+	assert.Equal(t, DefaultCRRefreshInterval, c.config.CRRefreshInterval)
+}
+
+func TestClientGetSnapshotMetadata(t *testing.T) {
+	t.Run("invalid-args", func(t *testing.T) {
+		th := newTestHarness()
+		c := newTestClient(t, th)
+
+		err := c.GetSnapshotMetadata(context.Background(), Args{})
+		assert.ErrorIs(t, err, ErrInvalidArgs)
+		assert.ErrorContains(t, err, "Emitter")
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		th := newTestHarness()
+		c := newTestClient(t, th)
+		assert.NoError(t, c.Close())
+
+		args := th.Args()
+		args.Clients = Clients{} // ignored
+		assert.ErrorIs(t, c.GetSnapshotMetadata(context.Background(), args), ErrClientClosed)
+	})
+
+	t.Run("uses-cache", func(t *testing.T) {
+		th := newTestHarness()
+		c := newTestClient(t, th)
+		c.defaultSA = &cachedServiceAccount{namespace: th.SANamespace, name: th.SAName}
+		c.crs[th.CSIDriver] = &cachedCR{cr: th.FakeCR(), fetchedAt: time.Now()}
+
+		args := th.Args()
+		args.SAName = ""
+		args.SANamespace = ""
+		args.CSIDriver = th.CSIDriver
+
+		// the invalid CA certificate in the cached CR is used
+		err := c.GetSnapshotMetadata(context.Background(), args)
+		assert.ErrorContains(t, err, "ServiceAccounts.CreateToken")
+		assert.Zero(t, countActions(th.FakeKubeClient.Actions(), "create", "selfsubjectreviews"))
+		assert.Zero(t, countActions(th.FakeSmsCRClient.Actions(), "get", "snapshotmetadataservices"))
+	})
+}
+
+func TestClientCachedDefaultServiceAccount(t *testing.T) {
+	th := newTestHarness()
+	c := newTestClient(t, th)
+
+	th.FakeKubeClient.PrependReactor("create", "selfsubjectreviews", func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+		return true, th.FakeAuthSelfSubjectReview(), nil
+	})
+
+	for i := 0; i < 2; i++ {
+		saNS, saName, err := newTestClientHelpers(th, c).getDefaultServiceAccount(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, th.SANamespace, saNS)
+		assert.Equal(t, th.SAName, saName)
+	}
+
+	assert.Equal(t, 1, countActions(th.FakeKubeClient.Actions(), "create", "selfsubjectreviews"))
+
+	t.Run("error", func(t *testing.T) {
+		th := newTestHarness()
+		c := newTestClient(t, th)
+
+		_, _, err := newTestClientHelpers(th, c).getDefaultServiceAccount(context.Background())
+		assert.ErrorContains(t, err, "SelfSubjectReviews.Create")
+		assert.Nil(t, c.defaultSA)
+	})
+}
+
+func TestClientCachedCR(t *testing.T) {
+	th := newTestHarness()
+	c := newTestClient(t, th)
+
+	_, err := newTestClientHelpers(th, c).getSnapshotMetadataServiceCR(context.Background(), th.CSIDriver)
+	assert.ErrorContains(t, err, "SnapshotMetadataServices.Get")
+	assert.Empty(t, c.crs)
+
+	_, err = th.FakeSmsCRClient.CbtV1alpha1().SnapshotMetadataServices().Create(context.Background(), th.FakeCR(), apimetav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		h := newTestClientHelpers(th, c)
+		cr, err := h.getSnapshotMetadataServiceCR(context.Background(), th.CSIDriver)
+		assert.NoError(t, err)
+		assert.Equal(t, th.Address, cr.Spec.Address)
+		assert.Equal(t, th.CSIDriver, h.csiDriver)
+	}
+
+	assert.Equal(t, 2, countActions(th.FakeSmsCRClient.Actions(), "get", "snapshotmetadataservices"))
+
+	// refreshed after the interval
+	c.crs[th.CSIDriver].fetchedAt = time.Now().Add(-DefaultCRRefreshInterval)
+	cr := th.FakeCR()
+	cr.Spec.Address = "new-address"
+	_, err = th.FakeSmsCRClient.CbtV1alpha1().SnapshotMetadataServices().Update(context.Background(), cr, apimetav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	cr, err = newTestClientHelpers(th, c).getSnapshotMetadataServiceCR(context.Background(), th.CSIDriver)
+	assert.NoError(t, err)
+	assert.Equal(t, "new-address", cr.Spec.Address)
+	assert.Equal(t, 3, countActions(th.FakeSmsCRClient.Actions(), "get", "snapshotmetadataservices"))
+
+	// refreshed after invalidation
+	c.invalidateCR(th.CSIDriver)
+	_, err = newTestClientHelpers(th, c).getSnapshotMetadataServiceCR(context.Background(), th.CSIDriver)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, countActions(th.FakeSmsCRClient.Actions(), "get", "snapshotmetadataservices"))
+}
+
+func TestIsStaleCRError(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		err   error
+		stale bool
+	}{
+		{"nil", nil, false},
+		{"unavailable", classifyStatusError(status.Error(codes.Unavailable, "connection refused")), true},
+		{"unauthenticated", classifyStatusError(status.Error(codes.Unauthenticated, "invalid audience")), true},
+		{"unknown-authority", fmt.Errorf("handshake: %w", x509.UnknownAuthorityError{}), true},
+		{"certificate-verification", &tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}}, true},
+		{"permission-denied", classifyStatusError(status.Error(codes.PermissionDenied, "denied")), false},
+		{"invalid-args", fmt.Errorf("%w: invalid", ErrInvalidArgs), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.stale, isStaleCRError(tc.err))
+		})
+	}
+}
+
+func TestClientCachedToken(t *testing.T) {
+	th := newTestHarness()
+	c := newTestClient(t, th)
+
+	numTokens := 0
+	th.FakeKubeClient.PrependReactor("create", "serviceaccounts", func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+		numTokens++
+		tr := th.FakeTokenRequest()
+		tr.Status.Token = fmt.Sprintf("token-%d", numTokens)
+		tr.Status.ExpirationTimestamp = apimetav1.NewTime(time.Now().Add(time.Minute * 10))
+		return true, tr, nil
+	})
+
+	h1 := newTestClientHelpers(th, c)
+	token, err := h1.createSecurityToken(context.Background(), th.SANamespace, th.SAName, th.Audience)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// cached for another enumeration
+	h2 := newTestClientHelpers(th, c)
+	token, err = h2.createSecurityToken(context.Background(), th.SANamespace, th.SAName, th.Audience)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// re-minted within an enumeration
+	token, err = h2.createSecurityToken(context.Background(), th.SANamespace, th.SAName, th.Audience)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	// different audience
+	token, err = newTestClientHelpers(th, c).createSecurityToken(context.Background(), th.SANamespace, th.SAName, "other")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+
+	// refreshed when close to expiry
+	key := tokenKey{saNamespace: th.SANamespace, saName: th.SAName, audience: th.Audience, expirySecs: DefaultTokenExpirySeconds}
+	assert.WithinDuration(t, time.Now().Add(time.Minute*8), c.tokens[key].refreshAt, time.Second*5)
+	c.tokens[key].refreshAt = time.Now()
+	token, err = newTestClientHelpers(th, c).createSecurityToken(context.Background(), th.SANamespace, th.SAName, th.Audience)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-4", token)
+
+	t.Run("error", func(t *testing.T) {
+		th := newTestHarness()
+		c := newTestClient(t, th)
+
+		_, err := newTestClientHelpers(th, c).createSecurityToken(context.Background(), th.SANamespace, th.SAName, th.Audience)
+		assert.ErrorContains(t, err, "ServiceAccounts.CreateToken")
+		assert.Empty(t, c.tokens)
+	})
+}
+
+func TestClientCachedConn(t *testing.T) {
+	rth := runtime.NewTestHarness().WithTestTLSFiles(t)
+	defer rth.RemoveTestTLSFiles(t)
+
+	caCert, err := os.ReadFile(rth.RuntimeArgs().TLSCertFile)
+	assert.NoError(t, err)
+
+	th := newTestHarness()
+	c := newTestClient(t, th)
+
+	_, err = newTestClientHelpers(th, c).getGRPCClient([]byte{}, "address")
+	assert.ErrorIs(t, err, ErrCACert)
+	assert.Empty(t, c.conns)
+
+	h1 := newTestClientHelpers(th, c)
+	client1, err := h1.getGRPCClient(caCert, "address")
+	assert.NoError(t, err)
+	assert.NotNil(t, client1)
+
+	h2 := newTestClientHelpers(th, c)
+	_, err = h2.getGRPCClient(caCert, "address")
+	assert.NoError(t, err)
+
+	assert.Len(t, c.conns, 1)
+	cc := c.conns["address"]
+	assert.Equal(t, 2, cc.refs)
+
+	h1.releaseConns()
+	h2.releaseConns()
+	assert.Equal(t, 0, cc.refs)
+	assert.NotEqual(t, connectivity.Shutdown, cc.conn.GetState())
+
+	// a changed CA certificate replaces the connection, which is closed when released
+	h3 := newTestClientHelpers(th, c)
+	_, err = h3.getGRPCClient(caCert, "address")
+	assert.NoError(t, err)
+
+	newCACert := append([]byte("\n"), caCert...)
+	_, err = newTestClientHelpers(th, c).getGRPCClient(newCACert, "address")
+	assert.NoError(t, err)
+	assert.NotEqual(t, cc, c.conns["address"])
+	assert.True(t, cc.stale)
+	assert.NotEqual(t, connectivity.Shutdown, cc.conn.GetState())
+
+	h3.releaseConns()
+	assert.Equal(t, connectivity.Shutdown, cc.conn.GetState())
+
+	// close
+	newCC := c.conns["address"]
+	assert.NoError(t, c.Close())
+	assert.Empty(t, c.conns)
+	assert.True(t, newCC.stale)
+	assert.NotEqual(t, connectivity.Shutdown, newCC.conn.GetState()) // still referenced
+
+	_, err = newTestClientHelpers(th, c).getGRPCClient(caCert, "address")
+	assert.ErrorIs(t, err, ErrClientClosed)
+}
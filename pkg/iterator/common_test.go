@@ -105,6 +105,9 @@ type testHarness struct {
 	RetGetVolumeSnapshotContent    *snapshotv1.VolumeSnapshotContent
 	RetGetVolumeSnapshotContentErr error
 
+	CalledWaitForSnapshotsReady bool
+	RetWaitForSnapshotsReadyErr error
+
 	InCallContext context.Context
 }
 
@@ -331,3 +334,8 @@ func (th *testHarness) getVolumeSnapshotContent(ctx context.Context, vs *snapsho
 	th.InGetVolumeSnapshotContentVs = vs
 	return th.RetGetVolumeSnapshotContent, th.RetGetVolumeSnapshotContentErr
 }
+
+func (th *testHarness) waitForSnapshotsReady(ctx context.Context) error {
+	th.CalledWaitForSnapshotsReady = true
+	return th.RetWaitForSnapshotsReadyErr
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"errors"
+	"slices"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+// The following errors classify the failures reported by the
+// SnapshotMetadata service or the Kubernetes API server.
+// Use errors.Is to test for them; the underlying error is preserved,
+// so status.Code returns the gRPC code reported by the service.
+var (
+	// ErrSnapshotNotReady indicates that a VolumeSnapshot or its
+	// VolumeSnapshotContent is not yet ready to use.
+	ErrSnapshotNotReady = errors.New("snapshot not ready")
+
+	// ErrSnapshotFailed indicates that the status of a VolumeSnapshot or its
+	// VolumeSnapshotContent reports an error.
+	ErrSnapshotFailed = errors.New("snapshot failed")
+
+	// ErrPermissionDenied indicates that the security token or the
+	// invoker is not authorized to perform the operation.
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrUnauthenticated indicates that the security token or the
+	// invoker's credentials were rejected.
+	ErrUnauthenticated = errors.New("unauthenticated")
+
+	// ErrServiceNotFound indicates that there is no SnapshotMetadataService
+	// CR for the CSI driver.
+	ErrServiceNotFound = errors.New("snapshot metadata service not found")
+
+	// ErrServiceNotReady indicates that the SnapshotMetadata service is
+	// unavailable and that the status of the SnapshotMetadataService CR of the
+	// CSI driver reports that the service is not ready. The error also matches
+	// ErrDriverUnavailable.
+	ErrServiceNotReady = errors.New("snapshot metadata service not ready")
+
+	// ErrDriverUnavailable indicates that the SnapshotMetadata service or
+	// its CSI driver cannot currently serve the request.
+	ErrDriverUnavailable = errors.New("snapshot metadata service unavailable")
+)
+
+// Error wraps an error with the sentinel that classifies it.
+type Error struct {
+	// Kind is one of the sentinel errors of this package.
+	Kind error
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// GRPCStatus returns the status of the underlying error, allowing
+// status.Code and status.FromError to be used on the Error.
+func (e *Error) GRPCStatus() *status.Status {
+	return status.Convert(e.Err)
+}
+
+// IsRetryable returns true if the error is likely to be transient, in
+// which case the enumeration may succeed if invoked again later.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrSnapshotNotReady), errors.Is(err, ErrDriverUnavailable), errors.Is(err, ErrServiceNotReady):
+		return true
+	}
+
+	return slices.Contains(DefaultRetryableCodes, status.Code(err))
+}
+
+// classifyStatusError wraps an error returned by the SnapshotMetadata
+// service according to its gRPC status code.
+// Errors that cannot be classified are returned unchanged.
+func classifyStatusError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	var kind error
+
+	switch st.Code() {
+	case codes.Unauthenticated:
+		kind = ErrUnauthenticated
+	case codes.PermissionDenied:
+		kind = ErrPermissionDenied
+	case codes.Unavailable:
+		// The sidecar reports a snapshot that is not ready with this code too.
+		if hasErrorReason(st, api.ErrorReasonSnapshotNotReady) {
+			kind = ErrSnapshotNotReady
+		} else {
+			kind = ErrDriverUnavailable
+		}
+	case codes.InvalidArgument:
+		kind = ErrInvalidArgs
+	default:
+		return err
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+// hasErrorReason returns true if the status has an ErrorInfo detail of the
+// SnapshotMetadata service with the reason.
+func hasErrorReason(st *status.Status, reason string) bool {
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == api.ErrorDomain && info.Reason == reason {
+			return true
+		}
+	}
+
+	return false
+}
+
+// classifyAPIError wraps an error returned by the Kubernetes API server
+// according to its reason.
+// Errors that cannot be classified are returned unchanged.
+func classifyAPIError(err error) error {
+	switch {
+	case apierrors.IsForbidden(err):
+		return &Error{Kind: ErrPermissionDenied, Err: err}
+	case apierrors.IsUnauthorized(err):
+		return &Error{Kind: ErrUnauthenticated, Err: err}
+	}
+
+	return err
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	smsCRv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	fakeSmsCR "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned/fake"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/k8sclientmocks"
+)
+
+func TestClassifyStatusError(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		expKind error
+	}{
+		{status.Error(codes.Unauthenticated, "unauthenticated user"), ErrUnauthenticated},
+		{status.Error(codes.PermissionDenied, "user does not have permissions to perform the operation"), ErrPermissionDenied},
+		{snapshotNotReadyError(t, "the VolumeSnapshot is not yet ready, name: snap"), ErrSnapshotNotReady},
+		{snapshotNotReadyError(t, "the VolumeSnapshotContent is not yet ready, name: snapcontent"), ErrSnapshotNotReady},
+		{status.Error(codes.Unavailable, "the VolumeSnapshot is not yet ready, name: snap"), ErrDriverUnavailable}, // no ErrorInfo
+		{status.Error(codes.Unavailable, "the CSI driver is not yet ready"), ErrDriverUnavailable},
+		{status.Error(codes.InvalidArgument, "snapshotName cannot be empty"), ErrInvalidArgs},
+		{status.Error(codes.Internal, "failed to send response"), nil},
+		{errors.New("not-a-status"), nil},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			err := fmt.Errorf("wrapped: %w", classifyStatusError(tc.err))
+
+			if tc.expKind == nil {
+				assert.ErrorIs(t, err, tc.err)
+				var e *Error
+				assert.False(t, errors.As(err, &e))
+				return
+			}
+
+			assert.ErrorIs(t, err, tc.expKind)
+			assert.ErrorIs(t, err, tc.err)
+			assert.Equal(t, status.Code(tc.err), status.Code(err))
+			assert.ErrorContains(t, err, tc.expKind.Error())
+		})
+	}
+}
+
+// snapshotNotReadyError returns an error like that of the sidecar for a snapshot that is not ready.
+func snapshotNotReadyError(t *testing.T, msg string) error {
+	st, err := status.New(codes.Unavailable, msg).WithDetails(&errdetails.ErrorInfo{
+		Reason: api.ErrorReasonSnapshotNotReady,
+		Domain: api.ErrorDomain,
+	})
+	assert.NoError(t, err)
+
+	return st.Err()
+}
+
+func TestClassifyAPIError(t *testing.T) {
+	gr := schema.GroupResource{Resource: "serviceaccounts"}
+
+	err := classifyAPIError(apierrors.NewForbidden(gr, "sa", errors.New("no")))
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	assert.True(t, apierrors.IsForbidden(err))
+
+	err = classifyAPIError(apierrors.NewUnauthorized("no"))
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+
+	notFound := apierrors.NewNotFound(gr, "sa")
+	assert.Equal(t, notFound, classifyAPIError(notFound))
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.False(t, IsRetryable(nil))
+	assert.False(t, IsRetryable(errors.New("other")))
+	assert.False(t, IsRetryable(&Error{Kind: ErrPermissionDenied, Err: status.Error(codes.PermissionDenied, "")}))
+	assert.False(t, IsRetryable(fmt.Errorf("%w: invalid", ErrInvalidArgs)))
+	assert.True(t, IsRetryable(fmt.Errorf("%w: not ready", ErrSnapshotNotReady)))
+	assert.True(t, IsRetryable(&Error{Kind: ErrDriverUnavailable, Err: status.Error(codes.Unavailable, "")}))
+	assert.True(t, IsRetryable(&Error{Kind: ErrServiceNotReady, Err: errors.New("not serving")}))
+	assert.True(t, IsRetryable(status.Error(codes.ResourceExhausted, "")))
+}
+
+func TestTypedErrors(t *testing.T) {
+	t.Run("service-not-found", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+
+		_, err := iter.getSnapshotMetadataServiceCR(context.Background(), th.CSIDriver)
+		assert.ErrorIs(t, err, ErrServiceNotFound)
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("service-not-ready", func(t *testing.T) {
+		th := newTestHarness()
+		cr := th.FakeCR()
+		cr.Status.Conditions = []apimetav1.Condition{
+			{Type: smsCRv1alpha1.SnapshotMetadataServiceReady, Status: apimetav1.ConditionFalse, Reason: "NotServing", Message: "not serving"},
+		}
+		th.FakeSmsCRClient = fakeSmsCR.NewSimpleClientset(cr)
+		iter := th.NewTestIterator()
+
+		// The status of a single replica does not prevent the service from being called.
+		sms, err := iter.getSnapshotMetadataServiceCR(context.Background(), th.CSIDriver)
+		assert.NoError(t, err)
+		assert.Equal(t, cr.Spec, sms.Spec)
+
+		unavailable := classifyStatusError(status.Error(codes.Unavailable, "unavailable"))
+		err = withServiceNotReady(sms, unavailable)
+		assert.ErrorIs(t, err, ErrServiceNotReady)
+		assert.ErrorIs(t, err, ErrDriverUnavailable)
+		assert.ErrorContains(t, err, "NotServing: not serving")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.True(t, IsRetryable(err))
+
+		other := classifyStatusError(status.Error(codes.PermissionDenied, "denied"))
+		assert.Equal(t, other, withServiceNotReady(sms, other))
+
+		cr.Status.Conditions[0].Status = apimetav1.ConditionTrue
+		assert.Equal(t, unavailable, withServiceNotReady(cr, unavailable))
+	})
+
+	t.Run("stream-error", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		mockStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		mockStream.EXPECT().Recv().Return(nil, snapshotNotReadyError(t, "the VolumeSnapshot is not yet ready, name: snap"))
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).Return(mockStream, nil)
+
+		err := iter.getAllocatedBlocks(context.Background(), mockClient, th.SecurityToken)
+		assert.ErrorIs(t, err, ErrSnapshotNotReady)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.ErrorContains(t, err, "GetMetadataAllocated")
+	})
+}
@@ -24,15 +24,23 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	grpcCreds "google.golang.org/grpc/credentials"
 	authv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	smsCRv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
 var (
@@ -49,6 +57,10 @@ const (
 	// It turns out that a service account name starts with a well defined prefix
 	// that is guaranteed not to match any other user name.
 	K8sServiceAccountUserNamePrefix = "system:serviceaccount:"
+
+	// msgBaseSnapshotIDRequired is the message of the InvalidArgument error of
+	// sidecars that do not support base snapshot names.
+	msgBaseSnapshotIDRequired = "baseSnapshotId cannot be empty"
 )
 
 // GetSnapshotMetadata enumerates either the allocated blocks of a
@@ -104,8 +116,11 @@ type Args struct {
 	// identified by SnapshotName will be enumerated.
 	//
 	// If PrevSnapshotName is specified and PrevSnapshotID is not specified
-	// then the VolumeSnapshotContent object associated with the named
-	// VolumeSnapshot object will be used to obtain its CSI handle.
+	// then the name is passed to the sidecar, which obtains the CSI handle
+	// from the VolumeSnapshotContent object associated with the named
+	// VolumeSnapshot object. If the sidecar rejects the request, as one that
+	// does not support base snapshot names does, the CSI handle is obtained
+	// from the VolumeSnapshotContent object by the iterator instead.
 	PrevSnapshotName string
 
 	// StartingOffset is the initial byte offset.
@@ -125,13 +140,52 @@ type Args struct {
 	// Specify the ServiceAccount object used to construct a security token
 	// with the audience string from the SnapshotMetadataService CR.
 	// If either of the following fields are unspecified, the default for the given client will be used.
+	// The fields cannot be used together with a TokenSource.
 	SANamespace string
 	SAName      string
 
+	// TokenSource is optional, and if specified provides the security token
+	// instead of the TokenRequest API being invoked for the ServiceAccount.
+	TokenSource TokenSource
+
 	// TokenExpirySecs specifies the time in seconds after which the
 	// security token will expire.
 	// If unspecified then the value of DefaultTokenExpirySeconds is used.
 	TokenExpirySecs int64
+
+	// WaitForReady is optional, and if specified is the maximum time to
+	// wait for the VolumeSnapshot objects identified by SnapshotName and
+	// PrevSnapshotName, and their VolumeSnapshotContent objects, to be
+	// ready to use before the enumeration starts.
+	WaitForReady time.Duration
+
+	// ValidateMetadata causes the Emitter to be wrapped in a
+	// ValidatingEmitter, so that the enumeration fails if the CSI driver
+	// returns inconsistent metadata.
+	// The records are then passed to the Emitter in byte offset order even
+	// if it is a ConcurrentIteratorEmitter.
+	ValidateMetadata bool
+
+	// Retry is optional, and if specified will cause the metadata stream
+	// to be resumed after a transient failure.
+	Retry RetryPolicy
+
+	// Parallelism is optional, and if greater than 1 will cause the byte
+	// range from StartingOffset to the capacity of the volume to be split
+	// into this number of ranges that are enumerated concurrently.
+	// The records are passed to the Emitter in byte offset order, unless
+	// it is a ConcurrentIteratorEmitter. In byte offset order, a limited
+	// number of records of each range is buffered while the preceding
+	// ranges are emitted, after which the enumeration of the range waits.
+	// It cannot be used together with a Checkpointer.
+	Parallelism int
+
+	// Checkpointer is optional, and if specified will be used to save the
+	// progress of the enumeration after each record is emitted.
+	// If it holds a checkpoint of an earlier enumeration of the same
+	// snapshots then the enumeration resumes from where it left off.
+	// The checkpoint is deleted when the enumeration completes.
+	Checkpointer Checkpointer
 }
 
 func (a Args) Validate() error {
@@ -150,6 +204,18 @@ func (a Args) Validate() error {
 		return fmt.Errorf("%w: SAName provided but SANamespace missing", ErrInvalidArgs)
 	case a.SANamespace != "" && a.SAName == "":
 		return fmt.Errorf("%w: SANamespace provided but SAName missing", ErrInvalidArgs)
+	case a.TokenSource != nil && a.SAName != "":
+		return fmt.Errorf("%w: SAName cannot be used with a TokenSource", ErrInvalidArgs)
+	case a.WaitForReady < 0:
+		return fmt.Errorf("%w: invalid WaitForReady", ErrInvalidArgs)
+	case a.Parallelism < 0:
+		return fmt.Errorf("%w: invalid Parallelism", ErrInvalidArgs)
+	case a.Parallelism > 1 && a.Checkpointer != nil:
+		return fmt.Errorf("%w: Parallelism cannot be used with a Checkpointer", ErrInvalidArgs)
+	}
+
+	if err := a.Retry.Validate(); err != nil {
+		return err
 	}
 
 	if err := a.Clients.Validate(); err != nil {
@@ -182,6 +248,34 @@ type iterator struct {
 	Args
 	recordNum int
 
+	// nextOffset is the byte offset at which the stream should be opened.
+	// It starts at StartingOffset and then tracks the end of the last
+	// tuple emitted.
+	nextOffset int64
+
+	// resumed is set when the stream is reopened after a transient failure
+	// or restarted from a checkpoint.
+	resumed bool
+
+	// prevSnapshotUID is the UID of the VolumeSnapshot named by PrevSnapshotName.
+	prevSnapshotUID types.UID
+
+	// prevSnapshotHandle is the CSI handle of the VolumeSnapshot named by
+	// PrevSnapshotName, set if the sidecar does not accept the name.
+	prevSnapshotHandle string
+
+	// checkpoint identifies the enumeration when a Checkpointer is set.
+	checkpoint *Checkpoint
+
+	// rangeStart and rangeEnd bound the byte offsets of the tuples emitted
+	// when enumerating one range of a parallel enumeration.
+	// A zero value is unbounded.
+	rangeStart int64
+	rangeEnd   int64
+
+	// conn is the connection opened by getGRPCClient, closed when run returns.
+	conn *grpc.ClientConn
+
 	h iteratorHelpers
 }
 
@@ -195,6 +289,7 @@ type iteratorHelpers interface {
 	getChangedBlocks(ctx context.Context, grpcClient api.SnapshotMetadataClient, securityToken string) error
 	getVolumeSnapshot(ctx context.Context, namespace, name string) (*snapshotv1.VolumeSnapshot, error)
 	getVolumeSnapshotContent(ctx context.Context, vs *snapshotv1.VolumeSnapshot) (*snapshotv1.VolumeSnapshotContent, error)
+	waitForSnapshotsReady(ctx context.Context) error
 }
 
 func newIterator(args Args) *iterator {
@@ -206,6 +301,16 @@ func newIterator(args Args) *iterator {
 		iter.TokenExpirySecs = DefaultTokenExpirySeconds
 	}
 
+	if iter.Retry.MaxAttempts > 0 {
+		iter.Retry = iter.Retry.withDefaults()
+	}
+
+	iter.nextOffset = iter.StartingOffset
+
+	if iter.ValidateMetadata {
+		iter.Emitter = &ValidatingEmitter{Emitter: iter.Emitter}
+	}
+
 	return iter
 }
 
@@ -215,12 +320,23 @@ func newIterator(args Args) *iterator {
 // return ErrCancelled.
 // When the enumeration terminates normally the emitter's
 // SnapshotMetadataIteratorDone operation is invoked.
-func (iter *iterator) run(ctx context.Context) error {
-	var err error
+func (iter *iterator) run(ctx context.Context) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "GetSnapshotMetadata",
+		attribute.String("namespace", iter.Namespace),
+		attribute.String("snapshotName", iter.SnapshotName),
+		attribute.Bool("delta", iter.isDelta()))
+	defer func() { tracing.EndSpan(span, err) }()
+	defer iter.closeConn()
+
+	if iter.WaitForReady > 0 {
+		if err = iter.h.waitForSnapshotsReady(ctx); err != nil {
+			return err
+		}
+	}
 
 	saName := iter.SAName           // optional field
 	saNamespace := iter.SANamespace // optional field
-	if saName == "" {
+	if saName == "" && iter.TokenSource == nil {
 		saNamespace, saName, err = iter.h.getDefaultServiceAccount(ctx)
 		if err != nil {
 			return err
@@ -235,13 +351,22 @@ func (iter *iterator) run(ctx context.Context) error {
 	}
 
 	// load the driver's SnapshotMetadataService object
-	smsCR, err := iter.h.getSnapshotMetadataServiceCR(ctx, csiDriver)
+	spanCtx, crSpan := tracing.StartSpan(ctx, "getSnapshotMetadataServiceCR", attribute.String("csiDriver", csiDriver))
+	smsCR, err := iter.h.getSnapshotMetadataServiceCR(spanCtx, csiDriver)
+	tracing.EndSpan(crSpan, err)
 	if err != nil {
 		return err
 	}
 
+	createSecurityToken := func(ctx context.Context) (string, error) {
+		ctx, span := tracing.StartSpan(ctx, "createSecurityToken")
+		securityToken, err := iter.h.createSecurityToken(ctx, saNamespace, saName, smsCR.Spec.Audience)
+		tracing.EndSpan(span, err)
+		return securityToken, err
+	}
+
 	// get the security token to use in the API
-	securityToken, err := iter.h.createSecurityToken(ctx, saNamespace, saName, smsCR.Spec.Audience)
+	securityToken, err := createSecurityToken(ctx)
 	if err != nil {
 		return err
 	}
@@ -257,29 +382,57 @@ func (iter *iterator) run(ctx context.Context) error {
 	ctx, cancelFn := context.WithCancel(ctx)
 	defer cancelFn()
 
-	switch {
-	case iter.PrevSnapshotID == "" && iter.PrevSnapshotName == "":
-		err = iter.h.getAllocatedBlocks(ctx, apiClient, securityToken)
-	case iter.PrevSnapshotID == "" && iter.PrevSnapshotName != "":
-		if iter.PrevSnapshotID, err = iter.getPrevSnapshotID(ctx); err != nil {
-			break
+	mintTokenFn := func() (string, error) {
+		return createSecurityToken(ctx)
+	}
+
+	if iter.PrevSnapshotID == "" && iter.PrevSnapshotName != "" {
+		if iter.prevSnapshotUID, err = iter.getPrevSnapshotUID(ctx); err != nil {
+			return err
+		}
+	}
+
+	if iter.Checkpointer != nil {
+		if err = iter.restoreCheckpoint(ctx); err != nil {
+			return err
 		}
-		fallthrough
-	default:
-		err = iter.h.getChangedBlocks(ctx, apiClient, securityToken)
 	}
 
+	streamCtx, streamSpan := tracing.StartSpan(ctx, "stream")
+	if iter.Parallelism > 1 {
+		err = iter.streamParallel(streamCtx, apiClient, securityToken, mintTokenFn)
+	} else {
+		getBlocks := iter.h.getChangedBlocks
+		if !iter.isDelta() {
+			getBlocks = iter.h.getAllocatedBlocks
+		}
+
+		err = iter.streamWithRetry(streamCtx, securityToken, mintTokenFn, func(securityToken string) error {
+			return getBlocks(streamCtx, apiClient, securityToken)
+		})
+	}
+
+	tracing.EndSpan(streamSpan, err)
+
 	if err != nil {
+		return withServiceNotReady(smsCR, err)
+	}
+
+	if err = iter.Emitter.SnapshotMetadataIteratorDone(iter.recordNum); err != nil {
 		return err
 	}
 
-	return iter.Emitter.SnapshotMetadataIteratorDone(iter.recordNum)
+	if iter.Checkpointer != nil {
+		return iter.Checkpointer.DeleteCheckpoint()
+	}
+
+	return nil
 }
 
 func (iter *iterator) getDefaultServiceAccount(ctx context.Context) (namespace string, name string, err error) {
 	ssr, err := iter.KubeClient.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authv1.SelfSubjectReview{}, apimetav1.CreateOptions{})
 	if err != nil {
-		return "", "", fmt.Errorf("SelfSubjectReviews.Create(): %w", err)
+		return "", "", fmt.Errorf("SelfSubjectReviews.Create(): %w", classifyAPIError(err))
 	}
 	if strings.HasPrefix(ssr.Status.UserInfo.Username, K8sServiceAccountUserNamePrefix) {
 		fields := strings.Split(ssr.Status.UserInfo.Username, ":")
@@ -296,18 +449,18 @@ func (iter *iterator) getDefaultServiceAccount(ctx context.Context) (namespace s
 func (iter *iterator) getCSIDriverFromPrimarySnapshot(ctx context.Context) (string, error) {
 	vs, err := iter.SnapshotClient.SnapshotV1().VolumeSnapshots(iter.Namespace).Get(ctx, iter.SnapshotName, apimetav1.GetOptions{})
 	if err != nil {
-		return "", fmt.Errorf("VolumeSnapshots.Get(%s/%s): %w", iter.Namespace, iter.SnapshotName, err)
+		return "", fmt.Errorf("VolumeSnapshots.Get(%s/%s): %w", iter.Namespace, iter.SnapshotName, classifyAPIError(err))
 	}
 
 	if vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil {
-		return "", fmt.Errorf("VolumeSnapshot(%s/%s) has no bound VolumeSnapshotContent", vs.Namespace, vs.Name)
+		return "", fmt.Errorf("%w: VolumeSnapshot(%s/%s) has no bound VolumeSnapshotContent", ErrSnapshotNotReady, vs.Namespace, vs.Name)
 	}
 
 	vsc, err := iter.SnapshotClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, *vs.Status.BoundVolumeSnapshotContentName, apimetav1.GetOptions{})
 	if err != nil {
 		return "", fmt.Errorf("VolumeSnapshotContents.Get(%s) for VolumeSnapshot(%s/%s): %w",
 			*vs.Status.BoundVolumeSnapshotContentName,
-			vs.Namespace, vs.Name, err)
+			vs.Namespace, vs.Name, classifyAPIError(err))
 	}
 
 	return vsc.Spec.Driver, nil
@@ -315,33 +468,81 @@ func (iter *iterator) getCSIDriverFromPrimarySnapshot(ctx context.Context) (stri
 
 func (iter *iterator) getSnapshotMetadataServiceCR(ctx context.Context, csiDriver string) (*smsCRv1alpha1.SnapshotMetadataService, error) {
 	sms, err := iter.SmsCRClient.CbtV1alpha1().SnapshotMetadataServices().Get(ctx, csiDriver, apimetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		err = &Error{Kind: ErrServiceNotFound, Err: err}
+	}
+
 	if err != nil {
-		return nil, fmt.Errorf("SnapshotMetadataServices.Get(%s): %w", csiDriver, err)
+		return nil, fmt.Errorf("SnapshotMetadataServices.Get(%s): %w", csiDriver, classifyAPIError(err))
 	}
 
 	return sms, nil
 }
 
+// withServiceNotReady classifies an error of an unavailable service as
+// ErrServiceNotReady, with the reason reported by the status of the
+// SnapshotMetadataService CR, if the status reports that the service is not
+// ready. The status is only that of the replica of the sidecar that updates
+// it, so the service is called regardless of the status.
+func withServiceNotReady(sms *smsCRv1alpha1.SnapshotMetadataService, err error) error {
+	if !errors.Is(err, ErrDriverUnavailable) {
+		return err
+	}
+
+	cond := meta.FindStatusCondition(sms.Status.Conditions, smsCRv1alpha1.SnapshotMetadataServiceReady)
+	if cond == nil || cond.Status != apimetav1.ConditionFalse {
+		return err
+	}
+
+	return &Error{
+		Kind: ErrServiceNotReady,
+		Err:  fmt.Errorf("SnapshotMetadataService(%s) reports %s: %s: %w", sms.Name, cond.Reason, cond.Message, err),
+	}
+}
+
 // createSecurityToken will create a security token for the specified storage
 // account using the audience string from the SnapshotMetadataService CR.
+// The token is obtained from the TokenSource if one is specified.
 func (iter *iterator) createSecurityToken(ctx context.Context, saNamespace, sa, audience string) (string, error) {
-	tokenRequest := authv1.TokenRequest{
-		Spec: authv1.TokenRequestSpec{
-			Audiences:         []string{audience},
-			ExpirationSeconds: &iter.TokenExpirySecs,
-		},
+	if iter.TokenSource != nil {
+		return iter.TokenSource.SecurityToken(ctx, audience)
 	}
 
-	tokenResp, err := iter.KubeClient.CoreV1().ServiceAccounts(saNamespace).
-		CreateToken(ctx, sa, &tokenRequest, apimetav1.CreateOptions{})
+	tokenResp, err := iter.createTokenRequest(ctx, saNamespace, sa, audience)
 	if err != nil {
-		return "", fmt.Errorf("ServiceAccounts.CreateToken(%s/%s): %v", saNamespace, sa, err)
+		return "", err
 	}
 
 	return tokenResp.Status.Token, nil
 }
 
+func (iter *iterator) createTokenRequest(ctx context.Context, saNamespace, sa, audience string) (*authv1.TokenRequest, error) {
+	return createTokenRequest(ctx, iter.KubeClient, saNamespace, sa, audience, iter.TokenExpirySecs)
+}
+
+// getGRPCClient returns a client using a new connection to the address,
+// which is closed when the enumeration completes.
 func (iter *iterator) getGRPCClient(caCert []byte, url string) (api.SnapshotMetadataClient, error) {
+	conn, err := newGRPCConn(caCert, url)
+	if err != nil {
+		return nil, err
+	}
+
+	iter.closeConn()
+	iter.conn = conn
+
+	return api.NewSnapshotMetadataClient(conn), nil
+}
+
+// closeConn closes the connection opened by getGRPCClient, if any.
+func (iter *iterator) closeConn() {
+	if iter.conn != nil {
+		_ = iter.conn.Close()
+		iter.conn = nil
+	}
+}
+
+func newGRPCConn(caCert []byte, url string) (*grpc.ClientConn, error) {
 	// Add the CA to the cert pool
 	certPool := x509.NewCertPool()
 	if !certPool.AppendCertsFromPEM(caCert) {
@@ -349,12 +550,15 @@ func (iter *iterator) getGRPCClient(caCert []byte, url string) (api.SnapshotMeta
 	}
 
 	tlsCredentials := grpcCreds.NewTLS(&tls.Config{RootCAs: certPool})
-	conn, err := grpc.NewClient(url, grpc.WithTransportCredentials(tlsCredentials))
+	conn, err := grpc.NewClient(url,
+		grpc.WithTransportCredentials(tlsCredentials),
+		// propagates the trace context if the application has set up tracing
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
 	if err != nil {
 		return nil, fmt.Errorf("grpc.NewClient(%s): %w", url, err)
 	}
 
-	return api.NewSnapshotMetadataClient(conn), nil
+	return conn, nil
 }
 
 func (iter *iterator) getAllocatedBlocks(ctx context.Context, grpcClient api.SnapshotMetadataClient, securityToken string) error {
@@ -362,11 +566,11 @@ func (iter *iterator) getAllocatedBlocks(ctx context.Context, grpcClient api.Sna
 		SecurityToken:  securityToken,
 		Namespace:      iter.Namespace,
 		SnapshotName:   iter.SnapshotName,
-		StartingOffset: iter.StartingOffset,
+		StartingOffset: iter.nextOffset,
 		MaxResults:     iter.MaxResults,
 	})
 	if err != nil {
-		return fmt.Errorf("GetMetadataAllocated(%s,%s): %w", iter.Namespace, iter.SnapshotName, err)
+		return fmt.Errorf("GetMetadataAllocated(%s,%s): %w", iter.Namespace, iter.SnapshotName, classifyStatusError(err))
 	}
 
 	for {
@@ -376,12 +580,10 @@ func (iter *iterator) getAllocatedBlocks(ctx context.Context, grpcClient api.Sna
 		}
 
 		if err != nil {
-			return fmt.Errorf("GetMetadataAllocated(%s,%s).Recv: %w", iter.Namespace, iter.SnapshotName, err)
+			return fmt.Errorf("GetMetadataAllocated(%s,%s).Recv: %w", iter.Namespace, iter.SnapshotName, classifyStatusError(err))
 		}
 
-		iter.recordNum++
-
-		err = iter.Emitter.SnapshotMetadataIteratorRecord(iter.recordNum, IteratorMetadata{
+		err = iter.emitRecord(IteratorMetadata{
 			BlockMetadataType:   resp.BlockMetadataType,
 			VolumeCapacityBytes: resp.VolumeCapacityBytes,
 			BlockMetadata:       resp.BlockMetadata,
@@ -392,48 +594,182 @@ func (iter *iterator) getAllocatedBlocks(ctx context.Context, grpcClient api.Sna
 	}
 }
 
+// getChangedBlocks enumerates the changed blocks.
+// A base snapshot specified only by name is passed to the sidecar by name.
+// Sidecars that do not support base snapshot names ignore the name and reject
+// the request for its missing base snapshot handle, in which case the handle
+// is obtained from the VolumeSnapshotContent object and the request retried.
+// Other errors are returned unchanged.
 func (iter *iterator) getChangedBlocks(ctx context.Context, grpcClient api.SnapshotMetadataClient, securityToken string) error {
-	stream, err := grpcClient.GetMetadataDelta(ctx, &api.GetMetadataDeltaRequest{
+	byName := iter.PrevSnapshotID == "" && iter.prevSnapshotHandle == ""
+
+	received, err := iter.streamChangedBlocks(ctx, grpcClient, securityToken)
+	if !byName || received || !isBaseSnapshotIDRequired(err) {
+		return err
+	}
+
+	if iter.prevSnapshotHandle, err = iter.getPrevSnapshotID(ctx); err != nil {
+		return err
+	}
+
+	_, err = iter.streamChangedBlocks(ctx, grpcClient, securityToken)
+
+	return err
+}
+
+// isBaseSnapshotIDRequired returns true if the error is the rejection of a
+// request without a base snapshot handle by a sidecar that does not support
+// base snapshot names.
+func isBaseSnapshotIDRequired(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != ErrInvalidArgs {
+		return false
+	}
+
+	st := e.GRPCStatus()
+
+	return st.Code() == codes.InvalidArgument && st.Message() == msgBaseSnapshotIDRequired
+}
+
+// streamChangedBlocks opens a GetMetadataDelta stream and emits its records.
+// It returns true if a response was received before the stream ended.
+func (iter *iterator) streamChangedBlocks(ctx context.Context, grpcClient api.SnapshotMetadataClient, securityToken string) (bool, error) {
+	req := &api.GetMetadataDeltaRequest{
 		SecurityToken:      securityToken,
 		Namespace:          iter.Namespace,
 		BaseSnapshotId:     iter.PrevSnapshotID,
 		TargetSnapshotName: iter.SnapshotName,
-		StartingOffset:     iter.StartingOffset,
+		StartingOffset:     iter.nextOffset,
 		MaxResults:         iter.MaxResults,
-	})
+	}
+
+	base := iter.PrevSnapshotID
+	switch {
+	case base != "":
+	case iter.prevSnapshotHandle != "":
+		req.BaseSnapshotId = iter.prevSnapshotHandle
+		base = iter.prevSnapshotHandle
+	default:
+		req.BaseSnapshotName = iter.PrevSnapshotName
+		base = iter.PrevSnapshotName
+	}
+
+	stream, err := grpcClient.GetMetadataDelta(ctx, req)
 	if err != nil {
-		return fmt.Errorf("GetMetadataDelta(%s,%s,%s): %w", iter.Namespace, iter.PrevSnapshotID, iter.SnapshotName, err)
+		return false, fmt.Errorf("GetMetadataDelta(%s,%s,%s): %w", iter.Namespace, base, iter.SnapshotName, classifyStatusError(err))
 	}
 
-	for {
+	for received := false; ; received = true {
 		resp, err := stream.Recv()
 		if err == io.EOF {
-			return nil
+			return received, nil
 		}
 
 		if err != nil {
-			return fmt.Errorf("GetMetadataDelta(%s,%s,%s).Recv: %w", iter.Namespace, iter.PrevSnapshotID, iter.SnapshotName, err)
+			return received, fmt.Errorf("GetMetadataDelta(%s,%s,%s).Recv: %w", iter.Namespace, base, iter.SnapshotName, classifyStatusError(err))
 		}
 
-		iter.recordNum++
-
-		err = iter.Emitter.SnapshotMetadataIteratorRecord(iter.recordNum, IteratorMetadata{
+		err = iter.emitRecord(IteratorMetadata{
 			BlockMetadataType:   resp.BlockMetadataType,
 			VolumeCapacityBytes: resp.VolumeCapacityBytes,
 			BlockMetadata:       resp.BlockMetadata,
 		})
 		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// emitRecord passes a record received from the stream to the emitter.
+// On a resumed stream, tuples that end at or before nextOffset have
+// already been emitted and are removed, and a VARIABLE_LENGTH tuple that
+// straddles nextOffset is trimmed to start at it. A record left with no
+// tuples is not emitted.
+//
+// When enumerating a byte range, tuples outside of the range are removed
+// and errStopStream is returned once the end of the range is reached.
+func (iter *iterator) emitRecord(metadata IteratorMetadata) error {
+	if iter.resumed {
+		metadata.BlockMetadata = iter.removeEmittedTuples(metadata.BlockMetadataType, metadata.BlockMetadata)
+		if len(metadata.BlockMetadata) == 0 {
+			return nil
+		}
+	}
+
+	var rangeEnded bool
+	if iter.rangeStart > 0 || iter.rangeEnd > 0 {
+		metadata.BlockMetadata, rangeEnded = iter.removeOutOfRangeTuples(metadata.BlockMetadataType, metadata.BlockMetadata)
+		if len(metadata.BlockMetadata) == 0 {
+			return iter.rangeStatus(rangeEnded)
+		}
+	}
+
+	iter.recordNum++
+
+	if err := iter.Emitter.SnapshotMetadataIteratorRecord(iter.recordNum, metadata); err != nil {
+		return err
+	}
+
+	if n := len(metadata.BlockMetadata); n > 0 {
+		last := metadata.BlockMetadata[n-1]
+		iter.nextOffset = max(iter.nextOffset, last.ByteOffset+last.SizeBytes)
+	}
+
+	if iter.checkpoint != nil {
+		if err := iter.saveCheckpoint(); err != nil {
 			return err
 		}
 	}
+
+	return iter.rangeStatus(rangeEnded)
+}
+
+func (iter *iterator) removeEmittedTuples(bmt api.BlockMetadataType, bmds []*api.BlockMetadata) []*api.BlockMetadata {
+	var ret []*api.BlockMetadata
+
+	for _, bmd := range bmds {
+		switch end := bmd.ByteOffset + bmd.SizeBytes; {
+		case end <= iter.nextOffset:
+			continue
+		case bmd.ByteOffset < iter.nextOffset && bmt == api.BlockMetadataType_VARIABLE_LENGTH:
+			ret = append(ret, &api.BlockMetadata{
+				ByteOffset: iter.nextOffset,
+				SizeBytes:  end - iter.nextOffset,
+			})
+		default:
+			ret = append(ret, bmd)
+		}
+	}
+
+	return ret
+}
+
+// isDelta returns true if changed blocks are to be enumerated.
+func (iter *iterator) isDelta() bool {
+	return iter.PrevSnapshotID != "" || iter.PrevSnapshotName != ""
+}
+
+// getPrevSnapshotUID returns the UID of the VolumeSnapshot named by
+// PrevSnapshotName, after checking that it is ready to use.
+func (iter *iterator) getPrevSnapshotUID(ctx context.Context) (types.UID, error) {
+	vs, err := iter.h.getVolumeSnapshot(ctx, iter.Namespace, iter.PrevSnapshotName)
+	if err != nil {
+		return "", err
+	}
+
+	return vs.UID, nil
 }
 
+// getPrevSnapshotID returns the CSI handle of the VolumeSnapshot named by
+// PrevSnapshotName, obtained from its VolumeSnapshotContent object.
 func (iter *iterator) getPrevSnapshotID(ctx context.Context) (string, error) {
 	vs, err := iter.h.getVolumeSnapshot(ctx, iter.Namespace, iter.PrevSnapshotName)
 	if err != nil {
 		return "", err
 	}
 
+	iter.prevSnapshotUID = vs.UID
+
 	vsc, err := iter.h.getVolumeSnapshotContent(ctx, vs)
 	if err != nil {
 		return "", err
@@ -445,17 +781,17 @@ func (iter *iterator) getPrevSnapshotID(ctx context.Context) (string, error) {
 func (iter *iterator) getVolumeSnapshot(ctx context.Context, namespace, vsName string) (*snapshotv1.VolumeSnapshot, error) {
 	vs, err := iter.Clients.SnapshotClient.SnapshotV1().VolumeSnapshots(namespace).Get(ctx, vsName, apimetav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("VolumeSnapshots.Get(%s/%s): %w", namespace, vsName, err)
+		return nil, fmt.Errorf("VolumeSnapshots.Get(%s/%s): %w", namespace, vsName, classifyAPIError(err))
 	}
 
 	// Check ready-to-use if set, otherwise ignore.
-	if vs.Status.ReadyToUse != nil && !*vs.Status.ReadyToUse {
-		return nil, fmt.Errorf("VolumeSnapshot %s/%s is not yet ready", namespace, vsName)
+	if vs.Status != nil && vs.Status.ReadyToUse != nil && !*vs.Status.ReadyToUse {
+		return nil, fmt.Errorf("%w: VolumeSnapshot %s/%s is not yet ready", ErrSnapshotNotReady, namespace, vsName)
 	}
 
 	// The BoundVolumeSnapshotContentName must be set.
-	if vs.Status.BoundVolumeSnapshotContentName == nil {
-		return nil, fmt.Errorf("VolumeSnapshot %s/%s boundVolumeSnapshotContentName not set", namespace, vsName)
+	if vs.Status == nil || vs.Status.BoundVolumeSnapshotContentName == nil {
+		return nil, fmt.Errorf("%w: VolumeSnapshot %s/%s boundVolumeSnapshotContentName not set", ErrSnapshotNotReady, namespace, vsName)
 	}
 
 	return vs, nil
@@ -465,7 +801,7 @@ func (iter *iterator) getVolumeSnapshotContent(ctx context.Context, vs *snapshot
 	vscName := *vs.Status.BoundVolumeSnapshotContentName
 	vsc, err := iter.Clients.SnapshotClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, vscName, apimetav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("VolumeSnapshotContent.Get(%s): %w", vscName, err)
+		return nil, fmt.Errorf("VolumeSnapshotContent.Get(%s): %w", vscName, classifyAPIError(err))
 	}
 
 	if vsc.Spec.VolumeSnapshotRef.UID != "" && vsc.Spec.VolumeSnapshotRef.UID != vs.UID {
@@ -476,12 +812,12 @@ func (iter *iterator) getVolumeSnapshotContent(ctx context.Context, vs *snapshot
 
 	// Check ready-to-use if set, otherwise ignore.
 	if vsc.Status.ReadyToUse != nil && !*vsc.Status.ReadyToUse {
-		return nil, fmt.Errorf("VolumeSnapshotContent(%s) is not yet ready", vscName)
+		return nil, fmt.Errorf("%w: VolumeSnapshotContent(%s) is not yet ready", ErrSnapshotNotReady, vscName)
 	}
 
 	// The SnapshotHandle must be set.
 	if vsc.Status.SnapshotHandle == nil {
-		return nil, fmt.Errorf("VolumeSnapshotContent(%s) snapshot handle not set", vscName)
+		return nil, fmt.Errorf("%w: VolumeSnapshotContent(%s) snapshot handle not set", ErrSnapshotNotReady, vscName)
 	}
 
 	return vsc, nil
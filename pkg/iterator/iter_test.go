@@ -26,6 +26,13 @@ import (
 	"github.com/golang/mock/gomock"
 	fakesnapshot "github.com/kubernetes-csi/external-snapshotter/client/v8/clientset/versioned/fake"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 	v1 "k8s.io/api/core/v1"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
@@ -117,6 +124,19 @@ func TestValidateArgs(t *testing.T) {
 	args.SAName = "serviceAccount"
 	err = args.Validate()
 	assert.NoError(t, err)
+
+	args.TokenSource = &StaticTokenSource{}
+	err = args.Validate()
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrInvalidArgs)
+	assert.ErrorContains(t, err, "TokenSource")
+
+	args.TokenSource = nil
+	args.WaitForReady = -1
+	err = args.Validate()
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrInvalidArgs)
+	assert.ErrorContains(t, err, "WaitForReady")
 }
 
 func TestNewIterator(t *testing.T) {
@@ -147,9 +167,8 @@ func TestRun(t *testing.T) {
 		th.RetGetDefaultSAName = th.SAName
 		th.RetGetDefaultSANamespace = th.SANamespace
 
-		vs, vsc := th.FakeVS()
+		vs, _ := th.FakeVS()
 		th.RetGetVolumeSnapshot = vs
-		th.RetGetVolumeSnapshotContent = vsc
 
 		iter := th.NewTestIterator()
 		iter.recordNum = 100
@@ -244,6 +263,27 @@ func TestRun(t *testing.T) {
 		assert.ErrorIs(t, th.InCallContext.Err(), context.Canceled)
 	})
 
+	t.Run("token-source-no-sa", func(t *testing.T) {
+		th := newTestHarness()
+		th.RetGetSnapshotMetadataServiceCRService = th.FakeCR()
+		th.RetGetGRPCClient = th.GRPCSnapshotMetadataClient(t)
+		th.RetCreateSecurityToken = "security-token"
+
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.CSIDriver = th.CSIDriver
+		iter.SAName = ""
+		iter.SANamespace = ""
+		iter.TokenSource = &StaticTokenSource{}
+
+		err := iter.run(context.Background())
+		assert.NoError(t, err)
+
+		// the ServiceAccount is not needed
+		assert.False(t, th.CalledGetDefaultServiceAccount)
+		assert.Equal(t, th.Audience, th.InCreateSecurityTokenAudience)
+	})
+
 	t.Run("err-get-csi-driver-from-primary-snapshot", func(t *testing.T) {
 		th := newTestHarness()
 		th.RetGetCSIDriverFromPrimarySnapshotErr = testErr
@@ -341,9 +381,8 @@ func TestRun(t *testing.T) {
 		th.RetCreateSecurityToken = "security-token"
 		th.RetGetChangedBlocksErr = testErr
 
-		vs, vsc := th.FakeVS()
+		vs, _ := th.FakeVS()
 		th.RetGetVolumeSnapshot = vs
-		th.RetGetVolumeSnapshotContent = vsc
 
 		iter := th.NewTestIterator()
 		iter.recordNum = 100
@@ -392,6 +431,45 @@ func TestRun(t *testing.T) {
 		// the call context is canceled
 		assert.ErrorIs(t, th.InCallContext.Err(), context.Canceled)
 	})
+
+	t.Run("tracing", func(t *testing.T) {
+		tp := otel.GetTracerProvider()
+		defer otel.SetTracerProvider(tp)
+
+		sr := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+		th := newTestHarness()
+		th.RetGetSnapshotMetadataServiceCRService = th.FakeCR()
+		th.RetGetGRPCClient = th.GRPCSnapshotMetadataClient(t)
+		th.RetCreateSecurityToken = "security-token"
+		th.RetGetAllocatedBlocksClientErr = testErr
+
+		iter := th.NewTestIterator()
+		iter.CSIDriver = th.CSIDriver
+		iter.PrevSnapshotName = ""
+
+		err := iter.run(context.Background())
+		assert.ErrorIs(t, err, testErr)
+
+		spans := sr.Ended()
+		assert.Len(t, spans, 4)
+
+		spanNames := []string{}
+		for _, span := range spans {
+			spanNames = append(spanNames, span.Name())
+		}
+
+		assert.Equal(t, []string{"getSnapshotMetadataServiceCR", "createSecurityToken", "stream", "GetSnapshotMetadata"}, spanNames)
+
+		// the operations are children of the enumeration span
+		for _, span := range spans[:3] {
+			assert.Equal(t, spans[3].SpanContext().SpanID(), span.Parent().SpanID())
+		}
+
+		assert.Equal(t, codes.Error, spans[2].Status().Code)
+		assert.Equal(t, codes.Error, spans[3].Status().Code)
+	})
 }
 
 func TestGetDefaultServiceAccount(t *testing.T) {
@@ -585,6 +663,17 @@ func TestCreateSecurityToken(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, th.SecurityToken, securityToken)
 	})
+
+	t.Run("token-source", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.TokenSource = &StaticTokenSource{Token: "static-token"}
+
+		securityToken, err := iter.createSecurityToken(context.Background(), th.SANamespace, th.SAName, th.Audience)
+		assert.NoError(t, err)
+		assert.Equal(t, "static-token", securityToken)
+		assert.Empty(t, th.FakeKubeClient.Actions())
+	})
 }
 
 func TestGetGRPCClient(t *testing.T) {
@@ -624,6 +713,13 @@ func TestGetGRPCClient(t *testing.T) {
 		client, err := iter.getGRPCClient(caCert, "")
 		assert.NoError(t, err)
 		assert.NotNil(t, client)
+
+		// The connection is closed when the enumeration completes.
+		conn := iter.conn
+		assert.NotNil(t, conn)
+		iter.closeConn()
+		assert.Nil(t, iter.conn)
+		assert.Equal(t, connectivity.Shutdown, conn.GetState())
 	})
 }
 
@@ -839,6 +935,127 @@ func TestGetChangedBlocks(t *testing.T) {
 		assert.ErrorIs(t, err, errTest)
 	})
 
+	t.Run("base-snapshot-name", func(t *testing.T) {
+		th := newTestHarness()
+		th.RetSnapshotMetadataIteratorRecord = nil
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = ""
+
+		assert.NotEmpty(t, iter.PrevSnapshotName)
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		defer mockController.Finish()
+
+		mockStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataDeltaClient(mockController)
+		mockStream.EXPECT().Recv().Return(nil, io.EOF)
+
+		expReq := th.FakeGetMetadataDeltaRequest()
+		expReq.BaseSnapshotId = ""
+		expReq.BaseSnapshotName = th.PrevSnapshotName
+		mockClient.EXPECT().GetMetadataDelta(gomock.Any(), expReq).Return(mockStream, nil)
+
+		err := iter.getChangedBlocks(context.Background(), mockClient, th.SecurityToken)
+		assert.NoError(t, err)
+	})
+
+	t.Run("base-snapshot-name-fallback", func(t *testing.T) {
+		th := newTestHarness()
+		th.RetSnapshotMetadataIteratorRecord = nil
+		vs, vsc := th.FakeVS()
+		th.RetGetVolumeSnapshot = vs
+		th.RetGetVolumeSnapshotContent = vsc
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = ""
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		defer mockController.Finish()
+
+		// a sidecar that does not support base snapshot names ignores the name
+		rejectStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataDeltaClient(mockController)
+		rejectStream.EXPECT().Recv().Return(nil, status.Error(grpccodes.InvalidArgument, msgBaseSnapshotIDRequired))
+		byNameReq := th.FakeGetMetadataDeltaRequest()
+		byNameReq.BaseSnapshotId = ""
+		byNameReq.BaseSnapshotName = th.PrevSnapshotName
+
+		mockStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataDeltaClient(mockController)
+		mockStream.EXPECT().Recv().Return(nil, io.EOF)
+		byIDReq := th.FakeGetMetadataDeltaRequest()
+		byIDReq.BaseSnapshotId = *vsc.Status.SnapshotHandle
+
+		gomock.InOrder(
+			mockClient.EXPECT().GetMetadataDelta(gomock.Any(), byNameReq).Return(rejectStream, nil),
+			mockClient.EXPECT().GetMetadataDelta(gomock.Any(), byIDReq).Return(mockStream, nil),
+		)
+
+		err := iter.getChangedBlocks(context.Background(), mockClient, th.SecurityToken)
+		assert.NoError(t, err)
+		assert.Equal(t, vs, th.InGetVolumeSnapshotContentVs)
+		assert.Empty(t, iter.PrevSnapshotID)
+		assert.Equal(t, *vsc.Status.SnapshotHandle, iter.prevSnapshotHandle)
+	})
+
+	t.Run("base-snapshot-name-fallback-error", func(t *testing.T) {
+		th := newTestHarness()
+		th.RetGetVolumeSnapshotErr = errTest
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = ""
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		defer mockController.Finish()
+
+		rejectStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataDeltaClient(mockController)
+		rejectStream.EXPECT().Recv().Return(nil, status.Error(grpccodes.InvalidArgument, msgBaseSnapshotIDRequired))
+		mockClient.EXPECT().GetMetadataDelta(gomock.Any(), gomock.Any()).Return(rejectStream, nil)
+
+		err := iter.getChangedBlocks(context.Background(), mockClient, th.SecurityToken)
+		assert.ErrorIs(t, err, errTest)
+	})
+
+	t.Run("base-snapshot-name-invalid", func(t *testing.T) {
+		th := newTestHarness()
+		th.RetGetVolumeSnapshotErr = errTest
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = ""
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		defer mockController.Finish()
+
+		// no fallback when a sidecar that supports base snapshot names rejects the request
+		rejectStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataDeltaClient(mockController)
+		rejectStream.EXPECT().Recv().Return(nil, status.Error(grpccodes.InvalidArgument, "the base snapshot is not of the same source volume as the target snapshot"))
+		mockClient.EXPECT().GetMetadataDelta(gomock.Any(), gomock.Any()).Return(rejectStream, nil)
+
+		err := iter.getChangedBlocks(context.Background(), mockClient, th.SecurityToken)
+		assert.ErrorIs(t, err, ErrInvalidArgs)
+		assert.NotErrorIs(t, err, errTest)
+		assert.ErrorContains(t, err, "not of the same source volume")
+		assert.Nil(t, th.InGetVolumeSnapshotContentVs)
+		assert.Empty(t, iter.prevSnapshotHandle)
+	})
+
+	t.Run("base-snapshot-id-invalid", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = th.PrevSnapshotHandle
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		defer mockController.Finish()
+
+		// no fallback when the base snapshot is specified by its handle
+		rejectStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataDeltaClient(mockController)
+		rejectStream.EXPECT().Recv().Return(nil, status.Error(grpccodes.InvalidArgument, "invalid base snapshot"))
+		mockClient.EXPECT().GetMetadataDelta(gomock.Any(), gomock.Any()).Return(rejectStream, nil)
+
+		err := iter.getChangedBlocks(context.Background(), mockClient, th.SecurityToken)
+		assert.ErrorIs(t, err, ErrInvalidArgs)
+		assert.Empty(t, iter.prevSnapshotHandle)
+	})
+
 	t.Run("stream-rec-rec-EOF", func(t *testing.T) {
 		th := newTestHarness()
 		th.RetSnapshotMetadataIteratorRecord = nil
@@ -927,37 +1144,22 @@ func TestGetChangedBlocks(t *testing.T) {
 	})
 }
 
-func TestGetPrevSnapshotID(t *testing.T) {
+func TestGetPrevSnapshotUID(t *testing.T) {
 	errTest := errors.New("test-error")
 
 	t.Run("success", func(t *testing.T) {
-		th := newTestHarness()
-		vs, vsc := th.FakeVS()
-		th.RetGetVolumeSnapshot = vs
-		th.RetGetVolumeSnapshotContent = vsc
-
-		iter := th.NewTestIterator()
-		iter.PrevSnapshotID = ""
-		iter.PrevSnapshotName = vs.Name
-
-		snapID, err := iter.getPrevSnapshotID(context.Background())
-		assert.NoError(t, err)
-		assert.Equal(t, *vsc.Status.SnapshotHandle, snapID)
-	})
-
-	t.Run("get-vsc-error", func(t *testing.T) {
 		th := newTestHarness()
 		vs, _ := th.FakeVS()
 		th.RetGetVolumeSnapshot = vs
-		th.RetGetVolumeSnapshotContentErr = errTest
 
 		iter := th.NewTestIterator()
 		iter.PrevSnapshotID = ""
 		iter.PrevSnapshotName = vs.Name
 
-		snapID, err := iter.getPrevSnapshotID(context.Background())
-		assert.ErrorIs(t, err, errTest)
-		assert.Empty(t, snapID)
+		uid, err := iter.getPrevSnapshotUID(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, vs.UID, uid)
+		assert.Equal(t, vs.Name, th.InGetVolumeSnapshotName)
 	})
 
 	t.Run("get-vs-error", func(t *testing.T) {
@@ -969,9 +1171,9 @@ func TestGetPrevSnapshotID(t *testing.T) {
 		iter.PrevSnapshotID = ""
 		iter.PrevSnapshotName = vs.Name
 
-		snapID, err := iter.getPrevSnapshotID(context.Background())
+		uid, err := iter.getPrevSnapshotUID(context.Background())
 		assert.ErrorIs(t, err, errTest)
-		assert.Empty(t, snapID)
+		assert.Empty(t, uid)
 	})
 
 	t.Run("getVolumeSnapshot", func(t *testing.T) {
@@ -1063,6 +1265,55 @@ func TestGetPrevSnapshotID(t *testing.T) {
 		})
 	})
 
+}
+
+func TestGetPrevSnapshotID(t *testing.T) {
+	errTest := errors.New("test-error")
+
+	t.Run("success", func(t *testing.T) {
+		th := newTestHarness()
+		vs, vsc := th.FakeVS()
+		th.RetGetVolumeSnapshot = vs
+		th.RetGetVolumeSnapshotContent = vsc
+
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = ""
+		iter.PrevSnapshotName = vs.Name
+
+		snapID, err := iter.getPrevSnapshotID(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, *vsc.Status.SnapshotHandle, snapID)
+	})
+
+	t.Run("get-vsc-error", func(t *testing.T) {
+		th := newTestHarness()
+		vs, _ := th.FakeVS()
+		th.RetGetVolumeSnapshot = vs
+		th.RetGetVolumeSnapshotContentErr = errTest
+
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = ""
+		iter.PrevSnapshotName = vs.Name
+
+		snapID, err := iter.getPrevSnapshotID(context.Background())
+		assert.ErrorIs(t, err, errTest)
+		assert.Empty(t, snapID)
+	})
+
+	t.Run("get-vs-error", func(t *testing.T) {
+		th := newTestHarness()
+		vs, _ := th.FakeVS()
+		th.RetGetVolumeSnapshotErr = errTest
+
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = ""
+		iter.PrevSnapshotName = vs.Name
+
+		snapID, err := iter.getPrevSnapshotID(context.Background())
+		assert.ErrorIs(t, err, errTest)
+		assert.Empty(t, snapID)
+	})
+
 	t.Run("getVolumeSnapshotContent", func(t *testing.T) {
 		t.Run("get-error", func(t *testing.T) {
 			th := newTestHarness()
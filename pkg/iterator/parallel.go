@@ -0,0 +1,296 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+const (
+	// Range boundaries are aligned so that fixed length blocks rarely
+	// straddle them.
+	rangeAlignment = int64(1024 * 1024) // 1 MiB
+
+	// The number of records buffered for each range in an ordered
+	// parallel enumeration. The records are emitted one range at a time,
+	// so a range that has buffered this many records waits for the
+	// preceding ranges to be emitted before receiving more.
+	rangeRecordBufferSize = 256
+)
+
+// errStopStream is used internally to terminate a stream before EOF.
+var errStopStream = errors.New("stop stream")
+
+// ConcurrentIteratorEmitter is an IteratorEmitter whose
+// SnapshotMetadataIteratorRecord operation is safe for concurrent use.
+// A parallel enumeration passes records to such an emitter as they
+// are received, instead of in byte offset order, if
+// SnapshotMetadataIteratorConcurrent returns true.
+type ConcurrentIteratorEmitter interface {
+	IteratorEmitter
+
+	SnapshotMetadataIteratorConcurrent() bool
+}
+
+type byteRange struct {
+	start int64
+	end   int64 // zero if unbounded
+}
+
+// rangeEmitter forwards the records of a range to the parallel enumeration.
+type rangeEmitter struct {
+	emitFn func(metadata IteratorMetadata) error
+}
+
+func (e *rangeEmitter) SnapshotMetadataIteratorRecord(_ int, metadata IteratorMetadata) error {
+	return e.emitFn(metadata)
+}
+
+func (e *rangeEmitter) SnapshotMetadataIteratorDone(_ int) error {
+	return nil
+}
+
+// streamParallel learns the capacity of the volume from the first record
+// of the stream, splits the remaining byte offsets into ranges and
+// enumerates each range in its own stream.
+func (iter *iterator) streamParallel(ctx context.Context, grpcClient api.SnapshotMetadataClient, securityToken string, mintTokenFn func() (string, error)) error {
+	capacity, err := iter.getVolumeCapacity(ctx, grpcClient, securityToken, mintTokenFn)
+	if err != nil {
+		return err
+	}
+
+	ranges := iter.partition(capacity)
+
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+
+	if ce, ok := iter.Emitter.(ConcurrentIteratorEmitter); ok && ce.SnapshotMetadataIteratorConcurrent() {
+		return iter.streamRangesUnordered(ctx, cancelFn, ranges, grpcClient, securityToken, mintTokenFn)
+	}
+
+	return iter.streamRangesOrdered(ctx, cancelFn, ranges, grpcClient, securityToken, mintTokenFn)
+}
+
+// streamRangesOrdered buffers the records of each range and passes them
+// to the emitter one range at a time.
+func (iter *iterator) streamRangesOrdered(ctx context.Context, cancelFn context.CancelFunc, ranges []byteRange, grpcClient api.SnapshotMetadataClient, securityToken string, mintTokenFn func() (string, error)) error {
+	var (
+		errs    = make([]error, len(ranges))
+		records = make([]chan IteratorMetadata, len(ranges))
+		wg      sync.WaitGroup
+	)
+
+	for i, r := range ranges {
+		records[i] = make(chan IteratorMetadata, rangeRecordBufferSize)
+		rangeIter := iter.newRangeIterator(i, r, func(metadata IteratorMetadata) error {
+			select {
+			case records[i] <- metadata:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(records[i])
+			errs[i] = rangeIter.streamRange(ctx, grpcClient, securityToken, mintTokenFn)
+		}()
+	}
+
+	defer wg.Wait()
+	defer cancelFn()
+
+	for i := range ranges {
+		for metadata := range records[i] {
+			if err := iter.emitRecord(metadata); err != nil {
+				return err
+			}
+		}
+
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+
+	return nil
+}
+
+// streamRangesUnordered passes the records of all ranges concurrently
+// to the emitter.
+func (iter *iterator) streamRangesUnordered(ctx context.Context, cancelFn context.CancelFunc, ranges []byteRange, grpcClient api.SnapshotMetadataClient, securityToken string, mintTokenFn func() (string, error)) error {
+	var (
+		firstErr error
+		mux      sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	emitFn := func(metadata IteratorMetadata) error {
+		mux.Lock()
+		iter.recordNum++
+		recordNum := iter.recordNum
+		mux.Unlock()
+
+		return iter.Emitter.SnapshotMetadataIteratorRecord(recordNum, metadata)
+	}
+
+	for i, r := range ranges {
+		rangeIter := iter.newRangeIterator(i, r, emitFn)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rangeIter.streamRange(ctx, grpcClient, securityToken, mintTokenFn); err != nil {
+				mux.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancelFn()
+				}
+				mux.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// getVolumeCapacity returns the volume capacity reported in the first
+// record of the stream, or 0 if there are no records.
+func (iter *iterator) getVolumeCapacity(ctx context.Context, grpcClient api.SnapshotMetadataClient, securityToken string, mintTokenFn func() (string, error)) (int64, error) {
+	var capacity int64
+
+	probeIter := iter.newRangeIterator(0, byteRange{start: iter.nextOffset}, func(metadata IteratorMetadata) error {
+		capacity = metadata.VolumeCapacityBytes
+		return errStopStream
+	})
+	probeIter.MaxResults = 1
+
+	if err := probeIter.streamRange(ctx, grpcClient, securityToken, mintTokenFn); err != nil {
+		return 0, err
+	}
+
+	return capacity, nil
+}
+
+// partition splits the byte offsets from nextOffset to capacity into
+// at most Parallelism aligned ranges. The last range is unbounded.
+func (iter *iterator) partition(capacity int64) []byteRange {
+	start := iter.nextOffset
+	size := (capacity - start + int64(iter.Parallelism) - 1) / int64(iter.Parallelism)
+	size = (size + rangeAlignment - 1) / rangeAlignment * rangeAlignment
+
+	ranges := []byteRange{}
+	for offset := start; offset < capacity && size > 0; offset += size {
+		ranges = append(ranges, byteRange{start: offset, end: offset + size})
+	}
+
+	if len(ranges) == 0 {
+		ranges = append(ranges, byteRange{start: start})
+	}
+
+	ranges[len(ranges)-1].end = 0
+
+	return ranges
+}
+
+// newRangeIterator returns an iterator that enumerates the given range.
+// Tuples that precede the range are emitted by the previous range, so the
+// lower bound is not enforced for the first range.
+func (iter *iterator) newRangeIterator(rangeNum int, r byteRange, emitFn func(IteratorMetadata) error) *iterator {
+	args := iter.Args
+	args.StartingOffset = r.start
+	args.Emitter = &rangeEmitter{emitFn: emitFn}
+	args.ValidateMetadata = false // the merged records are validated by the Emitter of iter
+
+	rangeIter := newIterator(args)
+	rangeIter.rangeEnd = r.end
+	if rangeNum > 0 {
+		rangeIter.rangeStart = r.start
+	}
+
+	return rangeIter
+}
+
+// streamRange enumerates the range, stopping the stream at the end of the range.
+func (iter *iterator) streamRange(ctx context.Context, grpcClient api.SnapshotMetadataClient, securityToken string, mintTokenFn func() (string, error)) error {
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+
+	err := iter.streamWithRetry(ctx, securityToken, mintTokenFn, func(securityToken string) error {
+		if !iter.isDelta() {
+			return iter.getAllocatedBlocks(ctx, grpcClient, securityToken)
+		}
+
+		return iter.getChangedBlocks(ctx, grpcClient, securityToken)
+	})
+	if errors.Is(err, errStopStream) {
+		return nil
+	}
+
+	return err
+}
+
+// removeOutOfRangeTuples removes the tuples that are outside of the range,
+// and reports if the end of the range was reached.
+// The bytes before the start of the range are emitted by the previous
+// range, so a VARIABLE_LENGTH tuple that straddles either bound is trimmed
+// to it. A FIXED_LENGTH tuple belongs to the range of its byte offset.
+func (iter *iterator) removeOutOfRangeTuples(bmt api.BlockMetadataType, bmds []*api.BlockMetadata) ([]*api.BlockMetadata, bool) {
+	var ret []*api.BlockMetadata
+
+	for _, bmd := range bmds {
+		if iter.rangeEnd > 0 && bmd.ByteOffset >= iter.rangeEnd {
+			return ret, true
+		}
+
+		if bmt == api.BlockMetadataType_VARIABLE_LENGTH {
+			start := max(bmd.ByteOffset, iter.rangeStart)
+			end := bmd.ByteOffset + bmd.SizeBytes
+			if iter.rangeEnd > 0 {
+				end = min(end, iter.rangeEnd)
+			}
+
+			switch {
+			case end <= start:
+				continue
+			case start != bmd.ByteOffset || end != bmd.ByteOffset+bmd.SizeBytes:
+				bmd = &api.BlockMetadata{ByteOffset: start, SizeBytes: end - start}
+			}
+		} else if bmd.ByteOffset < iter.rangeStart {
+			continue
+		}
+
+		ret = append(ret, bmd)
+	}
+
+	return ret, false
+}
+
+func (iter *iterator) rangeStatus(rangeEnded bool) error {
+	if rangeEnded {
+		return errStopStream
+	}
+
+	return nil
+}
@@ -0,0 +1,391 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/k8sclientmocks"
+)
+
+const mib = rangeAlignment
+
+// protoMatcher compares protobuf messages with proto.Equal, as the
+// messages may be concurrently marshaled by the mock.
+type protoMatcher struct {
+	msg proto.Message
+}
+
+func (m protoMatcher) Matches(x any) bool {
+	msg, ok := x.(proto.Message)
+	return ok && proto.Equal(m.msg, msg)
+}
+
+func (m protoMatcher) String() string {
+	return "proto equal to " + m.msg.(interface{ String() string }).String()
+}
+
+type concurrentTestEmitter struct {
+	mux        sync.Mutex
+	recordNums []int
+	offsets    []int64
+}
+
+func (e *concurrentTestEmitter) SnapshotMetadataIteratorRecord(recordNumber int, metadata IteratorMetadata) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.recordNums = append(e.recordNums, recordNumber)
+	for _, bmd := range metadata.BlockMetadata {
+		e.offsets = append(e.offsets, bmd.ByteOffset)
+	}
+	return nil
+}
+
+func (e *concurrentTestEmitter) SnapshotMetadataIteratorDone(_ int) error {
+	return nil
+}
+
+func (e *concurrentTestEmitter) SnapshotMetadataIteratorConcurrent() bool {
+	return true
+}
+
+func TestValidateArgsParallelism(t *testing.T) {
+	th := newTestHarness()
+	args := th.Args()
+
+	args.Parallelism = -1
+	err := args.Validate()
+	assert.ErrorIs(t, err, ErrInvalidArgs)
+	assert.ErrorContains(t, err, "invalid Parallelism")
+
+	args.Parallelism = 2
+	assert.NoError(t, args.Validate())
+
+	args.Checkpointer = &fakeCheckpointer{}
+	err = args.Validate()
+	assert.ErrorIs(t, err, ErrInvalidArgs)
+	assert.ErrorContains(t, err, "Checkpointer")
+}
+
+func TestPartition(t *testing.T) {
+	th := newTestHarness()
+	iter := th.NewTestIterator()
+	iter.Parallelism = 4
+
+	assert.Equal(t, []byteRange{{start: 0}}, iter.partition(0))
+	assert.Equal(t, []byteRange{{start: 0}}, iter.partition(4096))
+
+	assert.Equal(t, []byteRange{
+		{start: 0, end: 2 * mib},
+		{start: 2 * mib, end: 4 * mib},
+		{start: 4 * mib, end: 6 * mib},
+		{start: 6 * mib},
+	}, iter.partition(8*mib))
+
+	iter.nextOffset = 4 * mib
+	assert.Equal(t, []byteRange{
+		{start: 4 * mib, end: 5 * mib},
+		{start: 5 * mib, end: 6 * mib},
+		{start: 6 * mib},
+	}, iter.partition(7*mib-1))
+
+	iter.nextOffset = 8 * mib
+	assert.Equal(t, []byteRange{{start: 8 * mib}}, iter.partition(8*mib))
+}
+
+func TestRemoveOutOfRangeTuples(t *testing.T) {
+	th := newTestHarness()
+	iter := th.NewTestIterator()
+	iter.rangeStart = 2 * mib
+	iter.rangeEnd = 4 * mib
+
+	t.Run("fixed-length", func(t *testing.T) {
+		bmds := []*api.BlockMetadata{
+			{ByteOffset: mib + mib/2, SizeBytes: mib},
+			{ByteOffset: 2 * mib, SizeBytes: mib},
+			{ByteOffset: 3 * mib, SizeBytes: mib},
+		}
+		ret, ended := iter.removeOutOfRangeTuples(api.BlockMetadataType_FIXED_LENGTH, bmds)
+		assert.False(t, ended)
+		assert.Equal(t, bmds[1:], ret)
+
+		bmds = append(bmds, &api.BlockMetadata{ByteOffset: 4 * mib, SizeBytes: mib})
+		ret, ended = iter.removeOutOfRangeTuples(api.BlockMetadataType_FIXED_LENGTH, bmds)
+		assert.True(t, ended)
+		assert.Equal(t, bmds[1:3], ret)
+	})
+
+	t.Run("variable-length", func(t *testing.T) {
+		bmds := []*api.BlockMetadata{
+			{ByteOffset: 0, SizeBytes: mib},
+			{ByteOffset: mib, SizeBytes: 2 * mib},
+			{ByteOffset: 3*mib + mib/2, SizeBytes: mib},
+			{ByteOffset: 5 * mib, SizeBytes: mib},
+		}
+		ret, ended := iter.removeOutOfRangeTuples(api.BlockMetadataType_VARIABLE_LENGTH, bmds)
+		assert.True(t, ended)
+		assert.Equal(t, []*api.BlockMetadata{
+			{ByteOffset: 2 * mib, SizeBytes: mib},
+			{ByteOffset: 3*mib + mib/2, SizeBytes: mib / 2},
+		}, ret)
+		assert.Equal(t, int64(2*mib), bmds[1].SizeBytes, "the tuples are not modified")
+	})
+}
+
+func TestStreamParallel(t *testing.T) {
+	allocatedResp := func(offsets ...int64) *api.GetMetadataAllocatedResponse {
+		resp := &api.GetMetadataAllocatedResponse{
+			BlockMetadataType:   api.BlockMetadataType_FIXED_LENGTH,
+			VolumeCapacityBytes: 4 * mib,
+		}
+		for _, offset := range offsets {
+			resp.BlockMetadata = append(resp.BlockMetadata, &api.BlockMetadata{ByteOffset: offset, SizeBytes: mib / 2})
+		}
+		return resp
+	}
+
+	// expectStreams sets up a probe stream and the streams of two ranges,
+	// [0, 2MiB) and [2MiB, ...).
+	expectStreams := func(t *testing.T, th *testHarness, range1Err error) *k8sclientmocks.MockSnapshotMetadataClient {
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+
+		probeStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		probeStream.EXPECT().Recv().Return(allocatedResp(0), nil)
+		probeReq := th.FakeGetMetadataAllocatedRequest()
+		probeReq.MaxResults = 1
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), protoMatcher{probeReq}).Return(probeStream, nil)
+
+		range0Stream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		range0Stream.EXPECT().Recv().Return(allocatedResp(0, mib), nil)
+		range0Stream.EXPECT().Recv().Return(allocatedResp(mib+mib/2, 2*mib, 3*mib), nil) // stops at 2MiB
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), protoMatcher{th.FakeGetMetadataAllocatedRequest()}).Return(range0Stream, nil)
+
+		range1Stream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		range1Stream.EXPECT().Recv().Return(allocatedResp(mib+mib/2, 2*mib, 3*mib), nil) // first tuple belongs to range 0
+		range1Stream.EXPECT().Recv().Return(nil, range1Err)
+		range1Req := th.FakeGetMetadataAllocatedRequest()
+		range1Req.StartingOffset = 2 * mib
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), protoMatcher{range1Req}).Return(range1Stream, nil)
+
+		return mockClient
+	}
+
+	t.Run("ordered", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.Parallelism = 2
+
+		mockClient := expectStreams(t, th, io.EOF)
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.NoError(t, err)
+
+		assert.Equal(t, 3, iter.recordNum)
+		offsets := []int64{}
+		for _, rec := range th.InSnapshotMetadataIteratorRecordMeta {
+			for _, bmd := range rec.BlockMetadata {
+				offsets = append(offsets, bmd.ByteOffset)
+			}
+		}
+		assert.Equal(t, []int64{0, mib, mib + mib/2, 2 * mib, 3 * mib}, offsets)
+	})
+
+	t.Run("ordered-validated", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.Parallelism = 2
+		iter.ValidateMetadata = true
+		iter.Emitter = &ValidatingEmitter{Emitter: iter.Emitter}
+
+		// The ranges do not validate the records themselves.
+		rangeIter := iter.newRangeIterator(1, byteRange{start: 2 * mib}, nil)
+		assert.False(t, rangeIter.ValidateMetadata)
+		assert.IsType(t, &rangeEmitter{}, rangeIter.Emitter)
+
+		mockClient := expectStreams(t, th, io.EOF)
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, iter.recordNum)
+		assert.Len(t, th.InSnapshotMetadataIteratorRecordMeta, 3)
+	})
+
+	t.Run("ordered-variable-length", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.Parallelism = 2
+		iter.ValidateMetadata = true
+		iter.Emitter = &ValidatingEmitter{Emitter: iter.Emitter}
+
+		variableResp := func(bmds ...*api.BlockMetadata) *api.GetMetadataAllocatedResponse {
+			return &api.GetMetadataAllocatedResponse{
+				BlockMetadataType:   api.BlockMetadataType_VARIABLE_LENGTH,
+				VolumeCapacityBytes: 4 * mib,
+				BlockMetadata:       bmds,
+			}
+		}
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+
+		probeStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		probeStream.EXPECT().Recv().Return(variableResp(&api.BlockMetadata{ByteOffset: 0, SizeBytes: mib}), nil)
+		probeReq := th.FakeGetMetadataAllocatedRequest()
+		probeReq.MaxResults = 1
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), protoMatcher{probeReq}).Return(probeStream, nil)
+
+		// The extent that straddles 2MiB is returned by both ranges.
+		range0Stream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		range0Stream.EXPECT().Recv().Return(variableResp(
+			&api.BlockMetadata{ByteOffset: 0, SizeBytes: mib},
+			&api.BlockMetadata{ByteOffset: mib + mib/2, SizeBytes: mib},
+			&api.BlockMetadata{ByteOffset: 3 * mib, SizeBytes: mib},
+		), nil)
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), protoMatcher{th.FakeGetMetadataAllocatedRequest()}).Return(range0Stream, nil)
+
+		range1Stream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		range1Stream.EXPECT().Recv().Return(variableResp(
+			&api.BlockMetadata{ByteOffset: 2 * mib, SizeBytes: mib / 2},
+			&api.BlockMetadata{ByteOffset: 3 * mib, SizeBytes: mib},
+		), nil)
+		range1Stream.EXPECT().Recv().Return(nil, io.EOF)
+		range1Req := th.FakeGetMetadataAllocatedRequest()
+		range1Req.StartingOffset = 2 * mib
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), protoMatcher{range1Req}).Return(range1Stream, nil)
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.NoError(t, err)
+
+		bmds := []*api.BlockMetadata{}
+		for _, rec := range th.InSnapshotMetadataIteratorRecordMeta {
+			bmds = append(bmds, rec.BlockMetadata...)
+		}
+		assert.Equal(t, []*api.BlockMetadata{
+			{ByteOffset: 0, SizeBytes: mib},
+			{ByteOffset: mib + mib/2, SizeBytes: mib / 2},
+			{ByteOffset: 2 * mib, SizeBytes: mib / 2},
+			{ByteOffset: 3 * mib, SizeBytes: mib},
+		}, bmds)
+	})
+
+	t.Run("ordered-range-error", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.Parallelism = 2
+		errTest := errors.New("test-error")
+
+		mockClient := expectStreams(t, th, errTest)
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.ErrorIs(t, err, errTest)
+		assert.Equal(t, 3, iter.recordNum) // records preceding the error are emitted
+	})
+
+	t.Run("ordered-emitter-error", func(t *testing.T) {
+		th := newTestHarness()
+		th.RetSnapshotMetadataIteratorRecord = ErrCancelled
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.Parallelism = 2
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		range0Stream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		range0Stream.EXPECT().Recv().Return(allocatedResp(0, mib), nil).AnyTimes()
+		range1Stream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+		range1Stream.EXPECT().Recv().Return(nil, io.EOF).AnyTimes()
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, req *api.GetMetadataAllocatedRequest, _ ...grpc.CallOption) (api.SnapshotMetadata_GetMetadataAllocatedClient, error) {
+				if req.StartingOffset > 0 {
+					return range1Stream, nil
+				}
+				return range0Stream, nil
+			}).AnyTimes()
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.ErrorIs(t, err, ErrCancelled)
+		assert.Equal(t, 1, iter.recordNum)
+	})
+
+	t.Run("unordered", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.Parallelism = 2
+		emitter := &concurrentTestEmitter{}
+		iter.Emitter = emitter
+
+		mockClient := expectStreams(t, th, io.EOF)
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.NoError(t, err)
+
+		assert.Equal(t, 3, iter.recordNum)
+		sort.Ints(emitter.recordNums)
+		assert.Equal(t, []int{1, 2, 3}, emitter.recordNums)
+		sort.Slice(emitter.offsets, func(i, j int) bool { return emitter.offsets[i] < emitter.offsets[j] })
+		assert.Equal(t, []int64{0, mib, mib + mib/2, 2 * mib, 3 * mib}, emitter.offsets)
+	})
+
+	t.Run("probe-error", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.Parallelism = 2
+		errTest := errors.New("test-error")
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), gomock.Any()).Return(nil, errTest)
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.ErrorIs(t, err, errTest)
+	})
+
+	t.Run("changed-blocks-empty", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotID = th.PrevSnapshotHandle
+		iter.Parallelism = 2
+
+		mockController := gomock.NewController(t)
+		mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+		mockStream := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataDeltaClient(mockController)
+		mockStream.EXPECT().Recv().Return(nil, io.EOF).Times(2)
+		mockClient.EXPECT().GetMetadataDelta(gomock.Any(), gomock.Any()).Return(mockStream, nil).Times(2)
+
+		err := iter.streamParallel(context.Background(), mockClient, th.SecurityToken, nil)
+		assert.NoError(t, err)
+		assert.Zero(t, iter.recordNum)
+	})
+}
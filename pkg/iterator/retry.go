@@ -0,0 +1,158 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DefaultRetryInitialBackoff = time.Second
+	DefaultRetryMaxBackoff     = time.Second * 30
+)
+
+// DefaultRetryableCodes are the gRPC status codes that are considered
+// transient if RetryPolicy.RetryableCodes is not specified.
+// The sidecar returns Unavailable when it or the CSI driver is not ready,
+// and DeadlineExceeded when its maximum stream duration expires.
+// An Unauthenticated code will cause the security token to be re-minted.
+var DefaultRetryableCodes = []codes.Code{
+	codes.Aborted,
+	codes.DeadlineExceeded,
+	codes.ResourceExhausted,
+	codes.Unauthenticated,
+	codes.Unavailable,
+}
+
+// RetryPolicy controls the automatic resumption of a metadata stream
+// after a transient failure. The stream is reopened from the byte offset
+// following the last tuple emitted, and any tuples that overlap metadata
+// already emitted are removed so that the emitter sees one seamless sequence.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of consecutive attempts made to
+	// resume the stream without receiving new metadata.
+	// If 0 then the stream is not resumed.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first attempt to resume the stream.
+	// The delay doubles on each consecutive attempt.
+	// If unspecified then the value of DefaultRetryInitialBackoff is used.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum delay between attempts.
+	// If unspecified then the value of DefaultRetryMaxBackoff is used.
+	MaxBackoff time.Duration
+
+	// RetryableCodes are the gRPC status codes that are considered transient.
+	// If unspecified then the value of DefaultRetryableCodes is used.
+	RetryableCodes []codes.Code
+}
+
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.MaxAttempts < 0:
+		return fmt.Errorf("%w: invalid Retry.MaxAttempts", ErrInvalidArgs)
+	case p.InitialBackoff < 0:
+		return fmt.Errorf("%w: invalid Retry.InitialBackoff", ErrInvalidArgs)
+	case p.MaxBackoff < 0:
+		return fmt.Errorf("%w: invalid Retry.MaxBackoff", ErrInvalidArgs)
+	}
+
+	return nil
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = DefaultRetryInitialBackoff
+	}
+
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = DefaultRetryMaxBackoff
+	}
+
+	if len(p.RetryableCodes) == 0 {
+		p.RetryableCodes = DefaultRetryableCodes
+	}
+
+	return p
+}
+
+func (p RetryPolicy) isRetryable(err error) bool {
+	return slices.Contains(p.RetryableCodes, status.Code(err))
+}
+
+// backoff returns the delay before the given attempt, numbered from 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, p.MaxBackoff)
+}
+
+// streamWithRetry invokes streamFn and, if permitted by the retry policy,
+// invokes it again after a transient failure. The streamFn is expected to
+// open its stream at nextOffset. The security token is re-minted with
+// mintTokenFn if the server reports that it is no longer valid, or if
+// it has expired.
+func (iter *iterator) streamWithRetry(ctx context.Context, securityToken string, mintTokenFn func() (string, error), streamFn func(securityToken string) error) error {
+	var (
+		attempt        int
+		lastRecordNum  = iter.recordNum
+		tokenCreatedAt = time.Now()
+		tokenLifetime  = time.Duration(iter.TokenExpirySecs) * time.Second
+	)
+
+	for {
+		err := streamFn(securityToken)
+		if err == nil || ctx.Err() != nil || !iter.Retry.isRetryable(err) {
+			return err
+		}
+
+		if iter.recordNum != lastRecordNum {
+			attempt = 0 // progress was made
+			lastRecordNum = iter.recordNum
+		}
+
+		if attempt++; attempt > iter.Retry.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(iter.Retry.backoff(attempt)):
+		}
+
+		if status.Code(err) == codes.Unauthenticated || time.Since(tokenCreatedAt) >= tokenLifetime {
+			if securityToken, err = mintTokenFn(); err != nil {
+				return err
+			}
+
+			tokenCreatedAt = time.Now()
+		}
+
+		iter.resumed = true
+	}
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/k8sclientmocks"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Run("validate", func(t *testing.T) {
+		assert.NoError(t, RetryPolicy{}.Validate())
+
+		for _, p := range []RetryPolicy{{MaxAttempts: -1}, {InitialBackoff: -1}, {MaxBackoff: -1}} {
+			err := p.Validate()
+			assert.Error(t, err)
+			assert.ErrorIs(t, err, ErrInvalidArgs)
+		}
+
+		th := newTestHarness()
+		args := th.Args()
+		args.Retry.MaxAttempts = -1
+		err := args.Validate()
+		assert.ErrorIs(t, err, ErrInvalidArgs)
+		assert.ErrorContains(t, err, "Retry.MaxAttempts")
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		th := newTestHarness()
+		args := th.Args()
+		iter := newIterator(args)
+		assert.Equal(t, RetryPolicy{}, iter.Retry) // not applied when disabled
+
+		args.Retry.MaxAttempts = 3
+		iter = newIterator(args)
+		assert.Equal(t, DefaultRetryInitialBackoff, iter.Retry.InitialBackoff)
+		assert.Equal(t, DefaultRetryMaxBackoff, iter.Retry.MaxBackoff)
+		assert.Equal(t, DefaultRetryableCodes, iter.Retry.RetryableCodes)
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Second * 5}
+		assert.Equal(t, time.Second, p.backoff(1))
+		assert.Equal(t, time.Second*2, p.backoff(2))
+		assert.Equal(t, time.Second*4, p.backoff(3))
+		assert.Equal(t, time.Second*5, p.backoff(4))
+		assert.Equal(t, time.Second*5, p.backoff(100))
+	})
+
+	t.Run("is-retryable", func(t *testing.T) {
+		p := RetryPolicy{}.withDefaults()
+		assert.True(t, p.isRetryable(status.Error(codes.Unavailable, "")))
+		assert.True(t, p.isRetryable(errors.Join(errors.New("wrapped"), status.Error(codes.DeadlineExceeded, ""))))
+		assert.False(t, p.isRetryable(status.Error(codes.PermissionDenied, "")))
+		assert.False(t, p.isRetryable(ErrCancelled))
+	})
+}
+
+func TestStreamWithRetry(t *testing.T) {
+	errUnavailable := status.Error(codes.Unavailable, "unavailable")
+	errUnauthenticated := status.Error(codes.Unauthenticated, "unauthenticated")
+
+	newRetryIterator := func(th *testHarness, maxAttempts int) *iterator {
+		iter := th.NewTestIterator()
+		iter.Retry = RetryPolicy{MaxAttempts: maxAttempts, InitialBackoff: time.Millisecond}.withDefaults()
+		return iter
+	}
+
+	t.Run("no-retry-policy", func(t *testing.T) {
+		th := newTestHarness()
+		iter := th.NewTestIterator()
+
+		numCalls := 0
+		err := iter.streamWithRetry(context.Background(), "token", nil, func(string) error {
+			numCalls++
+			return errUnavailable
+		})
+		assert.ErrorIs(t, err, errUnavailable)
+		assert.Equal(t, 1, numCalls)
+		assert.False(t, iter.resumed)
+	})
+
+	t.Run("not-retryable", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newRetryIterator(th, 3)
+
+		numCalls := 0
+		err := iter.streamWithRetry(context.Background(), "token", nil, func(string) error {
+			numCalls++
+			return ErrCancelled
+		})
+		assert.ErrorIs(t, err, ErrCancelled)
+		assert.Equal(t, 1, numCalls)
+	})
+
+	t.Run("attempts-exhausted", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newRetryIterator(th, 2)
+
+		numCalls := 0
+		err := iter.streamWithRetry(context.Background(), "token", nil, func(string) error {
+			numCalls++
+			return errUnavailable
+		})
+		assert.ErrorIs(t, err, errUnavailable)
+		assert.Equal(t, 3, numCalls)
+		assert.True(t, iter.resumed)
+	})
+
+	t.Run("progress-resets-attempts", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newRetryIterator(th, 1)
+
+		numCalls := 0
+		err := iter.streamWithRetry(context.Background(), "token", nil, func(string) error {
+			numCalls++
+			if numCalls < 4 {
+				iter.recordNum++
+				return errUnavailable
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 4, numCalls)
+	})
+
+	t.Run("context-canceled", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newRetryIterator(th, 3)
+		iter.Retry.InitialBackoff = time.Hour
+
+		ctx, cancelFn := context.WithCancel(context.Background())
+		numCalls := 0
+		err := iter.streamWithRetry(ctx, "token", nil, func(string) error {
+			numCalls++
+			cancelFn()
+			return errUnavailable
+		})
+		assert.ErrorIs(t, err, errUnavailable)
+		assert.Equal(t, 1, numCalls)
+	})
+
+	t.Run("re-mint-token", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newRetryIterator(th, 3)
+
+		tokens := []string{}
+		err := iter.streamWithRetry(context.Background(), "token-1", func() (string, error) {
+			return "token-2", nil
+		}, func(token string) error {
+			tokens = append(tokens, token)
+			if len(tokens) == 1 {
+				return errUnauthenticated
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"token-1", "token-2"}, tokens)
+	})
+
+	t.Run("re-mint-token-err", func(t *testing.T) {
+		th := newTestHarness()
+		iter := newRetryIterator(th, 3)
+		errTest := errors.New("test-error")
+
+		err := iter.streamWithRetry(context.Background(), "token-1", func() (string, error) {
+			return "", errTest
+		}, func(token string) error {
+			return errUnauthenticated
+		})
+		assert.ErrorIs(t, err, errTest)
+	})
+}
+
+func TestGetAllocatedBlocksResumed(t *testing.T) {
+	th := newTestHarness()
+	th.StartingOffset = 1000
+	iter := th.NewTestIterator()
+	iter.Retry = RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Millisecond}.withDefaults()
+
+	mockController := gomock.NewController(t)
+	mockClient := k8sclientmocks.NewMockSnapshotMetadataClient(mockController)
+	defer mockController.Finish()
+
+	// first stream fails after one record
+	stream1 := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+	stream1.EXPECT().Recv().Return(&api.GetMetadataAllocatedResponse{
+		BlockMetadataType:   api.BlockMetadataType_VARIABLE_LENGTH,
+		VolumeCapacityBytes: 100000,
+		BlockMetadata: []*api.BlockMetadata{
+			{ByteOffset: 1000, SizeBytes: 1000},
+			{ByteOffset: 3000, SizeBytes: 1000},
+		},
+	}, nil)
+	stream1.EXPECT().Recv().Return(nil, status.Error(codes.Unavailable, "sidecar restarted"))
+
+	// second stream resumes from the end of the last tuple and overlaps it
+	stream2 := k8sclientmocks.NewMockSnapshotMetadata_GetMetadataAllocatedClient(mockController)
+	stream2.EXPECT().Recv().Return(&api.GetMetadataAllocatedResponse{
+		BlockMetadataType:   api.BlockMetadataType_VARIABLE_LENGTH,
+		VolumeCapacityBytes: 100000,
+		BlockMetadata: []*api.BlockMetadata{
+			{ByteOffset: 3000, SizeBytes: 1000},
+		},
+	}, nil)
+	stream2.EXPECT().Recv().Return(&api.GetMetadataAllocatedResponse{
+		BlockMetadataType:   api.BlockMetadataType_VARIABLE_LENGTH,
+		VolumeCapacityBytes: 100000,
+		BlockMetadata: []*api.BlockMetadata{
+			{ByteOffset: 3500, SizeBytes: 1000},
+			{ByteOffset: 6000, SizeBytes: 1000},
+		},
+	}, nil)
+	stream2.EXPECT().Recv().Return(nil, io.EOF)
+
+	expReq1 := th.FakeGetMetadataAllocatedRequest()
+	expReq2 := th.FakeGetMetadataAllocatedRequest()
+	expReq2.StartingOffset = 4000
+	gomock.InOrder(
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), expReq1).Return(stream1, nil),
+		mockClient.EXPECT().GetMetadataAllocated(gomock.Any(), expReq2).Return(stream2, nil),
+	)
+
+	err := iter.streamWithRetry(context.Background(), th.SecurityToken, nil, func(securityToken string) error {
+		return iter.getAllocatedBlocks(context.Background(), mockClient, securityToken)
+	})
+	assert.NoError(t, err)
+
+	// the record with only duplicate tuples is dropped
+	assert.Equal(t, 2, iter.recordNum)
+	assert.Equal(t, int64(7000), iter.nextOffset)
+
+	recs := th.InSnapshotMetadataIteratorRecordMeta
+	assert.Len(t, recs, 2)
+	assert.Len(t, recs[1].BlockMetadata, 2)
+	assert.Equal(t, int64(4000), recs[1].BlockMetadata[0].ByteOffset) // trimmed
+	assert.Equal(t, int64(500), recs[1].BlockMetadata[0].SizeBytes)
+	assert.Equal(t, int64(6000), recs[1].BlockMetadata[1].ByteOffset)
+}
+
+func TestRemoveEmittedTuples(t *testing.T) {
+	th := newTestHarness()
+	iter := th.NewTestIterator()
+	iter.nextOffset = 4096
+
+	bmds := []*api.BlockMetadata{
+		{ByteOffset: 0, SizeBytes: 4096},
+		{ByteOffset: 2048, SizeBytes: 4096},
+		{ByteOffset: 8192, SizeBytes: 4096},
+	}
+
+	ret := iter.removeEmittedTuples(api.BlockMetadataType_FIXED_LENGTH, bmds)
+	assert.Len(t, ret, 2)
+	assert.Equal(t, int64(2048), ret[0].ByteOffset) // fixed length is not trimmed
+	assert.Equal(t, int64(4096), ret[0].SizeBytes)
+
+	ret = iter.removeEmittedTuples(api.BlockMetadataType_VARIABLE_LENGTH, bmds)
+	assert.Len(t, ret, 2)
+	assert.Equal(t, int64(4096), ret[0].ByteOffset)
+	assert.Equal(t, int64(2048), ret[0].SizeBytes)
+	assert.Equal(t, int64(2048), bmds[1].ByteOffset) // not modified in place
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+// BlockMetadataResult exposes the properties of the metadata enumerated
+// by the sequence or channel it was returned with. They are set when the
+// first record is received from the stream.
+type BlockMetadataResult struct {
+	mux                 sync.Mutex
+	blockMetadataType   api.BlockMetadataType
+	volumeCapacityBytes int64
+	numRecords          int
+}
+
+func (r *BlockMetadataResult) BlockMetadataType() api.BlockMetadataType {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.blockMetadataType
+}
+
+func (r *BlockMetadataResult) VolumeCapacityBytes() int64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.volumeCapacityBytes
+}
+
+// NumRecords returns the number of records received from the stream.
+func (r *BlockMetadataResult) NumRecords() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.numRecords
+}
+
+func (r *BlockMetadataResult) setRecord(recordNumber int, metadata IteratorMetadata) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.blockMetadataType = metadata.BlockMetadataType
+	r.volumeCapacityBytes = metadata.VolumeCapacityBytes
+	r.numRecords = recordNumber
+}
+
+// BlockMetadataOrError is sent on the channel returned by
+// AllocatedBlocksChan and ChangedBlocksChan.
+// Exactly one of the fields is set.
+type BlockMetadataOrError struct {
+	BlockMetadata *api.BlockMetadata
+	Err           error
+}
+
+// AllocatedBlocks returns a sequence of the allocated blocks of the
+// VolumeSnapshot identified by args.SnapshotName.
+// The args.Emitter, args.PrevSnapshotID and args.PrevSnapshotName fields
+// must not be set.
+//
+// The enumeration is performed each time the sequence is iterated, and
+// terminates if the loop exits early. An error is returned as the final
+// element of the sequence.
+func AllocatedBlocks(ctx context.Context, args Args) (iter.Seq2[*api.BlockMetadata, error], *BlockMetadataResult) {
+	return blockMetadataSeq(func(emitter IteratorEmitter) error {
+		if args.PrevSnapshotID != "" || args.PrevSnapshotName != "" {
+			return fmt.Errorf("%w: PrevSnapshotID or PrevSnapshotName specified", ErrInvalidArgs)
+		}
+
+		return getSnapshotMetadataWithEmitter(ctx, args, emitter)
+	})
+}
+
+// ChangedBlocks returns a sequence of the blocks changed between the
+// VolumeSnapshot identified by args.SnapshotName and the one identified
+// by args.PrevSnapshotID or args.PrevSnapshotName.
+// The args.Emitter field must not be set.
+//
+// The enumeration is performed each time the sequence is iterated, and
+// terminates if the loop exits early. An error is returned as the final
+// element of the sequence.
+func ChangedBlocks(ctx context.Context, args Args) (iter.Seq2[*api.BlockMetadata, error], *BlockMetadataResult) {
+	return blockMetadataSeq(func(emitter IteratorEmitter) error {
+		if args.PrevSnapshotID == "" && args.PrevSnapshotName == "" {
+			return fmt.Errorf("%w: missing PrevSnapshotID or PrevSnapshotName", ErrInvalidArgs)
+		}
+
+		return getSnapshotMetadataWithEmitter(ctx, args, emitter)
+	})
+}
+
+// AllocatedBlocksChan performs the enumeration of AllocatedBlocks in a
+// goroutine and sends the blocks on a channel with the given buffer size.
+// The channel is closed when the enumeration terminates.
+// The enumeration can be terminated early by canceling the context.
+func AllocatedBlocksChan(ctx context.Context, args Args, bufferSize int) (<-chan BlockMetadataOrError, *BlockMetadataResult) {
+	seq, result := AllocatedBlocks(ctx, args)
+
+	return blockMetadataChan(ctx, seq, bufferSize), result
+}
+
+// ChangedBlocksChan performs the enumeration of ChangedBlocks in a
+// goroutine and sends the blocks on a channel with the given buffer size.
+// The channel is closed when the enumeration terminates.
+// The enumeration can be terminated early by canceling the context.
+func ChangedBlocksChan(ctx context.Context, args Args, bufferSize int) (<-chan BlockMetadataOrError, *BlockMetadataResult) {
+	seq, result := ChangedBlocks(ctx, args)
+
+	return blockMetadataChan(ctx, seq, bufferSize), result
+}
+
+func getSnapshotMetadataWithEmitter(ctx context.Context, args Args, emitter IteratorEmitter) error {
+	if args.Emitter != nil {
+		return fmt.Errorf("%w: Emitter specified", ErrInvalidArgs)
+	}
+
+	args.Emitter = emitter
+
+	return GetSnapshotMetadata(ctx, args)
+}
+
+// seqEmitter yields each tuple of the records it receives.
+type seqEmitter struct {
+	result *BlockMetadataResult
+	yield  func(*api.BlockMetadata, error) bool
+}
+
+func (e *seqEmitter) SnapshotMetadataIteratorRecord(recordNumber int, metadata IteratorMetadata) error {
+	e.result.setRecord(recordNumber, metadata)
+
+	for _, bmd := range metadata.BlockMetadata {
+		if !e.yield(bmd, nil) {
+			return ErrCancelled
+		}
+	}
+
+	return nil
+}
+
+func (e *seqEmitter) SnapshotMetadataIteratorDone(_ int) error {
+	return nil
+}
+
+// blockMetadataSeq returns a sequence that invokes runFn with an emitter
+// that yields the tuples of each record.
+func blockMetadataSeq(runFn func(emitter IteratorEmitter) error) (iter.Seq2[*api.BlockMetadata, error], *BlockMetadataResult) {
+	result := &BlockMetadataResult{}
+
+	seq := func(yield func(*api.BlockMetadata, error) bool) {
+		emitter := &seqEmitter{
+			result: result,
+			yield:  yield,
+		}
+
+		if err := runFn(emitter); err != nil && !errors.Is(err, ErrCancelled) {
+			yield(nil, err)
+		}
+	}
+
+	return seq, result
+}
+
+func blockMetadataChan(ctx context.Context, seq iter.Seq2[*api.BlockMetadata, error], bufferSize int) <-chan BlockMetadataOrError {
+	ch := make(chan BlockMetadataOrError, bufferSize)
+
+	go func() {
+		defer close(ch)
+
+		for bmd, err := range seq {
+			select {
+			case ch <- BlockMetadataOrError{BlockMetadata: bmd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+func TestBlockMetadataSeq(t *testing.T) {
+	errTest := errors.New("test-error")
+
+	records := []IteratorMetadata{
+		{
+			BlockMetadataType:   api.BlockMetadataType_FIXED_LENGTH,
+			VolumeCapacityBytes: 1 << 20,
+			BlockMetadata: []*api.BlockMetadata{
+				{ByteOffset: 0, SizeBytes: 4096},
+				{ByteOffset: 4096, SizeBytes: 4096},
+			},
+		},
+		{
+			BlockMetadataType:   api.BlockMetadataType_FIXED_LENGTH,
+			VolumeCapacityBytes: 1 << 20,
+			BlockMetadata: []*api.BlockMetadata{
+				{ByteOffset: 16384, SizeBytes: 4096},
+			},
+		},
+	}
+
+	// fakeRunFn emits the records and then returns retErr.
+	fakeRunFn := func(retErr error, emitErr *error) func(emitter IteratorEmitter) error {
+		return func(emitter IteratorEmitter) error {
+			for i, rec := range records {
+				if err := emitter.SnapshotMetadataIteratorRecord(i+1, rec); err != nil {
+					*emitErr = err
+					return err
+				}
+			}
+			return retErr
+		}
+	}
+
+	t.Run("all", func(t *testing.T) {
+		var emitErr error
+		seq, result := blockMetadataSeq(fakeRunFn(nil, &emitErr))
+
+		offsets := []int64{}
+		for bmd, err := range seq {
+			assert.NoError(t, err)
+			offsets = append(offsets, bmd.ByteOffset)
+		}
+
+		assert.Equal(t, []int64{0, 4096, 16384}, offsets)
+		assert.Equal(t, api.BlockMetadataType_FIXED_LENGTH, result.BlockMetadataType())
+		assert.Equal(t, int64(1<<20), result.VolumeCapacityBytes())
+		assert.Equal(t, 2, result.NumRecords())
+	})
+
+	t.Run("stop-early", func(t *testing.T) {
+		var emitErr error
+		seq, result := blockMetadataSeq(fakeRunFn(nil, &emitErr))
+
+		for bmd, err := range seq {
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), bmd.ByteOffset)
+			break
+		}
+
+		assert.ErrorIs(t, emitErr, ErrCancelled)
+		assert.Equal(t, 1, result.NumRecords())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var emitErr error
+		seq, _ := blockMetadataSeq(fakeRunFn(errTest, &emitErr))
+
+		var lastErr error
+		numBlocks := 0
+		for bmd, err := range seq {
+			if err != nil {
+				assert.Nil(t, bmd)
+				lastErr = err
+				continue
+			}
+			numBlocks++
+		}
+
+		assert.Equal(t, 3, numBlocks)
+		assert.ErrorIs(t, lastErr, errTest)
+	})
+
+	t.Run("chan", func(t *testing.T) {
+		var emitErr error
+		seq, _ := blockMetadataSeq(fakeRunFn(errTest, &emitErr))
+
+		items := []BlockMetadataOrError{}
+		for item := range blockMetadataChan(context.Background(), seq, 1) {
+			items = append(items, item)
+		}
+
+		assert.Len(t, items, 4)
+		assert.Equal(t, int64(16384), items[2].BlockMetadata.ByteOffset)
+		assert.ErrorIs(t, items[3].Err, errTest)
+	})
+
+	t.Run("chan-canceled", func(t *testing.T) {
+		var emitErr error
+		seq, _ := blockMetadataSeq(fakeRunFn(nil, &emitErr))
+
+		ctx, cancelFn := context.WithCancel(context.Background())
+		ch := blockMetadataChan(ctx, seq, 0)
+
+		item := <-ch
+		assert.Equal(t, int64(0), item.BlockMetadata.ByteOffset)
+		cancelFn()
+
+		for range ch { // drain until closed
+		}
+
+		assert.ErrorIs(t, emitErr, ErrCancelled)
+	})
+}
+
+func TestAllocatedAndChangedBlocks(t *testing.T) {
+	firstErr := func(seq func(func(*api.BlockMetadata, error) bool)) error {
+		for _, err := range seq {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	t.Run("allocated-with-prev-snapshot", func(t *testing.T) {
+		th := newTestHarness()
+		seq, _ := AllocatedBlocks(context.Background(), th.Args())
+		err := firstErr(seq)
+		assert.ErrorIs(t, err, ErrInvalidArgs)
+		assert.ErrorContains(t, err, "PrevSnapshotID or PrevSnapshotName specified")
+	})
+
+	t.Run("changed-without-prev-snapshot", func(t *testing.T) {
+		th := newTestHarness()
+		args := th.Args()
+		args.PrevSnapshotName = ""
+		seq, _ := ChangedBlocks(context.Background(), args)
+		err := firstErr(seq)
+		assert.ErrorIs(t, err, ErrInvalidArgs)
+		assert.ErrorContains(t, err, "missing PrevSnapshotID")
+	})
+
+	t.Run("emitter-specified", func(t *testing.T) {
+		th := newTestHarness()
+		seq, _ := ChangedBlocks(context.Background(), th.Args())
+		err := firstErr(seq)
+		assert.ErrorIs(t, err, ErrInvalidArgs)
+		assert.ErrorContains(t, err, "Emitter specified")
+	})
+
+	t.Run("enumeration-error", func(t *testing.T) {
+		th := newTestHarness()
+		args := th.Args()
+		args.Emitter = nil
+		args.PrevSnapshotName = ""
+		ch, _ := AllocatedBlocksChan(context.Background(), args, 1)
+		item := <-ch
+		assert.ErrorContains(t, item.Err, "VolumeSnapshots.Get")
+
+		_, ok := <-ch
+		assert.False(t, ok)
+	})
+
+	t.Run("changed-chan", func(t *testing.T) {
+		th := newTestHarness()
+		args := th.Args()
+		args.Emitter = nil
+		ch, _ := ChangedBlocksChan(context.Background(), args, 1)
+		item := <-ch
+		assert.ErrorContains(t, item.Err, "VolumeSnapshots.Get")
+	})
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var ErrTokenAudience = errors.New("security token does not have the required audience")
+
+// TokenSource provides the security token passed to the
+// SnapshotMetadata service.
+type TokenSource interface {
+	// SecurityToken returns a token for the audience specified in the
+	// SnapshotMetadataService CR. It is invoked at the start of the
+	// enumeration and again if a resumed stream needs a fresh token.
+	SecurityToken(ctx context.Context, audience string) (string, error)
+}
+
+// TokenRequestTokenSource creates a token for a ServiceAccount with the
+// TokenRequest API. The invoker must be permitted to create the
+// serviceaccounts/token subresource.
+type TokenRequestTokenSource struct {
+	KubeClient  kubernetes.Interface
+	SANamespace string
+	SAName      string
+
+	// ExpirySecs specifies the time in seconds after which the
+	// token will expire.
+	// If unspecified then the value of DefaultTokenExpirySeconds is used.
+	ExpirySecs int64
+}
+
+func (ts *TokenRequestTokenSource) SecurityToken(ctx context.Context, audience string) (string, error) {
+	expirySecs := ts.ExpirySecs
+	if expirySecs == 0 {
+		expirySecs = DefaultTokenExpirySeconds
+	}
+
+	tokenResp, err := createTokenRequest(ctx, ts.KubeClient, ts.SANamespace, ts.SAName, audience, expirySecs)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenResp.Status.Token, nil
+}
+
+// ProjectedTokenSource reads a token from a projected service account
+// token volume. The file is read on every invocation, so a token rotated
+// by the kubelet is picked up. The audience of the projected token must
+// match that of the SnapshotMetadataService CR.
+type ProjectedTokenSource struct {
+	// Path is the name of the token file.
+	Path string
+}
+
+func (ts *ProjectedTokenSource) SecurityToken(_ context.Context, audience string) (string, error) {
+	data, err := os.ReadFile(ts.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token(%q): %w", ts.Path, err)
+	}
+
+	token := strings.TrimSpace(string(data))
+
+	audiences, err := tokenAudiences(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode token(%q): %w", ts.Path, err)
+	}
+
+	if !slices.Contains(audiences, audience) {
+		return "", fmt.Errorf("%w: token(%q) audiences %v do not include %q", ErrTokenAudience, ts.Path, audiences, audience)
+	}
+
+	return token, nil
+}
+
+// StaticTokenSource returns a fixed token regardless of the audience.
+type StaticTokenSource struct {
+	Token string
+}
+
+func (ts *StaticTokenSource) SecurityToken(_ context.Context, _ string) (string, error) {
+	return ts.Token, nil
+}
+
+func createTokenRequest(ctx context.Context, kubeClient kubernetes.Interface, saNamespace, sa, audience string, expirySecs int64) (*authv1.TokenRequest, error) {
+	tokenRequest := authv1.TokenRequest{
+		Spec: authv1.TokenRequestSpec{
+			Audiences:         []string{audience},
+			ExpirationSeconds: &expirySecs,
+		},
+	}
+
+	tokenResp, err := kubeClient.CoreV1().ServiceAccounts(saNamespace).
+		CreateToken(ctx, sa, &tokenRequest, apimetav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("ServiceAccounts.CreateToken(%s/%s): %w", saNamespace, sa, classifyAPIError(err))
+	}
+
+	return tokenResp, nil
+}
+
+// tokenAudiences returns the "aud" claim of a JWT without verifying it.
+func tokenAudiences(token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	claims := struct {
+		Aud json.RawMessage `json:"aud"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	// the claim is either a string or an array of strings
+	var aud string
+	if err := json.Unmarshal(claims.Aud, &aud); err == nil {
+		return []string{aud}, nil
+	}
+
+	var auds []string
+	if err := json.Unmarshal(claims.Aud, &auds); err != nil {
+		return nil, fmt.Errorf("invalid aud claim: %w", err)
+	}
+
+	return auds, nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authv1 "k8s.io/api/authentication/v1"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+)
+
+func fakeJWT(payload string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".signature"
+}
+
+func TestTokenRequestTokenSource(t *testing.T) {
+	th := newTestHarness()
+
+	var expirySecs int64
+	th.FakeKubeClient.PrependReactor("create", "serviceaccounts", func(action clientgotesting.Action) (handled bool, ret apiruntime.Object, err error) {
+		tr := action.(clientgotesting.CreateAction).GetObject().(*authv1.TokenRequest)
+		assert.Equal(t, []string{th.Audience}, tr.Spec.Audiences)
+		expirySecs = *tr.Spec.ExpirationSeconds
+		return true, th.FakeTokenRequest(), nil
+	})
+
+	ts := &TokenRequestTokenSource{
+		KubeClient:  th.FakeKubeClient,
+		SANamespace: th.SANamespace,
+		SAName:      th.SAName,
+	}
+
+	token, err := ts.SecurityToken(context.Background(), th.Audience)
+	assert.NoError(t, err)
+	assert.Equal(t, th.SecurityToken, token)
+	assert.Equal(t, DefaultTokenExpirySeconds, expirySecs)
+
+	ts.ExpirySecs = 60
+	_, err = ts.SecurityToken(context.Background(), th.Audience)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(60), expirySecs)
+
+	ts.SAName = "no-such-sa"
+	th.FakeKubeClient.ReactionChain = th.FakeKubeClient.ReactionChain[1:]
+	_, err = ts.SecurityToken(context.Background(), th.Audience)
+	assert.ErrorContains(t, err, "ServiceAccounts.CreateToken")
+}
+
+func TestProjectedTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	ts := &ProjectedTokenSource{Path: path}
+
+	_, err := ts.SecurityToken(context.Background(), "audience")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	token1 := fakeJWT(`{"aud":"audience","sub":"1"}`)
+	assert.NoError(t, os.WriteFile(path, []byte(token1+"\n"), 0600))
+	token, err := ts.SecurityToken(context.Background(), "audience")
+	assert.NoError(t, err)
+	assert.Equal(t, token1, token)
+
+	// rotated
+	token2 := fakeJWT(`{"aud":["other","audience"],"sub":"2"}`)
+	assert.NoError(t, os.WriteFile(path, []byte(token2), 0600))
+	token, err = ts.SecurityToken(context.Background(), "audience")
+	assert.NoError(t, err)
+	assert.Equal(t, token2, token)
+
+	_, err = ts.SecurityToken(context.Background(), "wrong-audience")
+	assert.ErrorIs(t, err, ErrTokenAudience)
+
+	for _, invalid := range []string{"not-a-jwt", "a.!!!.c", fakeJWT("{"), fakeJWT(`{"aud":1}`)} {
+		assert.NoError(t, os.WriteFile(path, []byte(invalid), 0600))
+		_, err = ts.SecurityToken(context.Background(), "audience")
+		assert.ErrorContains(t, err, "failed to decode token", invalid)
+	}
+}
+
+func TestStaticTokenSource(t *testing.T) {
+	ts := &StaticTokenSource{Token: "token"}
+	token, err := ts.SecurityToken(context.Background(), "audience")
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token)
+}
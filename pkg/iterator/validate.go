@@ -0,0 +1,109 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+var ErrInvalidMetadata = errors.New("invalid block metadata")
+
+// ValidatingEmitter checks the invariants of the metadata streamed by the
+// CSI driver before passing each record to the wrapped Emitter:
+//   - every record has the same known BlockMetadataType and the same
+//     positive VolumeCapacityBytes,
+//   - the tuples have a positive size, are in increasing byte offset order
+//     and do not overlap, both within and across records,
+//   - the tuples lie within the volume capacity,
+//   - the tuples of FIXED_LENGTH metadata are all of the same size, other
+//     than a shorter block at the end of the volume.
+//
+// The enumeration fails with ErrInvalidMetadata on the first violation,
+// and the record is not passed to the wrapped Emitter.
+// A ValidatingEmitter must not be used for more than one enumeration.
+type ValidatingEmitter struct {
+	// Emitter receives the records that pass validation.
+	Emitter IteratorEmitter
+
+	numRecords          int
+	blockMetadataType   api.BlockMetadataType
+	volumeCapacityBytes int64
+	fixedSizeBytes      int64
+	nextOffset          int64
+}
+
+func (e *ValidatingEmitter) SnapshotMetadataIteratorRecord(recordNumber int, metadata IteratorMetadata) error {
+	if err := e.validateRecord(metadata); err != nil {
+		return fmt.Errorf("%w: record %d: %s", ErrInvalidMetadata, recordNumber, err)
+	}
+
+	return e.Emitter.SnapshotMetadataIteratorRecord(recordNumber, metadata)
+}
+
+func (e *ValidatingEmitter) SnapshotMetadataIteratorDone(numberRecords int) error {
+	return e.Emitter.SnapshotMetadataIteratorDone(numberRecords)
+}
+
+func (e *ValidatingEmitter) validateRecord(metadata IteratorMetadata) error {
+	if e.numRecords == 0 {
+		switch {
+		case metadata.BlockMetadataType != api.BlockMetadataType_FIXED_LENGTH && metadata.BlockMetadataType != api.BlockMetadataType_VARIABLE_LENGTH:
+			return fmt.Errorf("unsupported BlockMetadataType %s", metadata.BlockMetadataType)
+		case metadata.VolumeCapacityBytes <= 0:
+			return fmt.Errorf("invalid VolumeCapacityBytes %d", metadata.VolumeCapacityBytes)
+		}
+
+		e.blockMetadataType = metadata.BlockMetadataType
+		e.volumeCapacityBytes = metadata.VolumeCapacityBytes
+	}
+
+	switch {
+	case metadata.BlockMetadataType != e.blockMetadataType:
+		return fmt.Errorf("BlockMetadataType changed from %s to %s", e.blockMetadataType, metadata.BlockMetadataType)
+	case metadata.VolumeCapacityBytes != e.volumeCapacityBytes:
+		return fmt.Errorf("VolumeCapacityBytes changed from %d to %d", e.volumeCapacityBytes, metadata.VolumeCapacityBytes)
+	}
+
+	e.numRecords++
+
+	for i, bmd := range metadata.BlockMetadata {
+		end := bmd.ByteOffset + bmd.SizeBytes
+
+		switch {
+		case bmd.SizeBytes <= 0:
+			return fmt.Errorf("tuple %d: invalid SizeBytes %d", i, bmd.SizeBytes)
+		case bmd.ByteOffset < e.nextOffset:
+			return fmt.Errorf("tuple %d: ByteOffset %d overlaps or precedes the previous tuple ending at %d", i, bmd.ByteOffset, e.nextOffset)
+		case end > e.volumeCapacityBytes:
+			return fmt.Errorf("tuple %d: extent [%d, %d) exceeds VolumeCapacityBytes %d", i, bmd.ByteOffset, end, e.volumeCapacityBytes)
+		case e.blockMetadataType == api.BlockMetadataType_FIXED_LENGTH && e.fixedSizeBytes != 0 && bmd.SizeBytes != e.fixedSizeBytes &&
+			!(bmd.SizeBytes < e.fixedSizeBytes && end == e.volumeCapacityBytes): // a short last block
+			return fmt.Errorf("tuple %d: SizeBytes %d differs from the fixed block size %d", i, bmd.SizeBytes, e.fixedSizeBytes)
+		}
+
+		if e.blockMetadataType == api.BlockMetadataType_FIXED_LENGTH && e.fixedSizeBytes == 0 {
+			e.fixedSizeBytes = bmd.SizeBytes
+		}
+
+		e.nextOffset = end
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/api"
+)
+
+func TestValidatingEmitter(t *testing.T) {
+	const capacity = int64(1 << 20)
+
+	record := func(bmt api.BlockMetadataType, capacity int64, tuples ...int64) IteratorMetadata {
+		md := IteratorMetadata{
+			BlockMetadataType:   bmt,
+			VolumeCapacityBytes: capacity,
+		}
+		for i := 0; i+1 < len(tuples); i += 2 {
+			md.BlockMetadata = append(md.BlockMetadata, &api.BlockMetadata{ByteOffset: tuples[i], SizeBytes: tuples[i+1]})
+		}
+		return md
+	}
+
+	fixed := api.BlockMetadataType_FIXED_LENGTH
+	variable := api.BlockMetadataType_VARIABLE_LENGTH
+
+	for _, tc := range []struct {
+		name       string
+		records    []IteratorMetadata
+		expErr     string
+		expRecords int
+	}{
+		{
+			name: "valid-fixed",
+			records: []IteratorMetadata{
+				record(fixed, capacity, 0, 4096, 8192, 4096),
+				record(fixed, capacity),
+				record(fixed, capacity, 12288, 4096, capacity-1024, 1024), // short last block
+			},
+			expRecords: 3,
+		},
+		{
+			name: "valid-variable",
+			records: []IteratorMetadata{
+				record(variable, capacity, 0, 4096, 4096, 65536),
+				record(variable, capacity, 69632, 1024),
+			},
+			expRecords: 2,
+		},
+		{
+			name:    "unknown-type",
+			records: []IteratorMetadata{record(api.BlockMetadataType_UNKNOWN, capacity, 0, 4096)},
+			expErr:  "record 1: unsupported BlockMetadataType UNKNOWN",
+		},
+		{
+			name:    "invalid-capacity",
+			records: []IteratorMetadata{record(fixed, 0, 0, 4096)},
+			expErr:  "record 1: invalid VolumeCapacityBytes 0",
+		},
+		{
+			name:       "type-changed",
+			records:    []IteratorMetadata{record(fixed, capacity, 0, 4096), record(variable, capacity, 4096, 4096)},
+			expErr:     "record 2: BlockMetadataType changed from FIXED_LENGTH to VARIABLE_LENGTH",
+			expRecords: 1,
+		},
+		{
+			name:       "capacity-changed",
+			records:    []IteratorMetadata{record(fixed, capacity, 0, 4096), record(fixed, 2*capacity, 4096, 4096)},
+			expErr:     "record 2: VolumeCapacityBytes changed",
+			expRecords: 1,
+		},
+		{
+			name:    "invalid-size",
+			records: []IteratorMetadata{record(variable, capacity, 0, 0)},
+			expErr:  "record 1: tuple 0: invalid SizeBytes 0",
+		},
+		{
+			name:    "overlap-within-record",
+			records: []IteratorMetadata{record(variable, capacity, 0, 8192, 4096, 4096)},
+			expErr:  "record 1: tuple 1: ByteOffset 4096 overlaps",
+		},
+		{
+			name:       "unsorted-across-records",
+			records:    []IteratorMetadata{record(fixed, capacity, 8192, 4096), record(fixed, capacity, 0, 4096)},
+			expErr:     "record 2: tuple 0: ByteOffset 0 overlaps or precedes",
+			expRecords: 1,
+		},
+		{
+			name:    "beyond-capacity",
+			records: []IteratorMetadata{record(variable, capacity, capacity-4096, 8192)},
+			expErr:  "exceeds VolumeCapacityBytes",
+		},
+		{
+			name:    "fixed-size-mismatch",
+			records: []IteratorMetadata{record(fixed, capacity, 0, 4096, 4096, 8192)},
+			expErr:  "record 1: tuple 1: SizeBytes 8192 differs from the fixed block size 4096",
+		},
+		{
+			name:    "fixed-short-block-not-at-end",
+			records: []IteratorMetadata{record(fixed, capacity, 0, 4096, 4096, 1024)},
+			expErr:  "SizeBytes 1024 differs",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			th := newTestHarness()
+			e := &ValidatingEmitter{Emitter: th}
+
+			var err error
+			for i, rec := range tc.records {
+				if err = e.SnapshotMetadataIteratorRecord(i+1, rec); err != nil {
+					break
+				}
+			}
+
+			if tc.expErr == "" {
+				assert.NoError(t, err)
+				assert.NoError(t, e.SnapshotMetadataIteratorDone(len(tc.records)))
+				assert.Equal(t, len(tc.records), th.InSnapshotMetadataIteratorDoneNR)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidMetadata)
+				assert.ErrorContains(t, err, tc.expErr)
+			}
+
+			assert.Len(t, th.InSnapshotMetadataIteratorRecordMeta, tc.expRecords)
+		})
+	}
+}
+
+func TestNewIteratorValidateMetadata(t *testing.T) {
+	th := newTestHarness()
+	args := th.Args()
+	args.ValidateMetadata = true
+
+	iter := newIterator(args)
+	ve, ok := iter.Emitter.(*ValidatingEmitter)
+	assert.True(t, ok)
+	assert.Equal(t, args.Emitter, ve.Emitter)
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"fmt"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// waitForSnapshotsReady watches the VolumeSnapshot identified by
+// SnapshotName and, if specified, the one identified by PrevSnapshotName,
+// together with their bound VolumeSnapshotContent objects, until they are
+// all ready to use. It fails with ErrSnapshotNotReady if this does not
+// happen within the WaitForReady duration, and with ErrSnapshotFailed if
+// the status of any of the objects reports an error.
+func (iter *iterator) waitForSnapshotsReady(ctx context.Context) error {
+	waitCtx, cancelFn := context.WithTimeout(ctx, iter.WaitForReady)
+	defer cancelFn()
+
+	names := []string{iter.SnapshotName}
+	if iter.PrevSnapshotID == "" && iter.PrevSnapshotName != "" {
+		names = append(names, iter.PrevSnapshotName)
+	}
+
+	for _, name := range names {
+		vs, err := iter.waitForVolumeSnapshot(waitCtx, name)
+		if err == nil {
+			err = iter.waitForVolumeSnapshotContent(waitCtx, *vs.Status.BoundVolumeSnapshotContentName)
+		}
+
+		if err != nil && waitCtx.Err() != nil && ctx.Err() == nil {
+			return fmt.Errorf("%w: VolumeSnapshot %s/%s not ready after %s", ErrSnapshotNotReady, iter.Namespace, name, iter.WaitForReady)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (iter *iterator) waitForVolumeSnapshot(ctx context.Context, name string) (*snapshotv1.VolumeSnapshot, error) {
+	client := iter.SnapshotClient.SnapshotV1().VolumeSnapshots(iter.Namespace)
+
+	var readyVS *snapshotv1.VolumeSnapshot
+
+	err := waitForObject(ctx, name,
+		func(ctx context.Context, opts apimetav1.ListOptions) ([]*snapshotv1.VolumeSnapshot, string, error) {
+			list, err := client.List(ctx, opts)
+			if err != nil {
+				return nil, "", fmt.Errorf("VolumeSnapshots.List(%s/%s): %w", iter.Namespace, name, classifyAPIError(err))
+			}
+
+			items := make([]*snapshotv1.VolumeSnapshot, 0, len(list.Items))
+			for i := range list.Items {
+				items = append(items, &list.Items[i])
+			}
+
+			return items, list.ResourceVersion, nil
+		},
+		client.Watch,
+		func(vs *snapshotv1.VolumeSnapshot) (bool, error) {
+			switch {
+			case vs.Status == nil:
+				return false, nil
+			case vs.Status.Error != nil && vs.Status.Error.Message != nil:
+				return false, fmt.Errorf("%w: VolumeSnapshot %s/%s: %s", ErrSnapshotFailed, vs.Namespace, vs.Name, *vs.Status.Error.Message)
+			case vs.Status.BoundVolumeSnapshotContentName == nil || vs.Status.ReadyToUse == nil || !*vs.Status.ReadyToUse:
+				return false, nil
+			}
+
+			readyVS = vs
+
+			return true, nil
+		})
+
+	return readyVS, err
+}
+
+func (iter *iterator) waitForVolumeSnapshotContent(ctx context.Context, name string) error {
+	client := iter.SnapshotClient.SnapshotV1().VolumeSnapshotContents()
+
+	return waitForObject(ctx, name,
+		func(ctx context.Context, opts apimetav1.ListOptions) ([]*snapshotv1.VolumeSnapshotContent, string, error) {
+			list, err := client.List(ctx, opts)
+			if err != nil {
+				return nil, "", fmt.Errorf("VolumeSnapshotContents.List(%s): %w", name, classifyAPIError(err))
+			}
+
+			items := make([]*snapshotv1.VolumeSnapshotContent, 0, len(list.Items))
+			for i := range list.Items {
+				items = append(items, &list.Items[i])
+			}
+
+			return items, list.ResourceVersion, nil
+		},
+		client.Watch,
+		func(vsc *snapshotv1.VolumeSnapshotContent) (bool, error) {
+			switch {
+			case vsc.Status == nil:
+				return false, nil
+			case vsc.Status.Error != nil && vsc.Status.Error.Message != nil:
+				return false, fmt.Errorf("%w: VolumeSnapshotContent %s: %s", ErrSnapshotFailed, vsc.Name, *vsc.Status.Error.Message)
+			}
+
+			return vsc.Status.SnapshotHandle != nil && vsc.Status.ReadyToUse != nil && *vsc.Status.ReadyToUse, nil
+		})
+}
+
+// waitForObject lists the named object and then watches it until readyFn
+// returns true or an error. The object is listed again if the watch is
+// closed by the server.
+func waitForObject[T apimetav1.Object](
+	ctx context.Context,
+	name string,
+	listFn func(ctx context.Context, opts apimetav1.ListOptions) ([]T, string, error),
+	watchFn func(ctx context.Context, opts apimetav1.ListOptions) (watch.Interface, error),
+	readyFn func(obj T) (bool, error),
+) error {
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", name).String()
+
+	for {
+		items, resourceVersion, err := listFn(ctx, apimetav1.ListOptions{FieldSelector: fieldSelector})
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range items {
+			if obj.GetName() != name {
+				continue
+			}
+
+			if ready, err := readyFn(obj); ready || err != nil {
+				return err
+			}
+		}
+
+		w, err := watchFn(ctx, apimetav1.ListOptions{FieldSelector: fieldSelector, ResourceVersion: resourceVersion})
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %w", name, classifyAPIError(err))
+		}
+
+		done, err := consumeWatchEvents(ctx, w, name, readyFn)
+		w.Stop()
+
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// consumeWatchEvents returns true when readyFn returns true or an error,
+// and false if the watch is closed.
+func consumeWatchEvents[T apimetav1.Object](ctx context.Context, w watch.Interface, name string, readyFn func(obj T) (bool, error)) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case event, ok := <-w.ResultChan():
+			if !ok || event.Type == watch.Error {
+				return false, nil
+			}
+
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				continue
+			}
+
+			obj, ok := event.Object.(T)
+			if !ok || obj.GetName() != name {
+				continue
+			}
+
+			if ready, err := readyFn(obj); ready || err != nil {
+				return true, err
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iterator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	"github.com/stretchr/testify/assert"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWaitForSnapshotsReady(t *testing.T) {
+	readyVS := func(th *testHarness, name string) (*snapshotv1.VolumeSnapshot, *snapshotv1.VolumeSnapshotContent) {
+		th.SnapshotName = name
+		vs, vsc := th.FakeVS()
+		ready := true
+		vs.Status.ReadyToUse = &ready
+		vsc.Status.ReadyToUse = &ready
+		return vs, vsc
+	}
+
+	createObjects := func(t *testing.T, th *testHarness, vs *snapshotv1.VolumeSnapshot, vsc *snapshotv1.VolumeSnapshotContent) {
+		_, err := th.FakeSnapshotClient.SnapshotV1().VolumeSnapshots(vs.Namespace).Create(context.Background(), vs, apimetav1.CreateOptions{})
+		assert.NoError(t, err)
+		_, err = th.FakeSnapshotClient.SnapshotV1().VolumeSnapshotContents().Create(context.Background(), vsc, apimetav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+
+	// waitForWatches waits until the fake client has been asked for the given number of watches.
+	waitForWatches := func(th *testHarness, n int) {
+		for {
+			numWatches := 0
+			for _, action := range th.FakeSnapshotClient.Actions() {
+				if action.GetVerb() == "watch" {
+					numWatches++
+				}
+			}
+			if numWatches >= n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("already-ready", func(t *testing.T) {
+		th := newTestHarness()
+		vs, vsc := readyVS(th, "snap")
+		createObjects(t, th, vs, vsc)
+		pvs, pvsc := readyVS(th, "prev")
+		createObjects(t, th, pvs, pvsc)
+
+		iter := th.NewTestIterator()
+		iter.SnapshotName = "snap"
+		iter.PrevSnapshotName = "prev"
+		iter.WaitForReady = time.Minute
+
+		assert.NoError(t, iter.waitForSnapshotsReady(context.Background()))
+	})
+
+	t.Run("becomes-ready", func(t *testing.T) {
+		th := newTestHarness()
+		vs, vsc := readyVS(th, "snap")
+		notReadyVS := vs.DeepCopy()
+		notReadyVS.Status = nil
+		_, err := th.FakeSnapshotClient.SnapshotV1().VolumeSnapshots(vs.Namespace).Create(context.Background(), notReadyVS, apimetav1.CreateOptions{})
+		assert.NoError(t, err)
+
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.WaitForReady = time.Minute
+
+		errCh := make(chan error)
+		go func() {
+			errCh <- iter.waitForSnapshotsReady(context.Background())
+		}()
+
+		waitForWatches(th, 1)
+		_, err = th.FakeSnapshotClient.SnapshotV1().VolumeSnapshots(vs.Namespace).Update(context.Background(), vs, apimetav1.UpdateOptions{})
+		assert.NoError(t, err)
+
+		waitForWatches(th, 2)
+		_, err = th.FakeSnapshotClient.SnapshotV1().VolumeSnapshotContents().Create(context.Background(), vsc, apimetav1.CreateOptions{})
+		assert.NoError(t, err)
+
+		assert.NoError(t, <-errCh)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		th := newTestHarness()
+		vs, vsc := readyVS(th, "snap")
+		createObjects(t, th, vs, vsc)
+
+		iter := th.NewTestIterator()
+		iter.SnapshotName = "snap"
+		iter.PrevSnapshotName = "prev" // does not exist
+		iter.WaitForReady = time.Millisecond * 50
+
+		err := iter.waitForSnapshotsReady(context.Background())
+		assert.ErrorIs(t, err, ErrSnapshotNotReady)
+		assert.ErrorContains(t, err, "namespace/prev")
+		assert.True(t, IsRetryable(err))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		th := newTestHarness()
+
+		iter := th.NewTestIterator()
+		iter.WaitForReady = time.Minute
+
+		ctx, cancelFn := context.WithCancel(context.Background())
+		cancelFn()
+
+		err := iter.waitForSnapshotsReady(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.NotErrorIs(t, err, ErrSnapshotNotReady)
+	})
+
+	t.Run("snapshot-failed", func(t *testing.T) {
+		th := newTestHarness()
+		vs, vsc := readyVS(th, "snap")
+		msg := "snapshot failed"
+		vs.Status.ReadyToUse = nil
+		vs.Status.Error = &snapshotv1.VolumeSnapshotError{Message: &msg}
+		createObjects(t, th, vs, vsc)
+
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.WaitForReady = time.Minute
+
+		err := iter.waitForSnapshotsReady(context.Background())
+		assert.ErrorIs(t, err, ErrSnapshotFailed)
+		assert.ErrorContains(t, err, msg)
+		assert.False(t, IsRetryable(err))
+	})
+
+	t.Run("snapshot-content-failed", func(t *testing.T) {
+		th := newTestHarness()
+		vs, vsc := readyVS(th, "snap")
+		msg := "snapshot content failed"
+		vsc.Status.Error = &snapshotv1.VolumeSnapshotError{Message: &msg}
+		createObjects(t, th, vs, vsc)
+
+		iter := th.NewTestIterator()
+		iter.PrevSnapshotName = ""
+		iter.WaitForReady = time.Minute
+
+		err := iter.waitForSnapshotsReady(context.Background())
+		assert.ErrorIs(t, err, ErrSnapshotFailed)
+		assert.ErrorContains(t, err, msg)
+	})
+}
+
+func TestRunWaitForReady(t *testing.T) {
+	th := newTestHarness()
+	th.RetWaitForSnapshotsReadyErr = errors.New("test-error")
+
+	iter := th.NewTestIterator()
+	iter.WaitForReady = time.Minute
+
+	err := iter.run(context.Background())
+	assert.ErrorIs(t, err, th.RetWaitForSnapshotsReadyErr)
+	assert.True(t, th.CalledWaitForSnapshotsReady)
+	assert.False(t, th.CalledGetCSIDriverFromPrimarySnapshot)
+
+	th = newTestHarness()
+	th.RetGetCSIDriverFromPrimarySnapshotErr = errors.New("test-error")
+	iter = th.NewTestIterator()
+
+	err = iter.run(context.Background())
+	assert.ErrorIs(t, err, th.RetGetCSIDriverFromPrimarySnapshotErr)
+	assert.False(t, th.CalledWaitForSnapshotsReady)
+}
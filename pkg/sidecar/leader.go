@@ -0,0 +1,146 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// leaseNamePrefix is the prefix of the name of the leader election Lease.
+	leaseNamePrefix = "external-snapshot-metadata-"
+
+	// inClusterNamespaceFile contains the namespace of the pod.
+	inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// leaderElectionConfig configures the election of a leader among the
+// replicas of the sidecar.
+type leaderElectionConfig struct {
+	// The name of the CSI driver, from which the name of the Lease is derived.
+	DriverName string
+	// The namespace of the Lease. Defaults to the namespace of the pod.
+	Namespace     string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// leaderElection elects the replica of the sidecar that publishes the
+// SnapshotMetadataService CR and maintains its status, so that the replicas
+// do not overwrite each other. A nil leaderElection is always the leader.
+type leaderElection struct {
+	config   leaderElectionConfig
+	identity string
+	lock     resourcelock.Interface
+	leading  atomic.Bool
+}
+
+func newLeaderElection(config leaderElectionConfig, kubeClient kubernetes.Interface) (*leaderElection, error) {
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the leader election identity: %w", err)
+	}
+
+	namespace := config.Namespace
+	if namespace == "" {
+		if namespace, err = podNamespace(); err != nil {
+			return nil, fmt.Errorf("the leader election namespace is required when not running in a pod: %w", err)
+		}
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, namespace, leaseName(config.DriverName),
+		kubeClient.CoreV1(), kubeClient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the leader election lock: %w", err)
+	}
+
+	return &leaderElection{
+		config:   config,
+		identity: identity,
+		lock:     lock,
+	}, nil
+}
+
+// run campaigns for the leadership until the context is canceled, and calls
+// lead with a context that is canceled when the leadership is lost.
+func (l *leaderElection) run(ctx context.Context, lead func(ctx context.Context)) error {
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            l.lock,
+		LeaseDuration:   l.config.LeaseDuration,
+		RenewDeadline:   l.config.RenewDeadline,
+		RetryPeriod:     l.config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.lock.Describe(),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				l.leading.Store(true)
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				l.leading.Store(false)
+				klog.Infof("%s stopped leading the SnapshotMetadataService %q", l.identity, l.config.DriverName)
+			},
+			OnNewLeader: func(leader string) {
+				klog.Infof("The SnapshotMetadataService %q is led by %s", l.config.DriverName, leader)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Campaign again after losing the leadership.
+	for ctx.Err() == nil {
+		le.Run(ctx)
+	}
+
+	return nil
+}
+
+// isLeader returns true if the replica holds the Lease.
+func (l *leaderElection) isLeader() bool {
+	return l == nil || l.leading.Load()
+}
+
+// podNamespace returns the namespace of the pod of the sidecar.
+func podNamespace() (string, error) {
+	data, err := os.ReadFile(inClusterNamespaceFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+var leaseNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+// leaseName returns the name of the Lease of the CSI driver.
+func leaseName(driverName string) string {
+	return strings.ToLower(leaseNameInvalidChars.ReplaceAllString(leaseNamePrefix+driverName, "-"))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecar
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaseName(t *testing.T) {
+	assert.Equal(t, "external-snapshot-metadata-hostpath-csi-k8s-io", leaseName("hostpath.csi.k8s.io"))
+}
+
+func TestLeaderElection(t *testing.T) {
+	config := leaderElectionConfig{
+		DriverName:    "driver",
+		Namespace:     "default",
+		LeaseDuration: 2 * time.Second,
+		RenewDeadline: time.Second,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+
+	t.Run("namespace", func(t *testing.T) {
+		if _, err := os.Stat(inClusterNamespaceFile); err != nil {
+			c := config
+			c.Namespace = ""
+			_, err = newLeaderElection(c, fakekube.NewSimpleClientset())
+			assert.ErrorContains(t, err, "the leader election namespace is required")
+		}
+	})
+
+	t.Run("lead", func(t *testing.T) {
+		l, err := newLeaderElection(config, fakekube.NewSimpleClientset())
+		assert.NoError(t, err)
+		assert.False(t, l.isLeader())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		leading := make(chan struct{})
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			assert.NoError(t, l.run(ctx, func(ctx context.Context) {
+				close(leading)
+				<-ctx.Done()
+			}))
+		}()
+
+		<-leading
+		assert.True(t, l.isLeader())
+
+		cancel()
+		<-done
+		assert.False(t, l.isLeader())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var l *leaderElection
+		assert.True(t, l.isLeader())
+	})
+}
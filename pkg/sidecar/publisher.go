@@ -0,0 +1,324 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	smsv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	cbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned"
+)
+
+const (
+	// publisherFieldManager is the field manager of the server-side apply of
+	// the SnapshotMetadataService CR.
+	publisherFieldManager = "external-snapshot-metadata"
+
+	// publisherResyncPeriod is the interval at which the CR is applied again
+	// to revert changes made by others.
+	publisherResyncPeriod = 10 * time.Minute
+)
+
+// publisherConfig configures the publication of the SnapshotMetadataService CR.
+type publisherConfig struct {
+	// The name of the CSI driver, which is also the name of the CR.
+	DriverName string
+	// The DNS name of the Kubernetes Service of the sidecar.
+	ServiceDNSName string
+	// The port of the Kubernetes Service of the sidecar.
+	ServicePort int
+	// The audience of the security tokens of the clients.
+	Audience string
+	// Path to the PEM encoded CA certificate of the TLS certificate of the sidecar.
+	// Not used if the publisher is given the CA certificate.
+	CACertFile string
+}
+
+func (c *publisherConfig) validate() error {
+	switch {
+	case c.ServiceDNSName == "":
+		return errors.New("the service DNS name is required to publish the SnapshotMetadataService")
+	case c.ServicePort <= 0:
+		return errors.New("invalid service port")
+	case c.Audience == "":
+		return errors.New("the audience is required to publish the SnapshotMetadataService")
+	}
+
+	return nil
+}
+
+// caCertSource provides the CA certificate published in the CR.
+type caCertSource interface {
+	// CACert returns the PEM encoded CA certificate.
+	CACert() []byte
+	// CACertChanged returns a channel that receives a value when the CA certificate changes.
+	CACertChanged() <-chan struct{}
+}
+
+// servicePublisher creates or updates the SnapshotMetadataService CR of the
+// CSI driver with server-side apply, and applies it again when the CA
+// certificate changes.
+type servicePublisher struct {
+	config    publisherConfig
+	cbtClient cbt.Interface
+	ca        caCertSource
+	caWatcher *caWatcher // set if the CA certificate file is watched
+
+	// onPublish is called after the CR is applied.
+	onPublish func()
+}
+
+// newServicePublisher returns a publisher of the given CA certificate, or of
+// the contents of the CA certificate file if ca is nil.
+func newServicePublisher(config publisherConfig, ca caCertSource, cbtClient cbt.Interface) (*servicePublisher, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	p := &servicePublisher{
+		config:    config,
+		cbtClient: cbtClient,
+		ca:        ca,
+	}
+
+	if ca == nil {
+		if config.CACertFile == "" {
+			return nil, errors.New("the CA certificate file is required to publish the SnapshotMetadataService")
+		}
+
+		caWatcher, err := newCAWatcher(config.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+
+		p.ca, p.caWatcher = caWatcher, caWatcher
+	}
+
+	return p, nil
+}
+
+// run watches the CA certificate file, if used, and publishes the CR until
+// the context is canceled.
+func (p *servicePublisher) run(ctx context.Context) {
+	p.watchCACert(ctx)
+	p.publishLoop(ctx)
+}
+
+// watchCACert watches the CA certificate file, if used, until the context is canceled.
+func (p *servicePublisher) watchCACert(ctx context.Context) {
+	if p.caWatcher != nil {
+		go func() {
+			if err := p.caWatcher.start(ctx); err != nil {
+				klog.Errorf("error in CA certificate watcher: %v", err)
+			}
+		}()
+	}
+}
+
+// publishLoop applies the CR, and applies it again when the CA certificate
+// changes or the resync period elapses, until the context is canceled.
+func (p *servicePublisher) publishLoop(ctx context.Context) {
+	ticker := time.NewTicker(publisherResyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		if err := p.publish(ctx); err != nil && ctx.Err() == nil {
+			klog.Errorf("failed to publish the SnapshotMetadataService %q: %v", p.config.DriverName, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.ca.CACertChanged():
+		}
+	}
+}
+
+// publish applies the CR.
+func (p *servicePublisher) publish(ctx context.Context) error {
+	data, err := json.Marshal(p.applyConfiguration())
+	if err != nil {
+		return err
+	}
+
+	_, err = p.cbtClient.CbtV1alpha1().SnapshotMetadataServices().Patch(ctx, p.config.DriverName, types.ApplyPatchType, data,
+		apimetav1.PatchOptions{FieldManager: publisherFieldManager, Force: ptr.To(true)})
+	if err != nil {
+		return err
+	}
+
+	klog.V(4).Infof("Published the SnapshotMetadataService %q", p.config.DriverName)
+
+	if p.onPublish != nil {
+		p.onPublish()
+	}
+
+	return nil
+}
+
+// applyConfiguration returns the fields of the CR owned by the publisher.
+// Only these fields are present so that the fields set by others are retained.
+func (p *servicePublisher) applyConfiguration() map[string]any {
+	return map[string]any{
+		"apiVersion": smsv1alpha1.SchemeGroupVersion.String(),
+		"kind":       "SnapshotMetadataService",
+		"metadata": map[string]any{
+			"name": p.config.DriverName,
+		},
+		"spec": map[string]any{
+			"address":  net.JoinHostPort(p.config.ServiceDNSName, strconv.Itoa(p.config.ServicePort)),
+			"audience": p.config.Audience,
+			"caCert":   p.ca.CACert(), // base64 encoded like the []byte field
+		},
+	}
+}
+
+// caWatcher watches the CA certificate file for changes, in the manner
+// of the CertWatcher of the TLS certificate of the gRPC server.
+type caWatcher struct {
+	mux     sync.Mutex
+	current []byte
+
+	path    string
+	watcher *fsnotify.Watcher
+	changed chan struct{}
+}
+
+func newCAWatcher(path string) (*caWatcher, error) {
+	cw := &caWatcher{
+		path:    path,
+		changed: make(chan struct{}, 1),
+	}
+
+	if err := cw.readCACert(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if cw.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+// CACert returns the current contents of the CA certificate file.
+func (cw *caWatcher) CACert() []byte {
+	cw.mux.Lock()
+	defer cw.mux.Unlock()
+
+	return cw.current
+}
+
+// CACertChanged returns a channel that receives a value when the contents
+// of the CA certificate file change.
+func (cw *caWatcher) CACertChanged() <-chan struct{} {
+	return cw.changed
+}
+
+// start watches the CA certificate file until the context is canceled.
+func (cw *caWatcher) start(ctx context.Context) error {
+	if err := cw.watcher.Add(cw.path); err != nil {
+		return err
+	}
+
+	go cw.watch()
+
+	<-ctx.Done()
+
+	return cw.watcher.Close()
+}
+
+func (cw *caWatcher) watch() {
+	for {
+		select {
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return
+			}
+
+			cw.handleEvent(event)
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			klog.Errorf("CA certificate watch error: %v", err)
+		}
+	}
+}
+
+func (cw *caWatcher) handleEvent(event fsnotify.Event) {
+	if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Remove) {
+		return
+	}
+
+	// Files mounted from a Secret are replaced, so the watch must be re-added.
+	if event.Has(fsnotify.Remove) {
+		if err := cw.watcher.Add(event.Name); err != nil {
+			klog.Errorf("error re-watching the CA certificate file: %v", err)
+		}
+	}
+
+	if err := cw.readCACert(); err != nil {
+		klog.Errorf("error re-reading the CA certificate: %v", err)
+	}
+}
+
+// readCACert reads the CA certificate file and signals a subsequent change of its contents.
+func (cw *caWatcher) readCACert() error {
+	data, err := os.ReadFile(cw.path)
+	if err != nil {
+		return fmt.Errorf("error reading the CA certificate: %w", err)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return fmt.Errorf("the CA certificate file %q is empty", cw.path)
+	}
+
+	cw.mux.Lock()
+	modified := cw.current != nil && !bytes.Equal(cw.current, data)
+	cw.current = data
+	cw.mux.Unlock()
+
+	if modified {
+		klog.Info("Updated the CA certificate")
+
+		select {
+		case cw.changed <- struct{}{}:
+		default: // already pending
+		}
+	}
+
+	return nil
+}
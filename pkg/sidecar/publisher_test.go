@@ -0,0 +1,147 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgotesting "k8s.io/client-go/testing"
+
+	smsv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	fakecbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned/fake"
+)
+
+func TestPublisherConfigValidate(t *testing.T) {
+	valid := publisherConfig{
+		DriverName:     "driver",
+		ServiceDNSName: "csi-snapshot-metadata.default",
+		ServicePort:    6443,
+		Audience:       "audience",
+		CACertFile:     "/ca.crt",
+	}
+	assert.NoError(t, valid.validate())
+
+	for name, modify := range map[string]func(c *publisherConfig){
+		"dns-name": func(c *publisherConfig) { c.ServiceDNSName = "" },
+		"port":     func(c *publisherConfig) { c.ServicePort = 0 },
+		"audience": func(c *publisherConfig) { c.Audience = "" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := valid
+			modify(&c)
+			assert.Error(t, c.validate())
+		})
+	}
+}
+
+func TestServicePublisher(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, []byte("ca-1"), 0o600))
+
+	config := publisherConfig{
+		DriverName:     "driver",
+		ServiceDNSName: "csi-snapshot-metadata.default",
+		ServicePort:    6443,
+		Audience:       "audience",
+		CACertFile:     caFile,
+	}
+
+	t.Run("missing-ca-cert", func(t *testing.T) {
+		c := config
+		c.CACertFile = ""
+		_, err := newServicePublisher(c, nil, fakecbt.NewSimpleClientset())
+		assert.ErrorContains(t, err, "the CA certificate file is required")
+
+		c.CACertFile = filepath.Join(t.TempDir(), "missing")
+		_, err = newServicePublisher(c, nil, fakecbt.NewSimpleClientset())
+		assert.ErrorContains(t, err, "error reading the CA certificate")
+	})
+
+	t.Run("publish-on-ca-change", func(t *testing.T) {
+		var (
+			mux     sync.Mutex
+			applied []*smsv1alpha1.SnapshotMetadataService
+		)
+
+		cbtClient := fakecbt.NewSimpleClientset()
+		cbtClient.PrependReactor("patch", "snapshotmetadataservices", func(action clientgotesting.Action) (bool, k8sruntime.Object, error) {
+			pa := action.(clientgotesting.PatchAction)
+			assert.Equal(t, types.ApplyPatchType, pa.GetPatchType())
+			assert.Equal(t, "driver", pa.GetName())
+
+			sms := &smsv1alpha1.SnapshotMetadataService{}
+			assert.NoError(t, json.Unmarshal(pa.GetPatch(), sms))
+
+			mux.Lock()
+			applied = append(applied, sms)
+			mux.Unlock()
+
+			return true, sms, nil
+		})
+
+		p, err := newServicePublisher(config, nil, cbtClient)
+		assert.NoError(t, err)
+
+		published := make(chan struct{}, 10)
+		p.onPublish = func() { published <- struct{}{} }
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go p.run(ctx)
+
+		<-published
+
+		mux.Lock()
+		assert.Len(t, applied, 1)
+		assert.Equal(t, "SnapshotMetadataService", applied[0].Kind)
+		assert.Equal(t, smsv1alpha1.SchemeGroupVersion.String(), applied[0].APIVersion)
+		assert.Equal(t, smsv1alpha1.SnapshotMetadataServiceSpec{
+			Address:  "csi-snapshot-metadata.default:6443",
+			Audience: "audience",
+			CACert:   []byte("ca-1"),
+		}, applied[0].Spec)
+		mux.Unlock()
+
+		// The CR is applied again when the CA certificate is rotated.
+		assert.Eventually(t, func() bool {
+			if err := os.WriteFile(caFile, []byte("ca-2"), 0o600); err != nil {
+				return false
+			}
+
+			select {
+			case <-published:
+				return true
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}, 10*time.Second, 10*time.Millisecond)
+
+		mux.Lock()
+		assert.Equal(t, []byte("ca-2"), applied[len(applied)-1].Spec.CACert)
+		mux.Unlock()
+	})
+}
@@ -18,20 +18,27 @@ package sidecar
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	cw "github.com/kubernetes-csi/external-snapshotter/v8/pkg/webhook"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authz"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/selfsigned"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/server/grpc"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
 const (
@@ -45,21 +52,91 @@ const (
 	defaultKubeconfig              = ""
 	defaultMaxStreamingDurationMin = 10
 	defaultMetricsPath             = "/metrics"
-
-	flagCSIAddress              = "csi-address"
-	flagCSITimeout              = "timeout"
-	flagGRPCPort                = "port"
-	flagHTTPEndpoint            = "http-endpoint"
-	flagKubeAPIBurst            = "kube-api-burst"
-	flagKubeAPIQPS              = "kube-api-qps"
-	flagKubeconfig              = "kubeconfig"
-	flagMaxStreamingDurationMin = "max-streaming-duration-min"
-	flagMetricsPath             = "metrics-path"
-	flagTLSCert                 = "tls-cert"
-	flagTLSKey                  = "tls-key"
-	flagVersion                 = "version"
-	flagAudience                = "audience"
-	flagDisableMetrics          = "disable-metrics"
+	defaultCSIResponseValidation   = string(grpc.ResponseValidationOff)
+	defaultLiveLookupOnCacheMiss   = true
+	defaultAuthCacheSize           = 1024
+	defaultAuthCachePositiveTTL    = 2 * time.Minute
+	defaultAuthCacheNegativeTTL    = 30 * time.Second
+	defaultVerifyBaseSnapshot      = true
+	defaultAuthorizationVerb       = authz.DefaultSARVerb
+	defaultCSIReconnect            = false
+	defaultAuditLevel              = string(grpc.AuditLevelNone)
+	defaultAuditLogMaxSizeMB       = 100
+	defaultAuditLogMaxBackups      = 5
+	defaultAuditWebhookMaxRetries  = 3
+	defaultDrainTimeout            = grpc.HandlerDefaultDrainTimeout
+	defaultTracingSamplingRatio    = 1.0
+	defaultStatusUpdateInterval    = time.Minute
+	defaultLeaseDuration           = 15 * time.Second
+	defaultRenewDeadline           = 10 * time.Second
+	defaultRetryPeriod             = 5 * time.Second
+
+	flagCSIAddress               = "csi-address"
+	flagCSITimeout               = "timeout"
+	flagGRPCPort                 = "port"
+	flagHTTPEndpoint             = "http-endpoint"
+	flagKubeAPIBurst             = "kube-api-burst"
+	flagKubeAPIQPS               = "kube-api-qps"
+	flagKubeconfig               = "kubeconfig"
+	flagMaxStreamingDurationMin  = "max-streaming-duration-min"
+	flagMetricsPath              = "metrics-path"
+	flagTLSCert                  = "tls-cert"
+	flagTLSKey                   = "tls-key"
+	flagVersion                  = "version"
+	flagAudience                 = "audience"
+	flagDisableMetrics           = "disable-metrics"
+	flagCSIResponseValidation    = "csi-response-validation"
+	flagLiveLookupOnCacheMiss    = "live-lookup-on-cache-miss"
+	flagAuthCacheSize            = "auth-cache-size"
+	flagAuthCachePositiveTTL     = "auth-cache-positive-ttl"
+	flagAuthCacheNegativeTTL     = "auth-cache-negative-ttl"
+	flagVerifyBaseSnapshot       = "verify-base-snapshot"
+	flagAuthorizationVerb        = "authorization-verb"
+	flagAuthorizationSubresource = "authorization-subresource"
+	flagAuthorizationIncludeName = "authorization-include-name"
+	flagCSIReconnect             = "csi-reconnect"
+	flagMaxStreams               = "max-streams"
+	flagMaxStreamsPerNamespace   = "max-streams-per-namespace"
+	flagMaxStreamsPerUser        = "max-streams-per-user"
+	flagRPCRate                  = "rpc-rate"
+	flagRPCBurst                 = "rpc-burst"
+	flagDefaultMaxResults        = "default-max-results"
+	flagMaxResultsLimit          = "max-results-limit"
+	flagCoalesceResponses        = "coalesce-responses"
+	flagAuditLevel               = "audit-level"
+	flagAuditLogPath             = "audit-log-path"
+	flagAuditLogMaxSizeMB        = "audit-log-max-size-mb"
+	flagAuditLogMaxBackups       = "audit-log-max-backups"
+	flagAuditWebhookURL          = "audit-webhook-url"
+	flagAuditWebhookMaxRetries   = "audit-webhook-max-retries"
+	flagAuditWebhookBlock        = "audit-webhook-block"
+	flagDrainTimeout             = "drain-timeout"
+	flagStatusUpdateInterval     = "status-update-interval"
+	flagPublishService           = "publish-service"
+	flagServiceDNSName           = "service-dns-name"
+	flagServicePort              = "service-port"
+	flagCACert                   = "ca-cert"
+	flagLeaderElection           = "leader-election"
+	flagLeaderElectionNamespace  = "leader-election-namespace"
+	flagLeaseDuration            = "leader-election-lease-duration"
+	flagRenewDeadline            = "leader-election-renew-deadline"
+	flagRetryPeriod              = "leader-election-retry-period"
+	flagTLSSelfSigned            = "tls-self-signed"
+	flagTLSSecretName            = "tls-secret-name"
+	flagTLSSecretNamespace       = "tls-secret-namespace"
+	flagTLSDNSNames              = "tls-dns-names"
+	flagTLSCertValidity          = "tls-certificate-validity"
+
+	flagDisableSnapshotMetricLabels = "disable-snapshot-metric-labels"
+	flagTracingEndpoint             = "tracing-endpoint"
+	flagTracingSamplingRatio        = "tracing-sampling-ratio"
+
+	// tracingServiceName is the service name of the exported spans.
+	tracingServiceName = "csi-snapshot-metadata"
+	// tracingShutdownTimeout bounds the time to export the remaining spans on exit.
+	tracingShutdownTimeout = 5 * time.Second
+	// statusFlushTimeout bounds the time to publish a failure status on exit.
+	statusFlushTimeout = 5 * time.Second
 
 	// tlsCertEnvVar is an environment variable that specifies the path to tls certificate file.
 	tlsCertEnvVar = "TLS_CERT_PATH"
@@ -84,6 +161,15 @@ func Run(argv []string, version string) int {
 
 	klog.Infof("Version: %s", s.version)
 
+	// Tracing is set up before the gRPC connections are established.
+	shutdownTracing, err := s.setupTracing()
+	if err != nil {
+		klog.Error(err)
+		return 1
+	}
+
+	defer shutdownTracing()
+
 	rt, err := runtime.New(s.runtimeArgsFromFlags())
 	if err != nil {
 		klog.Error(err)
@@ -92,35 +178,128 @@ func Run(argv []string, version string) int {
 
 	klog.Infof("CSI driver name: %q", rt.DriverName)
 
-	// Setup a certificate watcher
+	// Setup a certificate watcher, or the self-signed certificate
 	ctx, cancel := context.WithCancel(context.TODO())
 	defer cancel()
 
-	cw, err := cw.NewCertWatcher(rt.TLSCertFile, rt.TLSKeyFile)
-	if err != nil {
-		klog.Errorf("failed to start certwatcher: %v", err)
+	var (
+		certProvider grpc.CertificateProvider
+		certWatcher  *cw.CertWatcher
+		selfSigned   *selfsigned.Manager
+	)
+
+	if rt.SelfSignedTLS {
+		if selfSigned, err = s.createSelfSignedManager(rt); err == nil {
+			err = selfSigned.Initialize(ctx)
+		}
+
+		if err != nil {
+			klog.Errorf("failed to initialize the self-signed certificate: %v", err)
+			return 1
+		}
+
+		certProvider = selfSigned
+	} else {
+		if certWatcher, err = cw.NewCertWatcher(rt.TLSCertFile, rt.TLSKeyFile); err != nil {
+			klog.Errorf("failed to start certwatcher: %v", err)
+			return 1
+		}
+
+		certProvider = certWatcher
+	}
+
+	// Start the informers; lookups use the API server until the caches sync.
+	if err := rt.StartInformers(ctx); err != nil {
+		klog.Error(err)
+		return 1
+	}
+
+	config := s.createServerConfig(rt, certProvider)
+
+	if config.Audit.Sink, err = s.createAuditSink(rt); err != nil {
+		klog.Error(err)
 		return 1
 	}
 
-	grpcServer, err := startGRPCServerAndValidateCSIDriver(s.createServerConfig(rt, cw))
+	var publisher *servicePublisher
+	if *s.publishService {
+		// The self-signed CA is published instead of the -ca-cert file.
+		var ca caCertSource
+		if selfSigned != nil {
+			ca = selfSigned
+		}
+
+		if publisher, err = newServicePublisher(s.publisherConfig(rt), ca, rt.CBTClient); err != nil {
+			klog.Error(err)
+			return 1
+		}
+	}
+
+	// Only the leader of the replicas publishes the CR and its status.
+	var elector *leaderElection
+	if *s.leaderElection {
+		if elector, err = newLeaderElection(s.leaderElectionConfig(rt), rt.KubeClient); err != nil {
+			klog.Error(err)
+			return 1
+		}
+	}
+
+	// Publish the state of the sidecar in the SnapshotMetadataService CR.
+	var reporter *statusReporter
+	if *s.statusUpdateInterval > 0 {
+		reporter = newStatusReporter(rt.CBTClient, rt.DriverName, s.version, *s.statusUpdateInterval, certProvider.GetCertificate)
+		reporter.isLeader = elector.isLeader
+		go reporter.run(ctx)
+	}
+
+	grpcServer, err := startGRPCServerAndValidateCSIDriver(config, reporter)
 	if err != nil {
 		klog.Error(err)
+		reporter.flush(statusFlushTimeout)
 		return 1
 	}
 
+	// Publish the SnapshotMetadataService CR once the CSI driver is validated.
+	if publisher != nil {
+		if reporter != nil {
+			publisher.onPublish = reporter.updateSoon
+		}
+
+		if elector == nil {
+			go publisher.run(ctx)
+		} else {
+			publisher.watchCACert(ctx)
+		}
+	}
+
+	if elector != nil {
+		go func() {
+			err := elector.run(ctx, func(ctx context.Context) {
+				reporter.updateSoon()
+
+				if publisher != nil {
+					publisher.publishLoop(ctx)
+				}
+			})
+			if err != nil {
+				klog.Errorf("failed to elect the leader of the SnapshotMetadataService: %v", err)
+			}
+		}()
+	}
+
+	if rt.CSIReconnect {
+		go func() {
+			if err := reconnectOnCSIConnectionLoss(ctx, rt, grpcServer, reporter); err != nil {
+				klog.Fatalf("Failed to reconnect to the CSI driver: %v", err)
+			}
+		}()
+	}
+
 	// Start the HTTP server for health and metrics endpoints.
 	mux := http.NewServeMux()
 
 	// Always register the health endpoint - tracks gRPC server readiness.
-	mux.HandleFunc(defaultHealthPath, func(w http.ResponseWriter, r *http.Request) {
-		if grpcServer.IsReady() {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("ok"))
-		} else {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("not ready"))
-		}
-	})
+	mux.HandleFunc(defaultHealthPath, healthHandler(grpcServer))
 
 	// Conditionally register metrics endpoint.
 	if !*s.disableMetrics {
@@ -135,13 +314,19 @@ func Run(argv []string, version string) int {
 		}
 	}()
 
-	// Dispatch the go routine for certificate watcher
-	go func() {
-		if err := cw.Start(ctx); err != nil {
-			klog.Errorf("error in certificate watcher: %v", err)
-		}
-	}()
+	// Dispatch the go routine for certificate watcher, or to rotate the self-signed certificate
+	if certWatcher != nil {
+		go func() {
+			if err := certWatcher.Start(ctx); err != nil {
+				klog.Errorf("error in certificate watcher: %v", err)
+			}
+		}()
+	} else {
+		go selfSigned.Run(ctx)
+	}
 
+	// The status is not updated on termination: the other replicas are still
+	// serving, and the leadership is released to one of them.
 	shutdownOnTerminationSignal(grpcServer)
 
 	return 0
@@ -153,20 +338,65 @@ type sidecarFlagSet struct {
 	version string
 
 	// flag variables
-	csiAddress         *string
-	csiTimeout         *time.Duration
-	grpcPort           *int
-	httpEndpoint       *string
-	kubeAPIBurst       *int
-	kubeAPIQPS         *float64
-	kubeconfig         *string
-	maxStreamingDurMin *int
-	metricsPath        *string
-	showVersion        *bool
-	tlsCert            *string
-	tlsKey             *string
-	audience           *string
-	disableMetrics     *bool
+	csiAddress           *string
+	csiTimeout           *time.Duration
+	grpcPort             *int
+	httpEndpoint         *string
+	kubeAPIBurst         *int
+	kubeAPIQPS           *float64
+	kubeconfig           *string
+	maxStreamingDurMin   *int
+	metricsPath          *string
+	showVersion          *bool
+	tlsCert              *string
+	tlsKey               *string
+	audience             *string
+	disableMetrics       *bool
+	csiRespValidation    *string
+	liveLookupOnMiss     *bool
+	authCacheSize        *int
+	authCachePosTTL      *time.Duration
+	authCacheNegTTL      *time.Duration
+	verifyBaseSnapshot   *bool
+	authzVerb            *string
+	authzSubresource     *string
+	authzIncludeName     *bool
+	csiReconnect         *bool
+	maxStreams           *int
+	maxStreamsPerNs      *int
+	maxStreamsPerUser    *int
+	rpcRate              *float64
+	rpcBurst             *int
+	defaultMaxResults    *int
+	maxResultsLimit      *int
+	coalesceResponses    *bool
+	auditLevel           *string
+	auditLogPath         *string
+	auditLogMaxSizeMB    *int
+	auditLogMaxBackups   *int
+	auditWebhookURL      *string
+	auditWebhookRetries  *int
+	auditWebhookBlock    *bool
+	drainTimeout         *time.Duration
+	statusUpdateInterval *time.Duration
+	publishService       *bool
+	serviceDNSName       *string
+	servicePort          *int
+	caCert               *string
+	leaderElection       *bool
+	leaderElectionNs     *string
+	leaseDuration        *time.Duration
+	renewDeadline        *time.Duration
+	retryPeriod          *time.Duration
+	tlsSelfSigned        *bool
+	tlsSecretName        *string
+	tlsSecretNamespace   *string
+	tlsDNSNames          *string
+	tlsCertValidity      *time.Duration
+
+	disableSnapMetricLabels *bool
+	tracingEndpoint         *string
+	tracingSamplingRatio    *float64
 }
 
 var sidecarFlagSetErrorHandling flag.ErrorHandling = flag.ExitOnError // UT interception point.
@@ -186,9 +416,61 @@ func newSidecarFlagSet(name, version string) *sidecarFlagSet {
 	s.grpcPort = s.Int(flagGRPCPort, defaultGRPCPort, "GRPC SnapshotMetadata service port number")
 	s.tlsCert = s.String(flagTLSCert, os.Getenv(tlsCertEnvVar), "Path to the TLS certificate file. Can also be set with the environment variable "+tlsCertEnvVar+".")
 	s.tlsKey = s.String(flagTLSKey, os.Getenv(tlsKeyEnvVar), "Path to the TLS private key file. Can also be set with the environment variable "+tlsKeyEnvVar+".")
+	s.tlsSelfSigned = s.Bool(flagTLSSelfSigned, false,
+		"Generate a CA and a serving certificate for -"+flagTLSDNSNames+" instead of using -"+flagTLSCert+" and -"+flagTLSKey+". The certificates are stored in a Secret shared by the replicas and re-issued before they expire.")
+	s.tlsSecretName = s.String(flagTLSSecretName, "", "The name of the Secret of the self-signed certificate. Defaults to a name derived from the CSI driver name.")
+	s.tlsSecretNamespace = s.String(flagTLSSecretNamespace, "", "The namespace of the Secret of the self-signed certificate. Defaults to the namespace of the pod.")
+	s.tlsDNSNames = s.String(flagTLSDNSNames, "", "Comma separated DNS names of the self-signed certificate. Defaults to -"+flagServiceDNSName+".")
+	s.tlsCertValidity = s.Duration(flagTLSCertValidity, selfsigned.DefaultValidity,
+		"The validity period of the self-signed certificate. It is re-issued when two thirds of the period have elapsed. Defaults to "+selfsigned.DefaultValidity.String()+".")
 	s.audience = s.String(flagAudience, "", "Audience string used for authentication.")
 
+	s.csiRespValidation = s.String(flagCSIResponseValidation, defaultCSIResponseValidation,
+		"Validation of the CSI driver metadata responses against the CSI specification: "+
+			"'off', 'log' to log and count invalid responses, 'metric' to only count them, or 'strict' to abort the stream with an Internal error. Defaults to "+defaultCSIResponseValidation+".")
+	s.liveLookupOnMiss = s.Bool(flagLiveLookupOnCacheMiss, defaultLiveLookupOnCacheMiss,
+		"Fetch a VolumeSnapshot, VolumeSnapshotContent, VolumeSnapshotClass or SnapshotMetadataService from the API server if it is not found in the informer cache.")
+	s.authCacheSize = s.Int(flagAuthCacheSize, defaultAuthCacheSize, "The maximum number of cached TokenReview and SubjectAccessReview decisions in each cache. Set to 0 to disable caching.")
+	s.authCachePosTTL = s.Duration(flagAuthCachePositiveTTL, defaultAuthCachePositiveTTL, "The duration for which authenticated tokens and allowed access are cached.")
+	s.authCacheNegTTL = s.Duration(flagAuthCacheNegativeTTL, defaultAuthCacheNegativeTTL, "The duration for which unauthenticated tokens and denied access are cached.")
+	s.verifyBaseSnapshot = s.Bool(flagVerifyBaseSnapshot, defaultVerifyBaseSnapshot,
+		"Verify that the base snapshot of a GetMetadataDelta request is bound to a VolumeSnapshot accessible to the user, created from the same source volume as the target snapshot. Snapshots of unknown source volumes, such as pre-provisioned snapshots, are rejected unless disabled.")
+	s.authzVerb = s.String(flagAuthorizationVerb, defaultAuthorizationVerb, "The verb of the SubjectAccessReview that authorizes access to the metadata of a VolumeSnapshot. Defaults to "+defaultAuthorizationVerb+".")
+	s.authzSubresource = s.String(flagAuthorizationSubresource, "", "An optional subresource of volumesnapshots, such as 'metadata', to check in the SubjectAccessReview.")
+	s.authzIncludeName = s.Bool(flagAuthorizationIncludeName, false, "Include the name of the VolumeSnapshot in the SubjectAccessReview so that access can be restricted with RBAC resourceNames.")
+	s.csiReconnect = s.Bool(flagCSIReconnect, defaultCSIReconnect,
+		"Reconnect to the CSI driver if the connection is lost, instead of exiting. Metadata requests fail with Unavailable until the CSI driver is validated again.")
+	s.maxStreams = s.Int(flagMaxStreams, 0, "The maximum number of concurrent metadata streams. Not limited if 0.")
+	s.maxStreamsPerNs = s.Int(flagMaxStreamsPerNamespace, 0, "The maximum number of concurrent metadata streams for the snapshots of a namespace. Not limited if 0.")
+	s.maxStreamsPerUser = s.Int(flagMaxStreamsPerUser, 0, "The maximum number of concurrent metadata streams of an authenticated user. Not limited if 0.")
+	s.rpcRate = s.Float64(flagRPCRate, 0, "The number of new metadata RPCs allowed per second. Not limited if 0.")
+	s.rpcBurst = s.Int(flagRPCBurst, 0, "The number of new metadata RPCs allowed in excess of -"+flagRPCRate+". Defaults to the rate rounded up.")
+	s.defaultMaxResults = s.Int(flagDefaultMaxResults, 0, "The maximum number of BlockMetadata tuples in a response when the client does not specify max_results. Not limited if 0.")
+	s.maxResultsLimit = s.Int(flagMaxResultsLimit, 0, "The upper bound of the max_results specified by a client, which limits the size of each response. Not limited if 0.")
+	s.coalesceResponses = s.Bool(flagCoalesceResponses, false, "Combine the BlockMetadata tuples of small CSI driver responses into responses of max_results tuples.")
+	s.auditLevel = s.String(flagAuditLevel, defaultAuditLevel,
+		"The audit level of metadata requests: 'none', 'metadata' to record the user, snapshots, amount of metadata returned and status of each request, or 'request' to also record the request parameters. Defaults to "+defaultAuditLevel+".")
+	s.auditLogPath = s.String(flagAuditLogPath, "", "Path to the file where audit records are written as JSON lines. One of this or -"+flagAuditWebhookURL+" is required if auditing is enabled.")
+	s.auditLogMaxSizeMB = s.Int(flagAuditLogMaxSizeMB, defaultAuditLogMaxSizeMB, "The maximum size in megabytes of the audit log file before it is rotated. Set to 0 to disable rotation.")
+	s.auditLogMaxBackups = s.Int(flagAuditLogMaxBackups, defaultAuditLogMaxBackups, "The maximum number of rotated audit log files to retain.")
+	s.auditWebhookURL = s.String(flagAuditWebhookURL, "", "URL to which each audit record is posted as a JSON document.")
+	s.auditWebhookRetries = s.Int(flagAuditWebhookMaxRetries, defaultAuditWebhookMaxRetries, "The maximum number of times a failed audit webhook request is retried, with an exponential backoff, before the record is dropped.")
+	s.auditWebhookBlock = s.Bool(flagAuditWebhookBlock, false, "Delay the completion of metadata requests while the audit webhook queue is full, instead of dropping their audit records.")
 	s.maxStreamingDurMin = s.Int(flagMaxStreamingDurationMin, defaultMaxStreamingDurationMin, "The maximum duration in minutes for any individual streaming session")
+	s.drainTimeout = s.Duration(flagDrainTimeout, defaultDrainTimeout,
+		"The maximum time to wait for the streams in progress to end on termination, after which they are canceled. Should be less than the termination grace period of the pod. Defaults to "+defaultDrainTimeout.String()+".")
+	s.statusUpdateInterval = s.Duration(flagStatusUpdateInterval, defaultStatusUpdateInterval,
+		"The interval at which the status of the SnapshotMetadataService CR of the CSI driver is refreshed. The status is also updated when the sidecar changes state. Set to 0 to disable status updates. Defaults to "+defaultStatusUpdateInterval.String()+".")
+	s.publishService = s.Bool(flagPublishService, false,
+		"Create or update the SnapshotMetadataService CR of the CSI driver with the address of the service, the -"+flagAudience+" and the CA certificate, which is applied again when it changes.")
+	s.serviceDNSName = s.String(flagServiceDNSName, "", "The DNS name of the Kubernetes Service of the sidecar, published in the SnapshotMetadataService CR.")
+	s.servicePort = s.Int(flagServicePort, 0, "The port of the Kubernetes Service of the sidecar, published in the SnapshotMetadataService CR. Defaults to the GRPC port.")
+	s.caCert = s.String(flagCACert, "", "Path to the CA certificate file of the TLS certificate, published in the SnapshotMetadataService CR.")
+	s.leaderElection = s.Bool(flagLeaderElection, false, "Elect a leader among the replicas of the sidecar to publish the SnapshotMetadataService CR and its status.")
+	s.leaderElectionNs = s.String(flagLeaderElectionNamespace, "", "The namespace of the leader election Lease. Defaults to the namespace of the pod.")
+	s.leaseDuration = s.Duration(flagLeaseDuration, defaultLeaseDuration, "The duration that non-leader candidates wait before attempting to acquire leadership. Defaults to "+defaultLeaseDuration.String()+".")
+	s.renewDeadline = s.Duration(flagRenewDeadline, defaultRenewDeadline, "The duration that the leader retries refreshing leadership before giving it up. Defaults to "+defaultRenewDeadline.String()+".")
+	s.retryPeriod = s.Duration(flagRetryPeriod, defaultRetryPeriod, "The duration that candidates wait between attempts to acquire or renew leadership. Defaults to "+defaultRetryPeriod.String()+".")
 
 	s.kubeAPIQPS = s.Float64(flagKubeAPIQPS, defaultKubeAPIQPS, "QPS to use while communicating with the kubernetes apiserver. Defaults to 5.0.")
 	s.kubeAPIBurst = s.Int(flagKubeAPIBurst, defaultKubeAPIBurst, "Burst to use while communicating with the kubernetes apiserver. Defaults to 10.")
@@ -197,6 +479,12 @@ func newSidecarFlagSet(name, version string) *sidecarFlagSet {
 		"The TCP network address where the HTTP server for diagnostics, including health check and metrics, will listen. Defaults to "+defaultHTTPEndpoint+".")
 	s.metricsPath = s.String(flagMetricsPath, defaultMetricsPath, "The HTTP path where prometheus metrics will be exposed. Defaults to "+defaultMetricsPath+".")
 	s.disableMetrics = s.Bool(flagDisableMetrics, false, "Disable the metrics endpoint. The health endpoint will still be available.")
+	s.disableSnapMetricLabels = s.Bool(flagDisableSnapshotMetricLabels, false,
+		"Omit the high-cardinality target_snapshot and base_snapshot labels from the operation metrics.")
+	s.tracingEndpoint = s.String(flagTracingEndpoint, "",
+		"The URL of an OTLP gRPC collector, such as http://otel-collector:4317, to which OpenTelemetry traces are exported. Tracing is disabled if not set.")
+	s.tracingSamplingRatio = s.Float64(flagTracingSamplingRatio, defaultTracingSamplingRatio,
+		"The fraction of the traces started by the sidecar that are sampled. Requests of traced clients follow the sampling decision of the client.")
 
 	// K8s logging initialization
 	klog.InitFlags(s.FlagSet)
@@ -233,6 +521,11 @@ func (s *sidecarFlagSet) runtimeArgsFromFlags() runtime.Args {
 		HttpEndpoint: *s.httpEndpoint,
 		MetricsPath:  *s.metricsPath,
 		Audience:     *s.audience,
+		CSIReconnect: *s.csiReconnect,
+
+		SelfSignedTLS:               *s.tlsSelfSigned,
+		DisableSnapshotMetricLabels: *s.disableSnapMetricLabels,
+		EnableTracing:               *s.tracingEndpoint != "",
 	}
 }
 
@@ -265,6 +558,10 @@ func (s *sidecarFlagSet) runtimeArgsToArgv(progName string, rta runtime.Args) []
 		argv = append(argv, "-"+flagTLSKey, rta.TLSKeyFile)
 	}
 
+	if rta.SelfSignedTLS {
+		argv = append(argv, "-"+flagTLSSelfSigned)
+	}
+
 	if rta.KubeAPIBurst != defaultKubeAPIBurst {
 		argv = append(argv, "-"+flagKubeAPIBurst, strconv.Itoa(rta.KubeAPIBurst))
 	}
@@ -281,20 +578,181 @@ func (s *sidecarFlagSet) runtimeArgsToArgv(progName string, rta runtime.Args) []
 		argv = append(argv, "-"+flagMetricsPath, rta.MetricsPath)
 	}
 
+	if rta.CSIReconnect != defaultCSIReconnect {
+		argv = append(argv, "-"+flagCSIReconnect+"="+strconv.FormatBool(rta.CSIReconnect))
+	}
+
+	if rta.DisableSnapshotMetricLabels {
+		argv = append(argv, "-"+flagDisableSnapshotMetricLabels)
+	}
+
 	return argv
 }
 
-func (s *sidecarFlagSet) createServerConfig(rt *runtime.Runtime, cw *cw.CertWatcher) grpc.ServerConfig {
+func (s *sidecarFlagSet) createServerConfig(rt *runtime.Runtime, certProvider grpc.CertificateProvider) grpc.ServerConfig {
 	return grpc.ServerConfig{
 		Runtime:      rt,
 		MaxStreamDur: time.Duration(*s.maxStreamingDurMin) * time.Minute,
-		Certwatcher:  cw,
+		DrainTimeout: *s.drainTimeout,
+		Certwatcher:  certProvider,
+
+		ResponseValidation:    grpc.ResponseValidationMode(*s.csiRespValidation),
+		LiveLookupOnCacheMiss: *s.liveLookupOnMiss,
+		AuthCache: authcache.Config{
+			Size:        *s.authCacheSize,
+			PositiveTTL: *s.authCachePosTTL,
+			NegativeTTL: *s.authCacheNegTTL,
+		},
+		VerifyBaseSnapshot: *s.verifyBaseSnapshot,
+		SAR: authz.SARConfig{
+			Verb:        *s.authzVerb,
+			Subresource: *s.authzSubresource,
+			IncludeName: *s.authzIncludeName,
+		},
+		StreamLimits: grpc.StreamLimitsConfig{
+			MaxStreams:             *s.maxStreams,
+			MaxStreamsPerNamespace: *s.maxStreamsPerNs,
+			MaxStreamsPerUser:      *s.maxStreamsPerUser,
+			RPCRate:                *s.rpcRate,
+			RPCBurst:               *s.rpcBurst,
+		},
+		Batching: grpc.BatchingConfig{
+			DefaultMaxResults: int32(*s.defaultMaxResults),
+			MaxResults:        int32(*s.maxResultsLimit),
+			Coalesce:          *s.coalesceResponses,
+		},
+		Audit: grpc.AuditConfig{
+			Level: grpc.AuditLevel(*s.auditLevel),
+		},
+		Tracing: *s.tracingEndpoint != "",
+	}
+}
+
+// createSelfSignedManager returns the manager of the self-signed certificate.
+func (s *sidecarFlagSet) createSelfSignedManager(rt *runtime.Runtime) (*selfsigned.Manager, error) {
+	config := selfsigned.Config{
+		Namespace:  *s.tlsSecretNamespace,
+		SecretName: *s.tlsSecretName,
+		Validity:   *s.tlsCertValidity,
+	}
+
+	if config.Namespace == "" {
+		namespace, err := podNamespace()
+		if err != nil {
+			return nil, fmt.Errorf("the namespace of the certificate Secret is required when not running in a pod: %w", err)
+		}
+
+		config.Namespace = namespace
+	}
+
+	if config.SecretName == "" {
+		config.SecretName = leaseName(rt.DriverName) + "-tls"
+	}
+
+	for _, name := range strings.Split(*s.tlsDNSNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			config.DNSNames = append(config.DNSNames, name)
+		}
+	}
+
+	if len(config.DNSNames) == 0 && *s.serviceDNSName != "" {
+		config.DNSNames = []string{*s.serviceDNSName}
+	}
+
+	return selfsigned.NewManager(rt.KubeClient, config)
+}
+
+func (s *sidecarFlagSet) publisherConfig(rt *runtime.Runtime) publisherConfig {
+	servicePort := *s.servicePort
+	if servicePort == 0 {
+		servicePort = rt.GRPCPort
+	}
+
+	return publisherConfig{
+		DriverName:     rt.DriverName,
+		ServiceDNSName: *s.serviceDNSName,
+		ServicePort:    servicePort,
+		Audience:       rt.Args.Audience,
+		CACertFile:     *s.caCert,
+	}
+}
+
+func (s *sidecarFlagSet) leaderElectionConfig(rt *runtime.Runtime) leaderElectionConfig {
+	return leaderElectionConfig{
+		DriverName:    rt.DriverName,
+		Namespace:     *s.leaderElectionNs,
+		LeaseDuration: *s.leaseDuration,
+		RenewDeadline: *s.renewDeadline,
+		RetryPeriod:   *s.retryPeriod,
+	}
+}
+
+func (s *sidecarFlagSet) tracingConfig() tracing.Config {
+	return tracing.Config{
+		EndpointURL:   *s.tracingEndpoint,
+		SamplingRatio: *s.tracingSamplingRatio,
+	}
+}
+
+// setupTracing installs the OTLP trace exporter if tracing is enabled.
+// The returned function exports the remaining spans.
+func (s *sidecarFlagSet) setupTracing() (func(), error) {
+	config := s.tracingConfig()
+	if !config.Enabled() {
+		return func() {}, nil
+	}
+
+	shutdown, err := tracing.Setup(context.Background(), config, tracingServiceName, s.version)
+	if err != nil {
+		return nil, err
 	}
+
+	klog.Infof("Exporting traces to %q", config.EndpointURL)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+
+		if err := shutdown(ctx); err != nil {
+			klog.Errorf("failed to export the remaining spans: %v", err)
+		}
+	}, nil
+}
+
+// createAuditSink returns the audit sink configured by the flags, or nil
+// if auditing is disabled.
+func (s *sidecarFlagSet) createAuditSink(rt *runtime.Runtime) (grpc.AuditSink, error) {
+	if grpc.AuditLevel(*s.auditLevel) == grpc.AuditLevelNone {
+		return nil, nil
+	}
+
+	switch {
+	case *s.auditLogPath != "" && *s.auditWebhookURL != "":
+		return nil, fmt.Errorf("only one of -%s or -%s may be specified", flagAuditLogPath, flagAuditWebhookURL)
+	case *s.auditLogPath != "":
+		fs, err := grpc.NewAuditFileSink(*s.auditLogPath, int64(*s.auditLogMaxSizeMB)<<20, *s.auditLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the audit log: %w", err)
+		}
+
+		return fs, nil
+	case *s.auditWebhookURL != "":
+		return grpc.NewAuditWebhookSink(*s.auditWebhookURL, grpc.AuditWebhookOptions{
+			MaxRetries: *s.auditWebhookRetries,
+			Block:      *s.auditWebhookBlock,
+			OnDropped: func() {
+				rt.RecordAuditRecordDropped(runtime.AuditDropReasonDeliveryFailed)
+			},
+		}), nil
+	}
+
+	return nil, fmt.Errorf("one of -%s or -%s is required when -%s is %q", flagAuditLogPath, flagAuditWebhookURL, flagAuditLevel, *s.auditLevel)
 }
 
 // startGRPCServerAndValidateCSIDriver starts the GRPC server and waits
 // for it to validate the CSI driver capabilities.
-func startGRPCServerAndValidateCSIDriver(config grpc.ServerConfig) (*grpc.Server, error) {
+// The progress is published by the optional status reporter.
+func startGRPCServerAndValidateCSIDriver(config grpc.ServerConfig, reporter *statusReporter) (*grpc.Server, error) {
 	rt := config.Runtime
 
 	// create the GRPC server.
@@ -313,17 +771,84 @@ func startGRPCServerAndValidateCSIDriver(config grpc.ServerConfig) (*grpc.Server
 
 	klog.Infof("GRPC server started listening on port %d", rt.GRPCPort)
 
+	reporter.setServer(grpcServer)
+
 	// check for a compatible CSI driver.
 	if err := rt.WaitTillCSIDriverIsValidated(); err != nil {
+		reporter.setDriverValidated(apimetav1.ConditionFalse, reasonValidationFailed, err.Error())
 		return nil, err
 	}
 
 	// notify the server that it can start processing metadata requests.
 	grpcServer.CSIDriverIsReady()
+	reporter.setDriverValidated(apimetav1.ConditionTrue, reasonValidated, msgDriverValidated)
 
 	return grpcServer, nil
 }
 
+// csiRevalidationRetryInterval is the delay between attempts to validate
+// the CSI driver after the connection is re-established.
+var csiRevalidationRetryInterval = 5 * time.Second
+
+// reconnectOnCSIConnectionLoss stops the server from serving metadata while
+// the connection to the CSI driver is lost, and resumes service when the CSI
+// driver is validated again. It returns an error if the CSI driver cannot be
+// used again, or nil when the context is canceled.
+func reconnectOnCSIConnectionLoss(ctx context.Context, rt *runtime.Runtime, grpcServer *grpc.Server, reporter *statusReporter) error {
+	lost := rt.WatchCSIConnection(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-lost:
+		}
+
+		klog.Info("Lost connection to the CSI driver")
+		grpcServer.CSIDriverConnectionLost()
+		reporter.setDriverValidated(apimetav1.ConditionFalse, reasonConnectionLost, "Lost connection to the CSI driver")
+
+		for {
+			err := rt.RevalidateCSIDriver(ctx)
+			if err == nil {
+				break
+			}
+
+			if errors.Is(err, runtime.ErrCSIDriverNameChanged) {
+				reporter.setDriverValidated(apimetav1.ConditionFalse, reasonValidationFailed, err.Error())
+				reporter.flush(statusFlushTimeout)
+				return err
+			}
+
+			klog.Errorf("Failed to validate the CSI driver: %v", err)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(csiRevalidationRetryInterval):
+			}
+		}
+
+		klog.Info("Reconnected to the CSI driver")
+		grpcServer.CSIDriverIsReady()
+		reporter.setDriverValidated(apimetav1.ConditionTrue, reasonValidated, msgDriverValidated)
+	}
+}
+
+// healthHandler returns the handler of the health endpoint, which reports the
+// readiness of the gRPC server and the number of metadata streams in progress.
+func healthHandler(grpcServer *grpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if grpcServer.IsReady() {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "ok\nactive streams: %d\n", grpcServer.ActiveStreams())
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready\nactive streams: %d\n", grpcServer.ActiveStreams())
+		}
+	}
+}
+
 // Note: these are UNIX specific.
 var terminationSignals = []os.Signal{syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM}
 
@@ -17,12 +17,14 @@ limitations under the License.
 package sidecar
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -33,12 +35,19 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	cw "github.com/kubernetes-csi/external-snapshotter/v8/pkg/webhook"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
 
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authcache"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/authz"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/selfsigned"
 	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/server/grpc"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/tracing"
 )
 
 func TestSidecarFlagSet(t *testing.T) {
@@ -123,6 +132,21 @@ func TestSidecarFlagSet(t *testing.T) {
 		config := sfs.createServerConfig(rt, nil)
 		assert.Equal(t, rt, config.Runtime)
 		assert.Equal(t, time.Duration(defaultMaxStreamingDurationMin)*time.Minute, config.MaxStreamDur)
+		assert.Equal(t, grpc.ResponseValidationOff, config.ResponseValidation)
+		assert.True(t, config.LiveLookupOnCacheMiss)
+		assert.True(t, config.VerifyBaseSnapshot)
+		assert.Equal(t, authcache.Config{Size: defaultAuthCacheSize, PositiveTTL: defaultAuthCachePositiveTTL, NegativeTTL: defaultAuthCacheNegativeTTL}, config.AuthCache)
+		assert.Equal(t, authz.SARConfig{Verb: "get"}, config.SAR)
+		assert.False(t, config.StreamLimits.Enabled())
+		assert.Equal(t, grpc.BatchingConfig{}, config.Batching)
+		assert.Equal(t, grpc.AuditLevelNone, config.Audit.Level)
+		assert.Equal(t, grpc.HandlerDefaultDrainTimeout, config.DrainTimeout)
+		assert.False(t, config.Tracing)
+		assert.Equal(t, tracing.Config{SamplingRatio: defaultTracingSamplingRatio}, sfs.tracingConfig())
+
+		sink, err := sfs.createAuditSink(&runtime.Runtime{})
+		assert.NoError(t, err)
+		assert.Nil(t, sink)
 	})
 
 	t.Run("http-endpoint-and-metrics-flag", func(t *testing.T) {
@@ -133,7 +157,11 @@ func TestSidecarFlagSet(t *testing.T) {
 		expTLSKeyFile := "/tls/keyFile"
 		t.Setenv(tlsKeyEnvVar, expTLSKeyFile)
 
-		argv := []string{"progName", "-http-endpoint=localhost:8080", "-metrics-path=/metPath"}
+		argv := []string{"progName", "-http-endpoint=localhost:8080", "-metrics-path=/metPath", "-csi-response-validation=strict", "-live-lookup-on-cache-miss=false", "-auth-cache-size=0", "-verify-base-snapshot=false",
+			"-authorization-verb=list", "-authorization-subresource=metadata", "-authorization-include-name",
+			"-max-streams=10", "-max-streams-per-namespace=5", "-max-streams-per-user=2", "-rpc-rate=0.5", "-rpc-burst=3",
+			"-default-max-results=256", "-max-results-limit=1024", "-coalesce-responses", "-csi-reconnect", "-drain-timeout=5s", "-disable-snapshot-metric-labels",
+			"-tracing-endpoint=http://localhost:4317", "-tracing-sampling-ratio=0.1"}
 		sfs := newSidecarFlagSet(argv[0], "version")
 
 		hsv, err := sfs.parseFlagsAndHandleShowVersion(argv[1:])
@@ -153,6 +181,10 @@ func TestSidecarFlagSet(t *testing.T) {
 			TLSKeyFile:   expTLSKeyFile,
 			HttpEndpoint: "localhost:8080",
 			MetricsPath:  "/metPath",
+			CSIReconnect: true,
+
+			DisableSnapshotMetricLabels: true,
+			EnableTracing:               true,
 		}
 
 		assert.Equal(t, expRTA, rta)
@@ -161,6 +193,136 @@ func TestSidecarFlagSet(t *testing.T) {
 		config := sfs.createServerConfig(rt, nil)
 		assert.Equal(t, rt, config.Runtime)
 		assert.Equal(t, time.Duration(defaultMaxStreamingDurationMin)*time.Minute, config.MaxStreamDur)
+		assert.Equal(t, grpc.ResponseValidationStrict, config.ResponseValidation)
+		assert.False(t, config.LiveLookupOnCacheMiss)
+		assert.False(t, config.AuthCache.Enabled())
+		assert.False(t, config.VerifyBaseSnapshot)
+		assert.Equal(t, authz.SARConfig{Verb: "list", Subresource: "metadata", IncludeName: true}, config.SAR)
+		assert.Equal(t, grpc.StreamLimitsConfig{MaxStreams: 10, MaxStreamsPerNamespace: 5, MaxStreamsPerUser: 2, RPCRate: 0.5, RPCBurst: 3}, config.StreamLimits)
+		assert.Equal(t, grpc.BatchingConfig{DefaultMaxResults: 256, MaxResults: 1024, Coalesce: true}, config.Batching)
+		assert.Equal(t, 5*time.Second, config.DrainTimeout)
+		assert.True(t, config.Tracing)
+		assert.Equal(t, tracing.Config{EndpointURL: "http://localhost:4317", SamplingRatio: 0.1}, sfs.tracingConfig())
+	})
+
+	t.Run("self-signed-flags", func(t *testing.T) {
+		defer saveAndResetGlobalState()()
+
+		argv := []string{"progName", "-tls-self-signed", "-tls-secret-namespace=ns", "-service-dns-name=svc.ns"}
+		sfs := newSidecarFlagSet(argv[0], "version")
+
+		_, err := sfs.parseFlagsAndHandleShowVersion(argv[1:])
+		assert.NoError(t, err)
+
+		rta := sfs.runtimeArgsFromFlags()
+		assert.True(t, rta.SelfSignedTLS)
+		assert.Contains(t, sfs.runtimeArgsToArgv("progName", rta), "-"+flagTLSSelfSigned)
+
+		kubeClient := fakekube.NewSimpleClientset()
+		rt := &runtime.Runtime{KubeClient: kubeClient, DriverName: "hostpath.csi.k8s.io"}
+
+		m, err := sfs.createSelfSignedManager(rt)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		// The Secret name is derived from the driver name and the DNS names default to the service.
+		secret, err := kubeClient.CoreV1().Secrets("ns").Get(context.Background(), "external-snapshot-metadata-hostpath-csi-k8s-io-tls", apimetav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, m.CACert(), secret.Data[selfsigned.SecretKeyCACert])
+
+		cert, err := m.GetCertificate(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"svc.ns"}, cert.Leaf.DNSNames)
+
+		assert.NoError(t, sfs.Set(flagTLSDNSNames, "a.ns, b.ns"))
+		assert.NoError(t, sfs.Set(flagTLSSecretName, "secret"))
+		m, err = sfs.createSelfSignedManager(rt)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Initialize(context.Background()))
+
+		cert, err = m.GetCertificate(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.ns", "b.ns"}, cert.Leaf.DNSNames)
+	})
+
+	t.Run("tracing-flags", func(t *testing.T) {
+		defer saveAndResetGlobalState()()
+
+		for _, tc := range []struct {
+			name      string
+			args      []string
+			expErrStr string
+		}{
+			{"disabled", []string{"-tracing-sampling-ratio=2"}, ""},
+			{"enabled", []string{"-tracing-endpoint=http://localhost:4317"}, ""},
+			{"invalid-ratio", []string{"-tracing-endpoint=http://localhost:4317", "-tracing-sampling-ratio=2"}, "sampling ratio"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				tp, prop := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+				defer func() {
+					otel.SetTracerProvider(tp)
+					otel.SetTextMapPropagator(prop)
+				}()
+
+				argv := append([]string{"progName"}, tc.args...)
+				sfs := newSidecarFlagSet(argv[0], "version")
+
+				_, err := sfs.parseFlagsAndHandleShowVersion(argv[1:])
+				assert.NoError(t, err)
+
+				shutdown, err := sfs.setupTracing()
+				if tc.expErrStr != "" {
+					assert.ErrorContains(t, err, tc.expErrStr)
+					assert.Nil(t, shutdown)
+					return
+				}
+
+				assert.NoError(t, err)
+				assert.NotNil(t, shutdown)
+				shutdown()
+			})
+		}
+	})
+
+	t.Run("audit-flags", func(t *testing.T) {
+		defer saveAndResetGlobalState()()
+
+		logPath := filepath.Join(t.TempDir(), "audit.log")
+
+		for _, tc := range []struct {
+			name      string
+			args      []string
+			expSink   any
+			expErrStr string
+		}{
+			{"file", []string{"-audit-level=request", "-audit-log-path=" + logPath, "-audit-log-max-size-mb=1", "-audit-log-max-backups=2"}, &grpc.AuditFileSink{}, ""},
+			{"webhook", []string{"-audit-level=metadata", "-audit-webhook-url=http://localhost/audit", "-audit-webhook-max-retries=1", "-audit-webhook-block"}, &grpc.AuditWebhookSink{}, ""},
+			{"no-sink", []string{"-audit-level=metadata"}, nil, "is required"},
+			{"both-sinks", []string{"-audit-level=metadata", "-audit-log-path=" + logPath, "-audit-webhook-url=http://localhost/audit"}, nil, "only one of"},
+			{"file-error", []string{"-audit-level=metadata", "-audit-log-path=" + filepath.Join(logPath, "foo")}, nil, "failed to open the audit log"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				argv := append([]string{"progName"}, tc.args...)
+				sfs := newSidecarFlagSet(argv[0], "version")
+
+				_, err := sfs.parseFlagsAndHandleShowVersion(argv[1:])
+				assert.NoError(t, err)
+
+				config := sfs.createServerConfig(&runtime.Runtime{}, nil)
+				assert.Equal(t, grpc.AuditLevel(*sfs.auditLevel), config.Audit.Level)
+
+				sink, err := sfs.createAuditSink(&runtime.Runtime{})
+				if tc.expErrStr != "" {
+					assert.ErrorContains(t, err, tc.expErrStr)
+					assert.Nil(t, sink)
+					return
+				}
+
+				assert.NoError(t, err)
+				assert.IsType(t, tc.expSink, sink)
+				assert.NoError(t, sink.Close())
+			})
+		}
 	})
 }
 
@@ -197,7 +359,7 @@ func TestStartGRPCServerAndValidateCSIDriver(t *testing.T) {
 		assert.NoError(t, err)
 		assert.NotNil(t, cw)
 
-		s, err := startGRPCServerAndValidateCSIDriver(grpc.ServerConfig{Runtime: rt, Certwatcher: cw})
+		s, err := startGRPCServerAndValidateCSIDriver(grpc.ServerConfig{Runtime: rt, Certwatcher: cw}, nil)
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "invalid port")
 		assert.Nil(t, s)
@@ -218,7 +380,7 @@ func TestStartGRPCServerAndValidateCSIDriver(t *testing.T) {
 		assert.NoError(t, err)
 		assert.NotNil(t, cw)
 
-		s, err := startGRPCServerAndValidateCSIDriver(grpc.ServerConfig{Runtime: rt, Certwatcher: cw})
+		s, err := startGRPCServerAndValidateCSIDriver(grpc.ServerConfig{Runtime: rt, Certwatcher: cw}, nil)
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "error waiting for CSI driver to become ready") // probe unimplemented.
 		assert.Nil(t, s)
@@ -333,6 +495,13 @@ func TestRun(t *testing.T) {
 			if !strings.Contains(string(r), "snapshot_metadata_controller_operations_seconds") {
 				t.Errorf("didn't find expected type in metrics[%s]", string(r))
 			}
+			// The health endpoint reports the shutdown and the streams in progress
+			rsp, err = http.Get("http://" + rt.Args.HttpEndpoint + defaultHealthPath)
+			if err != nil || rsp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("unexpected health response %v, %v", err, rsp)
+			} else if r, _ = io.ReadAll(rsp.Body); string(r) != "not ready\nactive streams: 0\n" {
+				t.Errorf("unexpected health response body[%s]", string(r))
+			}
 			wg.Done()
 		}()
 
@@ -353,6 +522,49 @@ func TestRun(t *testing.T) {
 	})
 }
 
+func TestReconnectOnCSIConnectionLoss(t *testing.T) {
+	sms := &testSnapshotMetadataServer{}
+	rth := runtime.NewTestHarness().WithTestTLSFiles(t).WithFakeKubeConfig(t).WithFakeCSIDriver(t, sms)
+	defer rth.RemoveTestTLSFiles(t)
+	defer rth.RemoveFakeKubeConfig(t)
+	defer rth.TerminateFakeCSIDriver(t)
+
+	rth.FakeProbeResponse = &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}
+
+	rta := rth.RuntimeArgs()
+	rta.CSIReconnect = true
+	rt, err := runtime.New(rta)
+	assert.NoError(t, err)
+
+	certWatcher, err := cw.NewCertWatcher(rt.TLSCertFile, rt.TLSKeyFile)
+	assert.NoError(t, err)
+
+	grpcServer, err := grpc.NewServer(grpc.ServerConfig{Runtime: rt, Certwatcher: certWatcher})
+	assert.NoError(t, err)
+	grpcServer.CSIDriverIsReady()
+
+	defer func(d time.Duration) { csiRevalidationRetryInterval = d }(csiRevalidationRetryInterval)
+	csiRevalidationRetryInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+
+	go func() {
+		errChan <- reconnectOnCSIConnectionLoss(ctx, rt, grpcServer, nil)
+	}()
+
+	for i := 0; i < 2; i++ {
+		rth.FakeCSIDriver.Stop()
+		assert.Eventually(t, func() bool { return !grpcServer.IsReady() }, 10*time.Second, 10*time.Millisecond)
+
+		rth.RestartFakeCSIDriver(t)
+		assert.Eventually(t, grpcServer.IsReady, 10*time.Second, 10*time.Millisecond)
+	}
+
+	cancel()
+	assert.NoError(t, <-errChan)
+}
+
 func saveAndResetGlobalState() func() {
 	ss := struct {
 		stdout               *os.File
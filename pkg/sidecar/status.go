@@ -0,0 +1,295 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecar
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	smsv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	cbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned"
+)
+
+// The reasons of the SnapshotMetadataService conditions.
+const (
+	reasonServing               = "Serving"
+	reasonNotServing            = "NotServing"
+	reasonValidating            = "Validating"
+	reasonValidated             = "Validated"
+	reasonValidationFailed      = "ValidationFailed"
+	reasonConnectionLost        = "ConnectionLost"
+	reasonCertificateValid      = "Valid"
+	reasonCertificateExpired    = "Expired"
+	reasonCertificateNotYet     = "NotYetValid"
+	reasonCertificateUnreadable = "Unreadable"
+
+	msgDriverValidated = "The CSI driver supports the SnapshotMetadata service"
+)
+
+// readinessChecker reports whether metadata requests are being served.
+type readinessChecker interface {
+	IsReady() bool
+}
+
+// statusReporter maintains the status of the SnapshotMetadataService CR of
+// the CSI driver. The status is updated periodically, and when the state of
+// the CSI driver changes. The CR itself is not created by the sidecar.
+// With several replicas only the leader updates the status.
+type statusReporter struct {
+	client         cbt.Interface
+	driverName     string
+	version        string
+	interval       time.Duration
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	now            func() time.Time // UT interception point.
+	isLeader       func() bool      // nil without leader election
+
+	mux             sync.Mutex
+	server          readinessChecker
+	driverValidated apimetav1.Condition
+	trigger         chan struct{}
+}
+
+func newStatusReporter(client cbt.Interface, driverName, version string, interval time.Duration,
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *statusReporter {
+	return &statusReporter{
+		client:         client,
+		driverName:     driverName,
+		version:        version,
+		interval:       interval,
+		getCertificate: getCertificate,
+		now:            time.Now,
+		driverValidated: apimetav1.Condition{
+			Type:    smsv1alpha1.SnapshotMetadataServiceDriverValidated,
+			Status:  apimetav1.ConditionUnknown,
+			Reason:  reasonValidating,
+			Message: "Waiting for the CSI driver to be validated",
+		},
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// setServer sets the server whose readiness is reported by the Ready condition.
+func (r *statusReporter) setServer(server readinessChecker) {
+	if r == nil {
+		return
+	}
+
+	r.mux.Lock()
+	r.server = server
+	r.mux.Unlock()
+
+	r.updateSoon()
+}
+
+// setDriverValidated sets the DriverValidated condition.
+func (r *statusReporter) setDriverValidated(status apimetav1.ConditionStatus, reason, message string) {
+	if r == nil {
+		return
+	}
+
+	r.mux.Lock()
+	r.driverValidated.Status = status
+	r.driverValidated.Reason = reason
+	r.driverValidated.Message = message
+	r.mux.Unlock()
+
+	r.updateSoon()
+}
+
+// updateSoon arranges for the status to be updated by run.
+func (r *statusReporter) updateSoon() {
+	if r == nil {
+		return
+	}
+
+	select {
+	case r.trigger <- struct{}{}:
+	default: // already pending
+	}
+}
+
+// run updates the status until the context is canceled.
+func (r *statusReporter) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.update(ctx); err != nil && ctx.Err() == nil {
+			klog.Errorf("failed to update the status of SnapshotMetadataService %q: %v", r.driverName, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+	}
+}
+
+// flush updates the status within the timeout.
+// It is used to publish the failure of the sidecar before it exits.
+func (r *statusReporter) flush(timeout time.Duration) {
+	if r == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := r.update(ctx); err != nil {
+		klog.Errorf("failed to update the status of SnapshotMetadataService %q: %v", r.driverName, err)
+	}
+}
+
+// update fetches the CR and updates its status if it has changed.
+// A missing CR is not an error as it is created by the operator.
+func (r *statusReporter) update(ctx context.Context) error {
+	if r.isLeader != nil && !r.isLeader() {
+		return nil
+	}
+
+	sms, err := r.client.CbtV1alpha1().SnapshotMetadataServices().Get(ctx, r.driverName, apimetav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		klog.V(4).Infof("SnapshotMetadataService %q not found", r.driverName)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	status := sms.Status.DeepCopy()
+	r.computeStatus(status, sms.Generation)
+
+	if equality.Semantic.DeepEqual(&sms.Status, status) {
+		return nil
+	}
+
+	sms = sms.DeepCopy()
+	sms.Status = *status
+
+	_, err = r.client.CbtV1alpha1().SnapshotMetadataServices().UpdateStatus(ctx, sms, apimetav1.UpdateOptions{})
+
+	return err
+}
+
+// computeStatus sets the fields and conditions of the status from the
+// current state of the sidecar. The Ready condition reports the readiness of
+// this replica only, so clients must not rely on it to reach the service.
+func (r *statusReporter) computeStatus(status *smsv1alpha1.SnapshotMetadataServiceStatus, generation int64) {
+	r.mux.Lock()
+	ready := r.server != nil && r.server.IsReady()
+	driverValidated := r.driverValidated
+	r.mux.Unlock()
+
+	status.SidecarVersion = r.version
+	status.DriverName = r.driverName
+
+	readyCond := apimetav1.Condition{
+		Type:    smsv1alpha1.SnapshotMetadataServiceReady,
+		Status:  apimetav1.ConditionFalse,
+		Reason:  reasonNotServing,
+		Message: "The sidecar is not serving metadata requests",
+	}
+
+	if ready {
+		readyCond.Status = apimetav1.ConditionTrue
+		readyCond.Reason = reasonServing
+		readyCond.Message = "The sidecar is serving metadata requests"
+	}
+
+	certCond, notAfter := r.certificateCondition()
+	status.CertificateExpiry = notAfter
+
+	for _, cond := range []apimetav1.Condition{readyCond, driverValidated, certCond} {
+		cond.ObservedGeneration = generation
+		meta.SetStatusCondition(&status.Conditions, cond)
+	}
+}
+
+// certificateCondition returns the CertificateValid condition and the
+// expiry time of the current serving certificate, if it can be read.
+func (r *statusReporter) certificateCondition() (apimetav1.Condition, *apimetav1.Time) {
+	cond := apimetav1.Condition{
+		Type: smsv1alpha1.SnapshotMetadataServiceCertificateValid,
+	}
+
+	cert, err := r.leafCertificate()
+	if err != nil {
+		cond.Status = apimetav1.ConditionUnknown
+		cond.Reason = reasonCertificateUnreadable
+		cond.Message = err.Error()
+
+		return cond, nil
+	}
+
+	now := r.now()
+
+	switch {
+	case now.Before(cert.NotBefore):
+		cond.Status = apimetav1.ConditionFalse
+		cond.Reason = reasonCertificateNotYet
+		cond.Message = fmt.Sprintf("The certificate is not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		cond.Status = apimetav1.ConditionFalse
+		cond.Reason = reasonCertificateExpired
+		cond.Message = fmt.Sprintf("The certificate expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	default:
+		cond.Status = apimetav1.ConditionTrue
+		cond.Reason = reasonCertificateValid
+		cond.Message = fmt.Sprintf("The certificate is valid until %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	notAfter := apimetav1.NewTime(cert.NotAfter)
+
+	return cond, &notAfter
+}
+
+// leafCertificate returns the parsed serving certificate.
+func (r *statusReporter) leafCertificate() (*x509.Certificate, error) {
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the certificate: %w", err)
+	}
+
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the certificate: %w", err)
+	}
+
+	return leaf, nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecar
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	cw "github.com/kubernetes-csi/external-snapshotter/v8/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	apimetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+
+	smsv1alpha1 "github.com/kubernetes-csi/external-snapshot-metadata/client/apis/snapshotmetadataservice/v1alpha1"
+	fakecbt "github.com/kubernetes-csi/external-snapshot-metadata/client/clientset/versioned/fake"
+	"github.com/kubernetes-csi/external-snapshot-metadata/pkg/internal/runtime"
+)
+
+type fakeReadinessChecker struct {
+	ready bool
+}
+
+func (f *fakeReadinessChecker) IsReady() bool {
+	return f.ready
+}
+
+func TestStatusReporter(t *testing.T) {
+	rth := runtime.NewTestHarness().WithTestTLSFiles(t)
+	defer rth.RemoveTestTLSFiles(t)
+
+	certWatcher, err := cw.NewCertWatcher(rth.RuntimeArgs().TLSCertFile, rth.RuntimeArgs().TLSKeyFile)
+	assert.NoError(t, err)
+
+	const driverName = "driver"
+
+	newReporter := func(objs ...*smsv1alpha1.SnapshotMetadataService) (*statusReporter, *fakecbt.Clientset) {
+		client := fakecbt.NewSimpleClientset()
+		for _, obj := range objs {
+			assert.NoError(t, client.Tracker().Add(obj))
+		}
+
+		r := newStatusReporter(client, driverName, "v1.2.3", time.Minute, certWatcher.GetCertificate)
+
+		// The test certificate has expired.
+		leaf, err := r.leafCertificate()
+		assert.NoError(t, err)
+		r.now = func() time.Time { return leaf.NotBefore.Add(time.Hour) }
+
+		return r, client
+	}
+
+	getStatus := func(client *fakecbt.Clientset) smsv1alpha1.SnapshotMetadataServiceStatus {
+		sms, err := client.CbtV1alpha1().SnapshotMetadataServices().Get(context.Background(), driverName, apimetav1.GetOptions{})
+		assert.NoError(t, err)
+		return sms.Status
+	}
+
+	cr := &smsv1alpha1.SnapshotMetadataService{
+		ObjectMeta: apimetav1.ObjectMeta{Name: driverName, Generation: 2},
+	}
+
+	t.Run("cr-not-found", func(t *testing.T) {
+		r, _ := newReporter()
+		assert.NoError(t, r.update(context.Background()))
+	})
+
+	t.Run("validating", func(t *testing.T) {
+		r, client := newReporter(cr)
+		assert.NoError(t, r.update(context.Background()))
+
+		status := getStatus(client)
+		assert.Equal(t, "v1.2.3", status.SidecarVersion)
+		assert.Equal(t, driverName, status.DriverName)
+		assert.NotNil(t, status.CertificateExpiry)
+
+		ready := meta.FindStatusCondition(status.Conditions, smsv1alpha1.SnapshotMetadataServiceReady)
+		assert.NotNil(t, ready)
+		assert.Equal(t, apimetav1.ConditionFalse, ready.Status)
+		assert.Equal(t, reasonNotServing, ready.Reason)
+		assert.Equal(t, int64(2), ready.ObservedGeneration)
+
+		validated := meta.FindStatusCondition(status.Conditions, smsv1alpha1.SnapshotMetadataServiceDriverValidated)
+		assert.NotNil(t, validated)
+		assert.Equal(t, apimetav1.ConditionUnknown, validated.Status)
+		assert.Equal(t, reasonValidating, validated.Reason)
+
+		assert.True(t, meta.IsStatusConditionTrue(status.Conditions, smsv1alpha1.SnapshotMetadataServiceCertificateValid))
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		r, client := newReporter(cr)
+		r.setServer(&fakeReadinessChecker{ready: true})
+		r.setDriverValidated(apimetav1.ConditionTrue, reasonValidated, msgDriverValidated)
+		assert.NoError(t, r.update(context.Background()))
+
+		status := getStatus(client)
+		assert.True(t, meta.IsStatusConditionTrue(status.Conditions, smsv1alpha1.SnapshotMetadataServiceReady))
+		assert.True(t, meta.IsStatusConditionTrue(status.Conditions, smsv1alpha1.SnapshotMetadataServiceDriverValidated))
+
+		// An unchanged status is not updated.
+		numActions := len(client.Actions())
+		assert.NoError(t, r.update(context.Background()))
+		assert.Len(t, client.Actions(), numActions+1) // get only
+	})
+
+	t.Run("not-leader", func(t *testing.T) {
+		leader := false
+		r, client := newReporter(cr)
+		r.isLeader = func() bool { return leader }
+		r.setServer(&fakeReadinessChecker{ready: false})
+
+		// The status of the leader is not overwritten by the other replicas.
+		assert.NoError(t, r.update(context.Background()))
+		assert.Empty(t, client.Actions())
+		assert.Empty(t, getStatus(client).Conditions)
+
+		leader = true
+		assert.NoError(t, r.update(context.Background()))
+		assert.NotEmpty(t, getStatus(client).Conditions)
+	})
+
+	t.Run("connection-lost", func(t *testing.T) {
+		server := &fakeReadinessChecker{ready: true}
+		r, client := newReporter(cr)
+		r.setServer(server)
+		r.setDriverValidated(apimetav1.ConditionTrue, reasonValidated, msgDriverValidated)
+		assert.NoError(t, r.update(context.Background()))
+
+		server.ready = false
+		r.setDriverValidated(apimetav1.ConditionFalse, reasonConnectionLost, "lost")
+		assert.NoError(t, r.update(context.Background()))
+
+		status := getStatus(client)
+		assert.True(t, meta.IsStatusConditionFalse(status.Conditions, smsv1alpha1.SnapshotMetadataServiceReady))
+		validated := meta.FindStatusCondition(status.Conditions, smsv1alpha1.SnapshotMetadataServiceDriverValidated)
+		assert.Equal(t, apimetav1.ConditionFalse, validated.Status)
+		assert.Equal(t, reasonConnectionLost, validated.Reason)
+	})
+
+	t.Run("certificate", func(t *testing.T) {
+		r, _ := newReporter()
+		leaf, err := r.leafCertificate()
+		assert.NoError(t, err)
+
+		r.now = func() time.Time { return leaf.NotAfter.Add(time.Second) }
+		cond, notAfter := r.certificateCondition()
+		assert.Equal(t, apimetav1.ConditionFalse, cond.Status)
+		assert.Equal(t, reasonCertificateExpired, cond.Reason)
+		assert.True(t, notAfter.Time.Equal(leaf.NotAfter))
+
+		r.now = func() time.Time { return leaf.NotBefore.Add(-time.Second) }
+		cond, _ = r.certificateCondition()
+		assert.Equal(t, apimetav1.ConditionFalse, cond.Status)
+		assert.Equal(t, reasonCertificateNotYet, cond.Reason)
+
+		r.getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, errors.New("no cert") }
+		cond, notAfter = r.certificateCondition()
+		assert.Equal(t, apimetav1.ConditionUnknown, cond.Status)
+		assert.Equal(t, reasonCertificateUnreadable, cond.Reason)
+		assert.Nil(t, notAfter)
+	})
+
+	t.Run("update-error", func(t *testing.T) {
+		r, client := newReporter(cr)
+		client.PrependReactor("update", "snapshotmetadataservices", func(clientgotesting.Action) (bool, k8sruntime.Object, error) {
+			return true, nil, errors.New("update failed")
+		})
+		assert.ErrorContains(t, r.update(context.Background()), "update failed")
+	})
+
+	t.Run("nil-reporter", func(t *testing.T) {
+		var r *statusReporter
+		r.setServer(&fakeReadinessChecker{})
+		r.setDriverValidated(apimetav1.ConditionTrue, reasonValidated, msgDriverValidated)
+		r.updateSoon()
+		r.flush(time.Second)
+	})
+}